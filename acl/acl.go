@@ -0,0 +1,447 @@
+// Package acl authenticates users and checks their access
+//
+// Users are static and loaded from json file:
+//
+//	{"users": [
+//		{"name": "admin", "password": "pbkdf2-sha256:100000:5f1c...:9f86d0...", "commands": ["*"], "keys": ["*"], "namespaces": ["*"]},
+//		{"name": "app", "tokens": ["secret"], "commands": ["hget", "hset"], "keys": ["app:*"], "namespaces": ["app"]},
+//		{"name": "default", "commands": ["hget"], "keys": ["public:*"]}
+//	]}
+//
+// Passwords and tokens are plain text or PBKDF2-HMAC-SHA256 hash
+// as pbkdf2-sha256:iterations:salt:hash with hex salt and hash,
+// see Hash. Hashed token is id.secret and it is kept as id.hash,
+// see HashToken, so it is checked by one hash. User named default without password and tokens serves
+// requests without credentials, they are rejected otherwise.
+// Users without namespaces have access only to the default one.
+package acl
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/lukashes/db/db/namespace"
+	"github.com/lukashes/db/glob"
+)
+
+const (
+	// Name of user without credentials
+	Default = "default"
+
+	// Commands allowing everything
+	All = "*"
+
+	// Name of commands which manage server rather than keys
+	Admin = "admin"
+
+	hashPrefix = "pbkdf2-sha256:"
+
+	// Cost and salt size of hashes made by Hash
+	iterations = 100000
+	saltSize   = 16
+)
+
+var (
+	ErrUnauthenticated = errors.New("authentication required")
+	ErrForbidden       = errors.New("access denied")
+	ErrNoTokenID       = errors.New("token should be id.secret")
+)
+
+// User is an account with its rules
+type User struct {
+	Name     string   `json:"name"`
+	Password string   `json:"password,omitempty"`
+	Tokens   []string `json:"tokens,omitempty"`
+
+	// Allowed commands, * allows all of them
+	Commands []string `json:"commands"`
+
+	// Glob patterns of allowed keys, no key is allowed if it is empty
+	Keys []string `json:"keys,omitempty"`
+
+	// Glob patterns of allowed namespaces, only the default
+	// namespace is allowed if it is empty
+	Namespaces []string `json:"namespaces,omitempty"`
+}
+
+// Config is a list of users
+type Config struct {
+	Users []User `json:"users"`
+}
+
+// ACL keeps users by names and tokens
+//
+// Checking of hash is slow by design, so verified secrets are
+// kept in memory by their SHA-256.
+type ACL struct {
+	users  map[string]*user
+	tokens map[string]token // hashed by ids
+
+	mu       sync.RWMutex
+	verified map[[sha256.Size]byte]*user // tokens
+}
+
+type user struct {
+	name       string
+	password   *hash // nil if it is not set
+	commands   map[string]bool
+	keys       []string
+	namespaces []string
+
+	mu       sync.RWMutex
+	verified map[[sha256.Size]byte]bool // passwords
+}
+
+type token struct {
+	hash *hash
+	user *user
+}
+
+// PBKDF2-HMAC-SHA256 of secret
+type hash struct {
+	iterations int
+	salt       []byte
+	sum        []byte
+}
+
+// Load reads users from file
+func Load(path string) (*ACL, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var c Config
+	if err := json.Unmarshal(data, &c); err != nil {
+		return nil, fmt.Errorf("acl: %s: %s", path, err)
+	}
+
+	return New(c)
+}
+
+// New validates users, names and tokens should be unique
+func New(c Config) (*ACL, error) {
+	a := &ACL{
+		users:    make(map[string]*user, len(c.Users)),
+		tokens:   make(map[string]token),
+		verified: make(map[[sha256.Size]byte]*user),
+	}
+
+	for i, u := range c.Users {
+		if u.Name == "" {
+			return nil, fmt.Errorf("acl: user %d: empty name", i)
+		}
+		if _, ok := a.users[u.Name]; ok {
+			return nil, fmt.Errorf("acl: duplicated user %s", u.Name)
+		}
+		if u.Name == Default && (u.Password != "" || len(u.Tokens) > 0) {
+			return nil, fmt.Errorf("acl: user %s could not have credentials", Default)
+		}
+
+		uu := &user{
+			name:       u.Name,
+			commands:   make(map[string]bool, len(u.Commands)),
+			keys:       u.Keys,
+			namespaces: u.Namespaces,
+			verified:   make(map[[sha256.Size]byte]bool),
+		}
+		if len(uu.namespaces) == 0 {
+			uu.namespaces = []string{namespace.Default}
+		}
+		for _, c := range u.Commands {
+			uu.commands[c] = true
+		}
+		for _, k := range u.Keys {
+			if k == "" {
+				return nil, fmt.Errorf("acl: user %s: empty key pattern", u.Name)
+			}
+		}
+		for _, n := range u.Namespaces {
+			if n == "" {
+				return nil, fmt.Errorf("acl: user %s: empty namespace pattern", u.Name)
+			}
+		}
+
+		if u.Password != "" {
+			h, err := secret(u.Password)
+			if err != nil {
+				return nil, fmt.Errorf("acl: user %s: password: %s", u.Name, err)
+			}
+			uu.password = h
+		}
+		for _, t := range u.Tokens {
+			if strings.HasPrefix(t, hashPrefix) {
+				return nil, fmt.Errorf("acl: user %s: hashed token has no id, see HashToken", u.Name)
+			}
+			if i := strings.Index(t, "."+hashPrefix); i > 0 {
+				id := t[:i]
+				if o, ok := a.tokens[id]; ok {
+					return nil, fmt.Errorf("acl: token id %s of %s is used by %s", id, u.Name, o.user.name)
+				}
+				h, err := secret(t[i+1:])
+				if err != nil {
+					return nil, fmt.Errorf("acl: user %s: token: %s", u.Name, err)
+				}
+				a.tokens[id] = token{hash: h, user: uu}
+				continue
+			}
+
+			// Plain tokens are known, so they are verified
+			sum := sha256.Sum256([]byte(t))
+			if o, ok := a.verified[sum]; ok {
+				return nil, fmt.Errorf("acl: token of %s is used by %s", u.Name, o.name)
+			}
+			a.verified[sum] = uu
+		}
+
+		a.users[u.Name] = uu
+	}
+
+	return a, nil
+}
+
+// Hash returns PBKDF2 hash of secret with random salt,
+// it could be used in users file instead of plain text
+func Hash(secret string) string {
+	salt := make([]byte, saltSize)
+	if _, err := rand.Read(salt); err != nil {
+		panic(err)
+	}
+	sum := pbkdf2([]byte(secret), salt, iterations, sha256.Size)
+
+	return hashPrefix + strconv.Itoa(iterations) + ":" + hex.EncodeToString(salt) + ":" + hex.EncodeToString(sum)
+}
+
+// HashToken returns hash of token id.secret prefixed by id,
+// it could be used in users file instead of plain text
+func HashToken(token string) (string, error) {
+	i := strings.IndexByte(token, '.')
+	if i <= 0 {
+		return "", ErrNoTokenID
+	}
+
+	return token[:i] + "." + Hash(token), nil
+}
+
+// Returns hash of plain or hashed secret
+func secret(s string) (*hash, error) {
+	if !strings.HasPrefix(s, hashPrefix) {
+		s = Hash(s)
+	}
+
+	p := strings.Split(s[len(hashPrefix):], ":")
+	if len(p) != 3 {
+		return nil, errors.New("invalid hash, expected pbkdf2-sha256:iterations:salt:hash")
+	}
+
+	h := &hash{}
+	var err error
+	if h.iterations, err = strconv.Atoi(p[0]); err != nil || h.iterations < 1 {
+		return nil, errors.New("invalid iterations of hash")
+	}
+	if h.salt, err = hex.DecodeString(p[1]); err != nil || len(h.salt) == 0 {
+		return nil, errors.New("invalid salt of hash")
+	}
+	if h.sum, err = hex.DecodeString(p[2]); err != nil || len(h.sum) != sha256.Size {
+		return nil, errors.New("invalid sum of hash")
+	}
+
+	return h, nil
+}
+
+func (h *hash) match(secret string) bool {
+	sum := pbkdf2([]byte(secret), h.salt, h.iterations, len(h.sum))
+
+	return subtle.ConstantTimeCompare(sum, h.sum) == 1
+}
+
+// PBKDF2 of RFC 8018 with HMAC-SHA256
+func pbkdf2(password, salt []byte, iterations, l int) []byte {
+	prf := hmac.New(sha256.New, password)
+
+	var out []byte
+	for i := uint32(1); len(out) < l; i++ {
+		var block [4]byte
+		binary.BigEndian.PutUint32(block[:], i)
+
+		prf.Reset()
+		prf.Write(salt)
+		prf.Write(block[:])
+		u := prf.Sum(nil)
+		t := append([]byte(nil), u...)
+
+		for n := 1; n < iterations; n++ {
+			prf.Reset()
+			prf.Write(u)
+			u = prf.Sum(u[:0])
+			for j := range t {
+				t[j] ^= u[j]
+			}
+		}
+		out = append(out, t...)
+	}
+
+	return out[:l]
+}
+
+// Password returns name of user with the password
+func (a *ACL) Password(name, password string) (string, error) {
+	u, ok := a.users[name]
+	if !ok || u.password == nil {
+		return "", ErrUnauthenticated
+	}
+
+	sum := sha256.Sum256([]byte(password))
+	u.mu.RLock()
+	ok = u.verified[sum]
+	u.mu.RUnlock()
+	if ok {
+		return u.name, nil
+	}
+
+	if !u.password.match(password) {
+		return "", ErrUnauthenticated
+	}
+
+	u.mu.Lock()
+	u.verified[sum] = true
+	u.mu.Unlock()
+
+	return u.name, nil
+}
+
+// Token returns name of user with the bearer token
+//
+// Hashed token is found by id, so unknown token costs at most
+// one check of hash.
+func (a *ACL) Token(secret string) (string, error) {
+	sum := sha256.Sum256([]byte(secret))
+	a.mu.RLock()
+	u, ok := a.verified[sum]
+	a.mu.RUnlock()
+	if ok {
+		return u.name, nil
+	}
+
+	i := strings.IndexByte(secret, '.')
+	if i <= 0 {
+		return "", ErrUnauthenticated
+	}
+	t, ok := a.tokens[secret[:i]]
+	if !ok || !t.hash.match(secret) {
+		return "", ErrUnauthenticated
+	}
+
+	a.mu.Lock()
+	a.verified[sum] = t.user
+	a.mu.Unlock()
+
+	return t.user.name, nil
+}
+
+// Anonymous returns name of user for requests without
+// credentials if such user is configured
+func (a *ACL) Anonymous() (string, error) {
+	if _, ok := a.users[Default]; !ok {
+		return "", ErrUnauthenticated
+	}
+
+	return Default, nil
+}
+
+// Exists reports user is configured
+func (a *ACL) Exists(name string) bool {
+	_, ok := a.users[name]
+	return ok
+}
+
+// Check returns ErrForbidden if user could not run command
+// or some of keys does not match patterns of the user
+func (a *ACL) Check(name, command string, keys ...string) error {
+	u, ok := a.users[name]
+	if !ok {
+		return ErrUnauthenticated
+	}
+
+	if !u.commands[All] && !u.commands[command] {
+		return ErrForbidden
+	}
+
+	return a.CheckKeys(name, keys...)
+}
+
+// CheckKeys returns ErrForbidden if some of keys does not
+// match patterns of the user
+func (a *ACL) CheckKeys(name string, keys ...string) error {
+	u, ok := a.users[name]
+	if !ok {
+		return ErrUnauthenticated
+	}
+
+	for _, k := range keys {
+		if !u.allowed(k) {
+			return ErrForbidden
+		}
+	}
+
+	return nil
+}
+
+// CheckAllKeys returns ErrForbidden unless user has * pattern
+// of keys, it is required by commands which could reveal any key
+func (a *ACL) CheckAllKeys(name string) error {
+	u, ok := a.users[name]
+	if !ok {
+		return ErrUnauthenticated
+	}
+
+	for _, p := range u.keys {
+		if p == All {
+			return nil
+		}
+	}
+
+	return ErrForbidden
+}
+
+// CheckNamespace returns ErrForbidden if some of namespaces
+// does not match patterns of the user
+func (a *ACL) CheckNamespace(name string, namespaces ...string) error {
+	u, ok := a.users[name]
+	if !ok {
+		return ErrUnauthenticated
+	}
+
+	for _, n := range namespaces {
+		if !match(u.namespaces, n) {
+			return ErrForbidden
+		}
+	}
+
+	return nil
+}
+
+func (u *user) allowed(key string) bool {
+	return match(u.keys, key)
+}
+
+func match(patterns []string, s string) bool {
+	for _, p := range patterns {
+		if glob.Match(p, s) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,124 @@
+package acl
+
+import (
+	"encoding/hex"
+	"testing"
+)
+
+func TestACL(t *testing.T) {
+	hashed, err := HashToken("app1.hashed")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a, err := New(Config{Users: []User{
+		{Name: "admin", Password: Hash("pass"), Commands: []string{"*"}, Keys: []string{"*"}, Namespaces: []string{"*"}},
+		{Name: "app", Tokens: []string{"secret", hashed}, Commands: []string{"hget", "hset"}, Keys: []string{"app:*"}, Namespaces: []string{"app-*"}},
+		{Name: "plain", Password: "plain", Commands: []string{"hget"}},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if name, err := a.Password("admin", "pass"); err != nil || name != "admin" {
+		t.Fatalf("unexpected user %q, %v", name, err)
+	}
+	if _, err := a.Password("admin", "wrong"); err != ErrUnauthenticated {
+		t.Fatalf("expected authentication error, got %v", err)
+	}
+	if _, err := a.Password("app", ""); err != ErrUnauthenticated {
+		t.Fatalf("user without password is authenticated: %v", err)
+	}
+	if name, err := a.Password("plain", "plain"); err != nil || name != "plain" {
+		t.Fatalf("unexpected user %q, %v", name, err)
+	}
+	for _, token := range []string{"secret", "app1.hashed", "app1.hashed"} {
+		if name, err := a.Token(token); err != nil || name != "app" {
+			t.Fatalf("unexpected user %q, %v", name, err)
+		}
+	}
+	for _, token := range []string{"wrong", "app1.wrong", "app2.hashed", "hashed"} {
+		if _, err := a.Token(token); err != ErrUnauthenticated {
+			t.Fatalf("%s: expected authentication error, got %v", token, err)
+		}
+	}
+	if _, err := HashToken("secret"); err != ErrNoTokenID {
+		t.Fatalf("expected token id error, got %v", err)
+	}
+	if _, err := a.Anonymous(); err != ErrUnauthenticated {
+		t.Fatalf("expected authentication error, got %v", err)
+	}
+
+	for _, c := range []struct {
+		user, command string
+		keys          []string
+		err           error
+	}{
+		{"admin", Admin, nil, nil},
+		{"admin", "rm", []string{"any"}, nil},
+		{"app", "hget", []string{"app:1"}, nil},
+		{"app", "hset", []string{"app:1", "other"}, ErrForbidden},
+		{"app", "rm", []string{"app:1"}, ErrForbidden},
+		{"app", Admin, nil, ErrForbidden},
+		{"missing", "hget", nil, ErrUnauthenticated},
+	} {
+		if err := a.Check(c.user, c.command, c.keys...); err != c.err {
+			t.Errorf("%s %s %q: expected %v, got %v", c.user, c.command, c.keys, c.err, err)
+		}
+	}
+
+	if err := a.CheckAllKeys("admin"); err != nil {
+		t.Errorf("admin has no access to all keys: %v", err)
+	}
+	if err := a.CheckAllKeys("app"); err != ErrForbidden {
+		t.Errorf("expected forbidden error, got %v", err)
+	}
+	if err := a.CheckKeys("app", "app:1", "app:2"); err != nil {
+		t.Error(err)
+	}
+
+	for _, c := range []struct {
+		user       string
+		namespaces []string
+		err        error
+	}{
+		{"admin", []string{"0", "any"}, nil},
+		{"app", []string{"app-1"}, nil},
+		{"app", []string{"app-1", "0"}, ErrForbidden},
+		{"plain", []string{"0"}, nil},
+		{"plain", []string{"app-1"}, ErrForbidden},
+		{"missing", nil, ErrUnauthenticated},
+	} {
+		if err := a.CheckNamespace(c.user, c.namespaces...); err != c.err {
+			t.Errorf("%s %q: expected %v, got %v", c.user, c.namespaces, c.err, err)
+		}
+	}
+
+	for _, c := range []Config{
+		{Users: []User{{Name: "a"}, {Name: "a"}}},
+		{Users: []User{{Name: "a", Tokens: []string{"t"}}, {Name: "b", Tokens: []string{"t"}}}},
+		{Users: []User{{Name: Default, Password: "p"}}},
+		{Users: []User{{Name: "a", Password: "pbkdf2-sha256:1:zz:00"}}},
+		{Users: []User{{Name: "a", Tokens: []string{"id.pbkdf2-sha256:0:00:00"}}}},
+		{Users: []User{{Name: "a", Tokens: []string{Hash("id.t")}}}},
+		{Users: []User{{Name: "a", Tokens: []string{hashed}}, {Name: "b", Tokens: []string{hashed}}}},
+		{Users: []User{{Name: "a", Namespaces: []string{""}}}},
+	} {
+		if _, err := New(c); err == nil {
+			t.Errorf("invalid config %+v is accepted", c)
+		}
+	}
+}
+
+func TestPBKDF2(t *testing.T) {
+	// RFC 7914, section 11
+	want := "55ac046e56e3089fec1691c22544b605f94185216dde0465e68b9d57c20dacbc49ca9cccf179b645991664b39d77ef317c71b845b1e30bd509112041d3a19783"
+	if sum := hex.EncodeToString(pbkdf2([]byte("passwd"), []byte("salt"), 1, 64)); sum != want {
+		t.Fatalf("unexpected sum %s", sum)
+	}
+
+	want = "4ddcd8f60b98be21830cee5ef22701f9641a4418d04c0414aeff08876b34ab56a1d425a1225833549adb841b51c9b3176a272bdebba1d078478f62b397f33c8d"
+	if sum := hex.EncodeToString(pbkdf2([]byte("Password"), []byte("NaCl"), 80000, 64)); sum != want {
+		t.Fatalf("unexpected sum %s", sum)
+	}
+}
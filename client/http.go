@@ -3,11 +3,15 @@ package client
 import (
 	"bytes"
 	"encoding/gob"
+	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net/http"
 	"reflect"
 	"sync"
+
+	store "github.com/lukashes/db/db"
 )
 
 const (
@@ -28,32 +32,6 @@ func (v *Value) Decode(r interface{}) error {
 	return d.Decode(r)
 }
 
-func valueFromMap(m map[string]interface{}) (*Value, error) {
-	b := new(bytes.Buffer)
-
-	e := gob.NewEncoder(b)
-
-	err := e.Encode(m)
-	if err != nil {
-		return nil, err
-	}
-
-	return &Value{v: b.Bytes(), b: *b}, nil
-}
-
-func valueFromList(l []interface{}) (*Value, error) {
-	b := new(bytes.Buffer)
-
-	e := gob.NewEncoder(b)
-
-	err := e.Encode(l)
-	if err != nil {
-		return nil, err
-	}
-
-	return &Value{v: b.Bytes(), b: *b}, nil
-}
-
 func valueFromInt(i int64) (*Value, error) {
 	b := new(bytes.Buffer)
 
@@ -98,7 +76,7 @@ func New(addr string) (*DB, error) {
 }
 
 func (db *DB) Get(key string) (*Value, error) {
-	res, err := db.client.Get(db.prefix + "/get/" + key)
+	res, err := db.client.Get(db.prefix + "/hget/" + key)
 	if err != nil {
 		return nil, err
 	}
@@ -109,36 +87,100 @@ func (db *DB) Get(key string) (*Value, error) {
 		return nil, err
 	}
 
+	if res.StatusCode != http.StatusOK {
+		return nil, statusError(res)
+	}
+
 	return &Value{v: body, b: *bytes.NewBuffer(body)}, nil
 }
 
+// GetList returns list with elements as string, int64,
+// float64, []byte, []interface{} or map[string]interface{}
+func (db *DB) GetList(key string) ([]interface{}, error) {
+	var l []store.Value
+	if err := db.getJSON("/lget/"+key, &l); err != nil {
+		return nil, err
+	}
+
+	return store.List(l...).Interface().([]interface{}), nil
+}
+
+// GetDict returns dict with elements as for GetList
+func (db *DB) GetDict(key string) (map[string]interface{}, error) {
+	var d map[string]store.Value
+	if err := db.getJSON("/dget/"+key, &d); err != nil {
+		return nil, err
+	}
+
+	return store.Dict(d).Interface().(map[string]interface{}), nil
+}
+
+func (db *DB) getJSON(path string, v interface{}) error {
+	res, err := db.client.Get(db.prefix + path)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return statusError(res)
+	}
+
+	return json.NewDecoder(res.Body).Decode(v)
+}
+
+// Add writes value, lists and dicts are stored as server
+// types keeping elements typed, other values are gob encoded
 func (db *DB) Add(key string, val interface{}) error {
-	var v *Value
+	var (
+		v    io.Reader
+		path string
+	)
 
 	switch t := val.(type) {
 	default:
 		return fmt.Errorf("Unexpected type")
-	case map[string]interface{}:
-		v, _ = valueFromMap(t)
-	case []interface{}:
-		v, _ = valueFromList(t)
+	case map[string]interface{}, []interface{}:
+		e, err := store.ValueOf(t)
+		if err != nil {
+			return err
+		}
+		// Dict is sent as plain object of elements
+		var d []byte
+		if e.Kind() == store.KindDict {
+			d, err = json.Marshal(e.Dict())
+			path = "/dset/"
+		} else {
+			d, err = json.Marshal(e)
+			path = "/lset/"
+		}
+		if err != nil {
+			return err
+		}
+		v = bytes.NewReader(d)
 	case int, int8, int16, int32, int64:
 		v, _ = valueFromInt(reflect.ValueOf(t).Int())
+		path = "/hset/"
 	case string:
 		v, _ = valueFromString(t)
+		path = "/hset/"
 	}
 
-	res, err := db.client.Post(db.prefix+"/set/"+key, "application/x-www-form-urlencoded", v)
+	res, err := db.client.Post(db.prefix+path+key, "application/octet-stream", v)
 	if err != nil {
 		return err
 	}
 	defer res.Body.Close()
 
+	if res.StatusCode != http.StatusOK {
+		return statusError(res)
+	}
+
 	return nil
 }
 
 func (db *DB) Remove(key string) error {
-	res, err := db.client.Get(db.prefix + "/remove/" + key)
+	res, err := db.client.Get(db.prefix + "/rm/" + key)
 	if err != nil {
 		return err
 	}
@@ -146,3 +188,8 @@ func (db *DB) Remove(key string) error {
 
 	return nil
 }
+
+func statusError(res *http.Response) error {
+	msg, _ := ioutil.ReadAll(res.Body)
+	return fmt.Errorf("%s: %s", res.Status, msg)
+}
@@ -0,0 +1,340 @@
+package cluster
+
+import (
+	"crypto/tls"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"net"
+
+	"github.com/labstack/gommon/log"
+	"github.com/lukashes/db/db"
+	"github.com/lukashes/db/handshake"
+)
+
+const (
+	migrationBatch = 100 // keys in one message
+)
+
+var (
+	ErrNoBus     = errors.New("node has no cluster bus address")
+	ErrNotOwner  = errors.New("slot is not owned by this node")
+	ErrMigrating = errors.New("slot is already migrating")
+)
+
+type command uint8
+
+const (
+	cmdImport command = iota + 1 // target starts importing slot
+	cmdKeys                      // batch of keys of slot
+	cmdOwner                     // slot has new owner
+)
+
+type request struct {
+	Cmd   command
+	Slot  int
+	Node  string
+	Items [][]byte
+}
+
+type response struct {
+	Err string
+}
+
+// ServeBus accepts commands of other nodes, imported keys are written to d
+func (c *Cluster) ServeBus(ln net.Listener, d *db.DB) error {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return err
+		}
+
+		go func() {
+			defer conn.Close()
+
+			c.mu.RLock()
+			secret := c.secret
+			c.mu.RUnlock()
+
+			if secret != nil {
+				if err := handshake.Server(conn, secret); err != nil {
+					log.Warnf("cluster: bus %s: %s", conn.RemoteAddr(), err)
+					return
+				}
+			}
+
+			if err := c.serveBus(conn, d); err != nil {
+				log.Warnf("cluster: bus %s: %s", conn.RemoteAddr(), err)
+			}
+		}()
+	}
+}
+
+func (c *Cluster) serveBus(conn net.Conn, d *db.DB) error {
+	dec := gob.NewDecoder(conn)
+	enc := gob.NewEncoder(conn)
+
+	for {
+		var req request
+		if err := dec.Decode(&req); err != nil {
+			return nil
+		}
+
+		var res response
+		if err := c.handle(&req, d); err != nil {
+			res.Err = err.Error()
+		}
+
+		if err := enc.Encode(&res); err != nil {
+			return err
+		}
+	}
+}
+
+func (c *Cluster) handle(req *request, d *db.DB) error {
+	if req.Slot < 0 || req.Slot >= Slots {
+		return fmt.Errorf("invalid slot %d", req.Slot)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	n, ok := c.nodes[req.Node]
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrUnknownNode, req.Node)
+	}
+
+	switch req.Cmd {
+	case cmdImport:
+		c.importing[req.Slot] = n
+	case cmdKeys:
+		if c.importing[req.Slot] == nil {
+			return fmt.Errorf("slot %d is not importing", req.Slot)
+		}
+		for _, item := range req.Items {
+			if err := d.Import(item); err != nil {
+				return err
+			}
+		}
+	case cmdOwner:
+		c.setOwner(req.Slot, n)
+	default:
+		return fmt.Errorf("unknown command %d", req.Cmd)
+	}
+
+	return nil
+}
+
+// Should be called under lock
+func (c *Cluster) setOwner(slot int, n *Node) {
+	c.slots[slot] = n
+	delete(c.migrating, slot)
+	delete(c.importing, slot)
+}
+
+// Migrate moves keys of slot from d to target node and makes it owner
+//
+// Keys are taken from d one by one, so each key always exists
+// on one node only. Clients asking for moved keys are redirected
+// to target. When all keys are moved ownership is switched on both
+// nodes and other nodes are notified.
+func (c *Cluster) Migrate(d *db.DB, slot int, target string) error {
+	c.mu.Lock()
+	t, ok := c.nodes[target]
+	switch {
+	case !ok:
+		c.mu.Unlock()
+		return fmt.Errorf("%w: %s", ErrUnknownNode, target)
+	case slot < 0 || slot >= Slots || c.slots[slot].ID != c.self:
+		c.mu.Unlock()
+		return ErrNotOwner
+	case c.migrating[slot] != nil:
+		c.mu.Unlock()
+		return ErrMigrating
+	case t.Bus == "":
+		c.mu.Unlock()
+		return fmt.Errorf("%w: %s", ErrNoBus, target)
+	}
+	c.mu.Unlock()
+
+	peer, err := c.dial(t.Bus)
+	if err != nil {
+		return err
+	}
+	defer peer.close()
+
+	if err := peer.call(&request{Cmd: cmdImport, Slot: slot, Node: c.self}); err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	c.migrating[slot] = t
+	c.mu.Unlock()
+
+	// Second pass catches keys written while the first one was in progress
+	for i := 0; i < 2; i++ {
+		if err := c.moveKeys(d, peer, slot); err != nil {
+			c.mu.Lock()
+			delete(c.migrating, slot)
+			c.mu.Unlock()
+			return err
+		}
+	}
+
+	if err := peer.call(&request{Cmd: cmdOwner, Slot: slot, Node: target}); err != nil {
+		c.mu.Lock()
+		delete(c.migrating, slot)
+		c.mu.Unlock()
+		return err
+	}
+
+	c.mu.Lock()
+	c.setOwner(slot, t)
+	nodes := make([]*Node, 0, len(c.nodes))
+	for _, n := range c.nodes {
+		if n.ID != c.self && n.ID != target && n.Bus != "" {
+			nodes = append(nodes, n)
+		}
+	}
+	c.mu.Unlock()
+
+	// Other nodes redirect to source until notified, so it is not fatal
+	for _, n := range nodes {
+		if err := c.notify(n.Bus, &request{Cmd: cmdOwner, Slot: slot, Node: target}); err != nil {
+			log.Warnf("cluster: notify %s about slot %d: %s", n.ID, slot, err)
+		}
+	}
+
+	return nil
+}
+
+func (c *Cluster) moveKeys(d *db.DB, peer *peer, slot int) error {
+	var items [][]byte
+
+	send := func() error {
+		if len(items) == 0 {
+			return nil
+		}
+
+		if err := peer.call(&request{Cmd: cmdKeys, Slot: slot, Node: c.self, Items: items}); err != nil {
+			// Put keys back, target has not confirmed them
+			for _, item := range items {
+				d.Import(item)
+			}
+			return err
+		}
+
+		items = items[:0]
+
+		return nil
+	}
+
+	for _, key := range d.Keys() {
+		if Slot(key) != slot {
+			continue
+		}
+
+		item, err := d.Take(key)
+		if err == db.ErrNotFound {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		items = append(items, item)
+
+		if len(items) == migrationBatch {
+			if err := send(); err != nil {
+				return err
+			}
+		}
+	}
+
+	return send()
+}
+
+type peer struct {
+	conn net.Conn
+	enc  *gob.Encoder
+	dec  *gob.Decoder
+}
+
+// SetTLS encrypts connections to bus of other nodes,
+// listener of ServeBus should be wrapped by tls.NewListener
+func (c *Cluster) SetTLS(cfg *tls.Config) {
+	c.mu.Lock()
+	c.tls = cfg
+	c.mu.Unlock()
+}
+
+// SetSecret makes bus accept only nodes with the same secret,
+// it is sent to bus of other nodes as well
+func (c *Cluster) SetSecret(secret []byte) {
+	c.mu.Lock()
+	c.secret = secret
+	c.mu.Unlock()
+}
+
+func (c *Cluster) dial(addr string) (*peer, error) {
+	c.mu.RLock()
+	cfg, secret := c.tls, c.secret
+	c.mu.RUnlock()
+
+	var (
+		conn net.Conn
+		err  error
+	)
+	if cfg != nil {
+		conn, err = tls.Dial("tcp", addr, cfg)
+	} else {
+		conn, err = net.Dial("tcp", addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if secret != nil {
+		if err := handshake.Client(conn, secret); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+
+	return &peer{
+		conn: conn,
+		enc:  gob.NewEncoder(conn),
+		dec:  gob.NewDecoder(conn),
+	}, nil
+}
+
+func (p *peer) call(req *request) error {
+	if err := p.enc.Encode(req); err != nil {
+		return err
+	}
+
+	var res response
+	if err := p.dec.Decode(&res); err != nil {
+		return err
+	}
+
+	if res.Err != "" {
+		return errors.New(res.Err)
+	}
+
+	return nil
+}
+
+func (p *peer) close() error {
+	return p.conn.Close()
+}
+
+func (c *Cluster) notify(addr string, req *request) error {
+	p, err := c.dial(addr)
+	if err != nil {
+		return err
+	}
+	defer p.close()
+
+	return p.call(req)
+}
@@ -0,0 +1,233 @@
+// Package cluster splits keyspace between nodes
+//
+// Keyspace is divided into Slots by key hash, every node owns
+// ranges of slots. Topology is static and loaded from json file:
+//
+//	{"nodes": [
+//		{"id": "a", "addr": "10.0.0.1:8080", "slots": [[0, 8191]]},
+//		{"id": "b", "addr": "10.0.0.2:8080", "slots": [[8192, 16383]]}
+//	]}
+package cluster
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"sync"
+
+	"github.com/lukashes/db/db"
+)
+
+const (
+	Slots = 16384
+)
+
+var (
+	ErrUnknownNode = errors.New("node is not found in topology")
+	ErrCrossSlot   = errors.New("CROSSSLOT keys in request don't hash to the same slot")
+)
+
+// Slot returns slot of key
+func Slot(key string) int {
+	return int(db.Hash(key) % Slots)
+}
+
+// SameSlot reports whether all keys are in one slot
+func SameSlot(keys ...string) bool {
+	for _, k := range keys {
+		if Slot(k) != Slot(keys[0]) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Node is a member of cluster
+type Node struct {
+	ID   string `json:"id"`
+	Addr string `json:"addr"`
+
+	// Address of cluster bus used for slot migration
+	Bus string `json:"bus,omitempty"`
+
+	// Inclusive ranges of owned slots
+	Slots [][2]int `json:"slots"`
+}
+
+// Topology is a list of cluster members
+type Topology struct {
+	Nodes []Node `json:"nodes"`
+}
+
+// Cluster knows owners of slots from the point of view of one node
+type Cluster struct {
+	self string
+
+	mu    sync.RWMutex
+	nodes map[string]*Node
+	slots [Slots]*Node
+
+	// Slots in the middle of migration, node which
+	// receives keys and node which sends them
+	migrating map[int]*Node
+	importing map[int]*Node
+
+	// Bus connections are encrypted if it is set
+	tls *tls.Config
+
+	// Bus connections are authenticated if it is set
+	secret []byte
+}
+
+// Load reads topology file, self is identifier of the current node
+func Load(path, self string) (*Cluster, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var t Topology
+	if err := json.Unmarshal(data, &t); err != nil {
+		return nil, fmt.Errorf("cluster: %s: %s", path, err)
+	}
+
+	return New(t, self)
+}
+
+// New validates topology, every slot should have exactly one owner
+func New(t Topology, self string) (*Cluster, error) {
+	c := &Cluster{
+		self:      self,
+		nodes:     make(map[string]*Node, len(t.Nodes)),
+		migrating: make(map[int]*Node),
+		importing: make(map[int]*Node),
+	}
+
+	for i := range t.Nodes {
+		n := t.Nodes[i]
+		if n.ID == "" || n.Addr == "" {
+			return nil, fmt.Errorf("cluster: node %d: empty id or addr", i)
+		}
+		if _, ok := c.nodes[n.ID]; ok {
+			return nil, fmt.Errorf("cluster: duplicated node %s", n.ID)
+		}
+		c.nodes[n.ID] = &n
+
+		for _, r := range n.Slots {
+			if r[0] < 0 || r[1] >= Slots || r[0] > r[1] {
+				return nil, fmt.Errorf("cluster: node %s: invalid slots range %d-%d", n.ID, r[0], r[1])
+			}
+			for s := r[0]; s <= r[1]; s++ {
+				if o := c.slots[s]; o != nil {
+					return nil, fmt.Errorf("cluster: slot %d is owned by %s and %s", s, o.ID, n.ID)
+				}
+				c.slots[s] = &n
+			}
+		}
+	}
+
+	for s, o := range c.slots {
+		if o == nil {
+			return nil, fmt.Errorf("cluster: slot %d has no owner", s)
+		}
+	}
+
+	if _, ok := c.nodes[self]; !ok {
+		return nil, fmt.Errorf("cluster: %w: %s", ErrUnknownNode, self)
+	}
+
+	return c, nil
+}
+
+// Self returns the current node
+func (c *Cluster) Self() Node {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	return c.node(c.self)
+}
+
+// Owner returns owner of key and reports if it is the current node
+func (c *Cluster) Owner(key string) (Node, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	o := c.slots[Slot(key)]
+
+	return *o, o.ID == c.self
+}
+
+// Redirect tells client where to send request
+type Redirect int
+
+const (
+	Local Redirect = iota // serve request here
+	Moved                 // slot is owned by other node
+	Ask                   // key is already moved, ask target once
+)
+
+// Route decides where request for key should be served
+//
+// During migration source serves keys which still exist there
+// and asks target for others. Target serves slot only for asked
+// requests until it becomes the owner.
+func (c *Cluster) Route(key string, asking bool, exists func() bool) (Node, Redirect) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	slot := Slot(key)
+	owner := c.slots[slot]
+
+	if owner.ID != c.self {
+		if asking && c.importing[slot] != nil {
+			return *c.nodes[c.self], Local
+		}
+		return *owner, Moved
+	}
+
+	if target := c.migrating[slot]; target != nil && !exists() {
+		return *target, Ask
+	}
+
+	return *owner, Local
+}
+
+// Nodes returns actual topology sorted by node id
+func (c *Cluster) Nodes() []Node {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	nodes := make([]Node, 0, len(c.nodes))
+	for id := range c.nodes {
+		nodes = append(nodes, c.node(id))
+	}
+
+	sort.Slice(nodes, func(i, j int) bool {
+		return nodes[i].ID < nodes[j].ID
+	})
+
+	return nodes
+}
+
+// Returns node with slot ranges built from slots table
+func (c *Cluster) node(id string) Node {
+	n := Node{ID: id, Addr: c.nodes[id].Addr, Bus: c.nodes[id].Bus, Slots: [][2]int{}}
+
+	start := -1
+	for s := 0; s <= Slots; s++ {
+		owned := s < Slots && c.slots[s].ID == id
+		switch {
+		case owned && start < 0:
+			start = s
+		case !owned && start >= 0:
+			n.Slots = append(n.Slots, [2]int{start, s - 1})
+			start = -1
+		}
+	}
+
+	return n
+}
@@ -0,0 +1,153 @@
+package cluster
+
+import (
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/lukashes/db/db"
+)
+
+func TestTopology(t *testing.T) {
+	topology := Topology{Nodes: []Node{
+		{ID: "a", Addr: "127.0.0.1:8080", Slots: [][2]int{{0, 8191}}},
+		{ID: "b", Addr: "127.0.0.1:8081", Slots: [][2]int{{8192, Slots - 1}}},
+	}}
+
+	a, err := New(topology, "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := New(topology, "b")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 100; i++ {
+		key := fmt.Sprintf("key_%d", i)
+
+		oa, localA := a.Owner(key)
+		ob, localB := b.Owner(key)
+		if localA == localB || oa.ID != ob.ID {
+			t.Errorf("key %s: inconsistent owners %s and %s", key, oa.ID, ob.ID)
+		}
+
+		expected := "a"
+		if Slot(key) >= 8192 {
+			expected = "b"
+		}
+		if oa.ID != expected {
+			t.Errorf("key %s: expected owner %s, got %s", key, expected, oa.ID)
+		}
+	}
+
+	nodes := a.Nodes()
+	if len(nodes) != 2 || len(nodes[1].Slots) != 1 || nodes[1].Slots[0] != [2]int{8192, Slots - 1} {
+		t.Errorf("unexpected nodes %v", nodes)
+	}
+}
+
+func TestInvalidTopology(t *testing.T) {
+	for name, nodes := range map[string][]Node{
+		"uncovered": {{ID: "a", Addr: "a:1", Slots: [][2]int{{0, 100}}}},
+		"overlap": {
+			{ID: "a", Addr: "a:1", Slots: [][2]int{{0, 8192}}},
+			{ID: "b", Addr: "b:1", Slots: [][2]int{{8192, Slots - 1}}},
+		},
+		"range":   {{ID: "a", Addr: "a:1", Slots: [][2]int{{0, Slots}}}},
+		"unknown": {{ID: "b", Addr: "b:1", Slots: [][2]int{{0, Slots - 1}}}},
+	} {
+		if _, err := New(Topology{Nodes: nodes}, "a"); err == nil {
+			t.Errorf("%s: expected error", name)
+		}
+	}
+}
+
+func TestMigration(t *testing.T) {
+	var (
+		lns = make([]net.Listener, 2)
+		dbs = []*db.DB{db.New(), db.New()}
+	)
+	for i := range lns {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer ln.Close()
+		lns[i] = ln
+	}
+
+	topology := Topology{Nodes: []Node{
+		{ID: "a", Addr: "a:8080", Bus: lns[0].Addr().String(), Slots: [][2]int{{0, Slots - 1}}},
+		{ID: "b", Addr: "b:8080", Bus: lns[1].Addr().String()},
+	}}
+
+	a, err := New(topology, "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := New(topology, "b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if nodes := a.Nodes(); nodes[1].Bus != lns[1].Addr().String() {
+		t.Errorf("bus address is lost: %v", nodes)
+	}
+
+	a.SetSecret([]byte("secret"))
+	b.SetSecret([]byte("secret"))
+	go a.ServeBus(lns[0], dbs[0])
+	go b.ServeBus(lns[1], dbs[1])
+
+	slot := Slot("key_0")
+	var keys []string
+	for i := 0; len(keys) < 3; i++ {
+		key := fmt.Sprintf("key_%d", i)
+		if Slot(key) == slot {
+			keys = append(keys, key)
+			dbs[0].Write(key, []byte(key), nil)
+		}
+	}
+	dbs[0].Write("other", []byte("other"), nil)
+
+	// Slot is migrating: existing keys are served, others asked
+	a.mu.Lock()
+	a.migrating[slot] = a.nodes["b"]
+	a.mu.Unlock()
+
+	if _, r := a.Route(keys[0], false, func() bool { return true }); r != Local {
+		t.Errorf("existing key should be local, got %d", r)
+	}
+	if n, r := a.Route(keys[0], false, func() bool { return false }); r != Ask || n.ID != "b" {
+		t.Errorf("moved key should be asked at b, got %d %s", r, n.ID)
+	}
+
+	a.mu.Lock()
+	delete(a.migrating, slot)
+	a.mu.Unlock()
+
+	if err := a.Migrate(dbs[0], slot, "b"); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, key := range keys {
+		if _, err := dbs[0].Read(key); err != db.ErrNotFound {
+			t.Errorf("key %s is not removed from source: %v", key, err)
+		}
+		if v, err := dbs[1].Read(key); err != nil || string(v) != key {
+			t.Errorf("key %s is not moved: %q %v", key, v, err)
+		}
+		if n, r := a.Route(key, false, nil); r != Moved || n.ID != "b" {
+			t.Errorf("key %s should be moved to b, got %d %s", key, r, n.ID)
+		}
+		if _, r := b.Route(key, false, nil); r != Local {
+			t.Errorf("key %s should be local at b, got %d", key, r)
+		}
+	}
+
+	if Slot("other") != slot {
+		if _, err := dbs[0].Read("other"); err != nil {
+			t.Errorf("key of other slot is moved: %v", err)
+		}
+	}
+}
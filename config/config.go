@@ -0,0 +1,446 @@
+// Package config keeps settings of server
+//
+// Settings have dotted names by sections, e.g. tls.cert. They are
+// read from file in json, yaml or toml, then from environment and
+// then from flags, every source overrides previous ones:
+//
+//	file:  tls: {cert: node.pem}  or  [tls] cert = "node.pem"
+//	env:   DB_TLS_CERT=node.pem
+//	flag:  -tls-cert node.pem
+//
+// Lists are given by repeated flags, arrays of file or values
+// separated by semicolon.
+package config
+
+import (
+	"encoding"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lukashes/db/db/namespace"
+	"github.com/lukashes/db/glob"
+)
+
+var (
+	ErrUnknown    = errors.New("unknown setting")
+	ErrNotRuntime = errors.New("setting could not be changed at runtime")
+)
+
+// Config is a set of server settings
+type Config struct {
+	Addr string `config:"addr" usage:"address of HTTP listener"`
+	ACL  string `config:"acl" usage:"path to users file, empty to allow everything to everyone"`
+
+	Indexes []Index `config:"index" usage:"secondary index of dict field as name,field,key-pattern, could be repeated"`
+	Quotas  []Quota `config:"quota" usage:"namespace quota as name,max-keys,max-bytes,rps with 0 for unlimited, could be repeated"`
+
+	TLS struct {
+		Cert              string `config:"cert" usage:"path to PEM certificate, empty to listen without TLS"`
+		Key               string `config:"key" usage:"path to PEM key of certificate"`
+		ClientCA          string `config:"client-ca" usage:"path to PEM CA of client and node certificates, empty to skip verification"`
+		RequireClientCert bool   `config:"require-client-cert" usage:"reject clients without certificate verified by CA"`
+	} `config:"tls"`
+
+	Cluster struct {
+		Topology string `config:"topology" usage:"path to cluster topology file, empty for standalone mode"`
+		Node     string `config:"node" usage:"id of this node in cluster topology"`
+		Secret   string `config:"secret" secret:"true" usage:"shared secret of nodes, required by cluster bus"`
+	} `config:"cluster"`
+
+	Raft struct {
+		Node   string `config:"node" usage:"id of this node in raft group, empty to disable consensus mode"`
+		Peers  string `config:"peers" usage:"raft group members including this node: id=host:port,..."`
+		Dir    string `config:"dir" usage:"directory of raft term, log and snapshot, empty to keep them in memory"`
+		Secret string `config:"secret" secret:"true" usage:"shared secret of raft group members"`
+	} `config:"raft"`
+
+	Persistence struct {
+		Path     string        `config:"path" usage:"path to snapshot file, empty to keep data only in memory"`
+		Interval time.Duration `config:"interval" usage:"interval of saving snapshot, 0 to save only on shutdown"`
+		Log      string        `config:"log" usage:"path to append log of changes, snapshot is saved only on start if it is set"`
+		KeyFile  string        `config:"key-file" usage:"path to encryption key of snapshot"`
+		KeyEnv   string        `config:"key-env" usage:"environment variable with encryption key of snapshot"`
+
+		OldKeyFiles      []string `config:"old-key-files" usage:"paths to previous encryption keys, files encrypted by them are read and rewritten with current key, could be repeated"`
+		MigratePlaintext bool     `config:"migrate-plaintext" usage:"read unencrypted snapshot, it is encrypted on the next save"`
+	} `config:"persistence"`
+
+	Memory struct {
+		MaxKeys  int    `config:"max-keys" runtime:"true" usage:"max count of keys in default namespace, 0 for unlimited"`
+		MaxBytes Size   `config:"max-bytes" runtime:"true" usage:"max size of keys and values in default namespace, e.g. 512mb, 0 for unlimited"`
+		Policy   string `config:"policy" usage:"policy on reaching limits, only noeviction is supported"`
+
+		Compression Size `config:"compression" usage:"compress hash values of this size and more, e.g. 1kb, 0 to disable"`
+	} `config:"memory"`
+
+	Log struct {
+		Level string `config:"level" runtime:"true" usage:"log level: debug, info, warn, error or off"`
+	} `config:"log"`
+
+	Replication struct {
+		Listen   string `config:"listen" usage:"address for followers, empty if node is not leader"`
+		Leader   string `config:"leader" usage:"address of leader, node is read only follower if it is set"`
+		Backlog  int    `config:"backlog" usage:"mutations kept for followers which reconnect"`
+		User     string `config:"user" usage:"ACL user of follower"`
+		Password string `config:"password" secret:"true" usage:"password of follower"`
+	} `config:"replication"`
+}
+
+// Default returns config with default values
+func Default() *Config {
+	c := &Config{Addr: ":8080"}
+	c.Persistence.Interval = time.Minute
+	c.Memory.Policy = "noeviction"
+	c.Log.Level = "info"
+
+	return c
+}
+
+// Index is a definition of secondary index
+type Index struct {
+	Name    string
+	Field   string
+	Pattern string
+}
+
+func (i *Index) UnmarshalText(b []byte) error {
+	p := strings.SplitN(string(b), ",", 3)
+	if len(p) != 3 || p[0] == "" || p[1] == "" || p[2] == "" {
+		return fmt.Errorf("invalid index %q, expected name,field,key-pattern", b)
+	}
+	i.Name, i.Field, i.Pattern = p[0], p[1], p[2]
+
+	return nil
+}
+
+func (i Index) MarshalText() ([]byte, error) {
+	return []byte(i.Name + "," + i.Field + "," + i.Pattern), nil
+}
+
+// Quota is a quota of namespace
+type Quota struct {
+	Name string
+	namespace.Quota
+}
+
+func (q *Quota) UnmarshalText(b []byte) error {
+	p := strings.Split(string(b), ",")
+	if len(p) != 4 || !namespace.ValidName(p[0]) {
+		return fmt.Errorf("invalid quota %q, expected name,max-keys,max-bytes,rps", b)
+	}
+
+	var (
+		size Size
+		err  error
+	)
+	q.Name = p[0]
+	if q.MaxKeys, err = strconv.Atoi(p[1]); err != nil {
+		return fmt.Errorf("invalid quota %q: %s", b, err)
+	}
+	if err = size.UnmarshalText([]byte(p[2])); err != nil {
+		return fmt.Errorf("invalid quota %q: %s", b, err)
+	}
+	q.MaxBytes = int64(size)
+	if q.RPS, err = strconv.ParseFloat(p[3], 64); err != nil {
+		return fmt.Errorf("invalid quota %q: %s", b, err)
+	}
+	if q.MaxKeys < 0 || q.MaxBytes < 0 || q.RPS < 0 {
+		return fmt.Errorf("invalid quota %q: negative limit", b)
+	}
+
+	return nil
+}
+
+func (q Quota) MarshalText() ([]byte, error) {
+	return []byte(fmt.Sprintf("%s,%d,%d,%g", q.Name, q.MaxKeys, q.MaxBytes, q.RPS)), nil
+}
+
+// Size is a count of bytes, text could have suffix kb, mb or gb
+type Size int64
+
+var sizeUnits = []struct {
+	suffix string
+	n      int64
+}{{"gb", 1 << 30}, {"mb", 1 << 20}, {"kb", 1 << 10}, {"b", 1}}
+
+func (s *Size) UnmarshalText(b []byte) error {
+	t := strings.ToLower(strings.TrimSpace(string(b)))
+
+	n := int64(1)
+	for _, u := range sizeUnits {
+		if strings.HasSuffix(t, u.suffix) {
+			t, n = strings.TrimSpace(t[:len(t)-len(u.suffix)]), u.n
+			break
+		}
+	}
+
+	v, err := strconv.ParseInt(t, 10, 64)
+	if err != nil || v < 0 {
+		return fmt.Errorf("invalid size %q", b)
+	}
+	*s = Size(v * n)
+
+	return nil
+}
+
+func (s Size) MarshalText() ([]byte, error) {
+	return []byte(strconv.FormatInt(int64(s), 10)), nil
+}
+
+// Validate checks settings are consistent
+func (c *Config) Validate() error {
+	switch {
+	case c.Addr == "":
+		return errors.New("config: addr: empty address")
+	case (c.TLS.Cert == "") != (c.TLS.Key == ""):
+		return errors.New("config: tls: certificate and key should be set together")
+	case c.TLS.ClientCA != "" && c.TLS.Cert == "":
+		return errors.New("config: tls.client-ca: certificate is not set")
+	case c.TLS.RequireClientCert && c.TLS.ClientCA == "":
+		return errors.New("config: tls.require-client-cert: client CA is not set")
+	case c.Cluster.Topology != "" && c.Cluster.Node == "":
+		return errors.New("config: cluster.node: id of node is not set")
+	case c.Raft.Node != "" && c.Raft.Peers == "":
+		return errors.New("config: raft.peers: peers are not set")
+	case c.Raft.Node != "" && c.Raft.Secret == "":
+		return errors.New("config: raft.secret: secret of raft group is not set")
+	case c.Persistence.Interval < 0:
+		return errors.New("config: persistence.interval: negative interval")
+	case c.Persistence.Path != "" && c.Raft.Node != "":
+		return errors.New("config: persistence: snapshots are not supported in consensus mode")
+	case c.Persistence.Path == "" && (c.Persistence.KeyFile != "" || c.Persistence.KeyEnv != ""):
+		return errors.New("config: persistence: encryption key is set without path")
+	case c.Persistence.Path == "" && c.Persistence.Log != "":
+		return errors.New("config: persistence.log: snapshot path is not set")
+	case len(c.Persistence.OldKeyFiles) > 0 && c.Persistence.KeyFile == "" && c.Persistence.KeyEnv == "":
+		return errors.New("config: persistence.old-key-files: current encryption key is not set")
+	case c.Persistence.MigratePlaintext && c.Persistence.KeyFile == "" && c.Persistence.KeyEnv == "":
+		return errors.New("config: persistence.migrate-plaintext: encryption key is not set")
+	case c.Memory.MaxKeys < 0:
+		return errors.New("config: memory.max-keys: negative limit")
+	case c.Memory.Policy != "noeviction":
+		return fmt.Errorf("config: memory.policy: unsupported policy %q", c.Memory.Policy)
+	case c.Replication.Listen != "" && c.Replication.Leader != "":
+		return errors.New("config: replication: node could not be leader and follower")
+	case c.Replication.Backlog < 0:
+		return errors.New("config: replication.backlog: negative backlog")
+	}
+
+	if _, ok := levels[c.Log.Level]; !ok {
+		return fmt.Errorf("config: log.level: unknown level %q", c.Log.Level)
+	}
+
+	names := make(map[string]bool)
+	for _, q := range c.Quotas {
+		if names[q.Name] {
+			return fmt.Errorf("config: quota: duplicated namespace %s", q.Name)
+		}
+		names[q.Name] = true
+
+		if q.Name == namespace.Default && (c.Memory.MaxKeys > 0 || c.Memory.MaxBytes > 0) {
+			return fmt.Errorf("config: quota: default namespace is limited by memory settings")
+		}
+	}
+
+	return nil
+}
+
+// Log levels by names
+var levels = map[string]bool{"debug": true, "info": true, "warn": true, "error": true, "off": true}
+
+// Setting is a field of config
+type setting struct {
+	name    string
+	usage   string
+	runtime bool
+	secret  bool
+	v       reflect.Value
+}
+
+var textUnmarshaler = reflect.TypeOf((*encoding.TextUnmarshaler)(nil)).Elem()
+
+// Returns settings in order of fields
+func (c *Config) settings() []setting {
+	var s []setting
+	walk(reflect.ValueOf(c).Elem(), "", &s)
+
+	return s
+}
+
+func walk(v reflect.Value, prefix string, s *[]setting) {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		name := f.Tag.Get("config")
+		if name == "" {
+			continue
+		}
+		if prefix != "" {
+			name = prefix + "." + name
+		}
+
+		// Sections are structs which are not parsed from text
+		if f.Type.Kind() == reflect.Struct && !reflect.PtrTo(f.Type).Implements(textUnmarshaler) {
+			walk(v.Field(i), name, s)
+			continue
+		}
+
+		*s = append(*s, setting{
+			name:    name,
+			usage:   f.Tag.Get("usage"),
+			runtime: f.Tag.Get("runtime") == "true",
+			secret:  f.Tag.Get("secret") == "true",
+			v:       v.Field(i),
+		})
+	}
+}
+
+func (c *Config) setting(name string) (setting, bool) {
+	for _, s := range c.settings() {
+		if s.name == name {
+			return s, true
+		}
+	}
+
+	return setting{}, false
+}
+
+// Sets value of setting, list is replaced unless add is true
+func (s setting) set(value string, add bool) error {
+	if s.v.Kind() != reflect.Slice {
+		return parse(s.v, value)
+	}
+
+	if !add {
+		s.v.Set(reflect.MakeSlice(s.v.Type(), 0, 0))
+	}
+	for _, p := range strings.Split(value, ";") {
+		if p = strings.TrimSpace(p); p == "" {
+			continue
+		}
+		e := reflect.New(s.v.Type().Elem()).Elem()
+		if err := parse(e, p); err != nil {
+			return err
+		}
+		s.v.Set(reflect.Append(s.v, e))
+	}
+
+	return nil
+}
+
+func parse(v reflect.Value, value string) error {
+	if u, ok := v.Addr().Interface().(encoding.TextUnmarshaler); ok {
+		return u.UnmarshalText([]byte(value))
+	}
+
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(value)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("invalid bool %q", value)
+		}
+		v.SetBool(b)
+	case reflect.Int, reflect.Int64:
+		if v.Type() == reflect.TypeOf(time.Duration(0)) {
+			d, err := time.ParseDuration(value)
+			if err != nil {
+				return fmt.Errorf("invalid duration %q", value)
+			}
+			v.SetInt(int64(d))
+			return nil
+		}
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid number %q", value)
+		}
+		v.SetInt(n)
+	default:
+		return fmt.Errorf("unsupported type %s", v.Type())
+	}
+
+	return nil
+}
+
+// Returns text of value, elements of list are separated by semicolon
+func (s setting) String() string {
+	if s.secret && !s.v.IsZero() {
+		return "******"
+	}
+
+	if s.v.Kind() != reflect.Slice {
+		return format(s.v)
+	}
+
+	p := make([]string, s.v.Len())
+	for i := range p {
+		p[i] = format(s.v.Index(i))
+	}
+
+	return strings.Join(p, ";")
+}
+
+func format(v reflect.Value) string {
+	if m, ok := v.Interface().(encoding.TextMarshaler); ok {
+		b, _ := m.MarshalText()
+		return string(b)
+	}
+
+	return fmt.Sprint(v.Interface())
+}
+
+// Get returns values of settings which names match glob pattern,
+// secrets are masked
+func (c *Config) Get(pattern string) map[string]string {
+	values := make(map[string]string)
+	for _, s := range c.settings() {
+		if glob.Match(pattern, s.name) {
+			values[s.name] = s.String()
+		}
+	}
+
+	return values
+}
+
+// Names returns sorted names of all settings
+func (c *Config) Names() []string {
+	var names []string
+	for _, s := range c.settings() {
+		names = append(names, s.name)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+// Set changes setting which could be changed at runtime,
+// old value stays if new one is invalid
+func (c *Config) Set(name, value string) error {
+	s, ok := c.setting(name)
+	if !ok {
+		return ErrUnknown
+	}
+	if !s.runtime {
+		return ErrNotRuntime
+	}
+
+	old := reflect.New(s.v.Type()).Elem()
+	old.Set(s.v)
+
+	if err := s.set(value, false); err != nil {
+		s.v.Set(old)
+		return fmt.Errorf("config: %s: %s", name, err)
+	}
+	if err := c.Validate(); err != nil {
+		s.v.Set(old)
+		return err
+	}
+
+	return nil
+}
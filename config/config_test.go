@@ -0,0 +1,142 @@
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestLoad(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	files := map[string]string{
+		"db.json": `{
+			"addr": ":9000",
+			"tls": {"cert": "node.pem", "key": "node.key"},
+			"index": ["email,email,user:*", "age,age,user:*"],
+			"memory": {"max-bytes": "64mb"},
+			"persistence.interval": "10s"
+		}`,
+		"db.yaml": `
+addr: ":9000"   # comment
+tls:
+  cert: node.pem
+  key: 'node.key'
+index:
+  - email,email,user:*
+  - "age,age,user:*"
+memory:
+  max-bytes: 64mb
+persistence:
+  interval: 10s
+`,
+		"db.toml": `
+addr = ":9000"
+index = ["email,email,user:*", "age,age,user:*"] # comment
+
+[tls]
+cert = "node.pem"
+key = 'node.key'
+
+[memory]
+max-bytes = "64mb"
+
+[persistence]
+interval = "10s"
+`,
+	}
+
+	for name, data := range files {
+		path := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(path, []byte(data), 0600); err != nil {
+			t.Fatal(err)
+		}
+
+		c, err := Load([]string{"-config", path}, func(string) string { return "" })
+		if err != nil {
+			t.Fatalf("%s: %s", name, err)
+		}
+		if c.Addr != ":9000" || c.TLS.Cert != "node.pem" || c.TLS.Key != "node.key" {
+			t.Errorf("%s: unexpected settings %+v", name, c)
+		}
+		if c.Memory.MaxBytes != 64<<20 || c.Persistence.Interval != 10*time.Second {
+			t.Errorf("%s: unexpected memory and persistence %+v %+v", name, c.Memory, c.Persistence)
+		}
+		if want := []Index{{"email", "email", "user:*"}, {"age", "age", "user:*"}}; !reflect.DeepEqual(c.Indexes, want) {
+			t.Errorf("%s: unexpected indexes %+v", name, c.Indexes)
+		}
+	}
+
+	// Environment overrides file and flags override environment
+	env := map[string]string{
+		"DB_CONFIG":    filepath.Join(dir, "db.yaml"),
+		"DB_ADDR":      ":9001",
+		"DB_LOG_LEVEL": "debug",
+	}
+	c, err := Load([]string{"-addr", ":9002", "-quota", "a,1,1kb,0", "-quota", "b,0,0,10", "-tls-require-client-cert", "-tls-client-ca", "ca.pem"}, func(k string) string { return env[k] })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Addr != ":9002" || c.Log.Level != "debug" || !c.TLS.RequireClientCert || len(c.Quotas) != 2 || c.Quotas[0].MaxBytes != 1024 {
+		t.Errorf("unexpected overridden settings %+v", c)
+	}
+
+	for _, args := range [][]string{
+		{"-memory-policy", "allkeys-lru"},
+		{"-tls-cert", "node.pem"},
+		{"-log-level", "verbose"},
+		{"-index", "broken"},
+		{"-replication-listen", ":1", "-replication-leader", "leader:1"},
+		{"-quota", "0,1,0,0", "-memory-max-keys", "10"},
+		{"-persistence-path", "db.snap", "-persistence-old-key-files", "old.key"},
+		{"-persistence-path", "db.snap", "-persistence-migrate-plaintext"},
+		{"-persistence-log", "db.log"},
+		{"-raft-node", "a", "-raft-peers", "a=127.0.0.1:9000"},
+		{"-unknown", "1"},
+	} {
+		if _, err := Load(args, func(string) string { return "" }); err == nil {
+			t.Errorf("invalid args %q are accepted", args)
+		}
+	}
+}
+
+func TestSet(t *testing.T) {
+	c := Default()
+
+	if err := c.Set("memory.max-bytes", "1kb"); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Set("log.level", "verbose"); err == nil {
+		t.Fatal("invalid level is set")
+	}
+	if err := c.Set("addr", ":1"); err != ErrNotRuntime {
+		t.Fatalf("expected not runtime error, got %v", err)
+	}
+	if err := c.Set("missing", "1"); err != ErrUnknown {
+		t.Fatalf("expected unknown error, got %v", err)
+	}
+
+	c.Replication.Password = "secret"
+	want := map[string]string{
+		"memory.compression": "0",
+		"memory.max-bytes":   "1024",
+		"memory.max-keys":    "0",
+		"memory.policy":      "noeviction",
+	}
+	if v := c.Get("memory.*"); !reflect.DeepEqual(v, want) {
+		t.Fatalf("unexpected values %q", v)
+	}
+	if v := c.Get("log.level"); v["log.level"] != "info" {
+		t.Fatalf("invalid value is kept %q", v)
+	}
+	if v := c.Get("replication.password"); v["replication.password"] == "secret" {
+		t.Fatal("secret is not masked")
+	}
+}
@@ -0,0 +1,186 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+)
+
+// Prefix of environment variables, e.g. DB_TLS_CERT for tls.cert,
+// DB_CONFIG is path to config file
+const EnvPrefix = "DB_"
+
+// Load reads config file given by -config flag or DB_CONFIG
+// variable, then overrides settings by environment and args
+func Load(args []string, getenv func(string) string) (*Config, error) {
+	c := Default()
+
+	type value struct {
+		name, value string
+	}
+	var flags []value
+
+	fs := flag.NewFlagSet(filepath.Base(os.Args[0]), flag.ContinueOnError)
+	path := fs.String("config", getenv(EnvPrefix+"CONFIG"), "path to config file in json, yaml or toml")
+	for _, s := range c.settings() {
+		name := s.name
+		fn := func(v string) error {
+			flags = append(flags, value{name, v})
+			return nil
+		}
+		if s.v.Kind() == reflect.Bool {
+			fs.BoolFunc(FlagName(name), s.usage, fn)
+		} else {
+			fs.Func(FlagName(name), s.usage, fn)
+		}
+	}
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+
+	if *path != "" {
+		if err := c.readFile(*path); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, s := range c.settings() {
+		if v := getenv(EnvName(s.name)); v != "" {
+			if err := s.set(v, false); err != nil {
+				return nil, fmt.Errorf("config: %s: %s", EnvName(s.name), err)
+			}
+		}
+	}
+
+	// Repeated flags of list are added to each other
+	seen := make(map[string]bool)
+	for _, f := range flags {
+		s, _ := c.setting(f.name)
+		if err := s.set(f.value, seen[f.name]); err != nil {
+			return nil, fmt.Errorf("config: -%s: %s", FlagName(f.name), err)
+		}
+		seen[f.name] = true
+	}
+
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// FlagName returns name of flag of setting, e.g. tls-cert
+func FlagName(name string) string {
+	return strings.Replace(name, ".", "-", -1)
+}
+
+// EnvName returns name of environment variable of setting
+func EnvName(name string) string {
+	return EnvPrefix + strings.ToUpper(strings.NewReplacer(".", "_", "-", "_").Replace(name))
+}
+
+// Reads file, format is chosen by extension
+func (c *Config) readFile(path string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("config: %s", err)
+	}
+
+	var values map[string]interface{}
+	switch ext := strings.ToLower(filepath.Ext(path)); ext {
+	case ".json":
+		values, err = parseJSON(data)
+	case ".yaml", ".yml":
+		values, err = parseYAML(data)
+	case ".toml":
+		values, err = parseTOML(data)
+	default:
+		return fmt.Errorf("config: %s: unknown format %q", path, ext)
+	}
+	if err != nil {
+		return fmt.Errorf("config: %s: %s", path, err)
+	}
+
+	for name, v := range values {
+		s, ok := c.setting(name)
+		if !ok {
+			return fmt.Errorf("config: %s: %s %s", path, ErrUnknown, name)
+		}
+
+		switch t := v.(type) {
+		case string:
+			err = s.set(t, false)
+		case []string:
+			if s.v.Kind() != reflect.Slice {
+				return fmt.Errorf("config: %s: %s: list for single value", path, name)
+			}
+			s.v.Set(reflect.MakeSlice(s.v.Type(), 0, len(t)))
+			for _, e := range t {
+				if err = s.set(e, true); err != nil {
+					break
+				}
+			}
+		}
+		if err != nil {
+			return fmt.Errorf("config: %s: %s: %s", path, name, err)
+		}
+	}
+
+	return nil
+}
+
+// Returns values of json object by dotted names,
+// values are strings or lists of strings
+func parseJSON(data []byte) (map[string]interface{}, error) {
+	d := json.NewDecoder(bytes.NewReader(data))
+	d.UseNumber()
+
+	var m map[string]interface{}
+	if err := d.Decode(&m); err != nil {
+		return nil, err
+	}
+
+	values := make(map[string]interface{})
+	if err := flatten("", m, values); err != nil {
+		return nil, err
+	}
+
+	return values, nil
+}
+
+func flatten(prefix string, m map[string]interface{}, values map[string]interface{}) error {
+	for k, v := range m {
+		if prefix != "" {
+			k = prefix + "." + k
+		}
+
+		switch t := v.(type) {
+		case map[string]interface{}:
+			if err := flatten(k, t, values); err != nil {
+				return err
+			}
+		case []interface{}:
+			l := make([]string, len(t))
+			for i, e := range t {
+				switch e.(type) {
+				case map[string]interface{}, []interface{}:
+					return fmt.Errorf("%s: nested list", k)
+				}
+				l[i] = fmt.Sprint(e)
+			}
+			values[k] = l
+		case nil:
+			values[k] = ""
+		default:
+			values[k] = fmt.Sprint(t)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,207 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Parses subset of yaml: nested maps by indentation with spaces,
+// scalars, lists of scalars by dashes or in brackets and comments
+func parseYAML(data []byte) (map[string]interface{}, error) {
+	type section struct {
+		indent int
+		name   string
+	}
+
+	var (
+		values = make(map[string]interface{})
+		stack  []section
+		list   *section // key without value, it could have list items
+	)
+
+	for i, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimRight(stripComment(line), " \r")
+		text := strings.TrimLeft(line, " ")
+		if text == "" || text == "---" {
+			continue
+		}
+		if strings.HasPrefix(text, "\t") {
+			return nil, fmt.Errorf("line %d: tabs are not allowed for indentation", i+1)
+		}
+		indent := len(line) - len(text)
+
+		if text == "-" || strings.HasPrefix(text, "- ") {
+			if list == nil || indent < list.indent {
+				return nil, fmt.Errorf("line %d: list item without key", i+1)
+			}
+			v, err := scalar(strings.TrimSpace(text[1:]))
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %s", i+1, err)
+			}
+			l, _ := values[list.name].([]string)
+			values[list.name] = append(l, v)
+			continue
+		}
+
+		for len(stack) > 0 && stack[len(stack)-1].indent >= indent {
+			stack = stack[:len(stack)-1]
+		}
+		list = nil
+
+		p := strings.Index(text, ":")
+		if p <= 0 || (p+1 < len(text) && text[p+1] != ' ') {
+			return nil, fmt.Errorf("line %d: expected key: value", i+1)
+		}
+		name := strings.TrimSpace(text[:p])
+		if len(stack) > 0 {
+			name = stack[len(stack)-1].name + "." + name
+		}
+
+		value := strings.TrimSpace(text[p+1:])
+		if value == "" {
+			stack = append(stack, section{indent: indent, name: name})
+			list = &section{indent: indent, name: name}
+			continue
+		}
+
+		v, err := parseValue(value)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %s", i+1, err)
+		}
+		values[name] = v
+	}
+
+	return values, nil
+}
+
+// Parses subset of toml: sections, keys with strings, numbers,
+// booleans, one line arrays and comments
+func parseTOML(data []byte) (map[string]interface{}, error) {
+	var (
+		values = make(map[string]interface{})
+		prefix string
+	)
+
+	for i, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(stripComment(line))
+		if line == "" {
+			continue
+		}
+
+		if strings.HasPrefix(line, "[") {
+			if !strings.HasSuffix(line, "]") || strings.HasPrefix(line, "[[") {
+				return nil, fmt.Errorf("line %d: invalid section", i+1)
+			}
+			prefix = strings.TrimSpace(line[1 : len(line)-1])
+			continue
+		}
+
+		p := strings.Index(line, "=")
+		if p <= 0 {
+			return nil, fmt.Errorf("line %d: expected key = value", i+1)
+		}
+		name := strings.TrimSpace(line[:p])
+		if prefix != "" {
+			name = prefix + "." + name
+		}
+
+		v, err := parseValue(strings.TrimSpace(line[p+1:]))
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %s", i+1, err)
+		}
+		values[name] = v
+	}
+
+	return values, nil
+}
+
+// Returns scalar or list in brackets
+func parseValue(s string) (interface{}, error) {
+	if !strings.HasPrefix(s, "[") {
+		return scalar(s)
+	}
+	if !strings.HasSuffix(s, "]") {
+		return nil, errors.New("unterminated list")
+	}
+
+	l := []string{}
+	for _, e := range splitList(s[1 : len(s)-1]) {
+		if e = strings.TrimSpace(e); e == "" {
+			continue
+		}
+		v, err := scalar(e)
+		if err != nil {
+			return nil, err
+		}
+		l = append(l, v)
+	}
+
+	return l, nil
+}
+
+// Unquotes string in double or single quotes
+func scalar(s string) (string, error) {
+	switch {
+	case len(s) >= 2 && s[0] == '"' && s[len(s)-1] == '"':
+		v, err := strconv.Unquote(s)
+		if err != nil {
+			return "", fmt.Errorf("invalid string %s", s)
+		}
+		return v, nil
+	case len(s) >= 2 && s[0] == '\'' && s[len(s)-1] == '\'':
+		return strings.Replace(s[1:len(s)-1], "''", "'", -1), nil
+	case strings.HasPrefix(s, "{"):
+		return "", errors.New("inline maps are not supported")
+	}
+
+	return s, nil
+}
+
+// Splits by commas outside of quotes
+func splitList(s string) []string {
+	var (
+		parts []string
+		quote byte
+		start int
+	)
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case quote != 0:
+			if c == '\\' && quote == '"' {
+				i++
+			} else if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == ',':
+			parts = append(parts, s[start:i])
+			start = i + 1
+		}
+	}
+
+	return append(parts, s[start:])
+}
+
+// Removes comment starting by # outside of quotes
+func stripComment(line string) string {
+	var quote byte
+	for i := 0; i < len(line); i++ {
+		switch c := line[i]; {
+		case quote != 0:
+			if c == '\\' && quote == '"' {
+				i++
+			} else if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '#' && (i == 0 || line[i-1] == ' ' || line[i-1] == '\t'):
+			return line[:i]
+		}
+	}
+
+	return line
+}
@@ -0,0 +1,276 @@
+package db
+
+import (
+	"math/bits"
+	"strconv"
+	"strings"
+)
+
+// Bitmap is limited to 512MB like other hash values of reasonable size
+const maxBitOffset = 1<<32 - 1
+
+// BitOp is operation of BitOp method
+type BitOp int
+
+const (
+	BitAnd BitOp = iota
+	BitOr
+	BitXor
+	BitNot
+)
+
+// ParseBitOp returns operation by name: and, or, xor or not
+func ParseBitOp(s string) (BitOp, bool) {
+	switch strings.ToLower(s) {
+	case "and":
+		return BitAnd, true
+	case "or":
+		return BitOr, true
+	case "xor":
+		return BitXor, true
+	case "not":
+		return BitNot, true
+	}
+
+	return 0, false
+}
+
+// Joins chunks and decompresses value, so it could be changed in place
+func (n *node) flatten() error {
+	if n.chunks == nil {
+		return nil
+	}
+
+	v, err := n.copyBytes()
+	if err != nil {
+		return err
+	}
+
+	n.value = v
+	n.owned = true
+	n.chunks = nil
+	n.packed = false
+	n.size = 0
+
+	return nil
+}
+
+// SetBit sets bit at offset to 0 or 1 and returns previous bit
+//
+// Bits are counted from the most significant bit of the first byte,
+// value grows with zero bytes if needed. Missing key is created.
+func (db *DB) SetBit(key string, offset uint64, bit int) (int, error) {
+	if err := db.writable(key); err != nil {
+		return 0, err
+	}
+
+	return db.setBit(key, offset, bit)
+}
+
+func (db *DB) setBit(key string, offset uint64, bit int) (int, error) {
+	if offset > maxBitOffset || bit != 0 && bit != 1 {
+		return 0, ErrInvalidArgument
+	}
+
+	c := newChange(changeSetBit, strconv.FormatUint(offset, 10), strconv.Itoa(bit))
+
+	var old int
+	err := db.head().update(db, key, c, func(n *node, exists bool) error {
+		if !exists {
+			n.set([]byte{})
+		}
+		if n.tipe != TypeHash {
+			return ErrInvalidType
+		}
+		if err := n.flatten(); err != nil {
+			return err
+		}
+
+		i, mask := offset/8, byte(0x80>>(offset%8))
+		size := len(n.value)
+		if need := int(i) + 1; need > size {
+			size = need
+		}
+		if !n.owned {
+			// Value could be buffer given to Write, so it is copied once
+			v := make([]byte, size)
+			copy(v, n.value)
+			n.value, n.owned = v, true
+		} else if size > len(n.value) {
+			n.value = append(n.value, make([]byte, size-len(n.value))...)
+		}
+
+		if n.value[i]&mask != 0 {
+			old = 1
+		}
+		if bit == 1 {
+			n.value[i] |= mask
+		} else {
+			n.value[i] &^= mask
+		}
+
+		return nil
+	})
+
+	return old, err
+}
+
+// GetBit returns bit at offset, bits out of value are zero
+func (db *DB) GetBit(key string, offset uint64) (int, error) {
+	var bit int
+
+	err := db.View(key, func(v []byte) error {
+		if i := offset / 8; i < uint64(len(v)) && v[i]&(0x80>>(offset%8)) != 0 {
+			bit = 1
+		}
+		return nil
+	})
+	if err == ErrNotFound {
+		return 0, nil
+	}
+
+	return bit, err
+}
+
+// BitCount returns count of set bits in bytes from start to end
+//
+// Negative indexes count from the end, -1 is the last byte.
+func (db *DB) BitCount(key string, start, end int) (int, error) {
+	var cnt int
+
+	err := db.View(key, func(v []byte) error {
+		from, to, ok := byteRange(start, end, len(v))
+		if !ok {
+			return nil
+		}
+		for _, b := range v[from:to] {
+			cnt += bits.OnesCount8(b)
+		}
+		return nil
+	})
+	if err == ErrNotFound {
+		return 0, nil
+	}
+
+	return cnt, err
+}
+
+// BitPos returns position of the first bit equal to bit in bytes
+// from start to end or -1 if there is no such bit
+//
+// If range goes to the end of value, it is considered padded with
+// zeros, so clear bit is found after the last byte.
+func (db *DB) BitPos(key string, bit int, start, end int) (int, error) {
+	if bit != 0 && bit != 1 {
+		return 0, ErrInvalidArgument
+	}
+
+	pos := -1
+	err := db.View(key, func(v []byte) error {
+		from, to, ok := byteRange(start, end, len(v))
+		if !ok {
+			return nil
+		}
+
+		for i := from; i < to; i++ {
+			b := v[i]
+			if bit == 0 {
+				b = ^b
+			}
+			if b != 0 {
+				pos = i*8 + bits.LeadingZeros8(b)
+				return nil
+			}
+		}
+
+		if bit == 0 && to == len(v) {
+			pos = to * 8
+		}
+
+		return nil
+	})
+	if err == ErrNotFound {
+		if bit == 0 {
+			return 0, nil
+		}
+		return -1, nil
+	}
+
+	return pos, err
+}
+
+// BitOp stores result of operation on keys to dest and returns its length
+//
+// Shorter and missing values are padded with zeros, result is as long
+// as the longest one. Not takes exactly one key. Dest loses its ttl.
+func (db *DB) BitOp(op BitOp, dest string, keys ...string) (int, error) {
+	if len(keys) == 0 || op == BitNot && len(keys) != 1 {
+		return 0, ErrInvalidArgument
+	}
+
+	if err := db.writable(dest); err != nil {
+		return 0, err
+	}
+
+	vals := make([][]byte, 0, len(keys))
+	size := 0
+	for _, k := range keys {
+		v, err := db.Read(k)
+		if err != nil && err != ErrNotFound {
+			return 0, err
+		}
+		if len(v) > size {
+			size = len(v)
+		}
+		vals = append(vals, v)
+	}
+
+	res := make([]byte, size)
+	copy(res, vals[0])
+	for _, v := range vals[1:] {
+		for i := range res {
+			var b byte
+			if i < len(v) {
+				b = v[i]
+			}
+			switch op {
+			case BitAnd:
+				res[i] &= b
+			case BitOr:
+				res[i] |= b
+			case BitXor:
+				res[i] ^= b
+			}
+		}
+	}
+	if op == BitNot {
+		for i := range res {
+			res[i] = ^res[i]
+		}
+	}
+
+	return size, db.head().write(db, dest, db.pack(res), 0)
+}
+
+// Returns bounds of byte range for value of length l,
+// false if range is empty
+func byteRange(start, end, l int) (int, int, bool) {
+	if start < 0 {
+		start += l
+	}
+	if end < 0 {
+		end += l
+	}
+	if start < 0 {
+		start = 0
+	}
+	if end >= l {
+		end = l - 1
+	}
+
+	if start > end || start >= l {
+		return 0, 0, false
+	}
+
+	return start, end + 1, true
+}
@@ -0,0 +1,232 @@
+package db
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"math"
+	"strconv"
+)
+
+// Used when filter is created by BFAdd
+const (
+	DefaultErrorRate = 0.01
+	DefaultCapacity  = 100
+
+	// 128MB per filter
+	maxBloomBits = 1 << 30
+)
+
+type bloom struct {
+	bits []uint64
+	m    uint64 // count of bits
+	k    int    // count of hash functions
+
+	// Parameters filter was reserved with
+	errorRate float64
+	capacity  int
+	items     int
+}
+
+// Returns filter of optimal size for capacity items
+// and probability of false positives
+func newBloom(errorRate float64, capacity int) (*bloom, error) {
+	if errorRate <= 0 || errorRate >= 1 || capacity <= 0 {
+		return nil, ErrInvalidArgument
+	}
+
+	m := math.Ceil(-float64(capacity) * math.Log(errorRate) / (math.Ln2 * math.Ln2))
+	if m > maxBloomBits {
+		return nil, ErrInvalidArgument
+	}
+
+	b := &bloom{
+		m:         uint64(m),
+		k:         int(math.Max(1, math.Round(m/float64(capacity)*math.Ln2))),
+		errorRate: errorRate,
+		capacity:  capacity,
+	}
+	b.bits = make([]uint64, (b.m+63)/64)
+
+	return b, nil
+}
+
+func (b *bloom) tipe() Type {
+	return TypeBloom
+}
+
+func (b *bloom) clone() object {
+	c := *b
+	c.bits = append([]uint64(nil), b.bits...)
+
+	return &c
+}
+
+func (b *bloom) size() int64 {
+	return int64(len(b.bits)) * 8
+}
+
+// Calls fn for bit positions of item, stops when fn returns false
+//
+// Positions are derived from two halves of 64 bit hash.
+func (b *bloom) positions(item string, fn func(i uint64) bool) {
+	x := hash64([]byte(item))
+	h1, h2 := x>>32, x&0xffffffff|1
+
+	for i := 0; i < b.k; i++ {
+		if !fn((h1 + uint64(i)*h2) % b.m) {
+			return
+		}
+	}
+}
+
+// Returns true if item was not in filter
+func (b *bloom) add(item string) bool {
+	added := false
+	b.positions(item, func(i uint64) bool {
+		if b.bits[i/64]&(1<<(i%64)) == 0 {
+			b.bits[i/64] |= 1 << (i % 64)
+			added = true
+		}
+		return true
+	})
+
+	if added {
+		b.items++
+	}
+
+	return added
+}
+
+func (b *bloom) exists(item string) bool {
+	found := true
+	b.positions(item, func(i uint64) bool {
+		found = b.bits[i/64]&(1<<(i%64)) != 0
+		return found
+	})
+
+	return found
+}
+
+// Snapshot payload: error rate as float bits, capacity,
+// count of items, count of hash functions, bits count and words
+func (b *bloom) encode(w *bufio.Writer) {
+	writeUvarint(w, math.Float64bits(b.errorRate))
+	writeUvarint(w, uint64(b.capacity))
+	writeUvarint(w, uint64(b.items))
+	writeUvarint(w, uint64(b.k))
+	writeUvarint(w, b.m)
+
+	var buf [8]byte
+	for _, v := range b.bits {
+		binary.LittleEndian.PutUint64(buf[:], v)
+		w.Write(buf[:])
+	}
+}
+
+func decodeBloom(r *bufio.Reader) (*bloom, error) {
+	var v [5]uint64
+	for i := range v {
+		var err error
+		if v[i], err = binary.ReadUvarint(r); err != nil {
+			return nil, ErrCorrupted
+		}
+	}
+
+	b := &bloom{
+		errorRate: math.Float64frombits(v[0]),
+		capacity:  int(v[1]),
+		items:     int(v[2]),
+		k:         int(v[3]),
+		m:         v[4],
+	}
+	if b.m == 0 || b.m > maxBloomBits || b.k == 0 {
+		return nil, ErrCorrupted
+	}
+
+	var buf [8]byte
+	b.bits = make([]uint64, (b.m+63)/64)
+	for i := range b.bits {
+		if _, err := io.ReadFull(r, buf[:]); err != nil {
+			return nil, ErrCorrupted
+		}
+		b.bits[i] = binary.LittleEndian.Uint64(buf[:])
+	}
+
+	return b, nil
+}
+
+// BFReserve creates empty filter for capacity items with
+// given probability of false positives
+func (db *DB) BFReserve(key string, errorRate float64, capacity int) error {
+	if err := db.writable(key); err != nil {
+		return err
+	}
+
+	return db.bfReserve(key, errorRate, capacity)
+}
+
+func (db *DB) bfReserve(key string, errorRate float64, capacity int) error {
+	b, err := newBloom(errorRate, capacity)
+	if err != nil {
+		return err
+	}
+
+	c := newChange(changeBFReserve, formatFloat(errorRate), strconv.Itoa(capacity))
+
+	return db.head().update(db, key, c, func(n *node, exists bool) error {
+		if exists {
+			return ErrExists
+		}
+
+		return n.set(b)
+	})
+}
+
+// BFAdd adds item to filter and returns false if it
+// probably was there, missing filter is created with defaults
+func (db *DB) BFAdd(key, item string) (bool, error) {
+	if err := db.writable(key); err != nil {
+		return false, err
+	}
+
+	return db.bfAdd(key, item)
+}
+
+func (db *DB) bfAdd(key, item string) (bool, error) {
+	var added bool
+	err := db.head().update(db, key, newChange(changeBFAdd, item), func(n *node, exists bool) error {
+		if !exists {
+			b, _ := newBloom(DefaultErrorRate, DefaultCapacity)
+			n.set(b)
+		}
+		if n.tipe != TypeBloom {
+			return ErrInvalidType
+		}
+
+		added = n.obj.(*bloom).add(item)
+
+		return nil
+	})
+
+	return added, err
+}
+
+// BFExists reports whether item is probably in filter
+func (db *DB) BFExists(key, item string) (bool, error) {
+	var found bool
+
+	err := db.view(key, func(n *node) error {
+		if n.tipe != TypeBloom {
+			return ErrInvalidType
+		}
+		found = n.obj.(*bloom).exists(item)
+
+		return nil
+	})
+	if err == ErrNotFound {
+		return false, nil
+	}
+
+	return found, err
+}
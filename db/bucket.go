@@ -2,7 +2,7 @@ package db
 
 import (
 	"sync"
-	"time"
+	"sync/atomic"
 )
 
 type bucket struct {
@@ -10,6 +10,9 @@ type bucket struct {
 
 	// Pointer to first item at the bucket
 	nodes *node
+
+	// Counters of store of the bucket
+	used *usage
 }
 
 func (b *bucket) do(c func(b *bucket)) {
@@ -19,19 +22,30 @@ func (b *bucket) do(c func(b *bucket)) {
 	c(b)
 }
 
-// Soft delete
-//
-// Set node as expired
-func (b *bucket) delete(key string) {
-	b.mu.Lock()
-
+// Should be called under lock, returns true if key was alive
+func (b *bucket) remove(db *DB, key string) bool {
 	node, found := b.find(key)
-
-	if found {
-		node.exp = -1
+	if !found || !node.isAlive() {
+		return false
 	}
 
-	b.mu.Unlock()
+	b.drop(db, node)
+
+	return true
+}
+
+// Marks node as deleted and reports it, should be called under lock
+func (b *bucket) drop(db *DB, n *node) {
+	before := n.usage()
+	n.exp = -1
+	b.used.add(before, usage{})
+
+	if db.observed() {
+		db.emit(Mutation{Op: OpDelete, Key: n.key})
+	}
+	db.event(EventDel, n.key, n.tipe)
+	db.indexes.update(n.key, n)
+	db.waiters.wake(n.key)
 }
 
 func (b *bucket) keys() []string {
@@ -69,67 +83,200 @@ func (b *bucket) find(key string) (*node, bool) {
 	return n, false
 }
 
-func (b *bucket) save(key string, hash uint32, val interface{}, ttl *int) error {
+func (b *bucket) save(db *DB, key string, hash uint32, val interface{}, exp int64) error {
 	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.put(db, key, hash, val, exp)
+}
+
+// Saves value only if alive key does not exist
+func (b *bucket) insert(db *DB, key string, hash uint32, val interface{}, exp int64) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if n, found := b.find(key); found && n.isAlive() {
+		return ErrExists
+	}
 
+	return b.put(db, key, hash, val, exp)
+}
+
+// Should be called under lock
+func (b *bucket) put(db *DB, key string, hash uint32, val interface{}, exp int64) error {
 	n, found := b.find(key)
 
-	exp := 0
-	if ttl != nil { // todo: do not generate time every call
-		exp = time.Now().Second() + *ttl
+	var before usage
+	if found {
+		before = n.usage()
 	}
 
 	if !found {
+		nn := &node{
+			key:  key,
+			hash: hash,
+		}
+		if err := nn.set(val); err != nil {
+			return err
+		}
+
 		if n == nil {
-			n = &node{
-				key:  key,
-				exp:  exp,
-				hash: hash,
-			}
-			b.nodes = n
+			b.nodes = nn
 		} else {
-			n.next = &node{
-				key:  key,
-				exp:  exp,
-				hash: hash,
+			n.next = nn
+		}
+		n = nn
+	} else if err := n.set(val); err != nil {
+		return err
+	}
+
+	// Rewriting also revives soft deleted node
+	n.exp = exp
+	n.version = atomic.AddUint64(&versions, 1)
+	b.used.add(before, n.usage())
+
+	if db.observed() {
+		db.emit(Mutation{Op: OpWrite, Key: key, Data: encodeNode(n)})
+	}
+	db.event(EventSet, key, n.tipe)
+	db.indexes.update(key, n)
+	db.waiters.wake(key)
+
+	return nil
+}
+
+// Changes value of key in place under lock
+//
+// Fn gets alive node or new empty one with exists false, such node
+// is saved only if fn succeeds. Key which is not moved from the tail
+// yet is copied first, so growing does not lose the change.
+// Fn removes existing key by errRemove. Change is replicated instead
+// of the value if it is set, fn could complete its arguments.
+func (b *bucket) update(db *DB, key string, hash uint32, c *change, fn func(n *node, exists bool) error) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	n, found := b.find(key)
+	if found && n.isAlive() {
+		// Fn could change node partially before failure
+		before := n.usage()
+		err := fn(n, true)
+		b.used.add(before, n.usage())
+		if err != nil {
+			if err == errRemove {
+				b.drop(db, n)
+			}
+			return err
+		}
+	} else {
+		nn := &node{key: key, hash: hash}
+		exists := false
+		// Dead node of the head hides node of the tail
+		if t := db.tail(); t != nil && !found {
+			t.view(key, func(old *node) error {
+				nn = old.clone()
+				exists = true
+				return nil
+			})
+		}
+
+		removed := false
+		if err := fn(nn, exists); err != nil {
+			if err != errRemove || !exists {
+				return err
 			}
-			n = n.next
+			// Dead copy hides node of the tail from growing
+			removed = true
+		}
+
+		// Replaced node could be expired but not removed yet
+		var before usage
+		if found {
+			before = n.usage()
+		}
+
+		switch {
+		case found:
+			nn.next = n.next
+			*n = *nn
+		case n == nil:
+			b.nodes = nn
+			n = nn
+		default:
+			n.next = nn
+			n = nn
+		}
+		b.used.add(before, n.usage())
+
+		if removed {
+			b.drop(db, n)
+			return errRemove
 		}
 	}
 
-	switch t := val.(type) {
-	case []byte:
-		n.value = t
-		n.tipe = TypeHash
-	case []string:
-		n.list = t
-		n.tipe = TypeList
-	case map[string]string:
-		n.dict = t
-		n.tipe = TypeDict
-	default:
-		b.mu.Unlock()
-		return ErrInvalidType
+	n.version = atomic.AddUint64(&versions, 1)
+
+	if db.observed() {
+		if c != nil {
+			db.emit(Mutation{Op: OpUpdate, Key: key, Data: c.encode()})
+		} else {
+			db.emit(Mutation{Op: OpWrite, Key: key, Data: encodeNode(n)})
+		}
 	}
+	db.event(EventSet, key, n.tipe)
+	db.indexes.update(key, n)
+	db.waiters.wake(key)
 
-	b.mu.Unlock()
 	return nil
 }
 
-func (b *bucket) lookup(key string) *node {
+// Soft deletes expired nodes and reports them
+//
+// Mutation is not emitted, receivers expire keys by themselves.
+func (b *bucket) expire(db *DB) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for n := b.nodes; n != nil; n = n.next {
+		if n.exp > 0 && !n.isAlive() {
+			before := n.usage()
+			n.exp = -1
+			b.used.add(before, usage{})
+			db.event(EventExpired, n.key, n.tipe)
+			db.indexes.update(n.key, n)
+		}
+	}
+}
+
+// Returns copies of alive nodes
+func (b *bucket) clone() []*node {
 	b.mu.RLock()
+	defer b.mu.RUnlock()
 
-	n, found := b.find(key)
-	if !found {
-		b.mu.RUnlock()
-		return nil
+	return b.alive()
+}
+
+// Copies alive nodes, should be called under lock
+func (b *bucket) alive() []*node {
+	var nodes []*node
+	for n := b.nodes; n != nil; n = n.next {
+		if n.isAlive() {
+			nodes = append(nodes, n.clone())
+		}
 	}
 
-	if !n.isAlive() {
-		b.mu.RUnlock()
-		return nil
+	return nodes
+}
+
+// Calls fn for alive node under read lock
+func (b *bucket) view(key string, fn func(n *node) error) error {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	n, found := b.find(key)
+	if !found || !n.isAlive() {
+		return ErrNotFound
 	}
 
-	b.mu.RUnlock()
-	return n
+	return fn(n)
 }
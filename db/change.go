@@ -0,0 +1,257 @@
+package db
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"strconv"
+	"time"
+)
+
+type changeOp uint8
+
+const (
+	changeSetBit changeOp = iota + 1
+	changeBFReserve
+	changeBFAdd
+	changeGeoAdd
+	changePFAdd
+	changeJSONSet
+	changeJSONDel
+	changeJSONArrAppend
+	changeJSONNumIncrBy
+	changeXAdd
+	changeXGroupCreate
+	changeXReadGroup
+	changeXAck
+)
+
+// Operation which changes value in place, it is replicated
+// instead of the whole value
+//
+// Arguments are resolved, so the operation gives the same
+// result on the same value, e.g. generated id of stream entry
+// or time of delivery are set by leader.
+type change struct {
+	op   changeOp
+	args []string
+}
+
+func newChange(op changeOp, args ...string) *change {
+	return &change{op: op, args: args}
+}
+
+// Mutation data: operation and arguments
+func (c *change) encode() []byte {
+	b := new(bytes.Buffer)
+	w := bufio.NewWriter(b)
+
+	w.WriteByte(byte(c.op))
+	writeUvarint(w, uint64(len(c.args)))
+	for _, a := range c.args {
+		writeString(w, a)
+	}
+	w.Flush()
+
+	return b.Bytes()
+}
+
+func decodeChange(data []byte) (*change, error) {
+	r := bufio.NewReader(bytes.NewReader(data))
+
+	op, err := r.ReadByte()
+	if err != nil {
+		return nil, ErrCorrupted
+	}
+	cnt, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, ErrCorrupted
+	}
+
+	c := &change{op: changeOp(op), args: make([]string, 0, prealloc(cnt))}
+	for i := uint64(0); i < cnt; i++ {
+		a, err := readString(r)
+		if err != nil {
+			return nil, err
+		}
+		c.args = append(c.args, a)
+	}
+
+	return c, nil
+}
+
+// Applies change received from other DB to key
+func (db *DB) applyChange(key string, c *change) error {
+	a := &changeArgs{args: c.args}
+
+	var run func() error
+	switch c.op {
+	case changeSetBit:
+		offset, bit := a.uint(), a.int()
+		run = func() error {
+			_, err := db.setBit(key, offset, bit)
+			return err
+		}
+	case changeBFReserve:
+		rate, capacity := a.float(), a.int()
+		run = func() error {
+			return db.bfReserve(key, rate, capacity)
+		}
+	case changeBFAdd:
+		item := a.next()
+		run = func() error {
+			_, err := db.bfAdd(key, item)
+			return err
+		}
+	case changeGeoAdd:
+		var points []GeoPoint
+		for len(a.args) > 0 {
+			points = append(points, GeoPoint{Name: a.next(), Lon: a.float(), Lat: a.float()})
+		}
+		run = func() error {
+			_, err := db.geoAdd(key, points...)
+			return err
+		}
+	case changePFAdd:
+		elems := a.rest()
+		run = func() error {
+			_, err := db.pfAdd(key, elems...)
+			return err
+		}
+	case changeJSONSet:
+		path, value := a.next(), a.next()
+		run = func() error {
+			return db.jsonSet(key, path, []byte(value))
+		}
+	case changeJSONDel:
+		path := a.next()
+		run = func() error {
+			return db.jsonDel(key, path)
+		}
+	case changeJSONArrAppend:
+		path := a.next()
+		var values [][]byte
+		for _, v := range a.rest() {
+			values = append(values, []byte(v))
+		}
+		run = func() error {
+			_, err := db.jsonArrAppend(key, path, values...)
+			return err
+		}
+	case changeJSONNumIncrBy:
+		path, by := a.next(), a.float()
+		run = func() error {
+			_, err := db.jsonNumIncrBy(key, path, by)
+			return err
+		}
+	case changeXAdd:
+		id, maxLen := a.next(), a.int()
+		fields := make(map[string]string)
+		for len(a.args) > 0 {
+			k := a.next()
+			fields[k] = a.next()
+		}
+		run = func() error {
+			_, err := db.xAdd(key, id, fields, maxLen)
+			return err
+		}
+	case changeXGroupCreate:
+		name, start, mkStream := a.next(), a.next(), a.next() == "1"
+		run = func() error {
+			return db.xGroupCreate(key, name, start, mkStream)
+		}
+	case changeXReadGroup:
+		name, consumer, id, count, now := a.next(), a.next(), a.next(), a.int(), a.int64()
+		run = func() error {
+			_, err := db.xDeliver(key, name, consumer, id, count, time.Unix(0, now))
+			return err
+		}
+	case changeXAck:
+		name := a.next()
+		var ids []StreamID
+		for _, s := range a.rest() {
+			id, err := ParseStreamID(s)
+			if err != nil {
+				return ErrCorrupted
+			}
+			ids = append(ids, id)
+		}
+		run = func() error {
+			_, err := db.xAck(key, name, ids...)
+			return err
+		}
+	default:
+		return ErrInvalidOp
+	}
+
+	if a.err != nil {
+		return a.err
+	}
+
+	return run()
+}
+
+// Reads arguments of change, the first error is kept
+type changeArgs struct {
+	args []string
+	err  error
+}
+
+func (a *changeArgs) next() string {
+	if len(a.args) == 0 {
+		a.err = ErrCorrupted
+		return ""
+	}
+
+	s := a.args[0]
+	a.args = a.args[1:]
+
+	return s
+}
+
+func (a *changeArgs) rest() []string {
+	s := a.args
+	a.args = nil
+
+	return s
+}
+
+func (a *changeArgs) int() int {
+	v, err := strconv.Atoi(a.next())
+	if err != nil {
+		a.err = ErrCorrupted
+	}
+
+	return v
+}
+
+func (a *changeArgs) int64() int64 {
+	v, err := strconv.ParseInt(a.next(), 10, 64)
+	if err != nil {
+		a.err = ErrCorrupted
+	}
+
+	return v
+}
+
+func (a *changeArgs) uint() uint64 {
+	v, err := strconv.ParseUint(a.next(), 10, 64)
+	if err != nil {
+		a.err = ErrCorrupted
+	}
+
+	return v
+}
+
+func (a *changeArgs) float() float64 {
+	v, err := strconv.ParseFloat(a.next(), 64)
+	if err != nil {
+		a.err = ErrCorrupted
+	}
+
+	return v
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
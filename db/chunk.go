@@ -0,0 +1,192 @@
+package db
+
+import (
+	"io"
+	"sync"
+)
+
+const (
+	chunkSize = 64 << 10 // max size of one chunk of large value
+)
+
+var chunkPool = sync.Pool{
+	New: func() interface{} {
+		b := make([]byte, chunkSize)
+		return &b
+	},
+}
+
+// WriteStream reads r until EOF and stores data as hash value
+//
+// Data is kept in chunks, so the whole value is never
+// buffered contiguously. Value becomes visible only after
+// the stream is read completely. If compression is enabled
+// and value reaches threshold every chunk is compressed,
+// chunk which does not get shorter is kept raw.
+func (db *DB) WriteStream(key string, r io.Reader, ttl *int) error {
+
+	if err := db.writable(key); err != nil {
+		return err
+	}
+
+	val, err := db.readChunks(r)
+	if err != nil {
+		return err
+	}
+
+	return db.head().write(db, key, val, expiry(ttl))
+}
+
+// Reads r by chunks, returns chunks or packed value
+func (db *DB) readChunks(r io.Reader) (interface{}, error) {
+	buf := chunkPool.Get().(*[]byte)
+	defer chunkPool.Put(buf)
+
+	var (
+		chunks = make([][]byte, 0, 1)
+		size   int
+		pack   bool
+		gain   bool // some chunk is compressed
+	)
+	for {
+		n, err := io.ReadFull(r, *buf)
+		if n > 0 {
+			size += n
+
+			// Compress chunks read before reaching threshold
+			if !pack && db.compressThreshold > 0 && size >= db.compressThreshold {
+				pack = true
+				for i, c := range chunks {
+					d, ok, err := packChunk(c)
+					if err != nil {
+						return nil, err
+					}
+					chunks[i], gain = d, gain || ok
+				}
+			}
+
+			chunk := (*buf)[:n]
+			if pack {
+				d, ok, err := packChunk(chunk)
+				if err != nil {
+					return nil, err
+				}
+				chunk, gain = d, gain || ok
+			} else {
+				chunk = append([]byte(nil), chunk...)
+			}
+			chunks = append(chunks, chunk)
+		}
+
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if !pack {
+		return chunks, nil
+	}
+
+	// Value is not compressed if no chunk is shorter
+	if !gain {
+		for i, c := range chunks {
+			chunks[i] = c[1:]
+		}
+		return chunks, nil
+	}
+
+	return packed{chunks: chunks, size: size}, nil
+}
+
+// ReadStream returns reader of hash value
+//
+// Values written by WriteStream are read without copying,
+// other values are copied once. Compressed chunks are
+// decompressed one by one during reading.
+func (db *DB) ReadStream(key string) (*ChunkReader, error) {
+	var r *ChunkReader
+
+	err := db.view(key, func(n *node) error {
+		if n.tipe != TypeHash {
+			return ErrInvalidType
+		}
+
+		switch {
+		case n.packed:
+			r = &ChunkReader{chunks: n.chunks, packed: true, size: n.size}
+		case n.chunks != nil:
+			r = &ChunkReader{chunks: n.chunks}
+			for _, c := range n.chunks {
+				r.size += len(c)
+			}
+		default:
+			v, err := n.copyBytes()
+			if err != nil {
+				return err
+			}
+			r = &ChunkReader{chunks: [][]byte{v}, size: len(v)}
+		}
+
+		return nil
+	})
+
+	return r, err
+}
+
+// ChunkReader reads value chunk by chunk
+type ChunkReader struct {
+	chunks [][]byte
+	cur    []byte // unread part of current chunk
+	packed bool
+	size   int
+}
+
+func (r *ChunkReader) Read(p []byte) (n int, err error) {
+	for len(p) > 0 {
+		if len(r.cur) == 0 {
+			if len(r.chunks) == 0 {
+				break
+			}
+
+			r.cur = r.chunks[0]
+			r.chunks = r.chunks[1:]
+
+			if r.packed {
+				if r.cur, err = unpackChunk(r.cur); err != nil {
+					return n, err
+				}
+			}
+		}
+
+		c := copy(p, r.cur)
+		r.cur = r.cur[c:]
+
+		p = p[c:]
+		n += c
+	}
+
+	r.size -= n
+
+	if n == 0 && len(r.cur) == 0 && len(r.chunks) == 0 {
+		return 0, io.EOF
+	}
+
+	return n, nil
+}
+
+// Len returns number of unread bytes
+func (r *ChunkReader) Len() int {
+	return r.size
+}
+
+// Close releases chunks
+func (r *ChunkReader) Close() error {
+	r.chunks = nil
+	r.cur = nil
+	r.size = 0
+
+	return nil
+}
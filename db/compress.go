@@ -0,0 +1,113 @@
+package db
+
+import (
+	"bytes"
+	"io"
+	"sync"
+
+	"github.com/klauspost/compress/flate"
+)
+
+// Compressed hash value
+type packed struct {
+	chunks [][]byte
+	size   int
+}
+
+var (
+	deflaters = sync.Pool{
+		New: func() interface{} {
+			w, _ := flate.NewWriter(nil, flate.BestSpeed)
+			return w
+		},
+	}
+	inflaters = sync.Pool{
+		New: func() interface{} {
+			return flate.NewReader(nil)
+		},
+	}
+)
+
+// WithCompression enables compression of hash values
+// which are not shorter than threshold bytes
+func WithCompression(threshold int) Option {
+	return func(db *DB) {
+		db.compressThreshold = threshold
+	}
+}
+
+// Chunks of compressed value are tagged, chunk which
+// is not shorter after compression is kept raw
+const (
+	chunkRaw byte = iota
+	chunkDeflated
+)
+
+// Returns compressed value or the same slice if
+// compression is disabled or useless for the data
+func (db *DB) pack(val []byte) interface{} {
+	if db.compressThreshold <= 0 || len(val) < db.compressThreshold {
+		return val
+	}
+
+	c, ok, err := packChunk(val)
+	if err != nil || !ok {
+		return val
+	}
+
+	return packed{chunks: [][]byte{c}, size: len(val)}
+}
+
+// Returns tagged chunk of data and true if it is compressed
+func packChunk(data []byte) ([]byte, bool, error) {
+	b := new(bytes.Buffer)
+	b.WriteByte(chunkDeflated)
+
+	w := deflaters.Get().(*flate.Writer)
+	defer deflaters.Put(w)
+
+	w.Reset(b)
+	if _, err := w.Write(data); err != nil {
+		return nil, false, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, false, err
+	}
+
+	if b.Len()-1 >= len(data) {
+		raw := make([]byte, len(data)+1)
+		raw[0] = chunkRaw
+		copy(raw[1:], data)
+		return raw, false, nil
+	}
+
+	return b.Bytes(), true, nil
+}
+
+// Returns data of tagged chunk, raw chunk is not copied
+func unpackChunk(c []byte) ([]byte, error) {
+	if len(c) == 0 {
+		return nil, ErrCorrupted
+	}
+	if c[0] == chunkRaw {
+		return c[1:], nil
+	}
+
+	return inflate(c[1:])
+}
+
+func inflate(data []byte) ([]byte, error) {
+	b := new(bytes.Buffer)
+
+	r := inflaters.Get().(io.ReadCloser)
+	defer inflaters.Put(r)
+
+	if err := r.(flate.Resetter).Reset(bytes.NewReader(data), nil); err != nil {
+		return nil, err
+	}
+	if _, err := io.Copy(b, r); err != nil {
+		return nil, err
+	}
+
+	return b.Bytes(), nil
+}
@@ -3,7 +3,10 @@ package db
 import (
 	"sync"
 	"sync/atomic"
+	"time"
 	"unsafe"
+
+	"github.com/lukashes/db/pubsub"
 )
 
 const (
@@ -12,9 +15,15 @@ const (
 	seed        = 125 // for hash function
 )
 
+// Last version of keys, it is shared by all DBs, so
+// key of swapped DB gets other version
+var versions uint64
+
 type DB struct {
-	mu   sync.Mutex
-	once sync.Once
+	mu sync.Mutex
+
+	// Set while growing is scheduled or in progress
+	growing int32
 
 	// All writes should be to the head
 	// It means all fresh data are here
@@ -23,11 +32,43 @@ type DB struct {
 	// Tail is temporary old data pointer
 	// during moving buckets
 	t unsafe.Pointer
+
+	// Hash values of this size and more are compressed,
+	// zero disables compression
+	compressThreshold int
+
+	// Mutation hooks and read only flag
+	hooks    atomic.Value
+	readOnly int32
+
+	pubsub    *pubsub.Hub
+	listeners listeners
+
+	// Waiters of changes of keys
+	waiters waiters
+
+	// Secondary indexes of dict fields
+	indexes indexes
+
+	// Cache of compiled scripts
+	scripts       scripts
+	scriptTimeout time.Duration
 }
 
-func New() *DB {
+// Option configures DB
+type Option func(db *DB)
+
+func New(opts ...Option) *DB {
 	db := new(DB)
 
+	for _, o := range opts {
+		o(db)
+	}
+
+	if db.pubsub == nil {
+		db.pubsub = pubsub.New(pubsub.DefaultBuffer, pubsub.Disconnect)
+	}
+
 	db.h = unsafe.Pointer(newStore())
 
 	return db
@@ -37,24 +78,15 @@ func (db *DB) grow() {
 	//fmt.Printf("grow started!\n")
 	db.mu.Lock()
 	defer func() {
-		db.once = sync.Once{}
+		atomic.StoreInt32(&db.growing, 0)
 		db.mu.Unlock()
 	}()
 
 	tempStore := db.head()
-	buckets := len(tempStore.buckets) << 1
-	newStore := &store{
-		buckets:       make([]*bucket, buckets),
-		mask:          uint32(buckets) - 1,
-		growThreshold: int32(buckets * growingSize),
-	}
-
-	for k := range newStore.buckets {
-		newStore.buckets[k] = new(bucket)
-	}
+	newStore := tempStore.grown()
 
 	// Snapshot of actual data
-	db.t = db.h
+	atomic.StorePointer(&db.t, atomic.LoadPointer(&db.h))
 	atomic.StorePointer(&db.h, unsafe.Pointer(newStore))
 
 	for {
@@ -63,6 +95,29 @@ func (db *DB) grow() {
 		}
 	}
 
+	moveNodes(tempStore, newStore)
+
+	atomic.StorePointer(&db.t, nil)
+}
+
+// Returns empty store with twice more buckets
+func (c *store) grown() *store {
+	buckets := len(c.buckets) << 1
+	newStore := &store{
+		buckets:       make([]*bucket, buckets),
+		mask:          uint32(buckets) - 1,
+		growThreshold: int32(buckets * growingSize),
+	}
+
+	for k := range newStore.buckets {
+		newStore.buckets[k] = &bucket{used: &newStore.used}
+	}
+
+	return newStore
+}
+
+// Moves alive nodes of tempStore which are not in newStore yet
+func moveNodes(tempStore, newStore *store) {
 	// Start moving data to the new store
 	for k := range newStore.buckets {
 		newStore.buckets[k].do(func(b *bucket) {
@@ -101,6 +156,11 @@ func (db *DB) grow() {
 					}
 					sourceBuck.mu.Unlock()
 
+					// Added first, so moving node is not missed in stats
+					u := tail.usage()
+					b.used.add(usage{}, u)
+					sourceBuck.used.add(u, usage{})
+
 					atomic.AddInt32(&newStore.nodes, 1)
 				} else {
 					pre = head
@@ -109,8 +169,6 @@ func (db *DB) grow() {
 			}
 		})
 	}
-
-	atomic.StorePointer(&db.t, nil)
 }
 
 func (db *DB) head() *store {
@@ -126,8 +184,8 @@ func (db *DB) tail() *store {
 // Delete marks keys as deleted
 func (db *DB) Delete(key string) error {
 
-	if len(key) == 0 {
-		return ErrEmptyKey
+	if err := db.writable(key); err != nil {
+		return err
 	}
 
 	return db.head().delete(db, key)
@@ -142,175 +200,245 @@ func (db *DB) Keys() []string {
 }
 
 // Write sets new value or rewrite already exists
+//
+// Val is kept by DB and must not be modified after the call.
 func (db *DB) Write(key string, val []byte, ttl *int) error {
 
-	if len(key) == 0 {
-		return ErrEmptyKey
+	if err := db.writable(key); err != nil {
+		return err
 	}
 
-	return db.head().write(db, key, val, ttl)
+	return db.head().write(db, key, db.pack(val), expiry(ttl))
 }
 
-// Read returns value associated with key or nil
+// Read returns copy of value associated with key
 func (db *DB) Read(key string) ([]byte, error) {
+	var val []byte
 
-	node, err := db.head().read(key)
-	if err != nil && err != ErrNotFound {
-		return nil, err
-	}
+	err := db.view(key, func(n *node) error {
+		if n.tipe != TypeHash {
+			return ErrInvalidType
+		}
 
-	if node == nil && db.tail() != nil {
-		node, err = db.tail().read(key)
-	}
+		var err error
+		val, err = n.copyBytes()
+
+		return err
+	})
+
+	return val, err
+}
 
-	if node == nil {
-		return nil, ErrNotFound
+// View calls fn with value associated with key without copying
+//
+// Value is valid only until fn returns and must not be modified,
+// bucket stays read locked during the call so keep fn short.
+// Values written by WriteStream are joined into temporary
+// slice if they consist of several chunks, use ReadStream instead.
+// Compressed values are decompressed into temporary slice too.
+func (db *DB) View(key string, fn func(v []byte) error) error {
+	return db.view(key, func(n *node) error {
+		if n.tipe != TypeHash {
+			return ErrInvalidType
+		}
+
+		v, err := n.bytes()
+		if err != nil {
+			return err
+		}
+
+		return fn(v)
+	})
+}
+
+// Runs fn for the node under bucket read lock
+//
+// Looks for the key at the head first and at the tail
+// if growing is in progress.
+func (db *DB) view(key string, fn func(n *node) error) error {
+	err := db.head().view(key, fn)
+	if err != ErrNotFound {
+		return err
 	}
 
-	if node.tipe != TypeHash {
-		return nil, ErrInvalidType
+	if t := db.tail(); t != nil {
+		err = t.view(key, fn)
 	}
 
-	return node.value, err
+	return err
 }
 
 // WriteList writes list data type
 func (db *DB) WriteList(key string, val []string, ttl *int) error {
 
-	if len(key) == 0 {
-		return ErrEmptyKey
+	if err := db.writable(key); err != nil {
+		return err
+	}
+
+	return db.head().write(db, key, val, expiry(ttl))
+}
+
+// WriteListValues writes list of typed elements
+func (db *DB) WriteListValues(key string, val []Value, ttl *int) error {
+
+	if err := db.writable(key); err != nil {
+		return err
 	}
 
-	return db.head().write(db, key, val, ttl)
+	return db.head().write(db, key, val, expiry(ttl))
 }
 
 // WriteDict writes dict data type
 func (db *DB) WriteDict(key string, val map[string]string, ttl *int) error {
 
-	if len(key) == 0 {
-		return ErrEmptyKey
+	if err := db.writable(key); err != nil {
+		return err
 	}
 
-	return db.head().write(db, key, val, ttl)
+	return db.head().write(db, key, val, expiry(ttl))
+}
+
+// WriteDictValues writes dict of typed elements
+func (db *DB) WriteDictValues(key string, val map[string]Value, ttl *int) error {
+
+	if err := db.writable(key); err != nil {
+		return err
+	}
+
+	return db.head().write(db, key, val, expiry(ttl))
 }
 
 // ReadListIndex returns data by list index
 //
-// If index or key do not exist returns ErrNoFound
+// If index or key do not exist returns ErrNoFound.
+// Elements which are not strings are formatted by Value.String.
 func (db *DB) ReadListIndex(key string, idx int) ([]byte, error) {
+	var val []byte
 
-	node, err := db.head().read(key)
-	if err != nil && err != ErrNotFound {
-		return nil, err
-	}
-
-	if node == nil && db.tail() != nil {
-		if node, err = db.tail().read(key); err != nil {
-			return nil, err
+	err := db.view(key, func(n *node) error {
+		if n.tipe != TypeList {
+			return ErrInvalidType
 		}
-	}
 
-	if node == nil {
-		return nil, ErrNotFound
-	}
+		if idx < 0 || len(n.list) <= idx {
+			return ErrInvalidIndex
+		}
 
-	if node.tipe != TypeList {
-		return nil, ErrInvalidType
-	}
+		val = []byte(n.list[idx].String())
 
-	if len(node.list) <= idx {
-		return nil, ErrInvalidIndex
-	}
+		return nil
+	})
 
-	return []byte(node.list[idx]), err
+	return val, err
 }
 
-// ReadList returns whole list data
+// ReadList returns copy of whole list data
+//
+// Elements which are not strings are formatted by Value.String.
 func (db *DB) ReadList(key string) ([]string, error) {
+	var val []string
 
-	node, err := db.head().read(key)
-	if err != nil && err != ErrNotFound {
-		return nil, err
-	}
+	err := db.view(key, func(n *node) error {
+		if n.tipe != TypeList {
+			return ErrInvalidType
+		}
 
-	if node == nil && db.tail() != nil {
-		if node, err = db.tail().read(key); err != nil {
-			return nil, err
+		val = make([]string, len(n.list))
+		for k, v := range n.list {
+			val[k] = v.String()
 		}
-	}
 
-	if node == nil {
-		return nil, ErrNotFound
-	}
+		return nil
+	})
 
-	if node.tipe != TypeList {
-		return nil, ErrInvalidType
-	}
+	return val, err
+}
+
+// ReadListValues returns copy of list with typed elements
+func (db *DB) ReadListValues(key string) ([]Value, error) {
+	var val []Value
+
+	err := db.view(key, func(n *node) error {
+		if n.tipe != TypeList {
+			return ErrInvalidType
+		}
 
-	return node.list, err
+		val = cloneValues(n.list)
+
+		return nil
+	})
+
+	return val, err
 }
 
 // ReadDictIndex returns data by dict index
 //
 // If index or key do not exist returns ErrNoFound
 func (db *DB) ReadDictIndex(key string, idx string) ([]byte, error) {
+	var val []byte
 
-	node, err := db.head().read(key)
-	if err != nil && err != ErrNotFound {
-		return nil, err
-	}
-
-	if node == nil && db.tail() != nil {
-		if node, err = db.tail().read(key); err != nil {
-			return nil, err
+	err := db.view(key, func(n *node) error {
+		if n.tipe != TypeDict {
+			return ErrInvalidType
 		}
-	}
 
-	if node == nil {
-		return nil, ErrNotFound
-	}
+		v, ok := n.dict[idx]
+		if !ok {
+			return ErrInvalidIndex
+		}
 
-	if node.tipe != TypeDict {
-		return nil, ErrInvalidType
-	}
+		val = []byte(v.String())
 
-	v, ok := node.dict[idx]
-	if !ok {
-		return nil, ErrInvalidIndex
-	}
+		return nil
+	})
 
-	return []byte(v), err
+	return val, err
 }
 
-// ReadDict returns whole dict data
+// ReadDict returns copy of whole dict data
+//
+// Elements which are not strings are formatted by Value.String.
 func (db *DB) ReadDict(key string) (map[string]string, error) {
+	var val map[string]string
 
-	node, err := db.head().read(key)
-	if err != nil && err != ErrNotFound {
-		return nil, err
-	}
+	err := db.view(key, func(n *node) error {
+		if n.tipe != TypeDict {
+			return ErrInvalidType
+		}
 
-	if node == nil && db.tail() != nil {
-		if node, err = db.tail().read(key); err != nil {
-			return nil, err
+		val = make(map[string]string, len(n.dict))
+		for k, v := range n.dict {
+			val[k] = v.String()
 		}
-	}
 
-	if node == nil {
-		return nil, ErrNotFound
-	}
+		return nil
+	})
 
-	if node.tipe != TypeDict {
-		return nil, ErrInvalidType
-	}
+	return val, err
+}
 
-	return node.dict, err
+// ReadDictValues returns copy of dict with typed elements
+func (db *DB) ReadDictValues(key string) (map[string]Value, error) {
+	var val map[string]Value
+
+	err := db.view(key, func(n *node) error {
+		if n.tipe != TypeDict {
+			return ErrInvalidType
+		}
+
+		val = cloneDict(n.dict)
+
+		return nil
+	})
+
+	return val, err
 }
 
 // Exists checking key existing
 func (db *DB) Exists(key string) (bool, error) {
+	err := db.view(key, func(n *node) error {
+		return nil
+	})
 
-	val, err := db.head().read(key)
-
-	return val != nil, err
+	return err == nil, err
 }
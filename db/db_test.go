@@ -1,10 +1,20 @@
 package db
 
 import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
 	"math/rand"
+	"reflect"
 	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
+	"unsafe"
 )
 
 func initKeys(n int) (keys []string) {
@@ -15,6 +25,11 @@ func initKeys(n int) (keys []string) {
 	return keys
 }
 
+// Verbose json document about 1KB
+func jsonValue() []byte {
+	return bytes.Repeat([]byte(`{"name":"donald","surname":"duck","city":"duckburg"},`), 20)
+}
+
 func BenchmarkMapWrite(b *testing.B) {
 	db := make(map[string][]byte)
 	keys := initKeys(b.N)
@@ -73,6 +88,32 @@ func BenchmarkHashTableWrite(b *testing.B) {
 	}
 }
 
+func BenchmarkHashTableWriteCompressed(b *testing.B) {
+	db := New(WithCompression(256))
+	keys := initKeys(b.N)
+	val := jsonValue()
+
+	b.ResetTimer()
+	for _, k := range keys {
+		db.Write(k, val, nil)
+	}
+}
+
+func BenchmarkHashTableReadCompressed(b *testing.B) {
+	db := New(WithCompression(256))
+	keys := initKeys(b.N)
+	check := initKeys(b.N)
+	val := jsonValue()
+	for _, k := range keys {
+		db.Write(k, val, nil)
+	}
+
+	b.ResetTimer()
+	for _, k := range check {
+		db.Read(k)
+	}
+}
+
 func BenchmarkHashTableRead(b *testing.B) {
 	db := New()
 	keys := initKeys(b.N)
@@ -87,6 +128,44 @@ func BenchmarkHashTableRead(b *testing.B) {
 	}
 }
 
+func BenchmarkHashTableView(b *testing.B) {
+	db := New()
+	keys := initKeys(b.N)
+	check := initKeys(b.N)
+	for _, k := range keys {
+		db.Write(k, []byte(k), nil)
+	}
+
+	b.ResetTimer()
+	for _, k := range check {
+		db.View(k, func(v []byte) error {
+			return nil
+		})
+	}
+}
+
+func BenchmarkHashTableReadLarge(b *testing.B) {
+	db := New()
+	db.Write("large", make([]byte, 64<<10), nil)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		db.Read("large")
+	}
+}
+
+func BenchmarkHashTableViewLarge(b *testing.B) {
+	db := New()
+	db.Write("large", make([]byte, 64<<10), nil)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		db.View("large", func(v []byte) error {
+			return nil
+		})
+	}
+}
+
 func BenchmarkHashTableWriteList(b *testing.B) {
 	db := New()
 	data := map[int][]string{
@@ -142,6 +221,902 @@ func TestConsistency(t *testing.T) {
 	}
 }
 
+func TestReadCopy(t *testing.T) {
+	db := New()
+
+	key := "test"
+
+	if err := db.Write(key, []byte("val"), nil); err != nil {
+		t.Error(err)
+	}
+
+	v, err := db.Read(key)
+	if err != nil {
+		t.Error(err)
+	}
+	v[0] = 'x'
+
+	err = db.View(key, func(v []byte) error {
+		if string(v) != "val" {
+			t.Errorf("stored value modified: %s", v)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Error(err)
+	}
+
+	if err := db.View("unknown", func(v []byte) error { return nil }); err != ErrNotFound {
+		t.Errorf("expected not found, got %v", err)
+	}
+}
+
+func TestStream(t *testing.T) {
+	db := New()
+
+	key := "large"
+	val := bytes.Repeat([]byte("0123456789"), chunkSize/4)
+
+	if err := db.WriteStream(key, bytes.NewReader(val), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := db.ReadStream(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Len() != len(val) {
+		t.Errorf("invalid length %d, expected %d", r.Len(), len(val))
+	}
+
+	got, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, val) {
+		t.Error("invalid stream value")
+	}
+
+	got, err = db.Read(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, val) {
+		t.Error("invalid joined value")
+	}
+}
+
+func TestCompression(t *testing.T) {
+	db := New(WithCompression(256))
+
+	val := jsonValue()
+	if err := db.Write("json", val, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Write("short", []byte("short"), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	large := bytes.Repeat(val, 200)
+	if err := db.WriteStream("large", bytes.NewReader(large), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	for k, expected := range map[string][]byte{"json": val, "short": []byte("short"), "large": large} {
+		v, err := db.Read(k)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(v, expected) {
+			t.Errorf("invalid value of %s", k)
+		}
+
+		r, err := db.ReadStream(k)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v, _ = ioutil.ReadAll(r); !bytes.Equal(v, expected) {
+			t.Errorf("invalid stream value of %s", k)
+		}
+	}
+
+	s := db.Stats()
+	if s.CompressedValues != 2 {
+		t.Errorf("expected 2 compressed values, got %d", s.CompressedValues)
+	}
+	if s.CompressionRatio <= 0 || s.CompressionRatio >= 1 {
+		t.Errorf("unexpected ratio %f", s.CompressionRatio)
+	}
+
+	// Replaced and removed values are not counted
+	db.Write("json", []byte("short"), nil)
+	if s := db.Stats(); s.CompressedValues != 1 || s.RawBytes != int64(len(large)) {
+		t.Errorf("unexpected stats after replace %+v", s)
+	}
+	db.Delete("large")
+	if s := db.Stats(); s.CompressedValues != 0 || s.RawBytes != 0 || s.CompressedBytes != 0 {
+		t.Errorf("unexpected stats after remove %+v", s)
+	}
+}
+
+func TestCompressionGain(t *testing.T) {
+	db := New(WithCompression(256))
+
+	random := make([]byte, 2*chunkSize)
+	rand.Read(random)
+	mixed := append(bytes.Repeat(jsonValue(), chunkSize/len(jsonValue())+1)[:chunkSize], random...)
+
+	for k, v := range map[string][]byte{"random": random, "mixed": mixed} {
+		if err := db.WriteStream(k, bytes.NewReader(v), nil); err != nil {
+			t.Fatal(err)
+		}
+		r, err := db.ReadStream(k)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, _ := ioutil.ReadAll(r); !bytes.Equal(got, v) {
+			t.Errorf("invalid stream value of %s", k)
+		}
+		if got, _ := db.Read(k); !bytes.Equal(got, v) {
+			t.Errorf("invalid value of %s", k)
+		}
+	}
+
+	// Random chunks are kept raw
+	s := db.Stats()
+	if s.CompressedValues != 1 || s.RawBytes != int64(len(mixed)) {
+		t.Errorf("unexpected stats %+v", s)
+	}
+	if s.CompressedBytes < int64(len(random)) || s.CompressedBytes > int64(len(random))+chunkSize/2 {
+		t.Errorf("unexpected compressed size %d", s.CompressedBytes)
+	}
+}
+
+func TestSnapshot(t *testing.T) {
+	src := New(WithCompression(256))
+
+	ttl := 60
+	large := bytes.Repeat(jsonValue(), 200)
+	src.Write("hash", []byte("value"), &ttl)
+	src.WriteStream("large", bytes.NewReader(large), nil)
+	src.WriteList("list", []string{"donald", "duck"}, nil)
+	src.WriteDict("dict", map[string]string{"name": "daisy"}, nil)
+	src.Write("removed", []byte("value"), nil)
+	src.Delete("removed")
+
+	b := new(bytes.Buffer)
+	if err := src.Snapshot(b); err != nil {
+		t.Fatal(err)
+	}
+
+	dst := New()
+	if err := dst.Restore(bytes.NewReader(b.Bytes())); err != nil {
+		t.Fatal(err)
+	}
+
+	if v, err := dst.Read("hash"); err != nil || string(v) != "value" {
+		t.Errorf("unexpected hash %q: %v", v, err)
+	}
+	if v, err := dst.Read("large"); err != nil || !bytes.Equal(v, large) {
+		t.Errorf("unexpected large value: %v", err)
+	}
+	if v, err := dst.ReadListIndex("list", 1); err != nil || string(v) != "duck" {
+		t.Errorf("unexpected list item %q: %v", v, err)
+	}
+	if v, err := dst.ReadDictIndex("dict", "name"); err != nil || string(v) != "daisy" {
+		t.Errorf("unexpected dict item %q: %v", v, err)
+	}
+	if _, err := dst.Read("removed"); err != ErrNotFound {
+		t.Errorf("removed key restored: %v", err)
+	}
+
+	if err := dst.Restore(bytes.NewReader(b.Bytes()[:b.Len()-1])); err != ErrCorrupted {
+		t.Errorf("expected corrupted error, got %v", err)
+	}
+}
+
+func TestRewriteRemoved(t *testing.T) {
+	db := New()
+
+	db.Write("key", []byte("old"), nil)
+	db.Delete("key")
+	db.Write("key", []byte("new"), nil)
+
+	if v, err := db.Read("key"); err != nil || string(v) != "new" {
+		t.Errorf("unexpected value %q: %v", v, err)
+	}
+}
+
+func TestNotify(t *testing.T) {
+	db := New()
+
+	l := db.Notify("user:*", ClassWrite|ClassExpire)
+	defer l.Close()
+
+	ttl := 0
+	db.Write("user:1", []byte("a"), nil)
+	db.Write("post:1", []byte("b"), nil)
+	db.Delete("user:1")
+	db.WriteList("user:2", []string{"c"}, &ttl)
+
+	for _, e := range []Event{
+		{Type: EventSet, Key: "user:1", DataType: TypeHash},
+		{Type: EventSet, Key: "user:2", DataType: TypeList},
+		{Type: EventExpired, Key: "user:2", DataType: TypeList},
+	} {
+		select {
+		case got := <-l.C:
+			if got != e {
+				t.Fatalf("expected event %+v, got %+v", e, got)
+			}
+		case <-time.After(3 * time.Second):
+			t.Fatalf("event %+v is not received", e)
+		}
+	}
+}
+
+func TestWatch(t *testing.T) {
+	db := New()
+
+	if _, err := db.Watch("key", 0, 10*time.Millisecond); err != ErrTimeout {
+		t.Fatalf("expected timeout, got %v", err)
+	}
+
+	db.Write("key", []byte("a"), nil)
+	v := db.Version("key")
+	if w, err := db.Watch("key", 0, time.Second); err != nil || w != v {
+		t.Fatalf("expected version %d immediately, got %d: %v", v, w, err)
+	}
+
+	done := make(chan uint64)
+	go func() {
+		w, _ := db.Watch("key", v, 3*time.Second)
+		done <- w
+	}()
+
+	time.Sleep(10 * time.Millisecond)
+	db.Write("key", []byte("b"), nil)
+	if w := <-done; w == v || w != db.Version("key") {
+		t.Fatalf("unexpected version %d after write", w)
+	}
+
+	v = db.Version("key")
+	go func() {
+		w, _ := db.Watch("key", v, 3*time.Second)
+		done <- w
+	}()
+
+	time.Sleep(10 * time.Millisecond)
+	db.Delete("key")
+	if w := <-done; w != 0 {
+		t.Fatalf("expected zero version after delete, got %d", w)
+	}
+}
+
+func TestStreamType(t *testing.T) {
+	db := New()
+
+	for i := 1; i <= 5; i++ {
+		if _, err := db.XAdd("events", strconv.Itoa(i)+"-0", map[string]string{"n": strconv.Itoa(i)}, 3); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := db.XAdd("events", "2-0", nil, 0); err != ErrInvalidID {
+		t.Fatalf("expected invalid id, got %v", err)
+	}
+
+	all, err := db.XRange("events", "-", "+", 0)
+	if err != nil || len(all) != 3 || all[0].ID != (StreamID{3, 0}) {
+		t.Fatalf("unexpected range %v: %v", all, err)
+	}
+	rev, _ := db.XRevRange("events", "+", "4", 1)
+	if len(rev) != 1 || rev[0].Fields["n"] != "5" {
+		t.Fatalf("unexpected reverse range %v", rev)
+	}
+
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		db.XAdd("events", "*", map[string]string{"n": "6"}, 0)
+	}()
+	read, err := db.XRead("events", "$", 0, 3*time.Second)
+	if err != nil || len(read) != 1 || read[0].Fields["n"] != "6" {
+		t.Fatalf("unexpected blocking read %v: %v", read, err)
+	}
+
+	if err := db.XGroupCreate("events", "workers", "0", false); err != nil {
+		t.Fatal(err)
+	}
+	got, err := db.XReadGroup("events", "workers", "alice", ">", 2, 0)
+	if err != nil || len(got) != 2 {
+		t.Fatalf("unexpected group read %v: %v", got, err)
+	}
+	if n, _ := db.XAck("events", "workers", got[0].ID); n != 1 {
+		t.Fatal("entry is not acknowledged")
+	}
+
+	// Snapshot keeps groups and pending entries
+	b := new(bytes.Buffer)
+	if err := db.Snapshot(b); err != nil {
+		t.Fatal(err)
+	}
+	restored := New()
+	if err := restored.Restore(b); err != nil {
+		t.Fatal(err)
+	}
+
+	pending, err := restored.XPending("events", "workers")
+	if err != nil || len(pending) != 1 || pending[0].ID != got[1].ID || pending[0].Consumer != "alice" {
+		t.Fatalf("unexpected pending entries %v: %v", pending, err)
+	}
+	history, _ := restored.XReadGroup("events", "workers", "alice", "0", 0, 0)
+	if len(history) != 1 || history[0].ID != got[1].ID {
+		t.Fatalf("unexpected history %v", history)
+	}
+	rest, _ := restored.XReadGroup("events", "workers", "bob", ">", 0, 0)
+	if len(rest) != 2 {
+		t.Fatalf("expected 2 undelivered entries, got %v", rest)
+	}
+}
+
+func TestHLL(t *testing.T) {
+	db := New()
+
+	for i := 0; i < 10000; i++ {
+		db.PFAdd("a", "user"+strconv.Itoa(i))
+		db.PFAdd("b", "user"+strconv.Itoa(i+5000))
+	}
+
+	for _, c := range []struct {
+		keys     []string
+		expected float64
+	}{
+		{[]string{"a"}, 10000},
+		{[]string{"a", "b"}, 15000},
+	} {
+		n, err := db.PFCount(c.keys...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if d := float64(n)/c.expected - 1; d > 0.03 || d < -0.03 {
+			t.Errorf("count of %v is %d, expected about %v", c.keys, n, c.expected)
+		}
+	}
+
+	if err := db.PFMerge("c", "a", "b"); err != nil {
+		t.Fatal(err)
+	}
+	u, _ := db.PFCount("a", "b")
+	if n, _ := db.PFCount("c"); n != u {
+		t.Errorf("merged count %d differs from union %d", n, u)
+	}
+}
+
+func TestBloom(t *testing.T) {
+	db := New()
+
+	if err := db.BFReserve("seen", 0.01, 1000); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.BFReserve("seen", 0.01, 1000); err != ErrExists {
+		t.Fatalf("expected exists error, got %v", err)
+	}
+
+	for i := 0; i < 1000; i++ {
+		db.BFAdd("seen", strconv.Itoa(i))
+	}
+
+	fp := 0
+	for i := 0; i < 10000; i++ {
+		ok, err := db.BFExists("seen", strconv.Itoa(i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if i < 1000 && !ok {
+			t.Fatalf("added item %d is not found", i)
+		}
+		if i >= 1000 && ok {
+			fp++
+		}
+	}
+	if rate := float64(fp) / 9000; rate > 0.02 {
+		t.Errorf("false positive rate %v is too high", rate)
+	}
+
+	b := new(bytes.Buffer)
+	db.Snapshot(b)
+	restored := New()
+	if err := restored.Restore(b); err != nil {
+		t.Fatal(err)
+	}
+	if ok, _ := restored.BFExists("seen", "999"); !ok {
+		t.Error("restored filter lost item")
+	}
+}
+
+func TestBits(t *testing.T) {
+	db := New(WithCompression(1))
+
+	// Compressed value is changed in place as raw one
+	db.Write("a", []byte{0xff, 0x00}, nil)
+	if old, err := db.SetBit("a", 15, 1); err != nil || old != 0 {
+		t.Fatalf("unexpected old bit %d: %v", old, err)
+	}
+	if b, _ := db.GetBit("a", 15); b != 1 {
+		t.Fatal("bit is not set")
+	}
+
+	db.SetBit("b", 20, 1)
+	if v, _ := db.Read("b"); !bytes.Equal(v, []byte{0, 0, 0x08}) {
+		t.Fatalf("unexpected bitmap %x", v)
+	}
+
+	// Buffer of writer is not changed
+	buf := []byte{0x00}
+	db.Write("c", buf, nil)
+	db.SetBit("c", 0, 1)
+	if buf[0] != 0x00 {
+		t.Fatalf("written buffer is changed to %x", buf)
+	}
+	if v, _ := db.Read("c"); !bytes.Equal(v, []byte{0x80}) {
+		t.Fatalf("unexpected bitmap %x", v)
+	}
+	db.Delete("c")
+
+	if n, _ := db.BitCount("a", 0, -1); n != 9 {
+		t.Fatalf("expected 9 set bits, got %d", n)
+	}
+	if n, _ := db.BitCount("a", -1, -1); n != 1 {
+		t.Fatalf("expected 1 set bit in the last byte, got %d", n)
+	}
+	if p, _ := db.BitPos("a", 0, 0, -1); p != 8 {
+		t.Fatalf("expected first clear bit at 8, got %d", p)
+	}
+	if p, _ := db.BitPos("b", 1, 0, 1); p != -1 {
+		t.Fatalf("expected no set bit in range, got %d", p)
+	}
+
+	for _, c := range []struct {
+		op       BitOp
+		keys     []string
+		expected []byte
+	}{
+		{BitAnd, []string{"a", "b"}, []byte{0x00, 0x00, 0x00}},
+		{BitOr, []string{"a", "b"}, []byte{0xff, 0x01, 0x08}},
+		{BitXor, []string{"a", "a"}, []byte{0x00, 0x00}},
+		{BitNot, []string{"a"}, []byte{0x00, 0xfe}},
+	} {
+		if _, err := db.BitOp(c.op, "dest", c.keys...); err != nil {
+			t.Fatal(err)
+		}
+		if v, _ := db.Read("dest"); !bytes.Equal(v, c.expected) {
+			t.Errorf("op %d of %v is %x, expected %x", c.op, c.keys, v, c.expected)
+		}
+	}
+}
+
+func TestGeo(t *testing.T) {
+	db := New()
+
+	n, err := db.GeoAdd("couriers",
+		GeoPoint{"palermo", 13.361389, 38.115556},
+		GeoPoint{"catania", 15.087269, 37.502669},
+	)
+	if err != nil || n != 2 {
+		t.Fatalf("expected 2 added members, got %d: %v", n, err)
+	}
+	if _, err := db.GeoAdd("couriers", GeoPoint{"pole", 0, 90}); err != ErrInvalidArgument {
+		t.Fatalf("expected invalid argument, got %v", err)
+	}
+
+	pos, _ := db.GeoPos("couriers", "palermo", "missing")
+	if pos[0] == nil || math.Abs(pos[0].Lon-13.361389) > 1e-5 || pos[1] != nil {
+		t.Fatalf("unexpected positions %v", pos)
+	}
+
+	if d, _ := db.GeoDist("couriers", "palermo", "catania", "km"); math.Abs(d-166.2742) > 0.01 {
+		t.Fatalf("unexpected distance %v", d)
+	}
+
+	for _, c := range []struct {
+		q        GeoQuery
+		expected []string
+	}{
+		{GeoQuery{Lon: 15, Lat: 37, Radius: 100, Unit: "km"}, []string{"catania"}},
+		{GeoQuery{Lon: 15, Lat: 37, Radius: 200, Unit: "km"}, []string{"catania", "palermo"}},
+		{GeoQuery{Lon: 15, Lat: 37, Radius: 200, Unit: "km", Desc: true, Count: 1}, []string{"palermo"}},
+		{GeoQuery{Member: "palermo", Width: 400, Height: 400, Unit: "km"}, []string{"palermo", "catania"}},
+		{GeoQuery{Member: "palermo", Width: 100, Height: 400, Unit: "km"}, []string{"palermo"}},
+	} {
+		res, err := db.GeoSearch("couriers", c.q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var names []string
+		for _, r := range res {
+			names = append(names, r.Name)
+		}
+		if strings.Join(names, ",") != strings.Join(c.expected, ",") {
+			t.Errorf("search %+v found %v, expected %v", c.q, names, c.expected)
+		}
+	}
+}
+
+func TestJSON(t *testing.T) {
+	db := New()
+
+	if err := db.JSONSet("doc", "$.a", []byte(`1`)); err != ErrNotFound {
+		t.Fatalf("expected not found, got %v", err)
+	}
+	if err := db.JSONSet("doc", "$", []byte(`{"user":{"name":"don","tags":["a"]},"visits":9007199254740993}`)); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.JSONSet("doc", "$.user.city", []byte(`"duckburg"`)); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.JSONSet("doc", "$.user.address.zip", []byte(`1`)); err != ErrInvalidIndex {
+		t.Fatalf("expected invalid index for missing parent, got %v", err)
+	}
+	if l, err := db.JSONArrAppend("doc", `$["user"].tags`, []byte(`"b"`), []byte(`{"c":1}`)); err != nil || l != 3 {
+		t.Fatalf("unexpected length %d: %v", l, err)
+	}
+	if v, err := db.JSONNumIncrBy("doc", "$.user.tags[-1].c", 1.5); err != nil || v != 2.5 {
+		t.Fatalf("unexpected number %v: %v", v, err)
+	}
+	db.JSONNumIncrBy("doc", "$.visits", 1)
+	if err := db.JSONDel("doc", "$.user.tags[0]"); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range []struct {
+		path, expected string
+	}{
+		{"$.user.name", `"don"`},
+		{"$.user.tags", `["b",{"c":2.5}]`},
+		{"$.visits", `9007199254740994`},
+		{"$.user.*", `["duckburg","don",["b",{"c":2.5}]]`},
+	} {
+		v, err := db.JSONGet("doc", c.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if c.path == "$.user.*" {
+			// Order of members is not defined
+			if len(v) != len(c.expected) {
+				t.Errorf("unexpected %s value %s", c.path, v)
+			}
+			continue
+		}
+		if string(v) != c.expected {
+			t.Errorf("unexpected %s value %s, expected %s", c.path, v, c.expected)
+		}
+	}
+
+	if err := db.JSONSet("doc", "$.max", []byte(`9223372036854775807`)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.JSONNumIncrBy("doc", "$.max", 1); err != ErrInvalidArgument {
+		t.Fatalf("expected invalid argument on overflow, got %v", err)
+	}
+
+	db.Write("plain", []byte("value"), nil)
+	if err := db.JSONDel("plain", "$"); err != ErrInvalidType {
+		t.Fatalf("expected invalid type, got %v", err)
+	}
+	if _, err := db.Read("plain"); err != nil {
+		t.Fatalf("value of other type is removed: %v", err)
+	}
+
+	if err := db.JSONDel("doc", "$"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.JSONGet("doc", "$"); err != ErrNotFound {
+		t.Fatalf("expected removed document, got %v", err)
+	}
+	if err := db.JSONDel("doc", "$"); err != ErrNotFound {
+		t.Fatalf("expected not found, got %v", err)
+	}
+}
+
+func TestValues(t *testing.T) {
+	db := New()
+
+	v, err := ValueOf([]interface{}{"a", 1, 2.5, []byte{0, 1}, map[string]interface{}{"k": []interface{}{int64(7)}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wire, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(wire) != `["a",{"i":1},{"f":2.5},{"b":"AAE="},{"d":{"k":[{"i":7}]}}]` {
+		t.Fatalf("unexpected wire encoding %s", wire)
+	}
+
+	var decoded []Value
+	if err := json.Unmarshal(wire, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.WriteListValues("list", decoded, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// Snapshot keeps kinds of elements
+	b := new(bytes.Buffer)
+	db.Snapshot(b)
+	restored := New()
+	if err := restored.Restore(b); err != nil {
+		t.Fatal(err)
+	}
+
+	l, err := restored.ReadListValues("list")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(List(l...).Interface(), v.Interface()) {
+		t.Fatalf("unexpected list %v", List(l...).Interface())
+	}
+
+	if s, _ := restored.ReadList("list"); s[1] != "1" || s[4] != `{"d":{"k":[{"i":7}]}}` {
+		t.Fatalf("unexpected string list %q", s)
+	}
+
+	// Version 1 snapshot keeps strings
+	old := []byte("LDBS\x01\x01\x00\x01k\x02\x01a\x01b\xff")
+	if err := restored.Restore(bytes.NewReader(old)); err != nil {
+		t.Fatal(err)
+	}
+	if s, _ := restored.ReadList("k"); len(s) != 2 || s[1] != "b" {
+		t.Fatalf("unexpected list of old snapshot %q", s)
+	}
+}
+
+func TestIndex(t *testing.T) {
+	db := New(WithIndex("email", "user:*", "email"))
+
+	db.WriteDict("user:1", map[string]string{"email": "a@x"}, nil)
+	db.WriteDictValues("user:2", map[string]Value{"email": String("b@x"), "age": Int(30)}, nil)
+	db.WriteDictValues("user:3", map[string]Value{"email": String("a@x"), "age": Float(25.5)}, nil)
+	db.WriteDict("other", map[string]string{"email": "a@x"}, nil)
+
+	keys, err := db.FindByIndex("email", String("a@x"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(keys, []string{"user:1", "user:3"}) {
+		t.Fatalf("unexpected keys %q", keys)
+	}
+
+	// Existing keys are indexed on creation
+	if err := db.CreateIndex("age", "user:*", "age"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.CreateIndex("age", "user:*", "age"); err != ErrExists {
+		t.Fatalf("expected exists error, got %v", err)
+	}
+	min, max := Int(20), Int(26)
+	if keys, _ = db.FindRange("age", &min, &max, 0); !reflect.DeepEqual(keys, []string{"user:3"}) {
+		t.Fatalf("unexpected range %q", keys)
+	}
+	if keys, _ = db.FindRange("age", nil, nil, 1); !reflect.DeepEqual(keys, []string{"user:3"}) {
+		t.Fatalf("unexpected limited range %q", keys)
+	}
+
+	// Rewrite, delete and expiration are followed
+	db.WriteDict("user:1", map[string]string{"email": "c@x"}, nil)
+	db.Delete("user:3")
+	ttl := 1
+	db.WriteDict("user:2", map[string]string{"email": "c@x"}, &ttl)
+	if keys, _ = db.FindByIndex("email", String("c@x")); !reflect.DeepEqual(keys, []string{"user:1", "user:2"}) {
+		t.Fatalf("unexpected keys after rewrite %q", keys)
+	}
+	if keys, _ = db.FindByIndex("email", String("a@x")); len(keys) != 0 {
+		t.Fatalf("unexpected keys after delete %q", keys)
+	}
+	if keys, _ = db.FindRange("age", nil, nil, 0); len(keys) != 0 {
+		t.Fatalf("unexpected keys without field %q", keys)
+	}
+
+	time.Sleep(2 * time.Second)
+	if keys, _ = db.FindByIndex("email", String("c@x")); !reflect.DeepEqual(keys, []string{"user:1"}) {
+		t.Fatalf("unexpected keys after expiration %q", keys)
+	}
+
+	// Index is rebuilt from snapshot
+	b := new(bytes.Buffer)
+	db.Snapshot(b)
+	restored := New(WithIndex("email", "user:*", "email"))
+	if err := restored.Restore(b); err != nil {
+		t.Fatal(err)
+	}
+	if keys, _ = restored.FindByIndex("email", String("c@x")); !reflect.DeepEqual(keys, []string{"user:1"}) {
+		t.Fatalf("unexpected keys after restore %q", keys)
+	}
+
+	restored.Flush()
+	if keys, _ = restored.FindByIndex("email", String("c@x")); len(keys) != 0 {
+		t.Fatalf("unexpected keys after flush %q", keys)
+	}
+
+	if err := db.DropIndex("age"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.FindByIndex("age", Int(1)); err != ErrNoIndex {
+		t.Fatalf("expected no index error, got %v", err)
+	}
+}
+
+func TestIndexOrder(t *testing.T) {
+	db := New(WithIndex("n", "*", "n"))
+
+	var want []string
+	for i := 0; i < 1000; i++ {
+		key := fmt.Sprintf("k%04d", i)
+		db.WriteDictValues(key, map[string]Value{"n": Int(int64(i))}, nil)
+		if i%3 != 0 {
+			want = append(want, key)
+		}
+	}
+	for i := 0; i < 1000; i += 3 {
+		db.Delete(fmt.Sprintf("k%04d", i))
+	}
+
+	keys, _ := db.FindRange("n", nil, nil, 0)
+	if !reflect.DeepEqual(keys, want) {
+		t.Fatalf("unexpected order of %d keys", len(keys))
+	}
+	min, max := Int(10), Int(14)
+	if keys, _ = db.FindRange("n", &min, &max, 0); !reflect.DeepEqual(keys, []string{"k0010", "k0011", "k0013", "k0014"}) {
+		t.Fatalf("unexpected range %q", keys)
+	}
+}
+
+func TestDeleteWhileGrowing(t *testing.T) {
+	db := New(WithIndex("n", "*", "n"))
+	db.WriteDictValues("a", map[string]Value{"n": Int(1)}, nil)
+	db.WriteDictValues("b", map[string]Value{"n": Int(2)}, nil)
+
+	// Grow is stopped before moving nodes from the tail
+	tail := db.head()
+	head := tail.grown()
+	atomic.StorePointer(&db.t, unsafe.Pointer(tail))
+	atomic.StorePointer(&db.h, unsafe.Pointer(head))
+
+	if err := db.Delete("a"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Take("b"); err != nil {
+		t.Fatal(err)
+	}
+
+	moveNodes(tail, head)
+	atomic.StorePointer(&db.t, nil)
+
+	for _, key := range []string{"a", "b"} {
+		if ok, _ := db.Exists(key); ok {
+			t.Errorf("deleted key %s is moved from the tail", key)
+		}
+	}
+	if keys, _ := db.FindRange("n", nil, nil, 0); len(keys) != 0 {
+		t.Errorf("index keeps deleted keys %q", keys)
+	}
+}
+
+func TestWriteWhileGrowing(t *testing.T) {
+	db := New()
+	db.Write("a", []byte("old"), nil)
+
+	// Writer takes the head right before growing swaps it
+	tail := db.head()
+	head := tail.grown()
+	atomic.StorePointer(&db.t, unsafe.Pointer(tail))
+	atomic.StorePointer(&db.h, unsafe.Pointer(head))
+	head.write(db, "a", []byte("hot"), 0)
+
+	if err := tail.write(db, "a", []byte("new"), 0); err != nil {
+		t.Fatal(err)
+	}
+
+	moveNodes(tail, head)
+	atomic.StorePointer(&db.t, nil)
+
+	if v, err := db.Read("a"); err != nil || string(v) != "new" {
+		t.Errorf("write to the tail is lost, got %q %v", v, err)
+	}
+}
+
+func TestCompareValues(t *testing.T) {
+	for _, c := range []struct {
+		a, b Value
+		want int
+	}{
+		{Int(1<<53 + 1), Float(1 << 53), 1},
+		{Float(1 << 53), Int(1<<53 + 1), -1},
+		{Int(1 << 53), Float(1 << 53), 0},
+		{Int(math.MaxInt64), Float(math.MaxInt64), -1},
+		{Int(math.MinInt64), Float(math.MinInt64), 0},
+		{Int(2), Float(2.5), -1},
+		{Int(-2), Float(-2.5), 1},
+		{Int(1), String("1"), -1},
+	} {
+		if got := compareValues(c.a, c.b); got != c.want {
+			t.Errorf("compare %v and %v: got %d, want %d", c.a, c.b, got, c.want)
+		}
+	}
+}
+
+func TestScript(t *testing.T) {
+	db := New(WithScriptTimeout(100 * time.Millisecond))
+
+	db.Write("balance:a", []byte("100"), nil)
+	db.Write("balance:b", []byte("5"), nil)
+
+	transfer := `
+		local amount = tonumber(ARGV[1])
+		local from = tonumber(db.get(KEYS[1]))
+		if from < amount then
+			return false
+		end
+		db.incrby(KEYS[1], -amount)
+		return db.incrby(KEYS[2], amount)
+	`
+	res, err := db.Eval(transfer, []string{"balance:a", "balance:b"}, []string{"30"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res != int64(35) {
+		t.Fatalf("unexpected result %v", res)
+	}
+	if v, _ := db.Read("balance:a"); string(v) != "70" {
+		t.Fatalf("unexpected balance %s", v)
+	}
+
+	sha, err := db.ScriptLoad(transfer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res, _ := db.EvalSHA(sha, []string{"balance:a", "balance:b"}, []string{"100"}); res != false {
+		t.Fatalf("unexpected result %v", res)
+	}
+	if _, err := db.EvalSHA("unknown", nil, nil); err != ErrNoScript {
+		t.Fatalf("expected no script error, got %v", err)
+	}
+
+	// Writes of failed script are not applied
+	_, err = db.Eval(`db.set(KEYS[1], "x") error("stop")`, []string{"balance:a"}, nil)
+	if err == nil || !strings.Contains(err.Error(), "stop") {
+		t.Fatalf("expected script error, got %v", err)
+	}
+	if v, _ := db.Read("balance:a"); string(v) != "70" {
+		t.Fatalf("value of failed script was written: %s", v)
+	}
+
+	if _, err := db.Eval(`return db.get("other")`, nil, nil); err != ErrUndeclaredKey {
+		t.Fatalf("expected undeclared key error, got %v", err)
+	}
+	if _, err := db.Eval(`while true do end`, nil, nil); err != ErrTimeout {
+		t.Fatalf("expected timeout, got %v", err)
+	}
+
+	// Lists and dicts are tables
+	res, err = db.Eval(`
+		db.dset(KEYS[1], {name = "a", tags = {"x", "y"}, n = 2})
+		local d = db.dget(KEYS[1])
+		db.lset(KEYS[2], d.tags)
+		return {d.name, d.n, #db.lget(KEYS[2]), db.type(KEYS[1])}
+	`, []string{"dict", "list"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(res, []interface{}{"a", int64(2), int64(2), "dict"}) {
+		t.Fatalf("unexpected result %v", res)
+	}
+	if d, _ := db.ReadDictValues("dict"); d["n"].Kind() != KindInt || len(d["tags"].List()) != 2 {
+		t.Fatalf("unexpected dict %v", d)
+	}
+}
+
 func TestList(t *testing.T) {
 	db := New()
 
@@ -205,3 +1180,157 @@ func TestGrowing(t *testing.T) {
 		}
 	}*/
 }
+
+// Returns count and size of alive keys by scan
+func measure(db *DB) (int, int64) {
+	var (
+		keys int
+		size int64
+	)
+	for _, b := range db.head().buckets {
+		for n := b.nodes; n != nil; n = n.next {
+			if !n.isAlive() {
+				continue
+			}
+			keys++
+			if d, ok := n.obj.(*document); ok && n.tipe == TypeJSON {
+				size += int64(len(n.key)) + jsonSize(d.root)
+			} else {
+				size += n.footprint()
+			}
+		}
+	}
+
+	return keys, size
+}
+
+func TestUsage(t *testing.T) {
+	db := New()
+
+	// Expired key is counted until it is removed, growing
+	// drops it as well, so it is checked in small DB
+	expired := -1
+	db.Write("b", []byte("value"), &expired)
+	if s := db.Stats(); s.Keys != 1 {
+		t.Fatalf("expected 1 key, got %d", s.Keys)
+	}
+	db.RemoveExpired()
+	if s := db.Stats(); s.Keys != 0 {
+		t.Fatalf("expected no keys, got %d", s.Keys)
+	}
+
+	db.Write("a", []byte("value"), nil)
+	db.Write("a", []byte("longer value"), nil)
+	db.WriteList("list", []string{"donald", "duck"}, nil)
+	db.Write("list", []byte("v"), nil)
+	db.XAdd("stream", "*", map[string]string{"name": "donald"}, 0)
+	db.XAdd("stream", "*", map[string]string{"name": "daisy"}, 1)
+	db.JSONSet("doc", "$", []byte(`{"user":{"name":"don","tags":["a"]}}`))
+	db.JSONSet("doc", "$.user.city", []byte(`"duckburg"`))
+	db.JSONArrAppend("doc", "$.user.tags", []byte(`"b"`))
+	db.JSONDel("doc", "$.user.name")
+	db.GeoAdd("geo", GeoPoint{Name: "a", Lon: 1, Lat: 1}, GeoPoint{Name: "a", Lon: 2, Lat: 2})
+	db.SetBit("bits", 100, 1)
+	db.Delete("missing")
+	for atomic.LoadInt32(&db.growing) == 1 {
+		time.Sleep(time.Millisecond)
+	}
+
+	keys, size := measure(db)
+	if s := db.Stats(); s.Keys != keys || s.Bytes != size {
+		t.Fatalf("counted %d keys of %d bytes, expected %d of %d", s.Keys, s.Bytes, keys, size)
+	}
+
+	db.Delete("a")
+	db.JSONDel("doc", "$")
+	keys, size = measure(db)
+	if s := db.Stats(); s.Keys != keys || s.Bytes != size {
+		t.Fatalf("counted %d keys of %d bytes after removal, expected %d of %d", s.Keys, s.Bytes, keys, size)
+	}
+
+	// Keys rewritten during growing are counted once
+	for i := 0; i < 10000; i++ {
+		k := strconv.Itoa(i)
+		db.Write(k, []byte(k), nil)
+		db.Write(strconv.Itoa(i/2), []byte(k), nil)
+	}
+	for atomic.LoadInt32(&db.growing) == 1 {
+		time.Sleep(time.Millisecond)
+	}
+	keys, size = measure(db)
+	if s := db.Stats(); s.Keys != keys || s.Bytes != size {
+		t.Fatalf("counted %d keys of %d bytes after growing, expected %d of %d", s.Keys, s.Bytes, keys, size)
+	}
+
+	db.Flush()
+	if s := db.Stats(); s.Keys != 0 || s.Bytes != 0 {
+		t.Fatalf("unexpected stats after flush %+v", s)
+	}
+}
+
+func TestApplyUpdate(t *testing.T) {
+	src, dst := New(), New()
+
+	var ms []Mutation
+	src.OnMutation(func(m Mutation) {
+		ms = append(ms, m)
+	})
+
+	src.SetBit("bits", 100, 1)
+	src.BFReserve("bloom", 0.01, 1000)
+	src.BFAdd("bloom", "duck")
+	src.GeoAdd("geo", GeoPoint{Name: "palermo", Lon: 13.361389, Lat: 38.115556})
+	src.PFAdd("hll", "a", "b", "c")
+	src.JSONSet("doc", "$", []byte(`{"a":[1],"n":1}`))
+	src.JSONArrAppend("doc", "$.a", []byte(`2`))
+	src.JSONNumIncrBy("doc", "$.n", 1.5)
+	src.JSONDel("doc", "$.a[0]")
+	for i := 0; i < 100; i++ {
+		src.XAdd("events", "*", map[string]string{"n": strconv.Itoa(i)}, 50)
+	}
+	src.XGroupCreate("events", "workers", "0", false)
+	src.XReadGroup("events", "workers", "w1", ">", 10, 0)
+	id, _ := src.XAdd("events", "*", map[string]string{"n": "last"}, 0)
+	src.XAck("events", "workers", id)
+
+	// Value is not sent on every change
+	if m := ms[len(ms)-2]; m.Op != OpUpdate || len(m.Data) > 64 {
+		t.Fatalf("unexpected mutation of xadd %v of %d bytes", m.Op, len(m.Data))
+	}
+
+	for _, m := range ms {
+		if err := dst.Apply(m); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, key := range []string{"bits", "bloom", "geo", "hll", "doc", "events"} {
+		var a, b []byte
+		src.view(key, func(n *node) error {
+			a = encodeNode(n)
+			return nil
+		})
+		dst.view(key, func(n *node) error {
+			b = encodeNode(n)
+			return nil
+		})
+		if key == "events" {
+			// Fields of entries are encoded in random order
+			x, _ := src.XRange(key, "-", "+", 0)
+			y, _ := dst.XRange(key, "-", "+", 0)
+			p, _ := src.XPending(key, "workers")
+			q, _ := dst.XPending(key, "workers")
+			for i := range p {
+				// Monotonic clock reading is not replicated
+				p[i].Delivered = p[i].Delivered.Round(0)
+			}
+			if !reflect.DeepEqual(x, y) || !reflect.DeepEqual(p, q) {
+				t.Errorf("%s differs after apply", key)
+			}
+			continue
+		}
+		if a == nil || !bytes.Equal(a, b) {
+			t.Errorf("%s differs after apply", key)
+		}
+	}
+}
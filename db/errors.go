@@ -3,8 +3,23 @@ package db
 import "errors"
 
 var (
-	ErrInvalidIndex = errors.New("index does not exist or out of range")
-	ErrInvalidType  = errors.New("unexpected operation for type")
-	ErrEmptyKey     = errors.New("empty key")
-	ErrNotFound     = errors.New("expected key not found")
+	ErrInvalidIndex    = errors.New("index does not exist or out of range")
+	ErrInvalidType     = errors.New("unexpected operation for type")
+	ErrEmptyKey        = errors.New("empty key")
+	ErrNotFound        = errors.New("expected key not found")
+	ErrCorrupted       = errors.New("corrupted snapshot")
+	ErrInvalidOp       = errors.New("unknown mutation")
+	ErrExists          = errors.New("key already exists")
+	ErrReadOnly        = errors.New("read only replica does not accept writes")
+	ErrTimeout         = errors.New("timeout")
+	ErrCanceled        = errors.New("canceled")
+	ErrInvalidID       = errors.New("invalid or too small stream id")
+	ErrNoGroup         = errors.New("consumer group does not exist")
+	ErrInvalidArgument = errors.New("invalid argument")
+	ErrNoIndex         = errors.New("index does not exist")
+	ErrNoScript        = errors.New("script is not loaded")
+	ErrUndeclaredKey   = errors.New("key is not declared in script keys")
 )
+
+// Returned by function of update to remove key
+var errRemove = errors.New("remove key")
@@ -0,0 +1,447 @@
+package db
+
+import (
+	"bufio"
+	"encoding/binary"
+	"math"
+	"sort"
+)
+
+// Geohash bounds and precision are the same as in redis,
+// so scores are 52 bit interleaved longitude and latitude
+const (
+	geoStep   = 26
+	geoLatMax = 85.05112878
+	geoLonMax = 180
+
+	// Meters
+	earthRadius  = 6372797.560856
+	mercatorMax  = 20037726.37
+	degreeMeters = earthRadius * math.Pi / 180
+)
+
+type GeoPoint struct {
+	Name string  `json:"name"`
+	Lon  float64 `json:"lon"`
+	Lat  float64 `json:"lat"`
+}
+
+// GeoQuery selects members around member or point
+// within radius or box of width and height
+type GeoQuery struct {
+	// Center is position of member if it is set
+	Member   string
+	Lon, Lat float64
+
+	Radius        float64
+	Width, Height float64
+
+	// One of m, km, mi, ft, meters by default
+	Unit string
+
+	// Results are sorted by distance, count limits
+	// them if it is positive
+	Desc  bool
+	Count int
+}
+
+type GeoResult struct {
+	GeoPoint
+
+	// Distance from center in units of query
+	Dist float64 `json:"dist"`
+}
+
+// Members ordered by score and name
+type geo struct {
+	items  []geoItem
+	scores map[string]uint64
+
+	// Size of names and scores
+	bytes int64
+}
+
+type geoItem struct {
+	score uint64
+	name  string
+}
+
+func (g *geo) tipe() Type {
+	return TypeGeo
+}
+
+func (g *geo) clone() object {
+	c := &geo{
+		items:  append([]geoItem(nil), g.items...),
+		scores: make(map[string]uint64, len(g.scores)),
+		bytes:  g.bytes,
+	}
+	for k, v := range g.scores {
+		c.scores[k] = v
+	}
+
+	return c
+}
+
+func (g *geo) size() int64 {
+	return g.bytes
+}
+
+func (g *geo) search(it geoItem) int {
+	return sort.Search(len(g.items), func(i int) bool {
+		c := g.items[i]
+		return c.score > it.score || c.score == it.score && c.name >= it.name
+	})
+}
+
+// Returns true if member is new
+func (g *geo) add(name string, score uint64) bool {
+	old, found := g.scores[name]
+	if found {
+		if old == score {
+			return false
+		}
+		i := g.search(geoItem{old, name})
+		g.items = append(g.items[:i], g.items[i+1:]...)
+	}
+
+	it := geoItem{score, name}
+	i := g.search(it)
+	g.items = append(g.items, geoItem{})
+	copy(g.items[i+1:], g.items[i:])
+	g.items[i] = it
+	g.scores[name] = score
+	if !found {
+		g.bytes += int64(len(name)) + 8
+	}
+
+	return !found
+}
+
+// Calls fn for members with scores in [min, max)
+func (g *geo) rang(min, max uint64, fn func(it geoItem)) {
+	for i := g.search(geoItem{score: min}); i < len(g.items) && g.items[i].score < max; i++ {
+		fn(g.items[i])
+	}
+}
+
+func validCoords(lon, lat float64) bool {
+	return lon >= -geoLonMax && lon <= geoLonMax && lat >= -geoLatMax && lat <= geoLatMax
+}
+
+// Interleaves step bits of longitude and latitude,
+// longitude takes the most significant bit
+func geoEncode(lon, lat float64, step uint) uint64 {
+	x := uint64((lon + geoLonMax) / (2 * geoLonMax) * float64(uint64(1)<<step))
+	y := uint64((lat + geoLatMax) / (2 * geoLatMax) * float64(uint64(1)<<step))
+
+	// Upper bounds belong to the last cell
+	max := uint64(1)<<step - 1
+	if x > max {
+		x = max
+	}
+	if y > max {
+		y = max
+	}
+
+	var h uint64
+	for i := int(step) - 1; i >= 0; i-- {
+		h = h<<2 | (x>>uint(i)&1)<<1 | y>>uint(i)&1
+	}
+
+	return h
+}
+
+// Returns center of cell
+func geoDecode(h uint64, step uint) (lon, lat float64) {
+	var x, y uint64
+	for i := int(step) - 1; i >= 0; i-- {
+		x = x<<1 | h>>uint(2*i+1)&1
+		y = y<<1 | h>>uint(2*i)&1
+	}
+
+	cells := float64(uint64(1) << step)
+	lon = (float64(x)+0.5)/cells*2*geoLonMax - geoLonMax
+	lat = (float64(y)+0.5)/cells*2*geoLatMax - geoLatMax
+
+	return lon, lat
+}
+
+// Haversine distance in meters
+func geoDistance(lon1, lat1, lon2, lat2 float64) float64 {
+	rad := math.Pi / 180
+	u := math.Sin((lat2 - lat1) * rad / 2)
+	v := math.Sin((lon2 - lon1) * rad / 2)
+	a := u*u + math.Cos(lat1*rad)*math.Cos(lat2*rad)*v*v
+
+	return 2 * earthRadius * math.Asin(math.Sqrt(a))
+}
+
+func unitMeters(unit string) (float64, bool) {
+	switch unit {
+	case "", "m":
+		return 1, true
+	case "km":
+		return 1000, true
+	case "mi":
+		return 1609.34, true
+	case "ft":
+		return 0.3048, true
+	}
+
+	return 0, false
+}
+
+// Returns the finest step whose cells around lat
+// are not smaller than radius in both directions
+func geoSearchStep(radius, lat float64) uint {
+	step := uint(1)
+	for r := radius; r < mercatorMax && step < geoStep; r *= 2 {
+		step++
+	}
+
+	for ; step > 1; step-- {
+		cells := float64(uint64(1) << step)
+		w := 2 * geoLonMax / cells * degreeMeters * math.Cos(lat*math.Pi/180)
+		h := 2 * geoLatMax / cells * degreeMeters
+		if w >= radius && h >= radius {
+			break
+		}
+	}
+
+	return step
+}
+
+// Returns members inside query area
+//
+// Center cell and its neighbours of search step cover the area,
+// members of their score ranges are filtered by exact distance.
+func (g *geo) query(q GeoQuery, lon, lat, unit float64) []GeoResult {
+	radius := q.Radius * unit
+	box := q.Radius == 0
+	if box {
+		radius = math.Hypot(q.Width, q.Height) * unit / 2
+	}
+
+	step := geoSearchStep(radius, lat)
+	cells := float64(uint64(1) << step)
+	dLon, dLat := 2*geoLonMax/cells, 2*geoLatMax/cells
+	shift := 2 * (geoStep - step)
+
+	seen := make(map[uint64]bool, 9)
+	var res []GeoResult
+	for _, dx := range []float64{0, -1, 1} {
+		for _, dy := range []float64{0, -1, 1} {
+			clon, clat := lon+dx*dLon, lat+dy*dLat
+			if clat < -geoLatMax || clat > geoLatMax {
+				continue
+			}
+			// Longitude wraps around antimeridian
+			if clon < -geoLonMax {
+				clon += 2 * geoLonMax
+			} else if clon > geoLonMax {
+				clon -= 2 * geoLonMax
+			}
+
+			cell := geoEncode(clon, clat, step)
+			if seen[cell] {
+				continue
+			}
+			seen[cell] = true
+
+			g.rang(cell<<shift, (cell+1)<<shift, func(it geoItem) {
+				plon, plat := geoDecode(it.score, geoStep)
+				d := geoDistance(lon, lat, plon, plat)
+				if box {
+					// Distances along axes through the center
+					w := geoDistance(lon, plat, plon, plat)
+					h := geoDistance(plon, lat, plon, plat)
+					if w > q.Width*unit/2 || h > q.Height*unit/2 {
+						return
+					}
+				} else if d > radius {
+					return
+				}
+				res = append(res, GeoResult{GeoPoint{it.name, plon, plat}, d / unit})
+			})
+		}
+	}
+
+	sort.Slice(res, func(i, j int) bool {
+		if q.Desc {
+			return res[i].Dist > res[j].Dist
+		}
+		return res[i].Dist < res[j].Dist
+	})
+	if q.Count > 0 && len(res) > q.Count {
+		res = res[:q.Count]
+	}
+
+	return res
+}
+
+// Snapshot payload: count of members, names and scores
+func (g *geo) encode(w *bufio.Writer) {
+	writeUvarint(w, uint64(len(g.items)))
+	for _, it := range g.items {
+		writeString(w, it.name)
+		writeUvarint(w, it.score)
+	}
+}
+
+func decodeGeo(r *bufio.Reader) (*geo, error) {
+	cnt, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, ErrCorrupted
+	}
+
+	g := &geo{scores: make(map[string]uint64, prealloc(cnt))}
+	for i := uint64(0); i < cnt; i++ {
+		name, err := readString(r)
+		if err != nil {
+			return nil, err
+		}
+		score, err := binary.ReadUvarint(r)
+		if err != nil {
+			return nil, ErrCorrupted
+		}
+		g.add(name, score)
+	}
+
+	return g, nil
+}
+
+func (db *DB) viewGeo(key string, fn func(g *geo) error) error {
+	return db.view(key, func(n *node) error {
+		if n.tipe != TypeGeo {
+			return ErrInvalidType
+		}
+
+		return fn(n.obj.(*geo))
+	})
+}
+
+// GeoAdd adds or moves members and returns count of new ones
+func (db *DB) GeoAdd(key string, points ...GeoPoint) (int, error) {
+	for _, p := range points {
+		if !validCoords(p.Lon, p.Lat) {
+			return 0, ErrInvalidArgument
+		}
+	}
+
+	if err := db.writable(key); err != nil {
+		return 0, err
+	}
+
+	return db.geoAdd(key, points...)
+}
+
+func (db *DB) geoAdd(key string, points ...GeoPoint) (int, error) {
+	c := newChange(changeGeoAdd)
+	for _, p := range points {
+		c.args = append(c.args, p.Name, formatFloat(p.Lon), formatFloat(p.Lat))
+	}
+
+	var added int
+	err := db.head().update(db, key, c, func(n *node, exists bool) error {
+		if !exists {
+			n.set(&geo{scores: make(map[string]uint64)})
+		}
+		if n.tipe != TypeGeo {
+			return ErrInvalidType
+		}
+
+		g := n.obj.(*geo)
+		for _, p := range points {
+			if g.add(p.Name, geoEncode(p.Lon, p.Lat, geoStep)) {
+				added++
+			}
+		}
+
+		return nil
+	})
+
+	return added, err
+}
+
+// GeoPos returns positions of members, nil for missing ones
+//
+// Positions are centers of geohash cells, they differ from
+// added ones by less than a meter.
+func (db *DB) GeoPos(key string, members ...string) ([]*GeoPoint, error) {
+	res := make([]*GeoPoint, len(members))
+
+	err := db.viewGeo(key, func(g *geo) error {
+		for i, m := range members {
+			if s, ok := g.scores[m]; ok {
+				lon, lat := geoDecode(s, geoStep)
+				res[i] = &GeoPoint{m, lon, lat}
+			}
+		}
+		return nil
+	})
+	if err == ErrNotFound {
+		err = nil
+	}
+
+	return res, err
+}
+
+// GeoDist returns distance between members in unit,
+// ErrInvalidIndex if any of them is missing
+func (db *DB) GeoDist(key, from, to, unit string) (float64, error) {
+	u, ok := unitMeters(unit)
+	if !ok {
+		return 0, ErrInvalidArgument
+	}
+
+	var d float64
+	err := db.viewGeo(key, func(g *geo) error {
+		a, ok := g.scores[from]
+		b, ok2 := g.scores[to]
+		if !ok || !ok2 {
+			return ErrInvalidIndex
+		}
+
+		lon1, lat1 := geoDecode(a, geoStep)
+		lon2, lat2 := geoDecode(b, geoStep)
+		d = geoDistance(lon1, lat1, lon2, lat2) / u
+
+		return nil
+	})
+
+	return d, err
+}
+
+// GeoSearch returns members within radius or box around center
+// sorted by distance
+func (db *DB) GeoSearch(key string, q GeoQuery) ([]GeoResult, error) {
+	u, ok := unitMeters(q.Unit)
+	if !ok || q.Radius < 0 || q.Width < 0 || q.Height < 0 || q.Radius == 0 && (q.Width == 0 || q.Height == 0) {
+		return nil, ErrInvalidArgument
+	}
+	if q.Member == "" && !validCoords(q.Lon, q.Lat) {
+		return nil, ErrInvalidArgument
+	}
+
+	var res []GeoResult
+	err := db.viewGeo(key, func(g *geo) error {
+		lon, lat := q.Lon, q.Lat
+		if q.Member != "" {
+			s, ok := g.scores[q.Member]
+			if !ok {
+				return ErrInvalidIndex
+			}
+			lon, lat = geoDecode(s, geoStep)
+		}
+
+		res = g.query(q, lon, lat, u)
+
+		return nil
+	})
+	if err == ErrNotFound {
+		err = nil
+	}
+
+	return res, err
+}
@@ -38,3 +38,30 @@ func hash(data []byte, seed uint32) uint32 {
 
 	return h
 }
+
+// Hash returns hash of key which is used for placing it
+func Hash(key string) uint32 {
+	return hash([]byte(key), seed)
+}
+
+// Seeds of independent hashes for probabilistic types
+const (
+	seedHigh = 0x9747b28c
+	seedLow  = 0x5bd1e995
+)
+
+// Returns 64 bit hash of data joined from two seeded hashes
+func hash64(data []byte) uint64 {
+	return uint64(mix(hash(data, seedHigh)))<<32 | uint64(mix(hash(data, seedLow)))
+}
+
+// Murmur3 finalizer, spreads bits of short inputs
+func mix(h uint32) uint32 {
+	h ^= h >> 16
+	h *= 0x85ebca6b
+	h ^= h >> 13
+	h *= 0xc2b2ae35
+	h ^= h >> 16
+
+	return h
+}
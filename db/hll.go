@@ -0,0 +1,197 @@
+package db
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"math"
+	"math/bits"
+)
+
+// HyperLogLog with 2^14 registers, standard error is about 0.8%
+const (
+	hllPrecision = 14
+	hllRegisters = 1 << hllPrecision
+)
+
+// Byte per register, it is 16KB for any count of elements
+type hll struct {
+	reg []byte
+}
+
+func newHLL() *hll {
+	return &hll{reg: make([]byte, hllRegisters)}
+}
+
+func (h *hll) tipe() Type {
+	return TypeHLL
+}
+
+func (h *hll) clone() object {
+	return &hll{reg: append([]byte(nil), h.reg...)}
+}
+
+func (h *hll) size() int64 {
+	return int64(len(h.reg))
+}
+
+// Returns true if estimation could change
+func (h *hll) add(elem string) bool {
+	x := hash64([]byte(elem))
+	i := x >> (64 - hllPrecision)
+
+	// Position of the first set bit of the rest, guard bit limits it
+	rank := byte(bits.LeadingZeros64(x<<hllPrecision|1<<(hllPrecision-1)) + 1)
+	if rank > h.reg[i] {
+		h.reg[i] = rank
+		return true
+	}
+
+	return false
+}
+
+func (h *hll) merge(o *hll) {
+	for i, r := range o.reg {
+		if r > h.reg[i] {
+			h.reg[i] = r
+		}
+	}
+}
+
+func (h *hll) count() uint64 {
+	var (
+		sum   float64
+		zeros int
+	)
+
+	for _, r := range h.reg {
+		sum += 1 / float64(uint64(1)<<r)
+		if r == 0 {
+			zeros++
+		}
+	}
+
+	m := float64(hllRegisters)
+	e := 0.7213 / (1 + 1.079/m) * m * m / sum
+
+	// Linear counting is more precise for small cardinalities
+	if e <= 2.5*m && zeros > 0 {
+		e = m * math.Log(m/float64(zeros))
+	}
+
+	return uint64(e + 0.5)
+}
+
+// Snapshot payload: registers
+func (h *hll) encode(w *bufio.Writer) {
+	writeUvarint(w, uint64(len(h.reg)))
+	w.Write(h.reg)
+}
+
+func decodeHLL(r *bufio.Reader) (*hll, error) {
+	l, err := binary.ReadUvarint(r)
+	if err != nil || l != hllRegisters {
+		return nil, ErrCorrupted
+	}
+
+	h := newHLL()
+	if _, err := io.ReadFull(r, h.reg); err != nil {
+		return nil, ErrCorrupted
+	}
+
+	return h, nil
+}
+
+// PFAdd adds elements to HyperLogLog and reports
+// whether estimated cardinality could change
+//
+// Missing key is created even without elements.
+func (db *DB) PFAdd(key string, elems ...string) (bool, error) {
+	if err := db.writable(key); err != nil {
+		return false, err
+	}
+
+	return db.pfAdd(key, elems...)
+}
+
+func (db *DB) pfAdd(key string, elems ...string) (bool, error) {
+	var changed bool
+	err := db.head().update(db, key, newChange(changePFAdd, elems...), func(n *node, exists bool) error {
+		if !exists {
+			n.set(newHLL())
+			changed = true
+		}
+		if n.tipe != TypeHLL {
+			return ErrInvalidType
+		}
+
+		h := n.obj.(*hll)
+		for _, e := range elems {
+			if h.add(e) {
+				changed = true
+			}
+		}
+
+		return nil
+	})
+
+	return changed, err
+}
+
+// PFCount returns estimated count of unique elements
+// of union of keys, missing keys are empty
+func (db *DB) PFCount(keys ...string) (uint64, error) {
+	h, err := db.union(keys)
+	if err != nil {
+		return 0, err
+	}
+
+	return h.count(), nil
+}
+
+// PFMerge writes union of dest and keys to dest
+func (db *DB) PFMerge(dest string, keys ...string) error {
+	if err := db.writable(dest); err != nil {
+		return err
+	}
+
+	h, err := db.union(keys)
+	if err != nil {
+		return err
+	}
+
+	// Union depends on other keys, so merged value is replicated
+	return db.head().update(db, dest, nil, func(n *node, exists bool) error {
+		if !exists {
+			n.set(newHLL())
+		}
+		if n.tipe != TypeHLL {
+			return ErrInvalidType
+		}
+
+		n.obj.(*hll).merge(h)
+
+		return nil
+	})
+}
+
+// Returns merged copy of keys
+func (db *DB) union(keys []string) (*hll, error) {
+	h := newHLL()
+
+	for _, k := range keys {
+		err := db.view(k, func(n *node) error {
+			if n.tipe != TypeHLL {
+				return ErrInvalidType
+			}
+			h.merge(n.obj.(*hll))
+
+			return nil
+		})
+		if err != nil && err != ErrNotFound {
+			return nil, err
+		}
+	}
+
+	return h, nil
+}
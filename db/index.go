@@ -0,0 +1,418 @@
+package db
+
+import (
+	"math"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/lukashes/db/glob"
+)
+
+// Secondary index of dicts by value of one field
+//
+// Entries are ordered by value and key. Numbers go before
+// other values and are compared numerically, others are
+// compared as text.
+type index struct {
+	mu sync.RWMutex
+
+	pattern string
+	field   string
+
+	items indexList
+	keys  map[string]indexEntry
+}
+
+type indexItem struct {
+	value Value
+	key   string
+}
+
+type indexEntry struct {
+	value Value
+	exp   int64
+}
+
+type indexes struct {
+	mu  sync.RWMutex
+	set map[string]*index
+
+	// Count of indexes for checking without lock
+	n int32
+}
+
+// WithIndex creates index at start, so keys restored
+// from snapshot are indexed
+func WithIndex(name, keyPattern, field string) Option {
+	return func(db *DB) {
+		db.indexes.add(name, newIndex(keyPattern, field))
+	}
+}
+
+func newIndex(pattern, field string) *index {
+	return &index{
+		pattern: pattern,
+		field:   field,
+		keys:    make(map[string]indexEntry),
+	}
+}
+
+// CreateIndex indexes dicts with keys matching glob pattern
+// by value of field
+//
+// Existing keys are indexed at once, then index follows every
+// write, delete and expiration. Fields holding lists or dicts
+// are not indexed. Index is kept only in memory.
+func (db *DB) CreateIndex(name, keyPattern, field string) error {
+	if name == "" {
+		return ErrEmptyKey
+	}
+	if keyPattern == "" || field == "" {
+		return ErrInvalidArgument
+	}
+
+	// Growing is suspended, so all keys are in the head
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	idx := newIndex(keyPattern, field)
+	if !db.indexes.add(name, idx) {
+		return ErrExists
+	}
+
+	// Writes wait for bucket lock, so they are applied
+	// to index before or after the bucket is scanned
+	for _, b := range db.head().buckets {
+		b.mu.RLock()
+		for n := b.nodes; n != nil; n = n.next {
+			idx.update(n.key, n)
+		}
+		b.mu.RUnlock()
+	}
+
+	return nil
+}
+
+// DropIndex removes index
+func (db *DB) DropIndex(name string) error {
+	is := &db.indexes
+	is.mu.Lock()
+	defer is.mu.Unlock()
+
+	if _, ok := is.set[name]; !ok {
+		return ErrNoIndex
+	}
+
+	delete(is.set, name)
+	atomic.AddInt32(&is.n, -1)
+
+	return nil
+}
+
+// FindByIndex returns keys whose field equals value,
+// keys are sorted
+func (db *DB) FindByIndex(name string, value Value) ([]string, error) {
+	return db.FindRange(name, &value, &value, 0)
+}
+
+// FindRange returns keys whose field is between min and max
+// inclusive ordered by value and key
+//
+// Nil bound is not limited, positive count limits number
+// of keys.
+func (db *DB) FindRange(name string, min, max *Value, count int) ([]string, error) {
+	idx := db.indexes.get(name)
+	if idx == nil {
+		return nil, ErrNoIndex
+	}
+
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+
+	now := time.Now().Unix()
+	keys := make([]string, 0)
+	for n := idx.items.seek(min); n != nil; n = n.next[0] {
+		it := n.item
+		if max != nil && compareValues(it.value, *max) > 0 {
+			break
+		}
+		if count > 0 && len(keys) == count {
+			break
+		}
+
+		// Expired keys stay until they are removed
+		if e := idx.keys[it.key]; e.exp != 0 && e.exp <= now {
+			continue
+		}
+		keys = append(keys, it.key)
+	}
+
+	return keys, nil
+}
+
+func (is *indexes) add(name string, idx *index) bool {
+	is.mu.Lock()
+	defer is.mu.Unlock()
+
+	if is.set == nil {
+		is.set = make(map[string]*index)
+	}
+	if _, ok := is.set[name]; ok {
+		return false
+	}
+
+	is.set[name] = idx
+	atomic.AddInt32(&is.n, 1)
+
+	return true
+}
+
+func (is *indexes) get(name string) *index {
+	is.mu.RLock()
+	defer is.mu.RUnlock()
+
+	return is.set[name]
+}
+
+// Follows change of node, should be called under bucket lock
+func (is *indexes) update(key string, n *node) {
+	if atomic.LoadInt32(&is.n) == 0 {
+		return
+	}
+
+	is.mu.RLock()
+	for _, idx := range is.set {
+		idx.update(key, n)
+	}
+	is.mu.RUnlock()
+}
+
+// Removes all entries
+func (is *indexes) clear() {
+	if atomic.LoadInt32(&is.n) == 0 {
+		return
+	}
+
+	is.mu.RLock()
+	for _, idx := range is.set {
+		idx.mu.Lock()
+		idx.items = indexList{}
+		idx.keys = make(map[string]indexEntry)
+		idx.mu.Unlock()
+	}
+	is.mu.RUnlock()
+}
+
+// Replaces entry of key by value of node,
+// entry is removed if node is not alive dict
+func (idx *index) update(key string, n *node) {
+	if !glob.Match(idx.pattern, key) {
+		return
+	}
+
+	var (
+		v  Value
+		ok bool
+	)
+	if n.isAlive() && n.tipe == TypeDict {
+		v, ok = n.dict[idx.field]
+		switch {
+		case v.kind == KindList, v.kind == KindDict:
+			ok = false
+		case v.kind == KindFloat && math.IsNaN(v.Float()):
+			ok = false
+		}
+	}
+
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	if old, found := idx.keys[key]; found {
+		idx.items.remove(indexItem{value: old.value, key: key})
+		delete(idx.keys, key)
+	}
+
+	if !ok {
+		return
+	}
+
+	idx.items.insert(indexItem{value: v, key: key})
+	idx.keys[key] = indexEntry{value: v, exp: n.exp}
+}
+
+// Maximum level of skip list, enough for 2^32 items
+const indexLevels = 32
+
+// Skip list of items ordered by value and key
+type indexList struct {
+	head  indexNode
+	level int
+	seed  uint64
+}
+
+type indexNode struct {
+	item indexItem
+	next []*indexNode
+}
+
+func (it indexItem) less(o indexItem) bool {
+	c := compareValues(it.value, o.value)
+	return c < 0 || c == 0 && it.key < o.key
+}
+
+// Returns the first node with value not less than min, nil min is the first node
+func (l *indexList) seek(min *Value) *indexNode {
+	x := &l.head
+	for lv := l.level - 1; lv >= 0; lv-- {
+		for min != nil && x.next[lv] != nil && compareValues(x.next[lv].item.value, *min) < 0 {
+			x = x.next[lv]
+		}
+	}
+
+	if len(x.next) == 0 {
+		return nil
+	}
+
+	return x.next[0]
+}
+
+// Returns the last nodes before item on every level
+func (l *indexList) path(it indexItem) [indexLevels]*indexNode {
+	var prev [indexLevels]*indexNode
+
+	x := &l.head
+	for lv := l.level - 1; lv >= 0; lv-- {
+		for x.next[lv] != nil && x.next[lv].item.less(it) {
+			x = x.next[lv]
+		}
+		prev[lv] = x
+	}
+
+	return prev
+}
+
+func (l *indexList) insert(it indexItem) {
+	if l.head.next == nil {
+		l.head.next = make([]*indexNode, indexLevels)
+	}
+
+	prev := l.path(it)
+
+	lv := l.randomLevel()
+	for ; l.level < lv; l.level++ {
+		prev[l.level] = &l.head
+	}
+
+	n := &indexNode{item: it, next: make([]*indexNode, lv)}
+	for i := 0; i < lv; i++ {
+		n.next[i] = prev[i].next[i]
+		prev[i].next[i] = n
+	}
+}
+
+func (l *indexList) remove(it indexItem) {
+	prev := l.path(it)
+
+	n := prev[0]
+	if n == nil || n.next[0] == nil || n.next[0].item.key != it.key {
+		return
+	}
+	n = n.next[0]
+
+	for i := range n.next {
+		prev[i].next[i] = n.next[i]
+	}
+	for l.level > 0 && l.head.next[l.level-1] == nil {
+		l.level--
+	}
+}
+
+// Returns level of new node, every next level is twice rarer
+func (l *indexList) randomLevel() int {
+	// Xorshift is enough for balancing
+	if l.seed == 0 {
+		l.seed = uint64(time.Now().UnixNano()) | 1
+	}
+	l.seed ^= l.seed << 13
+	l.seed ^= l.seed >> 7
+	l.seed ^= l.seed << 17
+
+	lv := 1
+	for r := l.seed; lv < indexLevels && r&1 == 1; r >>= 1 {
+		lv++
+	}
+
+	return lv
+}
+
+// Numbers are compared exactly, integers above 2^53
+// are not rounded to float
+func compareValues(a, b Value) int {
+	an, bn := a.isNumber(), b.isNumber()
+	switch {
+	case an && bn:
+		switch {
+		case a.kind == KindInt && b.kind == KindInt:
+			return compareInts(a.Int(), b.Int())
+		case a.kind == KindInt:
+			return compareIntFloat(a.Int(), b.Float())
+		case b.kind == KindInt:
+			return -compareIntFloat(b.Int(), a.Float())
+		}
+		switch x, y := a.Float(), b.Float(); {
+		case x < y:
+			return -1
+		case x > y:
+			return 1
+		}
+		return 0
+	case an:
+		return -1
+	case bn:
+		return 1
+	}
+
+	return strings.Compare(a.String(), b.String())
+}
+
+func (v Value) isNumber() bool {
+	return v.kind == KindInt || v.kind == KindFloat
+}
+
+func compareInts(a, b int64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+
+	return 0
+}
+
+func compareIntFloat(i int64, f float64) int {
+	switch {
+	case math.IsNaN(f):
+		return 0
+	case f >= math.MaxInt64:
+		return -1
+	case f < math.MinInt64:
+		return 1
+	}
+
+	// Integer part of f fits int64, fraction decides if they are equal
+	t := math.Trunc(f)
+	if c := compareInts(i, int64(t)); c != 0 {
+		return c
+	}
+	switch {
+	case f > t:
+		return -1
+	case f < t:
+		return 1
+	}
+
+	return 0
+}
@@ -0,0 +1,532 @@
+package db
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Parsed json document, numbers are kept as json.Number
+// so integers do not lose precision
+type document struct {
+	root interface{}
+
+	// Size of members and values
+	bytes int64
+}
+
+func (d *document) tipe() Type {
+	return TypeJSON
+}
+
+func (d *document) clone() object {
+	return &document{root: copyJSON(d.root), bytes: d.bytes}
+}
+
+func (d *document) size() int64 {
+	return d.bytes
+}
+
+// Snapshot payload: document text
+func (d *document) encode(w *bufio.Writer) {
+	b, _ := json.Marshal(d.root)
+	writeString(w, string(b))
+}
+
+func decodeDocument(r *bufio.Reader) (*document, error) {
+	s, err := readString(r)
+	if err != nil {
+		return nil, err
+	}
+
+	v, err := parseJSON([]byte(s))
+	if err != nil {
+		return nil, ErrCorrupted
+	}
+
+	return &document{root: v, bytes: jsonSize(v)}, nil
+}
+
+func parseJSON(b []byte) (interface{}, error) {
+	d := json.NewDecoder(bytes.NewReader(b))
+	d.UseNumber()
+
+	var v interface{}
+	if err := d.Decode(&v); err != nil {
+		return nil, ErrInvalidArgument
+	}
+	if d.More() {
+		return nil, ErrInvalidArgument
+	}
+
+	return v, nil
+}
+
+func copyJSON(v interface{}) interface{} {
+	switch t := v.(type) {
+	case map[string]interface{}:
+		c := make(map[string]interface{}, len(t))
+		for k, v := range t {
+			c[k] = copyJSON(v)
+		}
+		return c
+	case []interface{}:
+		c := make([]interface{}, len(t))
+		for i, v := range t {
+			c[i] = copyJSON(v)
+		}
+		return c
+	}
+
+	return v
+}
+
+// Returns approximate size of parsed json value
+func jsonSize(v interface{}) int64 {
+	switch t := v.(type) {
+	case map[string]interface{}:
+		var size int64
+		for k, v := range t {
+			size += int64(len(k)) + jsonSize(v)
+		}
+		return size
+	case []interface{}:
+		var size int64
+		for _, v := range t {
+			size += jsonSize(v)
+		}
+		return size
+	case string:
+		return int64(len(t))
+	case json.Number:
+		return int64(len(t))
+	case removed:
+		return 0
+	}
+
+	return 4
+}
+
+// Segment of json path, member name or array index
+type segment struct {
+	name     string
+	index    int
+	isIndex  bool
+	wildcard bool
+}
+
+// Parses subset of JSONPath: root $, .member, ["member"],
+// [index] with negative indexes from the end, .* and [*]
+//
+// Leading $ could be omitted, empty path is the root.
+func parsePath(p string) ([]segment, error) {
+	p = strings.TrimPrefix(p, "$")
+
+	var segs []segment
+	for len(p) > 0 {
+		switch p[0] {
+		case '.':
+			p = p[1:]
+			i := strings.IndexAny(p, ".[")
+			if i < 0 {
+				i = len(p)
+			}
+			if i == 0 {
+				return nil, ErrInvalidArgument
+			}
+			if p[:i] == "*" {
+				segs = append(segs, segment{wildcard: true})
+			} else {
+				segs = append(segs, segment{name: p[:i]})
+			}
+			p = p[i:]
+		case '[':
+			end := strings.IndexByte(p, ']')
+			if end < 0 {
+				return nil, ErrInvalidArgument
+			}
+			in := p[1:end]
+			switch {
+			case in == "*":
+				segs = append(segs, segment{wildcard: true})
+			case len(in) >= 2 && (in[0] == '"' || in[0] == '\'') && in[len(in)-1] == in[0]:
+				segs = append(segs, segment{name: in[1 : len(in)-1]})
+			default:
+				i, err := strconv.Atoi(in)
+				if err != nil {
+					return nil, ErrInvalidArgument
+				}
+				segs = append(segs, segment{index: i, isIndex: true})
+			}
+			p = p[end+1:]
+		default:
+			return nil, ErrInvalidArgument
+		}
+	}
+
+	return segs, nil
+}
+
+// Appends values matching path to res
+func match(v interface{}, segs []segment, res []interface{}) []interface{} {
+	if len(segs) == 0 {
+		return append(res, v)
+	}
+
+	s := segs[0]
+	switch t := v.(type) {
+	case map[string]interface{}:
+		if s.wildcard {
+			for _, c := range t {
+				res = match(c, segs[1:], res)
+			}
+		} else if c, ok := t[s.name]; ok && !s.isIndex {
+			res = match(c, segs[1:], res)
+		}
+	case []interface{}:
+		if s.wildcard {
+			for _, c := range t {
+				res = match(c, segs[1:], res)
+			}
+		} else if i, ok := arrayIndex(s, len(t)); ok {
+			res = match(t[i], segs[1:], res)
+		}
+	}
+
+	return res
+}
+
+func arrayIndex(s segment, l int) (int, bool) {
+	if !s.isIndex {
+		return 0, false
+	}
+
+	i := s.index
+	if i < 0 {
+		i += l
+	}
+
+	return i, i >= 0 && i < l
+}
+
+// Marks value which should be removed from its parent
+type removed struct{}
+
+// Returns v with value at path replaced by result of fn
+//
+// Fn gets current value and whether it exists. Missing object
+// member is created, other missing parents are ErrInvalidIndex.
+func modify(v interface{}, segs []segment, fn func(old interface{}, found bool) (interface{}, error)) (interface{}, error) {
+	if len(segs) == 0 {
+		return fn(v, true)
+	}
+
+	s := segs[0]
+	if s.wildcard {
+		return nil, ErrInvalidArgument
+	}
+
+	switch t := v.(type) {
+	case map[string]interface{}:
+		if s.isIndex {
+			return nil, ErrInvalidIndex
+		}
+		old, found := t[s.name]
+		if !found && len(segs) > 1 {
+			return nil, ErrInvalidIndex
+		}
+		var (
+			nv  interface{}
+			err error
+		)
+		if found {
+			nv, err = modify(old, segs[1:], fn)
+		} else {
+			nv, err = fn(nil, false)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := nv.(removed); ok {
+			delete(t, s.name)
+		} else {
+			t[s.name] = nv
+		}
+		return t, nil
+	case []interface{}:
+		i, ok := arrayIndex(s, len(t))
+		if !ok {
+			return nil, ErrInvalidIndex
+		}
+		nv, err := modify(t[i], segs[1:], fn)
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := nv.(removed); ok {
+			return append(t[:i], t[i+1:]...), nil
+		}
+		t[i] = nv
+		return t, nil
+	}
+
+	return nil, ErrInvalidIndex
+}
+
+// Changes document at path in place by change c, root
+// of missing document could be set if create is true
+func (db *DB) updateJSON(key, path string, create bool, c *change, fn func(old interface{}, found bool) (interface{}, error)) error {
+	segs, err := parsePath(path)
+	if err != nil {
+		return err
+	}
+
+	return db.head().update(db, key, c, func(n *node, exists bool) error {
+		if !exists {
+			if !create || len(segs) > 0 {
+				return ErrNotFound
+			}
+			n.set(&document{})
+		}
+		if n.tipe != TypeJSON {
+			return ErrInvalidType
+		}
+
+		d := n.obj.(*document)
+
+		// Size is changed by difference of changed value,
+		// member name is counted if member is added or removed
+		var delta int64
+		change := func(old interface{}, found bool) (interface{}, error) {
+			var before int64
+			switch {
+			case len(segs) == 0:
+				before = d.bytes
+			case found:
+				before = jsonSize(old)
+			}
+			v, err := fn(old, found)
+			if err != nil {
+				return nil, err
+			}
+			delta = jsonSize(v) - before
+			if last := len(segs) - 1; last >= 0 && !segs[last].isIndex {
+				if _, ok := v.(removed); ok {
+					delta -= int64(len(segs[last].name))
+				} else if !found {
+					delta += int64(len(segs[last].name))
+				}
+			}
+			return v, nil
+		}
+
+		// Parents are changed only after successful change of child
+		root, err := modify(d.root, segs, change)
+		if err != nil {
+			return err
+		}
+		if _, ok := root.(removed); ok {
+			return errRemove
+		}
+		d.root = root
+		d.bytes += delta
+
+		return nil
+	})
+}
+
+// JSONGet returns json of value at path
+//
+// Path with wildcards returns array of all matched values.
+func (db *DB) JSONGet(key, path string) ([]byte, error) {
+	segs, err := parsePath(path)
+	if err != nil {
+		return nil, err
+	}
+
+	wildcard := false
+	for _, s := range segs {
+		wildcard = wildcard || s.wildcard
+	}
+
+	var res []byte
+	err = db.view(key, func(n *node) error {
+		if n.tipe != TypeJSON {
+			return ErrInvalidType
+		}
+
+		vals := match(n.obj.(*document).root, segs, nil)
+		if wildcard {
+			if vals == nil {
+				vals = []interface{}{}
+			}
+			res, err = json.Marshal(vals)
+			return err
+		}
+		if len(vals) == 0 {
+			return ErrInvalidIndex
+		}
+
+		res, err = json.Marshal(vals[0])
+
+		return err
+	})
+
+	return res, err
+}
+
+// JSONSet sets json value at path, missing key could be
+// created only by setting the root
+func (db *DB) JSONSet(key, path string, value []byte) error {
+	if err := db.writable(key); err != nil {
+		return err
+	}
+
+	return db.jsonSet(key, path, value)
+}
+
+func (db *DB) jsonSet(key, path string, value []byte) error {
+	v, err := parseJSON(value)
+	if err != nil {
+		return err
+	}
+
+	c := newChange(changeJSONSet, path, string(value))
+
+	return db.updateJSON(key, path, true, c, func(interface{}, bool) (interface{}, error) {
+		return v, nil
+	})
+}
+
+// JSONDel removes value at path, root path removes the key
+func (db *DB) JSONDel(key, path string) error {
+	if err := db.writable(key); err != nil {
+		return err
+	}
+
+	return db.jsonDel(key, path)
+}
+
+func (db *DB) jsonDel(key, path string) error {
+	return db.updateJSON(key, path, false, newChange(changeJSONDel, path), func(old interface{}, found bool) (interface{}, error) {
+		if !found {
+			return nil, ErrInvalidIndex
+		}
+		return removed{}, nil
+	})
+}
+
+// JSONType returns type of document root
+func (db *DB) JSONType(key string) (string, error) {
+	var t string
+
+	err := db.view(key, func(n *node) error {
+		if n.tipe != TypeJSON {
+			return ErrInvalidType
+		}
+
+		switch n.obj.(*document).root.(type) {
+		case map[string]interface{}:
+			t = "object"
+		case []interface{}:
+			t = "array"
+		case string:
+			t = "string"
+		case json.Number:
+			t = "number"
+		case bool:
+			t = "boolean"
+		default:
+			t = "null"
+		}
+
+		return nil
+	})
+
+	return t, err
+}
+
+// JSONArrAppend appends values to array at path and returns its length
+func (db *DB) JSONArrAppend(key, path string, values ...[]byte) (int, error) {
+	if err := db.writable(key); err != nil {
+		return 0, err
+	}
+
+	return db.jsonArrAppend(key, path, values...)
+}
+
+func (db *DB) jsonArrAppend(key, path string, values ...[]byte) (int, error) {
+	c := newChange(changeJSONArrAppend, path)
+
+	vals := make([]interface{}, 0, len(values))
+	for _, b := range values {
+		v, err := parseJSON(b)
+		if err != nil {
+			return 0, err
+		}
+		vals = append(vals, v)
+		c.args = append(c.args, string(b))
+	}
+
+	var l int
+	err := db.updateJSON(key, path, false, c, func(old interface{}, found bool) (interface{}, error) {
+		arr, ok := old.([]interface{})
+		if !found || !ok {
+			return nil, ErrInvalidType
+		}
+		arr = append(arr, vals...)
+		l = len(arr)
+
+		return arr, nil
+	})
+
+	return l, err
+}
+
+// JSONNumIncrBy adds by to number at path and returns the result
+//
+// Integers stay integers if by is integer too, overflow of
+// integer is ErrInvalidArgument.
+func (db *DB) JSONNumIncrBy(key, path string, by float64) (float64, error) {
+	if err := db.writable(key); err != nil {
+		return 0, err
+	}
+
+	return db.jsonNumIncrBy(key, path, by)
+}
+
+func (db *DB) jsonNumIncrBy(key, path string, by float64) (float64, error) {
+	var res float64
+
+	c := newChange(changeJSONNumIncrBy, path, formatFloat(by))
+	err := db.updateJSON(key, path, false, c, func(old interface{}, found bool) (interface{}, error) {
+		num, ok := old.(json.Number)
+		if !found || !ok {
+			return nil, ErrInvalidType
+		}
+
+		if i, err := num.Int64(); err == nil && by == math.Trunc(by) && math.Abs(by) < 1<<53 {
+			r := i + int64(by)
+			if (by >= 0) != (r >= i) {
+				return nil, ErrInvalidArgument
+			}
+			res = float64(r)
+			return json.Number(strconv.FormatInt(r, 10)), nil
+		}
+
+		f, err := num.Float64()
+		if err != nil {
+			return nil, ErrInvalidType
+		}
+		res = f + by
+		if math.IsInf(res, 0) || math.IsNaN(res) {
+			return nil, ErrInvalidArgument
+		}
+
+		return json.Number(strconv.FormatFloat(res, 'g', -1, 64)), nil
+	})
+
+	return res, err
+}
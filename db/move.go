@@ -0,0 +1,45 @@
+package db
+
+import (
+	"bufio"
+	"bytes"
+)
+
+// Take removes key and returns it encoded, so it could
+// be moved to other DB by Import
+//
+// Value is read and removed atomically, no write to the key
+// could be lost between them.
+func (db *DB) Take(key string) ([]byte, error) {
+	data, err := db.head().take(db, key)
+	if err != ErrNotFound {
+		return data, err
+	}
+
+	if t := db.tail(); t != nil {
+		data, err = t.take(db, key)
+	}
+
+	return data, err
+}
+
+// Import writes key returned by Take if it does not exist
+//
+// Existing key is considered newer and stays untouched.
+// It is allowed in read only mode.
+func (db *DB) Import(data []byte) error {
+	key, exp, val, err := db.readNode(bufio.NewReader(bytes.NewReader(data)), snapshotVersion)
+	if err != nil {
+		return err
+	}
+
+	if exists, _ := db.Exists(key); exists {
+		return nil
+	}
+
+	if err := db.head().insert(db, key, val, exp); err != ErrExists {
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,164 @@
+package db
+
+import (
+	"bufio"
+	"bytes"
+	"sync/atomic"
+	"unsafe"
+)
+
+// Op is a kind of mutation
+type Op uint8
+
+const (
+	OpWrite Op = iota + 1
+	OpDelete
+	OpFlush
+	OpUpdate
+)
+
+// Mutation describes a change of keyspace
+//
+// Data of write is the key encoded as snapshot record, so it
+// keeps value, type and absolute expiration time. Data of update
+// is operation which changes value in place, it is applied to
+// the same value of receiver. Expired keys are not reported,
+// receiver expires them by the same time.
+type Mutation struct {
+	Op   Op
+	Key  string
+	Data []byte
+}
+
+// OnMutation registers fn which is called on every change
+//
+// Fn is called under bucket lock in order of changes, so it
+// must be fast and must not call DB.
+func (db *DB) OnMutation(fn func(m Mutation)) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	hooks, _ := db.hooks.Load().([]func(Mutation))
+	db.hooks.Store(append(hooks[:len(hooks):len(hooks)], fn))
+}
+
+// Apply changes keyspace by mutation received from other DB
+//
+// It is allowed in read only mode.
+func (db *DB) Apply(m Mutation) error {
+	switch m.Op {
+	case OpWrite:
+		key, exp, val, err := db.readNode(bufio.NewReader(bytes.NewReader(m.Data)), snapshotVersion)
+		if err != nil {
+			return err
+		}
+		return db.head().write(db, key, val, exp)
+	case OpUpdate:
+		c, err := decodeChange(m.Data)
+		if err != nil {
+			return err
+		}
+		return db.applyChange(m.Key, c)
+	case OpDelete:
+		return db.head().delete(db, m.Key)
+	case OpFlush:
+		db.flush()
+		return nil
+	}
+
+	return ErrInvalidOp
+}
+
+// SetReadOnly rejects all writes with ErrReadOnly,
+// only Apply and Restore are allowed
+func (db *DB) SetReadOnly(ro bool) {
+	var v int32
+	if ro {
+		v = 1
+	}
+
+	atomic.StoreInt32(&db.readOnly, v)
+}
+
+// ReadOnly reports whether writes are rejected
+func (db *DB) ReadOnly() bool {
+	return atomic.LoadInt32(&db.readOnly) == 1
+}
+
+// Flush removes all keys
+func (db *DB) Flush() error {
+	if atomic.LoadInt32(&db.readOnly) == 1 {
+		return ErrReadOnly
+	}
+
+	db.flush()
+
+	return nil
+}
+
+func (db *DB) flush() {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	// Keys written meanwhile could stay in indexes, so index
+	// returns key which is gone rather than misses existing one
+	db.indexes.clear()
+	atomic.StorePointer(&db.h, unsafe.Pointer(newStore()))
+
+	if db.observed() {
+		db.emit(Mutation{Op: OpFlush})
+	}
+	db.event(EventFlush, "", 0)
+	db.waiters.wake("")
+}
+
+// Checks key could be written
+func (db *DB) writable(key string) error {
+	if len(key) == 0 {
+		return ErrEmptyKey
+	}
+
+	if atomic.LoadInt32(&db.readOnly) == 1 {
+		return ErrReadOnly
+	}
+
+	return nil
+}
+
+func (db *DB) observed() bool {
+	hooks, _ := db.hooks.Load().([]func(Mutation))
+	return len(hooks) > 0
+}
+
+func (db *DB) emit(m Mutation) {
+	hooks, _ := db.hooks.Load().([]func(Mutation))
+	for _, fn := range hooks {
+		fn(m)
+	}
+}
+
+func encodeNode(n *node) []byte {
+	b := new(bytes.Buffer)
+	w := bufio.NewWriter(b)
+
+	writeNode(w, n)
+	w.Flush()
+
+	return b.Bytes()
+}
+
+// NewWrite returns write mutation for key, val is []byte,
+// []string, map[string]string, []Value or map[string]Value
+// as for Write methods
+func NewWrite(key string, val interface{}, ttl *int) (Mutation, error) {
+	if len(key) == 0 {
+		return Mutation{}, ErrEmptyKey
+	}
+
+	n := &node{key: key, exp: expiry(ttl)}
+	if err := n.set(val); err != nil {
+		return Mutation{}, err
+	}
+
+	return Mutation{Op: OpWrite, Key: key, Data: encodeNode(n)}, nil
+}
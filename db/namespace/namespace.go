@@ -0,0 +1,390 @@
+// Package namespace keeps named logical databases
+//
+// Every namespace is an isolated DB with own keys, stats,
+// subscribers and listeners. Namespaces are created on first
+// use and are saved together in one snapshot.
+package namespace
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/lukashes/db/db"
+)
+
+const (
+	// Name of namespace used when it is not selected
+	Default = "0"
+
+	// Limits of namespaces count and name length
+	MaxNamespaces = 256
+	MaxName       = 64
+)
+
+// Snapshot format:
+//
+//	magic "LDBN", version byte, count uvarint
+//	namespaces: name, DB snapshot
+//
+// Plain DB snapshot is restored to the default namespace.
+const (
+	snapshotMagic   = "LDBN"
+	snapshotVersion = 1
+	dbMagic         = "LDBS"
+)
+
+var (
+	ErrInvalidName = errors.New("namespace name should be 1-64 letters, digits, '-' or '_'")
+	ErrTooMany     = errors.New("too many namespaces")
+	ErrSwapDefault = errors.New("default namespace could not be swapped")
+)
+
+// OpSwap is a mutation of set which exchanges data of
+// namespace with namespace named by key
+const OpSwap db.Op = 0x80
+
+// Set is a collection of namespaces
+type Set struct {
+	mu     sync.RWMutex
+	dbs    map[string]*db.DB
+	names  map[*db.DB]string
+	limits map[string]*limiter
+	opts   []db.Option
+	hooks  []func(name string, m db.Mutation)
+
+	// Closed and replaced by SwapDB, so watchers
+	// of swapped namespaces move to their new DBs
+	swapped chan struct{}
+}
+
+// New returns set with default namespace, every
+// namespace is created with opts
+func New(opts ...db.Option) *Set {
+	s := &Set{
+		dbs:     make(map[string]*db.DB),
+		names:   make(map[*db.DB]string),
+		opts:    opts,
+		swapped: make(chan struct{}),
+	}
+	d := db.New(opts...)
+	s.dbs[Default], s.names[d] = d, Default
+
+	return s
+}
+
+// ValidName checks name could be used for namespace
+func ValidName(name string) bool {
+	if len(name) == 0 || len(name) > MaxName {
+		return false
+	}
+
+	for i := 0; i < len(name); i++ {
+		switch c := name[i]; {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9', c == '-', c == '_':
+		default:
+			return false
+		}
+	}
+
+	return true
+}
+
+// Default returns default namespace
+func (s *Set) Default() *db.DB {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.dbs[Default]
+}
+
+// Get returns namespace by name, it is created if it is missing
+func (s *Set) Get(name string) (*db.DB, error) {
+	s.mu.RLock()
+	d, ok := s.dbs[name]
+	s.mu.RUnlock()
+	if ok {
+		return d, nil
+	}
+
+	if !ValidName(name) {
+		return nil, ErrInvalidName
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.create(name)
+}
+
+// Should be called under lock
+func (s *Set) create(name string) (*db.DB, error) {
+	if d, ok := s.dbs[name]; ok {
+		return d, nil
+	}
+
+	if len(s.dbs) >= MaxNamespaces {
+		return nil, ErrTooMany
+	}
+
+	d := db.New(s.opts...)
+	s.dbs[name], s.names[d] = d, name
+	for _, fn := range s.hooks {
+		s.observe(d, fn)
+	}
+
+	return d, nil
+}
+
+// OnMutation registers fn which is called on every change of
+// every namespace, see db.OnMutation
+//
+// Fn gets name of namespace which has the DB at the moment
+// of change. Swap of namespaces is reported as OpSwap.
+func (s *Set) OnMutation(fn func(name string, m db.Mutation)) {
+	s.mu.Lock()
+	s.hooks = append(s.hooks, fn)
+	dbs := make([]*db.DB, 0, len(s.dbs))
+	for _, d := range s.dbs {
+		dbs = append(dbs, d)
+	}
+	s.mu.Unlock()
+
+	// DB calls hooks under own lock and hook takes lock of
+	// set, so existing DBs are observed out of it
+	for _, d := range dbs {
+		s.observe(d, fn)
+	}
+}
+
+// Name is resolved under lock, so changes are reported
+// either before or after swap record
+func (s *Set) observe(d *db.DB, fn func(name string, m db.Mutation)) {
+	d.OnMutation(func(m db.Mutation) {
+		s.mu.RLock()
+		fn(s.names[d], m)
+		s.mu.RUnlock()
+	})
+}
+
+// Apply changes namespace by mutation received from other
+// set, missing namespace is created
+func (s *Set) Apply(name string, m db.Mutation) error {
+	if m.Op == OpSwap {
+		return s.SwapDB(name, m.Key)
+	}
+
+	d, err := s.Get(name)
+	if err != nil {
+		return err
+	}
+
+	return d.Apply(m)
+}
+
+// Names returns sorted names of namespaces
+func (s *Set) Names() []string {
+	s.mu.RLock()
+	names := make([]string, 0, len(s.dbs))
+	for name := range s.dbs {
+		names = append(names, name)
+	}
+	s.mu.RUnlock()
+
+	sort.Strings(names)
+
+	return names
+}
+
+// FlushDB removes all keys of namespace
+func (s *Set) FlushDB(name string) error {
+	s.mu.RLock()
+	d, ok := s.dbs[name]
+	s.mu.RUnlock()
+
+	if !ok {
+		return nil
+	}
+
+	return d.Flush()
+}
+
+// SwapDB exchanges data of namespaces, missing ones are created
+//
+// Subscribers, listeners and indexes stay with data. Default
+// namespace is referenced by replication and persistence,
+// so it could not be swapped.
+func (s *Set) SwapDB(a, b string) error {
+	if !ValidName(a) || !ValidName(b) {
+		return ErrInvalidName
+	}
+	if a == Default || b == Default {
+		return ErrSwapDefault
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	da, err := s.create(a)
+	if err != nil {
+		return err
+	}
+	dbb, err := s.create(b)
+	if err != nil {
+		return err
+	}
+	if da.ReadOnly() || dbb.ReadOnly() {
+		return db.ErrReadOnly
+	}
+	s.dbs[a], s.dbs[b] = dbb, da
+	s.names[da], s.names[dbb] = b, a
+	close(s.swapped)
+	s.swapped = make(chan struct{})
+
+	for _, fn := range s.hooks {
+		fn(a, db.Mutation{Op: OpSwap, Key: b})
+	}
+
+	return nil
+}
+
+// Watch is DB.Watch of namespace which follows SwapDB,
+// so it returns version of key in DB swapped in
+func (s *Set) Watch(name, key string, version uint64, timeout time.Duration) (uint64, error) {
+	deadline := time.Now().Add(timeout)
+
+	for {
+		s.mu.RLock()
+		d, swapped := s.dbs[name], s.swapped
+		s.mu.RUnlock()
+		if d == nil {
+			return 0, db.ErrNotFound
+		}
+
+		v, err := d.WatchCancel(key, version, time.Until(deadline), swapped)
+		if err != db.ErrCanceled {
+			return v, err
+		}
+	}
+}
+
+// Stats returns counters and quotas of all namespaces
+func (s *Set) Stats() map[string]Stats {
+	stats := make(map[string]Stats)
+	for _, name := range s.Names() {
+		stats[name] = s.StatsOf(name)
+	}
+
+	return stats
+}
+
+// StatsOf returns counters and quota of namespace
+func (s *Set) StatsOf(name string) Stats {
+	s.mu.RLock()
+	d := s.dbs[name]
+	l := s.limits[name]
+	s.mu.RUnlock()
+
+	var st Stats
+	if d != nil {
+		st.Stats = d.Stats()
+	}
+	if l != nil {
+		q := l.quota
+		st.Quota = &q
+		st.Limited = atomic.LoadInt64(&l.limited)
+		st.Rejected = atomic.LoadInt64(&l.rejected)
+	}
+
+	return st
+}
+
+// Snapshot writes all namespaces to w
+//
+// Namespaces are written one by one, see db.Snapshot.
+func (s *Set) Snapshot(w io.Writer) error {
+	names := s.Names()
+
+	bw := bufio.NewWriter(w)
+	bw.WriteString(snapshotMagic)
+	bw.WriteByte(snapshotVersion)
+	writeUvarint(bw, uint64(len(names)))
+
+	for _, name := range names {
+		d, err := s.Get(name)
+		if err != nil {
+			return err
+		}
+
+		writeUvarint(bw, uint64(len(name)))
+		bw.WriteString(name)
+
+		// Shares buffer, so it is flushed by DB
+		if err := d.Snapshot(bw); err != nil {
+			return err
+		}
+	}
+
+	return bw.Flush()
+}
+
+// Restore loads namespaces from snapshot of set or of one DB
+//
+// Existing keys are rewritten, other keys stay untouched.
+func (s *Set) Restore(r io.Reader) error {
+	br := bufio.NewReader(r)
+
+	magic, err := br.Peek(len(snapshotMagic))
+	if err != nil {
+		return db.ErrCorrupted
+	}
+	if string(magic) == dbMagic {
+		return s.Default().Restore(br)
+	}
+
+	header := make([]byte, len(snapshotMagic)+1)
+	if _, err := io.ReadFull(br, header); err != nil {
+		return db.ErrCorrupted
+	}
+	if string(header[:len(snapshotMagic)]) != snapshotMagic || header[len(snapshotMagic)] != snapshotVersion {
+		return db.ErrCorrupted
+	}
+
+	cnt, err := binary.ReadUvarint(br)
+	if err != nil {
+		return db.ErrCorrupted
+	}
+
+	for i := uint64(0); i < cnt; i++ {
+		l, err := binary.ReadUvarint(br)
+		if err != nil || l == 0 || l > MaxName {
+			return db.ErrCorrupted
+		}
+		name := make([]byte, l)
+		if _, err := io.ReadFull(br, name); err != nil {
+			return db.ErrCorrupted
+		}
+
+		d, err := s.Get(string(name))
+		if err != nil {
+			return err
+		}
+
+		// DB reads from the same buffer and stops at its end
+		if err := d.Restore(br); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func writeUvarint(w *bufio.Writer, v uint64) {
+	var buf [binary.MaxVarintLen64]byte
+	w.Write(buf[:binary.PutUvarint(buf[:], v)])
+}
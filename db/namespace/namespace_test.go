@@ -0,0 +1,260 @@
+package namespace
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/lukashes/db/db"
+)
+
+func TestIsolation(t *testing.T) {
+	s := New()
+
+	a, err := s.Get("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.Write("key", []byte("a"), nil)
+	s.Default().Write("key", []byte("default"), nil)
+
+	if v, _ := a.Read("key"); string(v) != "a" {
+		t.Fatalf("unexpected value %q", v)
+	}
+	if _, err := s.Get("bad/name"); err != ErrInvalidName {
+		t.Fatalf("expected invalid name error, got %v", err)
+	}
+	if names := s.Names(); !reflect.DeepEqual(names, []string{"0", "a"}) {
+		t.Fatalf("unexpected names %q", names)
+	}
+	if st := s.Stats(); st["a"].Keys != 1 || st[Default].Keys != 1 {
+		t.Fatalf("unexpected stats %+v", st)
+	}
+
+	if err := s.SwapDB(Default, "a"); err != ErrSwapDefault {
+		t.Fatalf("expected swap default error, got %v", err)
+	}
+	if err := s.SwapDB("a", "b"); err != nil {
+		t.Fatal(err)
+	}
+	b, _ := s.Get("b")
+	if v, _ := b.Read("key"); string(v) != "a" {
+		t.Fatalf("unexpected value after swap %q", v)
+	}
+
+	if err := s.FlushDB("a"); err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := b.Read("key"); string(v) != "a" {
+		t.Fatalf("flush removed key of other namespace")
+	}
+	if a, _ = s.Get("a"); a == b {
+		t.Fatal("namespaces are the same after swap")
+	}
+
+	b.SetReadOnly(true)
+	if err := s.SwapDB("a", "b"); err != db.ErrReadOnly {
+		t.Fatalf("expected read only error, got %v", err)
+	}
+}
+
+func TestMutations(t *testing.T) {
+	type record struct {
+		name string
+		m    db.Mutation
+	}
+
+	src, dst := New(), New()
+	var log []record
+	src.OnMutation(func(name string, m db.Mutation) {
+		log = append(log, record{name, m})
+	})
+
+	a, _ := src.Get("a")
+	a.Write("key", []byte("a"), nil)
+	if err := src.SwapDB("a", "b"); err != nil {
+		t.Fatal(err)
+	}
+	a.Write("other", []byte("b"), nil)
+	c, _ := src.Get("c")
+	c.Write("key", []byte("c"), nil)
+
+	if len(log) != 4 || log[1].m.Op != OpSwap || log[2].name != "b" || log[3].name != "c" {
+		t.Fatalf("unexpected mutations %+v", log)
+	}
+
+	for _, r := range log {
+		if err := dst.Apply(r.name, r.m); err != nil {
+			t.Fatal(err)
+		}
+	}
+	b, _ := dst.Get("b")
+	if v, _ := b.Read("other"); string(v) != "b" {
+		t.Fatalf("unexpected value %q", v)
+	}
+	if v, _ := b.Read("key"); string(v) != "a" {
+		t.Fatalf("unexpected value %q", v)
+	}
+	if names := dst.Names(); !reflect.DeepEqual(names, []string{"0", "a", "b", "c"}) {
+		t.Fatalf("unexpected names %q", names)
+	}
+}
+
+func TestSnapshot(t *testing.T) {
+	s := New()
+	s.Default().Write("key", []byte("default"), nil)
+	for _, name := range []string{"a", "b"} {
+		d, _ := s.Get(name)
+		d.WriteList("list", []string{name}, nil)
+	}
+
+	b := new(bytes.Buffer)
+	if err := s.Snapshot(b); err != nil {
+		t.Fatal(err)
+	}
+
+	restored := New()
+	if err := restored.Restore(b); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"a", "b"} {
+		d, _ := restored.Get(name)
+		if l, _ := d.ReadList("list"); len(l) != 1 || l[0] != name {
+			t.Fatalf("unexpected list of %s: %q", name, l)
+		}
+	}
+	if v, _ := restored.Default().Read("key"); string(v) != "default" {
+		t.Fatalf("unexpected default value %q", v)
+	}
+
+	// Snapshot of single DB goes to default namespace
+	single := db.New()
+	single.Write("old", []byte("v"), nil)
+	b.Reset()
+	single.Snapshot(b)
+
+	restored = New()
+	if err := restored.Restore(b); err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := restored.Default().Read("old"); string(v) != "v" {
+		t.Fatalf("unexpected value of single snapshot %q", v)
+	}
+}
+
+func TestQuota(t *testing.T) {
+	s := New()
+	if err := s.SetQuota("a", Quota{MaxKeys: 2, MaxBytes: 100, RPS: 1, Burst: 6}); err != nil {
+		t.Fatal(err)
+	}
+	a, _ := s.Get("a")
+
+	for _, key := range []string{"k1", "k2"} {
+		if err := s.Allow("a", key, 1, false); err != nil {
+			t.Fatal(err)
+		}
+		a.Write(key, []byte("v"), nil)
+	}
+	if err := s.Allow("a", "k3", 1, false); err != ErrQuota {
+		t.Fatalf("expected quota error for new key, got %v", err)
+	}
+	// Existing key could be rewritten
+	if err := s.Allow("a", "k1", 1, false); err != nil {
+		t.Fatal(err)
+	}
+	// Reads are not checked against keys
+	if err := s.Allow("a", "k3", -1, false); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Allow("a", "k1", 200, false); err != ErrQuota {
+		t.Fatalf("expected quota error for large value, got %v", err)
+	}
+
+	// Burst is spent
+	if err := s.Allow("a", "k1", -1, false); err != ErrRateLimited {
+		t.Fatalf("expected rate limit error, got %v", err)
+	}
+
+	st := s.StatsOf("a")
+	if st.Quota == nil || st.Quota.MaxKeys != 2 || st.Limited != 1 || st.Rejected != 2 || st.Keys != 2 {
+		t.Fatalf("unexpected stats %+v", st)
+	}
+
+	// Other namespaces are unlimited
+	for i := 0; i < 10; i++ {
+		if err := s.Allow(Default, "k", 1000, false); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestQuotaBytes(t *testing.T) {
+	s := New()
+	if err := s.SetQuota("a", Quota{MaxBytes: 100}); err != nil {
+		t.Fatal(err)
+	}
+	a, _ := s.Get("a")
+
+	// Expired value is released before rejection
+	expired := -1
+	a.Write("old", make([]byte, 60), &expired)
+	if err := s.Allow("a", "k1", 60, false); err != nil {
+		t.Fatal(err)
+	}
+	a.Write("k1", make([]byte, 60), nil)
+
+	// Replaced value is released
+	if err := s.Allow("a", "k1", 70, true); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Allow("a", "k1", 70, false); err != ErrQuota {
+		t.Fatalf("expected quota error for grown value, got %v", err)
+	}
+	if err := s.Allow("a", "k2", 70, true); err != ErrQuota {
+		t.Fatalf("expected quota error for new key, got %v", err)
+	}
+
+	// Removed value is released
+	a.Delete("k1")
+	if err := s.Allow("a", "k2", 70, false); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWatchSwapped(t *testing.T) {
+	s := New()
+	a, _ := s.Get("a")
+	b, _ := s.Get("b")
+	a.Write("key", []byte("a"), nil)
+	b.Write("key", []byte("b"), nil)
+
+	done := make(chan error)
+	go func() {
+		v, err := s.Watch("a", "key", a.Version("key"), 3*time.Second)
+		if err == nil && v != b.Version("key") {
+			t.Errorf("unexpected version %d", v)
+		}
+		done <- err
+	}()
+
+	time.Sleep(10 * time.Millisecond)
+	if err := s.SwapDB("a", "b"); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-done; err != nil {
+		t.Fatalf("watcher is not moved to swapped DB: %v", err)
+	}
+
+	// Watcher of DB swapped in waits for its changes
+	go func() {
+		_, err := s.Watch("a", "key", b.Version("key"), 3*time.Second)
+		done <- err
+	}()
+
+	time.Sleep(10 * time.Millisecond)
+	b.Write("key", []byte("c"), nil)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,199 @@
+package namespace
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/lukashes/db/db"
+)
+
+// Expired keys are removed not more often than this
+// interval when write exceeds quota
+const sweepInterval = time.Second
+
+var (
+	ErrRateLimited = errors.New("namespace request rate limit exceeded")
+	ErrQuota       = errors.New("namespace quota exceeded")
+)
+
+// Quota limits namespace, zero fields are unlimited
+//
+// Keys and bytes are checked before writes against usage of
+// namespace, so concurrent writes could exceed them a little.
+type Quota struct {
+	MaxKeys  int     `json:"max_keys"`
+	MaxBytes int64   `json:"max_bytes"`
+	RPS      float64 `json:"rps"`
+
+	// Burst of requests over RPS, RPS is used if it is zero
+	Burst int `json:"burst,omitempty"`
+}
+
+// Stats of namespace with its quota
+type Stats struct {
+	db.Stats
+
+	Quota    *Quota `json:"quota,omitempty"`
+	Limited  int64  `json:"rate_limited"`
+	Rejected int64  `json:"quota_rejected"`
+}
+
+// Keeps quota state of one namespace
+type limiter struct {
+	mu    sync.Mutex
+	quota Quota
+
+	// Token bucket
+	tokens float64
+	last   time.Time
+
+	// Atomic counters of rejected requests and
+	// unix time of the last removal of expired keys
+	limited  int64
+	rejected int64
+	swept    int64
+}
+
+// SetQuota sets quota of namespace, it is created if it is missing
+func (s *Set) SetQuota(name string, q Quota) error {
+	if _, err := s.Get(name); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.limits == nil {
+		s.limits = make(map[string]*limiter)
+	}
+	s.limits[name] = &limiter{
+		quota:  q,
+		tokens: float64(q.burst()),
+		last:   time.Now(),
+	}
+
+	return nil
+}
+
+// Quota returns quota of namespace and false if it is unlimited
+func (s *Set) Quota(name string) (Quota, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	l, ok := s.limits[name]
+	if !ok {
+		return Quota{}, false
+	}
+
+	return l.quota, true
+}
+
+// Allow checks request to namespace against its quota
+//
+// Size is length of written data or negative if request
+// does not write, written key which exists is not counted.
+// If replace is set value of key is replaced by data, so
+// only difference with current value is counted.
+// ErrRateLimited is returned if request rate is exceeded and
+// ErrQuota if write exceeds keys or bytes.
+func (s *Set) Allow(name, key string, size int, replace bool) error {
+	s.mu.RLock()
+	l, ok := s.limits[name]
+	d := s.dbs[name]
+	s.mu.RUnlock()
+
+	if !ok {
+		return nil
+	}
+
+	if !l.take() {
+		atomic.AddInt64(&l.limited, 1)
+		return ErrRateLimited
+	}
+
+	if size < 0 || (l.quota.MaxKeys == 0 && l.quota.MaxBytes == 0) {
+		return nil
+	}
+
+	keys, bytes := 1, int64(size)
+	if old, err := d.Size(key); err == nil {
+		keys = 0
+		if replace {
+			bytes -= old - int64(len(key))
+		}
+	}
+
+	// Expired keys are counted until removal, so they
+	// are removed before rejection
+	if l.over(d, keys, bytes) && (!l.sweep(d) || l.over(d, keys, bytes)) {
+		atomic.AddInt64(&l.rejected, 1)
+		return ErrQuota
+	}
+
+	return nil
+}
+
+// Takes token for request, returns false if there is no one
+func (l *limiter) take() bool {
+	if l.quota.RPS <= 0 {
+		return true
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.quota.RPS
+	if burst := float64(l.quota.burst()); l.tokens > burst {
+		l.tokens = burst
+	}
+	l.last = now
+
+	if l.tokens < 1 {
+		return false
+	}
+	l.tokens--
+
+	return true
+}
+
+// Checks usage of d with new write exceeds quota
+func (l *limiter) over(d *db.DB, keys int, bytes int64) bool {
+	st := d.Stats()
+
+	if l.quota.MaxKeys > 0 && st.Keys+keys > l.quota.MaxKeys {
+		return true
+	}
+	if l.quota.MaxBytes > 0 && st.Bytes+bytes > l.quota.MaxBytes {
+		return true
+	}
+
+	return false
+}
+
+// Removes expired keys of d not more often than sweepInterval,
+// returns false if they were removed recently
+func (l *limiter) sweep(d *db.DB) bool {
+	now := time.Now().UnixNano()
+	last := atomic.LoadInt64(&l.swept)
+	if now-last < int64(sweepInterval) || !atomic.CompareAndSwapInt64(&l.swept, last, now) {
+		return false
+	}
+
+	d.RemoveExpired()
+
+	return true
+}
+
+func (q Quota) burst() int {
+	if q.Burst > 0 {
+		return q.Burst
+	}
+	if q.RPS < 1 {
+		return 1
+	}
+
+	return int(q.RPS)
+}
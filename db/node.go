@@ -1,6 +1,10 @@
 package db
 
-import "time"
+import (
+	"bufio"
+	"bytes"
+	"time"
+)
 
 type Type int
 
@@ -8,8 +12,36 @@ const (
 	TypeHash Type = iota
 	TypeList
 	TypeDict
+	TypeStream
+	TypeHLL
+	TypeBloom
+	TypeGeo
+	TypeJSON
 )
 
+func (t Type) String() string {
+	switch t {
+	case TypeHash:
+		return "hash"
+	case TypeList:
+		return "list"
+	case TypeDict:
+		return "dict"
+	case TypeStream:
+		return "stream"
+	case TypeHLL:
+		return "hll"
+	case TypeBloom:
+		return "bloom"
+	case TypeGeo:
+		return "geo"
+	case TypeJSON:
+		return "json"
+	}
+
+	return "unknown"
+}
+
 type node struct {
 	// Actual key and hash based on key
 	key  string
@@ -17,13 +49,52 @@ type node struct {
 
 	// Different types for reducing allocations
 	value []byte
-	list  []string
-	dict  map[string]string
+	list  []Value
+	dict  map[string]Value
+
+	// Value is not shared with writer, so it could be changed in place
+	owned bool
+
+	// Values of other types
+	obj object
+
+	// Large hash values written by stream, chunks
+	// are never modified in place after saving
+	chunks [][]byte
+
+	// Chunks are compressed, size keeps raw length
+	packed bool
+	size   int
 
 	// Meta
-	exp  int
-	tipe Type
-	next *node
+	exp     int64  // unix time in seconds, zero if key does not expire
+	version uint64 // changes on every write
+	tipe    Type
+	next    *node
+}
+
+// Value of type which is not hash, list or dict
+type object interface {
+	tipe() Type
+
+	// Returns deep copy
+	clone() object
+
+	// Writes snapshot payload
+	encode(w *bufio.Writer)
+
+	// Returns approximate size in bytes, it should be cheap
+	// as it is called on every change
+	size() int64
+}
+
+// Returns expiration time for ttl in seconds
+func expiry(ttl *int) int64 {
+	if ttl == nil {
+		return 0
+	}
+
+	return time.Now().Unix() + int64(*ttl)
 }
 
 func (n *node) isAlive() bool {
@@ -31,9 +102,162 @@ func (n *node) isAlive() bool {
 		return false
 	}
 
-	if n.exp == 0 || n.exp > time.Now().Second() {
+	if n.exp == 0 || n.exp > time.Now().Unix() {
 		return true
 	}
 
 	return false
 }
+
+// Returns approximate size of key and value in bytes,
+// values of other types could be left in node, so only
+// value of its type is measured
+func (n *node) footprint() int64 {
+	size := int64(len(n.key))
+
+	switch n.tipe {
+	case TypeHash:
+		size += int64(len(n.value))
+		for _, c := range n.chunks {
+			size += int64(len(c))
+		}
+	case TypeList:
+		for _, v := range n.list {
+			size += v.footprint()
+		}
+	case TypeDict:
+		for k, v := range n.dict {
+			size += int64(len(k)) + v.footprint()
+		}
+	default:
+		if n.obj != nil {
+			size += n.obj.size()
+		}
+	}
+
+	return size
+}
+
+// Sets value and type of node
+func (n *node) set(val interface{}) error {
+	switch t := val.(type) {
+	case []byte:
+		n.value = t
+		n.owned = false
+		n.chunks = nil
+		n.packed = false
+		n.tipe = TypeHash
+	case [][]byte:
+		n.value = nil
+		n.chunks = t
+		n.packed = false
+		n.tipe = TypeHash
+	case packed:
+		n.value = nil
+		n.chunks = t.chunks
+		n.packed = true
+		n.size = t.size
+		n.tipe = TypeHash
+	case []string:
+		n.list = Strings(t)
+		n.tipe = TypeList
+	case map[string]string:
+		n.dict = StringDict(t)
+		n.tipe = TypeDict
+	case []Value:
+		n.list = t
+		n.tipe = TypeList
+	case map[string]Value:
+		n.dict = t
+		n.tipe = TypeDict
+	case object:
+		n.obj = t
+		n.tipe = t.tipe()
+	default:
+		return ErrInvalidType
+	}
+
+	return nil
+}
+
+// Returns hash value
+//
+// Chunked and compressed values are joined into new slice
+func (n *node) bytes() ([]byte, error) {
+	if n.packed {
+		return n.unpack()
+	}
+
+	switch len(n.chunks) {
+	case 0:
+		return n.value, nil
+	case 1:
+		return n.chunks[0], nil
+	}
+
+	return bytes.Join(n.chunks, nil), nil
+}
+
+// Returns copy of hash value
+func (n *node) copyBytes() ([]byte, error) {
+	if n.packed {
+		return n.unpack()
+	}
+
+	if n.chunks != nil {
+		return bytes.Join(n.chunks, nil), nil
+	}
+
+	val := make([]byte, len(n.value))
+	copy(val, n.value)
+
+	return val, nil
+}
+
+func (n *node) unpack() ([]byte, error) {
+	val := make([]byte, 0, n.size)
+	for _, c := range n.chunks {
+		d, err := unpackChunk(c)
+		if err != nil {
+			return nil, err
+		}
+		val = append(val, d...)
+	}
+
+	return val, nil
+}
+
+// Returns detached copy of node data
+//
+// Chunks are shared as they are never modified in place
+func (n *node) clone() *node {
+	c := &node{
+		key:     n.key,
+		hash:    n.hash,
+		exp:     n.exp,
+		version: n.version,
+		tipe:    n.tipe,
+		chunks:  n.chunks,
+		packed:  n.packed,
+		size:    n.size,
+	}
+
+	if n.value != nil {
+		c.value = append([]byte(nil), n.value...)
+		c.owned = true
+	}
+
+	if n.list != nil {
+		c.list = cloneValues(n.list)
+	}
+
+	if n.dict != nil {
+		c.dict = cloneDict(n.dict)
+	}
+
+	if n.obj != nil {
+		c.obj = n.obj.clone()
+	}
+
+	return c
+}
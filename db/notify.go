@@ -0,0 +1,254 @@
+package db
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/lukashes/db/glob"
+	"github.com/lukashes/db/pubsub"
+)
+
+// Period of scanning for expired keys while somebody listens
+const sweepInterval = time.Second
+
+// EventType is a kind of keyspace change
+type EventType uint8
+
+const (
+	EventSet EventType = iota + 1
+	EventDel
+	EventExpired
+
+	// Reserved, keys are never evicted yet
+	EventEvicted
+
+	// All keys are removed, key of event is empty
+	EventFlush
+)
+
+func (e EventType) String() string {
+	switch e {
+	case EventSet:
+		return "set"
+	case EventDel:
+		return "del"
+	case EventExpired:
+		return "expired"
+	case EventEvicted:
+		return "evicted"
+	case EventFlush:
+		return "flush"
+	}
+
+	return "unknown"
+}
+
+// Class is a set of event types to listen
+type Class uint8
+
+const (
+	ClassWrite Class = 1 << iota
+	ClassDelete
+	ClassExpire
+	ClassEvict
+
+	ClassAll = ClassWrite | ClassDelete | ClassExpire | ClassEvict
+)
+
+// ParseClass returns class by name: write, delete, expire, evict or all
+func ParseClass(s string) (Class, bool) {
+	switch s {
+	case "write":
+		return ClassWrite, true
+	case "delete":
+		return ClassDelete, true
+	case "expire":
+		return ClassExpire, true
+	case "evict":
+		return ClassEvict, true
+	case "all":
+		return ClassAll, true
+	}
+
+	return 0, false
+}
+
+func (e EventType) class() Class {
+	switch e {
+	case EventSet:
+		return ClassWrite
+	case EventDel, EventFlush:
+		return ClassDelete
+	case EventExpired:
+		return ClassExpire
+	case EventEvicted:
+		return ClassEvict
+	}
+
+	return 0
+}
+
+// Event describes change of one key
+type Event struct {
+	Type     EventType
+	Key      string
+	DataType Type
+}
+
+// Listener receives events from C until it is closed
+type Listener struct {
+	// C is closed when listener is closed
+	C <-chan Event
+	c chan Event
+
+	pattern string
+	classes Class
+	db      *DB
+
+	// Guarded by listeners lock
+	closed bool
+	err    error
+}
+
+type listeners struct {
+	mu  sync.RWMutex
+	set map[*Listener]bool
+
+	// Count of listeners for checking without lock
+	n int32
+
+	// Set while expiry sweeper works
+	sweeping int32
+}
+
+// Notify returns listener of events of keys matching glob pattern
+//
+// Listener has bounded buffer and is closed with
+// pubsub.ErrSlowConsumer if it does not keep up.
+// Flush events match any pattern. While somebody listens,
+// expired keys are removed in background to report them.
+func (db *DB) Notify(pattern string, classes Class) *Listener {
+	c := make(chan Event, pubsub.DefaultBuffer)
+	l := &Listener{
+		C:       c,
+		c:       c,
+		pattern: pattern,
+		classes: classes,
+		db:      db,
+	}
+
+	ls := &db.listeners
+	ls.mu.Lock()
+	if ls.set == nil {
+		ls.set = make(map[*Listener]bool)
+	}
+	ls.set[l] = true
+	atomic.AddInt32(&ls.n, 1)
+	ls.mu.Unlock()
+
+	if atomic.CompareAndSwapInt32(&ls.sweeping, 0, 1) {
+		go db.sweep()
+	}
+
+	return l
+}
+
+// Close stops delivery and closes C
+func (l *Listener) Close() {
+	l.db.unlisten(l, pubsub.ErrClosed)
+}
+
+// Err returns reason why listener was closed
+func (l *Listener) Err() error {
+	l.db.listeners.mu.RLock()
+	defer l.db.listeners.mu.RUnlock()
+
+	return l.err
+}
+
+func (db *DB) unlisten(l *Listener, err error) {
+	ls := &db.listeners
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+
+	if l.closed {
+		return
+	}
+
+	delete(ls.set, l)
+	atomic.AddInt32(&ls.n, -1)
+
+	l.closed = true
+	l.err = err
+	close(l.c)
+}
+
+// Sends event to listeners, it never blocks
+func (db *DB) event(t EventType, key string, dt Type) {
+	ls := &db.listeners
+	if atomic.LoadInt32(&ls.n) == 0 {
+		return
+	}
+
+	e := Event{Type: t, Key: key, DataType: dt}
+
+	var slow []*Listener
+
+	ls.mu.RLock()
+	for l := range ls.set {
+		if l.classes&t.class() == 0 {
+			continue
+		}
+		if t != EventFlush && !glob.Match(l.pattern, key) {
+			continue
+		}
+
+		select {
+		case l.c <- e:
+		default:
+			slow = append(slow, l)
+		}
+	}
+	ls.mu.RUnlock()
+
+	for _, l := range slow {
+		db.unlisten(l, pubsub.ErrSlowConsumer)
+	}
+}
+
+// RemoveExpired removes expired keys, they are counted
+// in stats until removal
+//
+// Keys are removed periodically only while there are
+// listeners of events, otherwise they are just not visible.
+func (db *DB) RemoveExpired() {
+	for _, s := range []*store{db.head(), db.tail()} {
+		if s == nil {
+			continue
+		}
+		for _, b := range s.buckets {
+			b.expire(db)
+		}
+	}
+}
+
+// Removes expired keys and reports them until
+// the last listener is closed
+func (db *DB) sweep() {
+	t := time.NewTicker(sweepInterval)
+	defer t.Stop()
+
+	for range t.C {
+		if atomic.LoadInt32(&db.listeners.n) == 0 {
+			atomic.StoreInt32(&db.listeners.sweeping, 0)
+
+			// Listener could come after the check
+			if atomic.LoadInt32(&db.listeners.n) == 0 || !atomic.CompareAndSwapInt32(&db.listeners.sweeping, 0, 1) {
+				return
+			}
+		}
+
+		db.RemoveExpired()
+	}
+}
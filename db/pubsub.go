@@ -0,0 +1,31 @@
+package db
+
+import (
+	"github.com/lukashes/db/pubsub"
+)
+
+// WithPubSub sets buffer size of subscribers and
+// policy for subscribers which do not keep up
+func WithPubSub(buffer int, policy pubsub.Policy) Option {
+	return func(db *DB) {
+		db.pubsub = pubsub.New(buffer, policy)
+	}
+}
+
+// Publish sends msg to subscribers of channel and returns
+// count of receivers
+//
+// Channels are not keys, publishing is allowed in read only mode.
+func (db *DB) Publish(channel string, msg []byte) int {
+	return db.pubsub.Publish(channel, msg)
+}
+
+// Subscribe creates subscription to channels
+func (db *DB) Subscribe(channels ...string) *pubsub.Subscription {
+	return db.pubsub.Subscribe(channels...)
+}
+
+// PSubscribe creates subscription to channels matching patterns
+func (db *DB) PSubscribe(patterns ...string) *pubsub.Subscription {
+	return db.pubsub.PSubscribe(patterns...)
+}
@@ -0,0 +1,617 @@
+package db
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"math"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/lukashes/db/script"
+)
+
+// Default limit of script execution time
+const DefaultScriptTimeout = 5 * time.Second
+
+// Limit of nested tables in script values
+const maxScriptDepth = 64
+
+// Compiled scripts by SHA1 of source
+type scripts struct {
+	mu    sync.RWMutex
+	progs map[string]*script.Program
+}
+
+// WithScriptTimeout sets limit of script execution time
+func WithScriptTimeout(d time.Duration) Option {
+	return func(db *DB) {
+		db.scriptTimeout = d
+	}
+}
+
+// ScriptLoad compiles script and keeps it in cache,
+// returns SHA1 of source for EvalSHA
+func (db *DB) ScriptLoad(src string) (string, error) {
+	sum := sha1.Sum([]byte(src))
+	sha := hex.EncodeToString(sum[:])
+
+	db.scripts.mu.RLock()
+	_, ok := db.scripts.progs[sha]
+	db.scripts.mu.RUnlock()
+	if ok {
+		return sha, nil
+	}
+
+	p, err := script.Compile(src)
+	if err != nil {
+		return "", err
+	}
+
+	db.scripts.mu.Lock()
+	if db.scripts.progs == nil {
+		db.scripts.progs = make(map[string]*script.Program)
+	}
+	db.scripts.progs[sha] = p
+	db.scripts.mu.Unlock()
+
+	return sha, nil
+}
+
+// ScriptFlush removes all cached scripts
+func (db *DB) ScriptFlush() {
+	db.scripts.mu.Lock()
+	db.scripts.progs = nil
+	db.scripts.mu.Unlock()
+}
+
+// Eval runs script with keys and args, script is cached
+//
+// Script could access only given keys through db table, they
+// are in KEYS and args are in ARGV. Other writers of the keys
+// wait until script ends and scripts run one by one. Writes are
+// applied only when script succeeds, all of them at once.
+// Result is the first returned value: nil, bool, int64, float64,
+// string, []interface{} or map[string]interface{}.
+func (db *DB) Eval(src string, keys, args []string) (interface{}, error) {
+	sha, err := db.ScriptLoad(src)
+	if err != nil {
+		return nil, err
+	}
+
+	return db.EvalSHA(sha, keys, args)
+}
+
+// EvalSHA runs cached script, see Eval
+func (db *DB) EvalSHA(sha string, keys, args []string) (interface{}, error) {
+	db.scripts.mu.RLock()
+	p, ok := db.scripts.progs[sha]
+	db.scripts.mu.RUnlock()
+	if !ok {
+		return nil, ErrNoScript
+	}
+
+	for _, k := range keys {
+		if k == "" {
+			return nil, ErrEmptyKey
+		}
+	}
+
+	// Growing is suspended, so all keys are in the head
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	tx := &scriptTx{
+		db:     db,
+		store:  db.head(),
+		keys:   make(map[string]bool, len(keys)),
+		staged: make(map[string]*staged),
+	}
+
+	// Buckets are locked in order, so scripts never deadlock
+	// with each other or with writers holding one bucket
+	var buckets []int
+	locked := make(map[int]bool)
+	for _, k := range keys {
+		tx.keys[k] = true
+		i := int(hash([]byte(k), seed) & tx.store.mask)
+		if !locked[i] {
+			locked[i] = true
+			buckets = append(buckets, i)
+		}
+	}
+	sort.Ints(buckets)
+	for _, i := range buckets {
+		tx.store.buckets[i].mu.Lock()
+		defer tx.store.buckets[i].mu.Unlock()
+	}
+
+	timeout := db.scriptTimeout
+	if timeout <= 0 {
+		timeout = DefaultScriptTimeout
+	}
+
+	g := script.NewGlobals()
+	g.Set("KEYS", scriptStrings(keys))
+	g.Set("ARGV", scriptStrings(args))
+	g.Set("db", tx.library())
+
+	res, err := p.Run(g, timeout)
+	switch {
+	case tx.err != nil:
+		return nil, tx.err
+	case err == script.ErrTimeout:
+		return nil, ErrTimeout
+	case err != nil:
+		return nil, err
+	}
+
+	var v interface{}
+	if len(res) > 0 {
+		if v, err = scriptResult(res[0], 0); err != nil {
+			return nil, err
+		}
+	}
+
+	tx.commit()
+
+	return v, nil
+}
+
+// Keys of script with changes which are not applied yet
+type scriptTx struct {
+	db    *DB
+	store *store
+	keys  map[string]bool
+
+	staged map[string]*staged
+	order  []string
+
+	// Error of DB which stopped script
+	err error
+}
+
+type staged struct {
+	del bool
+	val interface{}
+	exp int64
+}
+
+// Value of key as seen by script
+type view struct {
+	tipe Type
+	hash []byte
+	list []Value
+	dict map[string]Value
+	exp  int64
+}
+
+func (tx *scriptTx) fail(err error) ([]interface{}, error) {
+	tx.err = err
+	return nil, err
+}
+
+func (tx *scriptTx) bucket(key string) (*bucket, uint32) {
+	h := hash([]byte(key), seed)
+	return tx.store.buckets[h&tx.store.mask], h
+}
+
+// Returns value of declared key, staged change goes first
+func (tx *scriptTx) get(key string) (*view, error) {
+	if !tx.keys[key] {
+		return nil, ErrUndeclaredKey
+	}
+
+	if s, ok := tx.staged[key]; ok {
+		if s.del {
+			return nil, nil
+		}
+		v := &view{exp: s.exp}
+		switch t := s.val.(type) {
+		case []byte:
+			v.tipe, v.hash = TypeHash, t
+		case []Value:
+			v.tipe, v.list = TypeList, t
+		case map[string]Value:
+			v.tipe, v.dict = TypeDict, t
+		}
+		return v, nil
+	}
+
+	b, _ := tx.bucket(key)
+	n, found := b.find(key)
+	if !found || !n.isAlive() {
+		return nil, nil
+	}
+
+	v := &view{tipe: n.tipe, list: n.list, dict: n.dict, exp: n.exp}
+	if n.tipe == TypeHash {
+		val, err := n.bytes()
+		if err != nil {
+			return nil, err
+		}
+		v.hash = val
+	}
+
+	return v, nil
+}
+
+func (tx *scriptTx) set(key string, s *staged) error {
+	if !tx.keys[key] {
+		return ErrUndeclaredKey
+	}
+	if err := tx.db.writable(key); err != nil {
+		return err
+	}
+
+	if _, ok := tx.staged[key]; !ok {
+		tx.order = append(tx.order, key)
+	}
+	tx.staged[key] = s
+
+	return nil
+}
+
+// Applies staged changes in order of first change
+func (tx *scriptTx) commit() {
+	for _, key := range tx.order {
+		s := tx.staged[key]
+		b, h := tx.bucket(key)
+		if s.del {
+			b.remove(tx.db, key)
+			continue
+		}
+
+		val := s.val
+		if v, ok := val.([]byte); ok {
+			val = tx.db.pack(v)
+		}
+		if err := b.put(tx.db, key, h, val, s.exp); err == nil {
+			tx.store.added(tx.db)
+		}
+	}
+}
+
+// Functions of db table available to scripts
+func (tx *scriptTx) library() *script.Table {
+	lib := script.NewTable()
+
+	fns := map[string]func(key string, args []interface{}) ([]interface{}, error){
+		"get": func(key string, _ []interface{}) ([]interface{}, error) {
+			v, err := tx.get(key)
+			if err != nil {
+				return tx.fail(err)
+			}
+			if v == nil {
+				return []interface{}{nil}, nil
+			}
+			if v.tipe != TypeHash {
+				return tx.fail(ErrInvalidType)
+			}
+			return []interface{}{string(v.hash)}, nil
+		},
+		"set": func(key string, args []interface{}) ([]interface{}, error) {
+			val, ok := scriptText(scriptArg(args, 0))
+			if !ok {
+				return nil, &script.Error{Msg: "string or number expected"}
+			}
+			exp, err := scriptExpiry(args, 1)
+			if err != nil {
+				return nil, err
+			}
+			if err := tx.set(key, &staged{val: []byte(val), exp: exp}); err != nil {
+				return tx.fail(err)
+			}
+			return nil, nil
+		},
+		"del": func(key string, _ []interface{}) ([]interface{}, error) {
+			v, err := tx.get(key)
+			if err != nil {
+				return tx.fail(err)
+			}
+			if v != nil {
+				if err := tx.set(key, &staged{del: true}); err != nil {
+					return tx.fail(err)
+				}
+			}
+			return []interface{}{v != nil}, nil
+		},
+		"exists": func(key string, _ []interface{}) ([]interface{}, error) {
+			v, err := tx.get(key)
+			if err != nil {
+				return tx.fail(err)
+			}
+			return []interface{}{v != nil}, nil
+		},
+		"type": func(key string, _ []interface{}) ([]interface{}, error) {
+			v, err := tx.get(key)
+			if err != nil {
+				return tx.fail(err)
+			}
+			if v == nil {
+				return []interface{}{nil}, nil
+			}
+			return []interface{}{v.tipe.String()}, nil
+		},
+		// Missing key is zero, expiration of key is kept
+		"incrby": func(key string, args []interface{}) ([]interface{}, error) {
+			by, ok := scriptArg(args, 0).(float64)
+			if !ok || by != math.Trunc(by) {
+				return nil, &script.Error{Msg: "integer expected"}
+			}
+			v, err := tx.get(key)
+			if err != nil {
+				return tx.fail(err)
+			}
+			var n, exp int64
+			if v != nil {
+				if v.tipe != TypeHash {
+					return tx.fail(ErrInvalidType)
+				}
+				if n, err = strconv.ParseInt(string(v.hash), 10, 64); err != nil {
+					return nil, &script.Error{Msg: "value is not an integer"}
+				}
+				exp = v.exp
+			}
+			n += int64(by)
+			if err := tx.set(key, &staged{val: []byte(strconv.FormatInt(n, 10)), exp: exp}); err != nil {
+				return tx.fail(err)
+			}
+			return []interface{}{float64(n)}, nil
+		},
+		"lget": func(key string, _ []interface{}) ([]interface{}, error) {
+			v, err := tx.get(key)
+			if err != nil {
+				return tx.fail(err)
+			}
+			if v == nil {
+				return []interface{}{nil}, nil
+			}
+			if v.tipe != TypeList {
+				return tx.fail(ErrInvalidType)
+			}
+			return []interface{}{toScript(List(v.list...))}, nil
+		},
+		"lset": func(key string, args []interface{}) ([]interface{}, error) {
+			t, ok := scriptArg(args, 0).(*script.Table)
+			if !ok {
+				return nil, &script.Error{Msg: "table expected"}
+			}
+			l, err := scriptList(t, 0)
+			if err != nil {
+				return nil, err
+			}
+			exp, err := scriptExpiry(args, 1)
+			if err != nil {
+				return nil, err
+			}
+			if err := tx.set(key, &staged{val: l, exp: exp}); err != nil {
+				return tx.fail(err)
+			}
+			return nil, nil
+		},
+		"dget": func(key string, _ []interface{}) ([]interface{}, error) {
+			v, err := tx.get(key)
+			if err != nil {
+				return tx.fail(err)
+			}
+			if v == nil {
+				return []interface{}{nil}, nil
+			}
+			if v.tipe != TypeDict {
+				return tx.fail(ErrInvalidType)
+			}
+			return []interface{}{toScript(Dict(v.dict))}, nil
+		},
+		"dset": func(key string, args []interface{}) ([]interface{}, error) {
+			t, ok := scriptArg(args, 0).(*script.Table)
+			if !ok {
+				return nil, &script.Error{Msg: "table expected"}
+			}
+			d, err := scriptDict(t, 0)
+			if err != nil {
+				return nil, err
+			}
+			exp, err := scriptExpiry(args, 1)
+			if err != nil {
+				return nil, err
+			}
+			if err := tx.set(key, &staged{val: d, exp: exp}); err != nil {
+				return tx.fail(err)
+			}
+			return nil, nil
+		},
+	}
+
+	for name, fn := range fns {
+		fn := fn
+		lib.Set(name, &script.Function{Name: name, Fn: func(args []interface{}) ([]interface{}, error) {
+			key, ok := scriptArg(args, 0).(string)
+			if !ok {
+				return nil, &script.Error{Msg: "key expected"}
+			}
+			return fn(key, args[1:])
+		}})
+	}
+
+	return lib
+}
+
+func scriptArg(args []interface{}, i int) interface{} {
+	if i < len(args) {
+		return args[i]
+	}
+
+	return nil
+}
+
+// Returns expiration for optional ttl in seconds
+func scriptExpiry(args []interface{}, i int) (int64, error) {
+	v := scriptArg(args, i)
+	if v == nil {
+		return 0, nil
+	}
+
+	f, ok := v.(float64)
+	if !ok || f != math.Trunc(f) || f > math.MaxInt32 || f < math.MinInt32 {
+		return 0, &script.Error{Msg: "ttl should be integer"}
+	}
+	ttl := int(f)
+
+	return expiry(&ttl), nil
+}
+
+func scriptText(v interface{}) (string, bool) {
+	switch v := v.(type) {
+	case string:
+		return v, true
+	case float64:
+		return script.ToString(v), true
+	}
+
+	return "", false
+}
+
+func scriptStrings(s []string) *script.Table {
+	t := script.NewTable()
+	for _, v := range s {
+		t.Append(v)
+	}
+
+	return t
+}
+
+// Numbers of script are float64, so large integers lose precision
+func toScript(v Value) interface{} {
+	switch v.kind {
+	case KindInt:
+		return float64(v.Int())
+	case KindFloat:
+		return v.Float()
+	case KindList:
+		t := script.NewTable()
+		for _, e := range v.list {
+			t.Append(toScript(e))
+		}
+		return t
+	case KindDict:
+		t := script.NewTable()
+		for k, e := range v.dict {
+			t.Set(k, toScript(e))
+		}
+		return t
+	}
+
+	return v.s
+}
+
+// Integral numbers become Int, tables without keys
+// besides array part become lists, others become dicts
+func fromScript(v interface{}, depth int) (Value, error) {
+	if depth > maxScriptDepth {
+		return Value{}, &script.Error{Msg: "too deep nesting of tables"}
+	}
+
+	switch v := v.(type) {
+	case string:
+		return String(v), nil
+	case float64:
+		if v == math.Trunc(v) && math.Abs(v) < 1<<63 {
+			return Int(int64(v)), nil
+		}
+		return Float(v), nil
+	case *script.Table:
+		if isArray(v) {
+			l, err := scriptList(v, depth+1)
+			return List(l...), err
+		}
+		d, err := scriptDict(v, depth+1)
+		return Dict(d), err
+	}
+
+	return Value{}, &script.Error{Msg: "value of this type could not be stored"}
+}
+
+func isArray(t *script.Table) bool {
+	n := 0
+	t.Range(func(k, v interface{}) bool {
+		n++
+		return true
+	})
+
+	return n == t.Len()
+}
+
+func scriptList(t *script.Table, depth int) ([]Value, error) {
+	if !isArray(t) {
+		return nil, &script.Error{Msg: "list should have only consecutive integer keys"}
+	}
+
+	l := make([]Value, 0, t.Len())
+	for i := 1; i <= t.Len(); i++ {
+		v, err := fromScript(t.Get(float64(i)), depth)
+		if err != nil {
+			return nil, err
+		}
+		l = append(l, v)
+	}
+
+	return l, nil
+}
+
+func scriptDict(t *script.Table, depth int) (map[string]Value, error) {
+	d := make(map[string]Value)
+
+	var err error
+	t.Range(func(k, v interface{}) bool {
+		key, ok := scriptText(k)
+		if !ok {
+			err = &script.Error{Msg: "dict keys should be strings"}
+			return false
+		}
+		d[key], err = fromScript(v, depth)
+		return err == nil
+	})
+
+	return d, err
+}
+
+// Converts value returned by script to Go value
+func scriptResult(v interface{}, depth int) (interface{}, error) {
+	if depth > maxScriptDepth {
+		return nil, &script.Error{Msg: "too deep nesting of tables"}
+	}
+
+	switch v := v.(type) {
+	case nil, bool, string:
+		return v, nil
+	case float64:
+		if v == math.Trunc(v) && math.Abs(v) < 1<<63 {
+			return int64(v), nil
+		}
+		return v, nil
+	case *script.Table:
+		if isArray(v) {
+			l := make([]interface{}, 0, v.Len())
+			for i := 1; i <= v.Len(); i++ {
+				e, err := scriptResult(v.Get(float64(i)), depth+1)
+				if err != nil {
+					return nil, err
+				}
+				l = append(l, e)
+			}
+			return l, nil
+		}
+
+		m := make(map[string]interface{})
+		var err error
+		v.Range(func(k, e interface{}) bool {
+			m[script.ToString(k)], err = scriptResult(e, depth+1)
+			return err == nil
+		})
+		return m, err
+	}
+
+	return nil, &script.Error{Msg: "function could not be returned"}
+}
@@ -0,0 +1,330 @@
+package db
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"strings"
+	"time"
+)
+
+// Snapshot format:
+//
+//	magic "LDBS", version byte
+//	records: type byte, exp varint, key, payload
+//	end byte
+//
+// Strings and bytes are prefixed with uvarint length,
+// hash payload is raw value, list payload is count of
+// items and items, dict payload is count and key value pairs.
+// Items are tagged values since version 2 and strings before.
+// Payloads of other types are described by their encoders.
+const (
+	snapshotMagic   = "LDBS"
+	snapshotVersion = 2
+
+	recordEnd = 0xff
+
+	maxPrealloc = 1024 // do not trust counts from snapshot too much
+)
+
+// Snapshot writes all alive keys to w
+//
+// Every bucket is captured under its own lock, so it is not
+// a point in time copy: concurrent writes could be included
+// or not. Growing is suspended while snapshot is written.
+func (db *DB) Snapshot(w io.Writer) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	bw := bufio.NewWriter(w)
+
+	bw.WriteString(snapshotMagic)
+	bw.WriteByte(snapshotVersion)
+
+	for _, b := range db.head().buckets {
+		for _, n := range b.clone() {
+			if err := writeNode(bw, n); err != nil {
+				return err
+			}
+		}
+	}
+
+	bw.WriteByte(recordEnd)
+
+	return bw.Flush()
+}
+
+// SnapshotAt writes all alive keys to w as they are at one
+// point in time, mark is called at this point
+//
+// All buckets are locked while keys are copied and mark is
+// called, so mark sees every mutation included in snapshot
+// and no other. Unlike Snapshot it keeps copy of the whole
+// keyspace in memory until it is written.
+func (db *DB) SnapshotAt(w io.Writer, mark func()) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	// Buckets are locked in order, as scripts do
+	buckets := db.head().buckets
+	for _, b := range buckets {
+		b.mu.RLock()
+	}
+	mark()
+	nodes := make([][]*node, len(buckets))
+	for i, b := range buckets {
+		nodes[i] = b.alive()
+		b.mu.RUnlock()
+	}
+
+	bw := bufio.NewWriter(w)
+
+	bw.WriteString(snapshotMagic)
+	bw.WriteByte(snapshotVersion)
+
+	for i := range nodes {
+		for _, n := range nodes[i] {
+			if err := writeNode(bw, n); err != nil {
+				return err
+			}
+		}
+		nodes[i] = nil
+	}
+
+	bw.WriteByte(recordEnd)
+
+	return bw.Flush()
+}
+
+// Restore loads keys from snapshot
+//
+// Existing keys are rewritten, other keys stay untouched.
+// Expired keys are skipped.
+func (db *DB) Restore(r io.Reader) error {
+	br := bufio.NewReader(r)
+
+	header := make([]byte, len(snapshotMagic)+1)
+	if _, err := io.ReadFull(br, header); err != nil {
+		return ErrCorrupted
+	}
+	version := header[len(snapshotMagic)]
+	if string(header[:len(snapshotMagic)]) != snapshotMagic || version < 1 || version > snapshotVersion {
+		return ErrCorrupted
+	}
+
+	now := time.Now().Unix()
+	for {
+		key, exp, val, err := db.readNode(br, version)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		if exp != 0 && exp <= now {
+			continue
+		}
+
+		if err := db.head().write(db, key, val, exp); err != nil {
+			return err
+		}
+	}
+}
+
+func writeNode(w *bufio.Writer, n *node) error {
+	w.WriteByte(byte(n.tipe))
+	writeVarint(w, n.exp)
+	writeString(w, n.key)
+
+	switch n.tipe {
+	case TypeHash:
+		return writeHash(w, n)
+	case TypeList:
+		writeValues(w, n.list)
+	case TypeDict:
+		writeValueDict(w, n.dict)
+	default:
+		if n.obj == nil {
+			return ErrInvalidType
+		}
+		n.obj.encode(w)
+	}
+
+	return nil
+}
+
+// Writes hash value chunk by chunk
+func writeHash(w *bufio.Writer, n *node) error {
+	switch {
+	case n.packed:
+		writeUvarint(w, uint64(n.size))
+		for _, c := range n.chunks {
+			d, err := unpackChunk(c)
+			if err != nil {
+				return err
+			}
+			w.Write(d)
+		}
+	case n.chunks != nil:
+		size := 0
+		for _, c := range n.chunks {
+			size += len(c)
+		}
+		writeUvarint(w, uint64(size))
+		for _, c := range n.chunks {
+			w.Write(c)
+		}
+	default:
+		writeUvarint(w, uint64(len(n.value)))
+		w.Write(n.value)
+	}
+
+	return nil
+}
+
+// Returns io.EOF at the end record
+func (db *DB) readNode(r *bufio.Reader, version byte) (key string, exp int64, val interface{}, err error) {
+	t, err := r.ReadByte()
+	if err != nil {
+		return "", 0, nil, ErrCorrupted
+	}
+	if t == recordEnd {
+		return "", 0, nil, io.EOF
+	}
+
+	if exp, err = binary.ReadVarint(r); err != nil {
+		return "", 0, nil, ErrCorrupted
+	}
+	if key, err = readString(r); err != nil {
+		return "", 0, nil, err
+	}
+
+	switch Type(t) {
+	case TypeHash:
+		size, err := binary.ReadUvarint(r)
+		if err != nil {
+			return "", 0, nil, ErrCorrupted
+		}
+		lr := &io.LimitedReader{R: r, N: int64(size)}
+		if val, err = db.readChunks(lr); err != nil {
+			return "", 0, nil, err
+		}
+		if lr.N != 0 {
+			return "", 0, nil, ErrCorrupted
+		}
+	case TypeList:
+		if version < 2 {
+			cnt, err := binary.ReadUvarint(r)
+			if err != nil {
+				return "", 0, nil, ErrCorrupted
+			}
+			list := make([]string, 0, prealloc(cnt))
+			for i := uint64(0); i < cnt; i++ {
+				v, err := readString(r)
+				if err != nil {
+					return "", 0, nil, err
+				}
+				list = append(list, v)
+			}
+			val = list
+		} else if val, err = readValues(r, 0); err != nil {
+			return "", 0, nil, err
+		}
+	case TypeDict:
+		if version < 2 {
+			val, err = readDict(r)
+		} else {
+			val, err = readValueDict(r, 0)
+		}
+		if err != nil {
+			return "", 0, nil, err
+		}
+	case TypeStream:
+		if val, err = decodeStream(r); err != nil {
+			return "", 0, nil, err
+		}
+	case TypeHLL:
+		if val, err = decodeHLL(r); err != nil {
+			return "", 0, nil, err
+		}
+	case TypeBloom:
+		if val, err = decodeBloom(r); err != nil {
+			return "", 0, nil, err
+		}
+	case TypeGeo:
+		if val, err = decodeGeo(r); err != nil {
+			return "", 0, nil, err
+		}
+	case TypeJSON:
+		if val, err = decodeDocument(r); err != nil {
+			return "", 0, nil, err
+		}
+	default:
+		return "", 0, nil, ErrCorrupted
+	}
+
+	return key, exp, val, nil
+}
+
+func readDict(r *bufio.Reader) (map[string]string, error) {
+	cnt, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, ErrCorrupted
+	}
+
+	dict := make(map[string]string, prealloc(cnt))
+	for i := uint64(0); i < cnt; i++ {
+		k, err := readString(r)
+		if err != nil {
+			return nil, err
+		}
+		v, err := readString(r)
+		if err != nil {
+			return nil, err
+		}
+		dict[k] = v
+	}
+
+	return dict, nil
+}
+
+func prealloc(cnt uint64) int {
+	if cnt > maxPrealloc {
+		return maxPrealloc
+	}
+
+	return int(cnt)
+}
+
+func writeVarint(w *bufio.Writer, v int64) {
+	var b [binary.MaxVarintLen64]byte
+	w.Write(b[:binary.PutVarint(b[:], v)])
+}
+
+func writeUvarint(w *bufio.Writer, v uint64) {
+	var b [binary.MaxVarintLen64]byte
+	w.Write(b[:binary.PutUvarint(b[:], v)])
+}
+
+func writeString(w *bufio.Writer, s string) {
+	writeUvarint(w, uint64(len(s)))
+	w.WriteString(s)
+}
+
+func readString(r *bufio.Reader) (string, error) {
+	l, err := binary.ReadUvarint(r)
+	if err != nil {
+		return "", ErrCorrupted
+	}
+
+	// Buffer grows with data, so invalid length fails on EOF
+	var b strings.Builder
+	b.Grow(prealloc(l))
+	if _, err := io.CopyN(&b, r, int64(l)); err != nil {
+		return "", ErrCorrupted
+	}
+
+	return b.String(), nil
+}
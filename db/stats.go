@@ -0,0 +1,128 @@
+package db
+
+import "sync/atomic"
+
+// Stats is a snapshot of DB counters
+type Stats struct {
+	// Count of keys and approximate size of their keys and
+	// values in bytes, expired keys are counted until removal
+	Keys  int   `json:"keys"`
+	Bytes int64 `json:"bytes"`
+
+	// Count of stored compressed values, raw and
+	// compressed size of them in bytes
+	CompressedValues int64   `json:"compressed_values"`
+	RawBytes         int64   `json:"raw_bytes"`
+	CompressedBytes  int64   `json:"compressed_bytes"`
+	CompressionRatio float64 `json:"compression_ratio"`
+}
+
+// Stats returns current counters
+func (db *DB) Stats() Stats {
+	u := db.usage()
+
+	s := Stats{
+		Keys:             int(u.keys),
+		Bytes:            u.bytes,
+		CompressedValues: u.packed,
+		RawBytes:         u.raw,
+		CompressedBytes:  u.compressed,
+	}
+
+	if s.RawBytes > 0 {
+		s.CompressionRatio = float64(s.CompressedBytes) / float64(s.RawBytes)
+	}
+
+	return s
+}
+
+// Size returns approximate size of key and its value in bytes,
+// it is share of the key in Stats
+func (db *DB) Size(key string) (int64, error) {
+	var size int64
+	err := db.view(key, func(n *node) error {
+		size = n.usage().bytes
+		return nil
+	})
+
+	return size, err
+}
+
+// Count of keys and their approximate size, it is share of node
+// or counters of store which are changed atomically
+type usage struct {
+	keys  int64
+	bytes int64
+
+	// Compressed values, raw and compressed size of them
+	packed     int64
+	raw        int64
+	compressed int64
+}
+
+// Returns share of node, it is counted until it is marked as
+// deleted, so expired node is counted until it is removed
+func (n *node) usage() usage {
+	if n.exp == -1 {
+		return usage{}
+	}
+
+	u := usage{keys: 1, bytes: n.footprint()}
+	if n.packed && n.tipe == TypeHash {
+		u.packed, u.raw = 1, int64(n.size)
+		for _, c := range n.chunks {
+			u.compressed += int64(len(c))
+		}
+	}
+
+	return u
+}
+
+// Changes counters by difference of node share before and after change
+func (u *usage) add(before, after usage) {
+	for _, c := range []struct {
+		counter       *int64
+		before, after int64
+	}{
+		{&u.keys, before.keys, after.keys},
+		{&u.bytes, before.bytes, after.bytes},
+		{&u.packed, before.packed, after.packed},
+		{&u.raw, before.raw, after.raw},
+		{&u.compressed, before.compressed, after.compressed},
+	} {
+		if d := c.after - c.before; d != 0 {
+			atomic.AddInt64(c.counter, d)
+		}
+	}
+}
+
+func (u *usage) load() usage {
+	return usage{
+		keys:       atomic.LoadInt64(&u.keys),
+		bytes:      atomic.LoadInt64(&u.bytes),
+		packed:     atomic.LoadInt64(&u.packed),
+		raw:        atomic.LoadInt64(&u.raw),
+		compressed: atomic.LoadInt64(&u.compressed),
+	}
+}
+
+// Returns usage of head and tail which is not moved yet,
+// keys replaced in head are counted twice until growing ends
+func (db *DB) usage() usage {
+	for {
+		h, t := db.head(), db.tail()
+
+		// Moved node is added to the head before it is removed
+		// from the tail, so tail is read first to not miss it
+		var u usage
+		if t != nil && t != h {
+			u = t.used.load()
+		}
+		u.add(usage{}, h.used.load())
+
+		// Growing could start or end meanwhile
+		if db.head() == h && db.tail() == t {
+			return u
+		}
+	}
+}
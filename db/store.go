@@ -12,6 +12,9 @@ type store struct {
 	// Atomic counters
 	writes int32
 	nodes  int32
+
+	// Keys of the store, buckets change it
+	used usage
 }
 
 func newStore() *store {
@@ -22,23 +25,18 @@ func newStore() *store {
 	c.growThreshold = int32(growingSize * growingSize)
 
 	for k := range c.buckets {
-		c.buckets[k] = new(bucket)
+		c.buckets[k] = &bucket{used: &c.used}
 	}
 
 	return &c
 }
 
+// Deletes key, key of the tail is hidden by dead copy,
+// so growing does not move it back
 func (c *store) delete(db *DB, key string) error {
-	atomic.AddInt32(&c.writes, 1)
-	defer func() { atomic.AddInt32(&c.writes, -1) }()
-
-	h := hash([]byte(key), seed)
-	k := h & c.mask
-	b := c.buckets[k]
-
-	b.delete(key)
-
-	return nil
+	return c.update(db, key, nil, func(*node, bool) error {
+		return errRemove
+	})
 }
 
 func (c *store) keys() []string {
@@ -50,37 +48,86 @@ func (c *store) keys() []string {
 	return keys
 }
 
-func (c *store) write(db *DB, key string, val interface{}, ttl *int) error {
+func (c *store) write(db *DB, key string, val interface{}, exp int64) error {
+	return c.save(db, key, val, exp, (*bucket).save)
+}
+
+// Writes only if key does not exist
+func (c *store) insert(db *DB, key string, val interface{}, exp int64) error {
+	return c.save(db, key, val, exp, (*bucket).insert)
+}
+
+// Changes value of key in place, see bucket.update
+func (c *store) update(db *DB, key string, ch *change, fn func(n *node, exists bool) error) error {
+	err := c.save(db, key, nil, 0, func(b *bucket, db *DB, key string, hash uint32, _ interface{}, _ int64) error {
+		return b.update(db, key, hash, ch, fn)
+	})
+	if err == errRemove {
+		return nil
+	}
+
+	return err
+}
+
+func (c *store) save(db *DB, key string, val interface{}, exp int64, save func(b *bucket, db *DB, key string, hash uint32, val interface{}, exp int64) error) error {
 	atomic.AddInt32(&c.writes, 1)
+	defer func() { atomic.AddInt32(&c.writes, -1) }()
+
+	// Growing started after store was taken does not wait
+	// for the write, so it goes to the new head
+	if head := db.head(); head != c {
+		return head.save(db, key, val, exp, save)
+	}
 
 	h := hash([]byte(key), seed)
 	k := h & c.mask
 	b := c.buckets[k]
 
-	b.save(key, h, val, ttl)
+	if err := save(b, db, key, h, val, exp); err != nil {
+		return err
+	}
+
+	c.added(db)
 
+	return nil
+}
+
+// Counts saved node and schedules growing
+func (c *store) added(db *DB) {
 	if grow := atomic.AddInt32(&c.nodes, 1) >= c.growThreshold; grow {
-		db.once.Do(func() {
+		if atomic.CompareAndSwapInt32(&db.growing, 0, 1) {
 			go db.grow()
-		})
+		}
 	}
+}
 
-	atomic.AddInt32(&c.writes, -1)
-	return nil
+// Removes alive key and returns it encoded as snapshot record,
+// key of the tail is taken as by delete
+func (c *store) take(db *DB, key string) ([]byte, error) {
+	var data []byte
+	err := c.update(db, key, nil, func(n *node, exists bool) error {
+		if exists {
+			data = encodeNode(n)
+		}
+		return errRemove
+	})
+	if err != nil {
+		return nil, err
+	}
+	if data == nil {
+		return nil, ErrNotFound
+	}
+
+	return data, nil
 }
 
-func (c *store) read(key string) (*node, error) {
+func (c *store) view(key string, fn func(n *node) error) error {
 	k := hash([]byte(key), seed)
-	h := k & c.mask
-	b := c.buckets[h]
+	b := c.buckets[k&c.mask]
 
 	if b == nil {
-		return nil, ErrNotFound
-	}
-
-	if n := b.lookup(key); n != nil {
-		return n, nil
+		return ErrNotFound
 	}
 
-	return nil, ErrNotFound
+	return b.view(key, fn)
 }
@@ -0,0 +1,777 @@
+package db
+
+import (
+	"bufio"
+	"encoding/binary"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// StreamID is time ordered id of stream entry
+type StreamID struct {
+	Ms  uint64
+	Seq uint64
+}
+
+func (id StreamID) String() string {
+	return strconv.FormatUint(id.Ms, 10) + "-" + strconv.FormatUint(id.Seq, 10)
+}
+
+func (id StreamID) MarshalText() ([]byte, error) {
+	return []byte(id.String()), nil
+}
+
+func (id *StreamID) UnmarshalText(b []byte) error {
+	v, err := ParseStreamID(string(b))
+	if err != nil {
+		return err
+	}
+	*id = v
+
+	return nil
+}
+
+func (id StreamID) less(o StreamID) bool {
+	return id.Ms < o.Ms || id.Ms == o.Ms && id.Seq < o.Seq
+}
+
+// ParseStreamID parses "ms-seq", sequence is zero if omitted
+func ParseStreamID(s string) (StreamID, error) {
+	var (
+		id  StreamID
+		err error
+	)
+
+	ms, seq, ok := strings.Cut(s, "-")
+	if id.Ms, err = strconv.ParseUint(ms, 10, 64); err != nil {
+		return id, ErrInvalidID
+	}
+	if ok {
+		if id.Seq, err = strconv.ParseUint(seq, 10, 64); err != nil {
+			return id, ErrInvalidID
+		}
+	}
+
+	return id, nil
+}
+
+// Parses bound of range, "-" and "+" are the first and
+// the last possible ids, sequence of end defaults to maximum
+func parseBound(s string, end bool) (StreamID, error) {
+	switch s {
+	case "-":
+		return StreamID{}, nil
+	case "+":
+		return StreamID{math.MaxUint64, math.MaxUint64}, nil
+	}
+
+	id, err := ParseStreamID(s)
+	if err == nil && end && !strings.Contains(s, "-") {
+		id.Seq = math.MaxUint64
+	}
+
+	return id, err
+}
+
+type StreamEntry struct {
+	ID     StreamID          `json:"id"`
+	Fields map[string]string `json:"fields"`
+}
+
+// PendingEntry is delivered but not acknowledged entry of group
+type PendingEntry struct {
+	ID        StreamID  `json:"id"`
+	Consumer  string    `json:"consumer"`
+	Delivered time.Time `json:"delivered"`
+	Count     int       `json:"count"`
+}
+
+type stream struct {
+	// Ordered by id
+	entries []StreamEntry
+	last    StreamID
+	groups  map[string]*group
+
+	// Size of entries, groups are not counted
+	bytes int64
+}
+
+type group struct {
+	// Last id delivered to the group
+	last    StreamID
+	pending map[StreamID]*PendingEntry
+}
+
+func (s *stream) tipe() Type {
+	return TypeStream
+}
+
+// Entries share field maps as they are never modified
+func (s *stream) clone() object {
+	c := &stream{
+		entries: append([]StreamEntry(nil), s.entries...),
+		last:    s.last,
+		bytes:   s.bytes,
+	}
+
+	if s.groups != nil {
+		c.groups = make(map[string]*group, len(s.groups))
+		for name, g := range s.groups {
+			cg := &group{last: g.last, pending: make(map[StreamID]*PendingEntry, len(g.pending))}
+			for id, p := range g.pending {
+				pp := *p
+				cg.pending[id] = &pp
+			}
+			c.groups[name] = cg
+		}
+	}
+
+	return c
+}
+
+func (s *stream) size() int64 {
+	return s.bytes
+}
+
+// Appends entry which id is greater than the last one
+func (s *stream) append(e StreamEntry) {
+	s.entries = append(s.entries, e)
+	s.bytes += e.size()
+}
+
+// Returns size of id and fields
+func (e StreamEntry) size() int64 {
+	size := int64(16)
+	for k, v := range e.Fields {
+		size += int64(len(k) + len(v))
+	}
+
+	return size
+}
+
+// Returns index of the first entry not less than id
+func (s *stream) search(id StreamID) int {
+	return sort.Search(len(s.entries), func(i int) bool {
+		return !s.entries[i].ID.less(id)
+	})
+}
+
+// Returns entries from start to end in order, no more than count if it is positive
+func (s *stream) rang(start, end StreamID, count int, rev bool) []StreamEntry {
+	i, j := s.search(start), len(s.entries)
+	if end.Seq < math.MaxUint64 {
+		j = s.search(StreamID{end.Ms, end.Seq + 1})
+	} else if end.Ms < math.MaxUint64 {
+		j = s.search(StreamID{end.Ms + 1, 0})
+	}
+	if i >= j {
+		return nil
+	}
+
+	res := make([]StreamEntry, 0, j-i)
+	for k := 0; k < j-i; k++ {
+		if count > 0 && len(res) == count {
+			break
+		}
+		e := s.entries[i+k]
+		if rev {
+			e = s.entries[j-1-k]
+		}
+		res = append(res, copyEntry(e))
+	}
+
+	return res
+}
+
+// Returns entries after id
+func (s *stream) after(id StreamID, count int) []StreamEntry {
+	if id.Seq < math.MaxUint64 {
+		id.Seq++
+	} else {
+		id = StreamID{id.Ms + 1, 0}
+	}
+
+	return s.rang(id, StreamID{math.MaxUint64, math.MaxUint64}, count, false)
+}
+
+func (s *stream) find(id StreamID) (StreamEntry, bool) {
+	i := s.search(id)
+	if i < len(s.entries) && s.entries[i].ID == id {
+		return s.entries[i], true
+	}
+
+	return StreamEntry{}, false
+}
+
+func copyEntry(e StreamEntry) StreamEntry {
+	c := StreamEntry{ID: e.ID, Fields: make(map[string]string, len(e.Fields))}
+	for k, v := range e.Fields {
+		c.Fields[k] = v
+	}
+
+	return c
+}
+
+// Returns id for new entry, "*" generates it by time,
+// "ms-*" generates only sequence
+func (s *stream) nextID(id string) (StreamID, error) {
+	ms := uint64(time.Now().UnixNano() / int64(time.Millisecond))
+
+	var next StreamID
+	switch {
+	case id == "*":
+		next = StreamID{ms, 0}
+		if !s.last.less(next) {
+			next = StreamID{s.last.Ms, s.last.Seq + 1}
+		}
+	case strings.HasSuffix(id, "-*"):
+		v, err := strconv.ParseUint(strings.TrimSuffix(id, "-*"), 10, 64)
+		if err != nil {
+			return next, ErrInvalidID
+		}
+		next = StreamID{v, 0}
+		if v == s.last.Ms {
+			next.Seq = s.last.Seq + 1
+		}
+	default:
+		v, err := ParseStreamID(id)
+		if err != nil {
+			return next, err
+		}
+		next = v
+	}
+
+	if next == (StreamID{}) || !s.last.less(next) {
+		return next, ErrInvalidID
+	}
+
+	return next, nil
+}
+
+// Removes the oldest entries above max length
+func (s *stream) trim(maxLen int) {
+	drop := len(s.entries) - maxLen
+	if maxLen <= 0 || drop <= 0 {
+		return
+	}
+
+	// Release removed entries before reslicing
+	for i := 0; i < drop; i++ {
+		s.bytes -= s.entries[i].size()
+		s.entries[i] = StreamEntry{}
+	}
+	s.entries = s.entries[drop:]
+}
+
+// Runs fn for existing stream
+func (db *DB) viewStream(key string, fn func(s *stream) error) error {
+	return db.view(key, func(n *node) error {
+		if n.tipe != TypeStream {
+			return ErrInvalidType
+		}
+
+		return fn(n.obj.(*stream))
+	})
+}
+
+// Changes stream in place by change c, new stream
+// is created only if create is set
+func (db *DB) updateStream(key string, create bool, c *change, fn func(s *stream) error) error {
+	return db.head().update(db, key, c, func(n *node, exists bool) error {
+		if !exists {
+			if !create {
+				return ErrNotFound
+			}
+			n.set(&stream{})
+		}
+		if n.tipe != TypeStream {
+			return ErrInvalidType
+		}
+
+		return fn(n.obj.(*stream))
+	})
+}
+
+// XAdd appends entry to stream and returns its id
+//
+// Id is "*" to generate it from current time, "ms-*" or
+// explicit "ms-seq" greater than the last one.
+// Positive maxLen trims the oldest entries.
+func (db *DB) XAdd(key, id string, fields map[string]string, maxLen int) (StreamID, error) {
+	if err := db.writable(key); err != nil {
+		return StreamID{}, err
+	}
+
+	return db.xAdd(key, id, fields, maxLen)
+}
+
+func (db *DB) xAdd(key, id string, fields map[string]string, maxLen int) (StreamID, error) {
+	var next StreamID
+
+	// Id is set when it is generated
+	c := newChange(changeXAdd, id, strconv.Itoa(maxLen))
+
+	e := StreamEntry{Fields: make(map[string]string, len(fields))}
+	for k, v := range fields {
+		e.Fields[k] = v
+		c.args = append(c.args, k, v)
+	}
+
+	err := db.updateStream(key, true, c, func(s *stream) error {
+		var err error
+		if next, err = s.nextID(id); err != nil {
+			return err
+		}
+		c.args[0] = next.String()
+
+		e.ID = next
+		s.append(e)
+		s.last = next
+		s.trim(maxLen)
+
+		return nil
+	})
+
+	return next, err
+}
+
+// XLen returns count of entries
+func (db *DB) XLen(key string) (int, error) {
+	var l int
+
+	err := db.viewStream(key, func(s *stream) error {
+		l = len(s.entries)
+		return nil
+	})
+
+	return l, err
+}
+
+// XRange returns entries with ids from start to end
+//
+// Bounds "-" and "+" mean the first and the last entries,
+// not positive count returns all of them.
+func (db *DB) XRange(key, start, end string, count int) ([]StreamEntry, error) {
+	return db.xrange(key, start, end, count, false)
+}
+
+// XRevRange returns entries from end to start in reverse order
+func (db *DB) XRevRange(key, end, start string, count int) ([]StreamEntry, error) {
+	return db.xrange(key, start, end, count, true)
+}
+
+func (db *DB) xrange(key, start, end string, count int, rev bool) ([]StreamEntry, error) {
+	from, err := parseBound(start, false)
+	if err != nil {
+		return nil, err
+	}
+	to, err := parseBound(end, true)
+	if err != nil {
+		return nil, err
+	}
+
+	var res []StreamEntry
+	err = db.viewStream(key, func(s *stream) error {
+		res = s.rang(from, to, count, rev)
+		return nil
+	})
+
+	return res, err
+}
+
+// XRead returns entries after id waiting up to block for new ones
+//
+// Id "$" means the last entry at the moment of call. Zero block
+// returns immediately, nothing after timeout is not an error.
+func (db *DB) XRead(key, id string, count int, block time.Duration) ([]StreamEntry, error) {
+	after, err := db.lastID(key, id)
+	if err != nil {
+		return nil, err
+	}
+
+	var res []StreamEntry
+	err = db.block(key, block, func() (bool, error) {
+		err := db.viewStream(key, func(s *stream) error {
+			res = s.after(after, count)
+			return nil
+		})
+		if err == ErrNotFound {
+			return false, nil
+		}
+
+		return len(res) > 0, err
+	})
+
+	return res, err
+}
+
+// Resolves "$" to the last id of stream
+func (db *DB) lastID(key, id string) (StreamID, error) {
+	if id != "$" {
+		return ParseStreamID(id)
+	}
+
+	var last StreamID
+	err := db.viewStream(key, func(s *stream) error {
+		last = s.last
+		return nil
+	})
+	if err == ErrNotFound {
+		err = nil
+	}
+
+	return last, err
+}
+
+// Calls try until it returns true, an error or block passes
+//
+// Try is repeated after every change of the key.
+func (db *DB) block(key string, block time.Duration, try func() (bool, error)) error {
+	deadline := time.NewTimer(block)
+	defer deadline.Stop()
+
+	for {
+		// Waiter is added before try to not miss a change
+		c := db.waiters.add(key)
+
+		ok, err := try()
+		if ok || err != nil || block <= 0 {
+			db.waiters.remove(key, c)
+			return err
+		}
+
+		select {
+		case <-c:
+		case <-deadline.C:
+			db.waiters.remove(key, c)
+			return nil
+		}
+	}
+}
+
+// XGroupCreate creates consumer group which starts reading after start
+//
+// Start "$" means the last entry, "0" all entries.
+// Missing stream is created if mkStream is set.
+func (db *DB) XGroupCreate(key, name, start string, mkStream bool) error {
+	if err := db.writable(key); err != nil {
+		return err
+	}
+
+	return db.xGroupCreate(key, name, start, mkStream)
+}
+
+func (db *DB) xGroupCreate(key, name, start string, mkStream bool) error {
+	mk := "0"
+	if mkStream {
+		mk = "1"
+	}
+	c := newChange(changeXGroupCreate, name, start, mk)
+
+	return db.updateStream(key, mkStream, c, func(s *stream) error {
+		if _, ok := s.groups[name]; ok {
+			return ErrExists
+		}
+
+		last := s.last
+		if start != "$" {
+			var err error
+			if last, err = ParseStreamID(start); err != nil {
+				return err
+			}
+		}
+
+		if s.groups == nil {
+			s.groups = make(map[string]*group)
+		}
+		s.groups[name] = &group{last: last, pending: make(map[StreamID]*PendingEntry)}
+
+		return nil
+	})
+}
+
+// XReadGroup reads entries for consumer of group
+//
+// Id ">" delivers entries which were never delivered to the group
+// and adds them to pending list of consumer, it waits up to block
+// for them. Other id returns pending entries of consumer after it.
+func (db *DB) XReadGroup(key, name, consumer, id string, count int, block time.Duration) ([]StreamEntry, error) {
+	if id != ">" {
+		if _, err := ParseStreamID(id); err != nil {
+			return nil, err
+		}
+		block = 0
+	}
+
+	if err := db.writable(key); err != nil {
+		return nil, err
+	}
+
+	var res []StreamEntry
+	err := db.block(key, block, func() (bool, error) {
+		// Nothing is changed if there are no new entries
+		var fresh bool
+		err := db.viewStream(key, func(s *stream) error {
+			g, ok := s.groups[name]
+			if !ok {
+				return ErrNoGroup
+			}
+			fresh = len(s.entries) > 0 && g.last.less(s.last)
+			return nil
+		})
+		if err != nil || id == ">" && !fresh {
+			return false, err
+		}
+
+		res, err = db.xDeliver(key, name, consumer, id, count, time.Now())
+
+		return len(res) > 0, err
+	})
+
+	return res, err
+}
+
+// Delivers entries of XReadGroup at time now
+func (db *DB) xDeliver(key, name, consumer, id string, count int, now time.Time) ([]StreamEntry, error) {
+	var after StreamID
+	if id != ">" {
+		var err error
+		if after, err = ParseStreamID(id); err != nil {
+			return nil, err
+		}
+	}
+
+	c := newChange(changeXReadGroup, name, consumer, id, strconv.Itoa(count), strconv.FormatInt(now.UnixNano(), 10))
+
+	var res []StreamEntry
+	err := db.updateStream(key, false, c, func(s *stream) error {
+		g, ok := s.groups[name]
+		if !ok {
+			return ErrNoGroup
+		}
+
+		if id == ">" {
+			res = s.after(g.last, count)
+			for _, e := range res {
+				g.pending[e.ID] = &PendingEntry{ID: e.ID, Consumer: consumer, Delivered: now, Count: 1}
+			}
+			if len(res) > 0 {
+				g.last = res[len(res)-1].ID
+			}
+			return nil
+		}
+
+		for _, p := range sortPending(g.pending) {
+			if p.Consumer != consumer || !after.less(p.ID) {
+				continue
+			}
+			if count > 0 && len(res) == count {
+				break
+			}
+			// Trimmed entry is returned without fields
+			e, _ := s.find(p.ID)
+			e = copyEntry(e)
+			e.ID = p.ID
+			res = append(res, e)
+
+			p.Delivered = now
+			p.Count++
+		}
+
+		return nil
+	})
+
+	return res, err
+}
+
+// XAck removes entries from pending list of group
+// and returns count of acknowledged ones
+func (db *DB) XAck(key, name string, ids ...StreamID) (int, error) {
+	if err := db.writable(key); err != nil {
+		return 0, err
+	}
+
+	return db.xAck(key, name, ids...)
+}
+
+func (db *DB) xAck(key, name string, ids ...StreamID) (int, error) {
+	c := newChange(changeXAck, name)
+	for _, id := range ids {
+		c.args = append(c.args, id.String())
+	}
+
+	var acked int
+	err := db.updateStream(key, false, c, func(s *stream) error {
+		g, ok := s.groups[name]
+		if !ok {
+			return ErrNoGroup
+		}
+
+		for _, id := range ids {
+			if _, ok := g.pending[id]; ok {
+				delete(g.pending, id)
+				acked++
+			}
+		}
+
+		return nil
+	})
+
+	return acked, err
+}
+
+// XPending returns pending entries of group ordered by id
+func (db *DB) XPending(key, name string) ([]PendingEntry, error) {
+	var res []PendingEntry
+
+	err := db.viewStream(key, func(s *stream) error {
+		g, ok := s.groups[name]
+		if !ok {
+			return ErrNoGroup
+		}
+
+		for _, p := range sortPending(g.pending) {
+			res = append(res, *p)
+		}
+
+		return nil
+	})
+
+	return res, err
+}
+
+func sortPending(m map[StreamID]*PendingEntry) []*PendingEntry {
+	res := make([]*PendingEntry, 0, len(m))
+	for _, p := range m {
+		res = append(res, p)
+	}
+
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].ID.less(res[j].ID)
+	})
+
+	return res
+}
+
+// Snapshot payload: last id, count of entries and entries
+// as id and fields, count of groups and groups as name,
+// last id and pending entries
+func (s *stream) encode(w *bufio.Writer) {
+	writeStreamID(w, s.last)
+
+	writeUvarint(w, uint64(len(s.entries)))
+	for _, e := range s.entries {
+		writeStreamID(w, e.ID)
+		writeUvarint(w, uint64(len(e.Fields)))
+		for k, v := range e.Fields {
+			writeString(w, k)
+			writeString(w, v)
+		}
+	}
+
+	writeUvarint(w, uint64(len(s.groups)))
+	for name, g := range s.groups {
+		writeString(w, name)
+		writeStreamID(w, g.last)
+		writeUvarint(w, uint64(len(g.pending)))
+		for _, p := range g.pending {
+			writeStreamID(w, p.ID)
+			writeString(w, p.Consumer)
+			writeVarint(w, p.Delivered.UnixNano()/int64(time.Millisecond))
+			writeUvarint(w, uint64(p.Count))
+		}
+	}
+}
+
+func decodeStream(r *bufio.Reader) (*stream, error) {
+	s := new(stream)
+
+	var err error
+	if s.last, err = readStreamID(r); err != nil {
+		return nil, err
+	}
+
+	cnt, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, ErrCorrupted
+	}
+	s.entries = make([]StreamEntry, 0, prealloc(cnt))
+	for i := uint64(0); i < cnt; i++ {
+		e := StreamEntry{}
+		if e.ID, err = readStreamID(r); err != nil {
+			return nil, err
+		}
+		if e.Fields, err = readDict(r); err != nil {
+			return nil, err
+		}
+		s.append(e)
+	}
+
+	if cnt, err = binary.ReadUvarint(r); err != nil {
+		return nil, ErrCorrupted
+	}
+	if cnt > 0 {
+		s.groups = make(map[string]*group, prealloc(cnt))
+	}
+	for i := uint64(0); i < cnt; i++ {
+		name, err := readString(r)
+		if err != nil {
+			return nil, err
+		}
+		g := &group{pending: make(map[StreamID]*PendingEntry)}
+		if g.last, err = readStreamID(r); err != nil {
+			return nil, err
+		}
+		pcnt, err := binary.ReadUvarint(r)
+		if err != nil {
+			return nil, ErrCorrupted
+		}
+		for j := uint64(0); j < pcnt; j++ {
+			p := &PendingEntry{}
+			if p.ID, err = readStreamID(r); err != nil {
+				return nil, err
+			}
+			if p.Consumer, err = readString(r); err != nil {
+				return nil, err
+			}
+			ms, err := binary.ReadVarint(r)
+			if err != nil {
+				return nil, ErrCorrupted
+			}
+			c, err := binary.ReadUvarint(r)
+			if err != nil {
+				return nil, ErrCorrupted
+			}
+			p.Delivered = time.Unix(0, ms*int64(time.Millisecond))
+			p.Count = int(c)
+			g.pending[p.ID] = p
+		}
+		s.groups[name] = g
+	}
+
+	return s, nil
+}
+
+func writeStreamID(w *bufio.Writer, id StreamID) {
+	writeUvarint(w, id.Ms)
+	writeUvarint(w, id.Seq)
+}
+
+func readStreamID(r *bufio.Reader) (StreamID, error) {
+	var (
+		id  StreamID
+		err error
+	)
+
+	if id.Ms, err = binary.ReadUvarint(r); err != nil {
+		return id, ErrCorrupted
+	}
+	if id.Seq, err = binary.ReadUvarint(r); err != nil {
+		return id, ErrCorrupted
+	}
+
+	return id, nil
+}
@@ -0,0 +1,85 @@
+package typed
+
+import (
+	"bytes"
+	"encoding"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+var ErrNotBinary = errors.New("value does not implement binary marshaling")
+
+// Codec converts values to the stored bytes and back
+type Codec[V any] interface {
+	Encode(v V) ([]byte, error)
+	Decode(data []byte, v *V) error
+}
+
+// JSON stores values as json documents
+type JSON[V any] struct{}
+
+func (JSON[V]) Encode(v V) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (JSON[V]) Decode(data []byte, v *V) error {
+	return json.Unmarshal(data, v)
+}
+
+// Gob stores values with encoding/gob, same as the http client does
+type Gob[V any] struct{}
+
+func (Gob[V]) Encode(v V) ([]byte, error) {
+	b := new(bytes.Buffer)
+	if err := gob.NewEncoder(b).Encode(v); err != nil {
+		return nil, err
+	}
+
+	return b.Bytes(), nil
+}
+
+func (Gob[V]) Decode(data []byte, v *V) error {
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(v)
+}
+
+// Binary is for compact generated types (protobuf and friends)
+//
+// V should implement encoding.BinaryMarshaler and
+// *V encoding.BinaryUnmarshaler, otherwise ErrNotBinary returned.
+type Binary[V any] struct{}
+
+func (Binary[V]) Encode(v V) ([]byte, error) {
+	m, ok := any(v).(encoding.BinaryMarshaler)
+	if !ok {
+		m, ok = any(&v).(encoding.BinaryMarshaler)
+	}
+	if !ok {
+		return nil, fmt.Errorf("%w: %T", ErrNotBinary, v)
+	}
+
+	return m.MarshalBinary()
+}
+
+func (Binary[V]) Decode(data []byte, v *V) error {
+	u, ok := any(v).(encoding.BinaryUnmarshaler)
+	if !ok {
+		return fmt.Errorf("%w: %T", ErrNotBinary, v)
+	}
+
+	return u.UnmarshalBinary(data)
+}
+
+// Raw passes bytes as is, encoded bytes are copied,
+// so caller could reuse its slice
+type Raw struct{}
+
+func (Raw) Encode(v []byte) ([]byte, error) {
+	return append([]byte(nil), v...), nil
+}
+
+func (Raw) Decode(data []byte, v *[]byte) error {
+	*v = data
+	return nil
+}
@@ -0,0 +1,145 @@
+// Package typed provides typed views over the byte store
+//
+//	users := typed.New[int, User](d, "users:", typed.JSON[User]{})
+//	users.Set(42, User{Name: "donald"}, nil)
+//	u, err := users.Get(42)
+package typed
+
+import (
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/lukashes/db/db"
+)
+
+// Key is a set of types which could be used as map keys
+type Key interface {
+	~string |
+		~int | ~int8 | ~int16 | ~int32 | ~int64 |
+		~uint | ~uint8 | ~uint16 | ~uint32 | ~uint64
+}
+
+// Map is a typed view of keys sharing the same prefix
+type Map[K Key, V any] struct {
+	store  *db.DB
+	prefix string
+	codec  Codec[V]
+}
+
+// New returns map view, all keys will be stored with prefix
+func New[K Key, V any](store *db.DB, prefix string, codec Codec[V]) *Map[K, V] {
+	return &Map[K, V]{
+		store:  store,
+		prefix: prefix,
+		codec:  codec,
+	}
+}
+
+// Get returns decoded value or db.ErrNotFound
+func (m *Map[K, V]) Get(k K) (V, error) {
+	var v V
+
+	data, err := m.store.Read(m.key(k))
+	if err != nil {
+		return v, err
+	}
+
+	err = m.codec.Decode(data, &v)
+
+	return v, err
+}
+
+// Set encodes value and writes it
+func (m *Map[K, V]) Set(k K, v V, ttl *int) error {
+	data, err := m.codec.Encode(v)
+	if err != nil {
+		return err
+	}
+
+	return m.store.Write(m.key(k), data, ttl)
+}
+
+// Delete removes key
+func (m *Map[K, V]) Delete(k K) error {
+	return m.store.Delete(m.key(k))
+}
+
+// Range calls fn for every alive key of the map
+//
+// Iteration stops when fn returns false. Keys which
+// can not be parsed as K are skipped, as well as keys
+// removed during iteration.
+func (m *Map[K, V]) Range(fn func(k K, v V) bool) error {
+	for _, key := range m.store.Keys() {
+		if !strings.HasPrefix(key, m.prefix) {
+			continue
+		}
+
+		k, ok := parseKey[K](key[len(m.prefix):])
+		if !ok {
+			continue
+		}
+
+		data, err := m.store.Read(key)
+		if err == db.ErrNotFound {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		var v V
+		if err := m.codec.Decode(data, &v); err != nil {
+			return err
+		}
+
+		if !fn(k, v) {
+			return nil
+		}
+	}
+
+	return nil
+}
+
+func (m *Map[K, V]) key(k K) string {
+	return m.prefix + formatKey(k)
+}
+
+func formatKey[K Key](k K) string {
+	v := reflect.ValueOf(k)
+
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return strconv.FormatInt(v.Int(), 10)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return strconv.FormatUint(v.Uint(), 10)
+	}
+
+	return v.String()
+}
+
+func parseKey[K Key](s string) (K, bool) {
+	var k K
+
+	v := reflect.ValueOf(&k).Elem()
+
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		i, err := strconv.ParseInt(s, 10, v.Type().Bits())
+		if err != nil {
+			return k, false
+		}
+		v.SetInt(i)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		i, err := strconv.ParseUint(s, 10, v.Type().Bits())
+		if err != nil {
+			return k, false
+		}
+		v.SetUint(i)
+	default:
+		v.SetString(s)
+	}
+
+	return k, true
+}
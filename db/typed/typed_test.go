@@ -0,0 +1,84 @@
+package typed
+
+import (
+	"testing"
+
+	"github.com/lukashes/db/db"
+)
+
+type user struct {
+	Name string
+	Age  int
+}
+
+func TestMap(t *testing.T) {
+	d := db.New()
+
+	users := New[int, user](d, "users:", JSON[user]{})
+	posts := New[string, string](d, "posts:", Gob[string]{})
+
+	if err := users.Set(1, user{"donald", 7}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := users.Set(2, user{"daisy", 6}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := posts.Set("1", "hello", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	u, err := users.Get(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.Name != "donald" || u.Age != 7 {
+		t.Errorf("unexpected value %#v", u)
+	}
+
+	seen := map[int]string{}
+	if err := users.Range(func(k int, v user) bool {
+		seen[k] = v.Name
+		return true
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if len(seen) != 2 || seen[2] != "daisy" {
+		t.Errorf("unexpected range result %v", seen)
+	}
+
+	if err := users.Delete(1); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := users.Get(1); err != db.ErrNotFound {
+		t.Errorf("expected not found, got %v", err)
+	}
+
+	p, err := posts.Get("1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p != "hello" {
+		t.Errorf("unexpected value %s", p)
+	}
+}
+
+func TestBinaryNotImplemented(t *testing.T) {
+	m := New[string, user](db.New(), "", Binary[user]{})
+
+	if err := m.Set("k", user{}, nil); err == nil {
+		t.Error("expected error for non binary type")
+	}
+}
+
+func TestRawCopy(t *testing.T) {
+	b := []byte("hello")
+	e, err := Raw{}.Encode(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b[0] = 'j'
+	if string(e) != "hello" {
+		t.Errorf("encoded value is changed by caller: %q", e)
+	}
+}
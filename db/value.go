@@ -0,0 +1,483 @@
+package db
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"math"
+	"strconv"
+)
+
+// Kind is type of list and dict element
+type Kind uint8
+
+const (
+	KindString Kind = iota
+	KindInt
+	KindFloat
+	KindBytes
+	KindList
+	KindDict
+)
+
+// Value is element of list or dict
+//
+// Wire encoding is json where strings are json strings, lists are
+// arrays and other kinds are objects with one member named by kind:
+//
+//	"text"  {"i":42}  {"f":1.5}  {"b":"Ynl0ZXM="}  [...]  {"d":{"k":...}}
+//
+// Decoding also accepts bare json numbers, integers become KindInt.
+type Value struct {
+	kind Kind
+
+	// String and bytes
+	s string
+
+	// Integer or float bits
+	n uint64
+
+	// Nested elements
+	list []Value
+	dict map[string]Value
+}
+
+// Returns approximate size of value in bytes
+func (v Value) footprint() int64 {
+	switch v.kind {
+	case KindString, KindBytes:
+		return int64(len(v.s))
+	case KindList:
+		var size int64
+		for _, e := range v.list {
+			size += e.footprint()
+		}
+		return size
+	case KindDict:
+		var size int64
+		for k, e := range v.dict {
+			size += int64(len(k)) + e.footprint()
+		}
+		return size
+	}
+
+	return 8
+}
+
+func String(s string) Value {
+	return Value{kind: KindString, s: s}
+}
+
+func Int(i int64) Value {
+	return Value{kind: KindInt, n: uint64(i)}
+}
+
+func Float(f float64) Value {
+	return Value{kind: KindFloat, n: math.Float64bits(f)}
+}
+
+func Bytes(b []byte) Value {
+	return Value{kind: KindBytes, s: string(b)}
+}
+
+func List(vals ...Value) Value {
+	return Value{kind: KindList, list: vals}
+}
+
+func Dict(vals map[string]Value) Value {
+	return Value{kind: KindDict, dict: vals}
+}
+
+func (v Value) Kind() Kind {
+	return v.kind
+}
+
+// Str returns string or bytes as string
+func (v Value) Str() string {
+	return v.s
+}
+
+func (v Value) Int() int64 {
+	return int64(v.n)
+}
+
+func (v Value) Float() float64 {
+	return math.Float64frombits(v.n)
+}
+
+func (v Value) Bytes() []byte {
+	return []byte(v.s)
+}
+
+func (v Value) List() []Value {
+	return v.list
+}
+
+func (v Value) Dict() map[string]Value {
+	return v.dict
+}
+
+// String returns text of value, numbers are formatted,
+// nested values are in wire encoding
+func (v Value) String() string {
+	switch v.kind {
+	case KindString, KindBytes:
+		return v.s
+	case KindInt:
+		return strconv.FormatInt(v.Int(), 10)
+	case KindFloat:
+		return strconv.FormatFloat(v.Float(), 'g', -1, 64)
+	}
+
+	b, _ := json.Marshal(v)
+
+	return string(b)
+}
+
+// ValueOf converts string, []byte, integers, floats and
+// slices or string keyed maps of them to Value
+func ValueOf(i interface{}) (Value, error) {
+	switch t := i.(type) {
+	case Value:
+		return t, nil
+	case string:
+		return String(t), nil
+	case []byte:
+		return Bytes(t), nil
+	case int:
+		return Int(int64(t)), nil
+	case int8:
+		return Int(int64(t)), nil
+	case int16:
+		return Int(int64(t)), nil
+	case int32:
+		return Int(int64(t)), nil
+	case int64:
+		return Int(t), nil
+	case uint8:
+		return Int(int64(t)), nil
+	case uint16:
+		return Int(int64(t)), nil
+	case uint32:
+		return Int(int64(t)), nil
+	case float32:
+		return Float(float64(t)), nil
+	case float64:
+		return Float(t), nil
+	case []string:
+		return List(Strings(t)...), nil
+	case map[string]string:
+		return Dict(StringDict(t)), nil
+	case []interface{}:
+		l := make([]Value, len(t))
+		for k, e := range t {
+			v, err := ValueOf(e)
+			if err != nil {
+				return Value{}, err
+			}
+			l[k] = v
+		}
+		return List(l...), nil
+	case map[string]interface{}:
+		d := make(map[string]Value, len(t))
+		for k, e := range t {
+			v, err := ValueOf(e)
+			if err != nil {
+				return Value{}, err
+			}
+			d[k] = v
+		}
+		return Dict(d), nil
+	}
+
+	return Value{}, ErrInvalidType
+}
+
+// Interface returns string, int64, float64, []byte,
+// []interface{} or map[string]interface{}
+func (v Value) Interface() interface{} {
+	switch v.kind {
+	case KindInt:
+		return v.Int()
+	case KindFloat:
+		return v.Float()
+	case KindBytes:
+		return v.Bytes()
+	case KindList:
+		l := make([]interface{}, len(v.list))
+		for k, e := range v.list {
+			l[k] = e.Interface()
+		}
+		return l
+	case KindDict:
+		d := make(map[string]interface{}, len(v.dict))
+		for k, e := range v.dict {
+			d[k] = e.Interface()
+		}
+		return d
+	}
+
+	return v.s
+}
+
+// Strings converts strings to values
+func Strings(s []string) []Value {
+	l := make([]Value, len(s))
+	for k, v := range s {
+		l[k] = String(v)
+	}
+
+	return l
+}
+
+// StringDict converts dict of strings to values
+func StringDict(m map[string]string) map[string]Value {
+	d := make(map[string]Value, len(m))
+	for k, v := range m {
+		d[k] = String(v)
+	}
+
+	return d
+}
+
+// Returns deep copy, strings are immutable and shared
+func (v Value) clone() Value {
+	switch v.kind {
+	case KindList:
+		v.list = cloneValues(v.list)
+	case KindDict:
+		v.dict = cloneDict(v.dict)
+	}
+
+	return v
+}
+
+func cloneValues(l []Value) []Value {
+	c := make([]Value, len(l))
+	for k, v := range l {
+		c[k] = v.clone()
+	}
+
+	return c
+}
+
+func cloneDict(d map[string]Value) map[string]Value {
+	c := make(map[string]Value, len(d))
+	for k, v := range d {
+		c[k] = v.clone()
+	}
+
+	return c
+}
+
+func (v Value) MarshalJSON() ([]byte, error) {
+	switch v.kind {
+	case KindString:
+		return json.Marshal(v.s)
+	case KindInt:
+		return []byte(`{"i":` + strconv.FormatInt(v.Int(), 10) + `}`), nil
+	case KindFloat:
+		f, err := json.Marshal(v.Float())
+		if err != nil {
+			return nil, err
+		}
+		return append(append([]byte(`{"f":`), f...), '}'), nil
+	case KindBytes:
+		return []byte(`{"b":"` + base64.StdEncoding.EncodeToString(v.Bytes()) + `"}`), nil
+	case KindList:
+		if v.list == nil {
+			return []byte("[]"), nil
+		}
+		return json.Marshal(v.list)
+	case KindDict:
+		d, err := json.Marshal(v.dict)
+		if err != nil {
+			return nil, err
+		}
+		return append(append([]byte(`{"d":`), d...), '}'), nil
+	}
+
+	return nil, ErrInvalidType
+}
+
+func (v *Value) UnmarshalJSON(b []byte) error {
+	b = bytes.TrimSpace(b)
+	if len(b) == 0 {
+		return ErrInvalidArgument
+	}
+
+	switch b[0] {
+	case '"':
+		var s string
+		if err := json.Unmarshal(b, &s); err != nil {
+			return err
+		}
+		*v = String(s)
+	case '[':
+		var l []Value
+		if err := json.Unmarshal(b, &l); err != nil {
+			return err
+		}
+		*v = List(l...)
+	case '{':
+		var tagged struct {
+			I *int64           `json:"i"`
+			F *float64         `json:"f"`
+			B []byte           `json:"b"`
+			D map[string]Value `json:"d"`
+		}
+		var members map[string]json.RawMessage
+		if err := json.Unmarshal(b, &members); err != nil {
+			return err
+		}
+		if len(members) != 1 {
+			return ErrInvalidArgument
+		}
+		if err := json.Unmarshal(b, &tagged); err != nil {
+			return err
+		}
+		switch {
+		case tagged.I != nil:
+			*v = Int(*tagged.I)
+		case tagged.F != nil:
+			*v = Float(*tagged.F)
+		case tagged.B != nil:
+			*v = Bytes(tagged.B)
+		case tagged.D != nil:
+			*v = Dict(tagged.D)
+		default:
+			return ErrInvalidArgument
+		}
+	default:
+		n := json.Number(b)
+		if i, err := n.Int64(); err == nil {
+			*v = Int(i)
+		} else if f, err := n.Float64(); err == nil {
+			*v = Float(f)
+		} else {
+			return ErrInvalidArgument
+		}
+	}
+
+	return nil
+}
+
+// Binary encoding: kind byte and payload, strings and bytes are
+// prefixed with length, integers are varints, floats are 8 bytes,
+// lists and dicts are count and elements
+func writeValue(w *bufio.Writer, v Value) {
+	w.WriteByte(byte(v.kind))
+
+	switch v.kind {
+	case KindString, KindBytes:
+		writeString(w, v.s)
+	case KindInt:
+		writeVarint(w, v.Int())
+	case KindFloat:
+		var b [8]byte
+		binary.LittleEndian.PutUint64(b[:], v.n)
+		w.Write(b[:])
+	case KindList:
+		writeValues(w, v.list)
+	case KindDict:
+		writeValueDict(w, v.dict)
+	}
+}
+
+func writeValues(w *bufio.Writer, l []Value) {
+	writeUvarint(w, uint64(len(l)))
+	for _, v := range l {
+		writeValue(w, v)
+	}
+}
+
+func writeValueDict(w *bufio.Writer, d map[string]Value) {
+	writeUvarint(w, uint64(len(d)))
+	for k, v := range d {
+		writeString(w, k)
+		writeValue(w, v)
+	}
+}
+
+// Nesting is limited to not overflow stack on corrupted data
+const maxDepth = 64
+
+func readValue(r *bufio.Reader, depth int) (Value, error) {
+	if depth > maxDepth {
+		return Value{}, ErrCorrupted
+	}
+
+	k, err := r.ReadByte()
+	if err != nil {
+		return Value{}, ErrCorrupted
+	}
+
+	switch Kind(k) {
+	case KindString, KindBytes:
+		s, err := readString(r)
+		return Value{kind: Kind(k), s: s}, err
+	case KindInt:
+		i, err := binary.ReadVarint(r)
+		if err != nil {
+			return Value{}, ErrCorrupted
+		}
+		return Int(i), nil
+	case KindFloat:
+		var b [8]byte
+		if _, err := io.ReadFull(r, b[:]); err != nil {
+			return Value{}, ErrCorrupted
+		}
+		return Value{kind: KindFloat, n: binary.LittleEndian.Uint64(b[:])}, nil
+	case KindList:
+		l, err := readValues(r, depth+1)
+		return List(l...), err
+	case KindDict:
+		d, err := readValueDict(r, depth+1)
+		return Dict(d), err
+	}
+
+	return Value{}, ErrCorrupted
+}
+
+func readValues(r *bufio.Reader, depth int) ([]Value, error) {
+	cnt, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, ErrCorrupted
+	}
+
+	l := make([]Value, 0, prealloc(cnt))
+	for i := uint64(0); i < cnt; i++ {
+		v, err := readValue(r, depth)
+		if err != nil {
+			return nil, err
+		}
+		l = append(l, v)
+	}
+
+	return l, nil
+}
+
+func readValueDict(r *bufio.Reader, depth int) (map[string]Value, error) {
+	cnt, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, ErrCorrupted
+	}
+
+	d := make(map[string]Value, prealloc(cnt))
+	for i := uint64(0); i < cnt; i++ {
+		k, err := readString(r)
+		if err != nil {
+			return nil, err
+		}
+		v, err := readValue(r, depth)
+		if err != nil {
+			return nil, err
+		}
+		d[k] = v
+	}
+
+	return d, nil
+}
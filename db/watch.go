@@ -0,0 +1,166 @@
+package db
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Waiters of key changes
+type waiters struct {
+	mu  sync.Mutex
+	set map[string]map[chan struct{}]bool
+
+	// Count of waiting keys for checking without lock
+	n int32
+}
+
+func (w *waiters) add(key string) chan struct{} {
+	c := make(chan struct{})
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.set == nil {
+		w.set = make(map[string]map[chan struct{}]bool)
+	}
+
+	cs, ok := w.set[key]
+	if !ok {
+		cs = make(map[chan struct{}]bool)
+		w.set[key] = cs
+		atomic.AddInt32(&w.n, 1)
+	}
+	cs[c] = true
+
+	return c
+}
+
+func (w *waiters) remove(key string, c chan struct{}) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	cs := w.set[key]
+	if !cs[c] {
+		return
+	}
+
+	delete(cs, c)
+	if len(cs) == 0 {
+		delete(w.set, key)
+		atomic.AddInt32(&w.n, -1)
+	}
+}
+
+// Wakes waiters of key, all of them if key is empty
+func (w *waiters) wake(key string) {
+	if atomic.LoadInt32(&w.n) == 0 {
+		return
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if key != "" {
+		w.close(key, w.set[key])
+		return
+	}
+
+	for k, cs := range w.set {
+		w.close(k, cs)
+	}
+}
+
+// Closes channels of waiters of key, w.mu is held
+func (w *waiters) close(key string, cs map[chan struct{}]bool) {
+	if cs == nil {
+		return
+	}
+
+	for c := range cs {
+		close(c)
+	}
+	delete(w.set, key)
+	atomic.AddInt32(&w.n, -1)
+}
+
+// Version returns version of key, zero if key does not exist
+//
+// Version changes on every write of the key and is
+// unique across all keys of all DBs.
+func (db *DB) Version(key string) uint64 {
+	v, _ := db.meta(key)
+	return v
+}
+
+// Returns version and expiration time of key
+func (db *DB) meta(key string) (uint64, int64) {
+	var (
+		v   uint64
+		exp int64
+	)
+
+	db.view(key, func(n *node) error {
+		v, exp = n.version, n.exp
+		return nil
+	})
+
+	return v, exp
+}
+
+// Watch blocks until version of key differs from version
+// and returns the new one
+//
+// Deleted or expired key has zero version. If nothing changes
+// during timeout it returns the same version and ErrTimeout.
+func (db *DB) Watch(key string, version uint64, timeout time.Duration) (uint64, error) {
+	return db.WatchCancel(key, version, timeout, nil)
+}
+
+// WatchCancel is Watch which returns ErrCanceled with the
+// same version when cancel is closed
+func (db *DB) WatchCancel(key string, version uint64, timeout time.Duration, cancel <-chan struct{}) (uint64, error) {
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+
+	for {
+		// Waiter is added before check to not miss a change
+		c := db.waiters.add(key)
+
+		v, exp := db.meta(key)
+		if v != version {
+			db.waiters.remove(key, c)
+			return v, nil
+		}
+
+		// Expiration is not reported by writers
+		var (
+			t       *time.Timer
+			expired <-chan time.Time
+		)
+		if exp > 0 {
+			t = time.NewTimer(time.Until(time.Unix(exp, 0)))
+			expired = t.C
+		}
+
+		var err error
+		select {
+		case <-c:
+		case <-expired:
+			db.waiters.remove(key, c)
+		case <-deadline.C:
+			db.waiters.remove(key, c)
+			err = ErrTimeout
+		case <-cancel:
+			db.waiters.remove(key, c)
+			err = ErrCanceled
+		}
+
+		if t != nil {
+			t.Stop()
+		}
+		if err != nil {
+			return v, err
+		}
+	}
+}
@@ -0,0 +1,115 @@
+// Package glob matches names by patterns in redis style
+//
+// Star matches any sequence of characters, question mark matches
+// single character, [abc] matches one of characters, [^a] or [!a]
+// negates class, [a-z] is a range and backslash escapes
+// special character.
+package glob
+
+// Match reports whether name matches pattern
+//
+// Matching is linear in pattern by name: star remembers single
+// backtrack point, later star replaces it because everything the
+// earlier star could absorb is absorbed by the later one as well.
+func Match(pattern, name string) bool {
+	var (
+		p, n  int
+		star  = -1 // position in pattern after last star
+		taken int  // position in name the last star is matched to
+	)
+
+	for n < len(name) {
+		if p < len(pattern) {
+			switch c := pattern[p]; c {
+			case '*':
+				for p < len(pattern) && pattern[p] == '*' {
+					p++
+				}
+				if p == len(pattern) {
+					return true
+				}
+				star, taken = p, n
+				continue
+			case '?':
+				p++
+				n++
+				continue
+			case '[':
+				if l, ok := matchClass(pattern[p+1:], name[n]); ok {
+					p += l + 1
+					n++
+					continue
+				}
+			default:
+				if c == '\\' && p+1 < len(pattern) {
+					if pattern[p+1] == name[n] {
+						p += 2
+						n++
+						continue
+					}
+				} else if c == name[n] {
+					p++
+					n++
+					continue
+				}
+			}
+		}
+
+		// Mismatch, the last star absorbs one more character
+		if star < 0 {
+			return false
+		}
+		taken++
+		p, n = star, taken
+	}
+
+	for p < len(pattern) && pattern[p] == '*' {
+		p++
+	}
+
+	return p == len(pattern)
+}
+
+// Returns length of class without closing bracket and match result
+func matchClass(class string, c byte) (int, bool) {
+	negate := false
+	i := 0
+	if i < len(class) && (class[i] == '^' || class[i] == '!') {
+		negate = true
+		i++
+	}
+
+	matched := false
+	for ; i < len(class) && class[i] != ']'; i++ {
+		lo := class[i]
+		if lo == '\\' && i+1 < len(class) {
+			i++
+			lo = class[i]
+		}
+
+		hi := lo
+		if i+2 < len(class) && class[i+1] == '-' && class[i+2] != ']' {
+			hi = class[i+2]
+			i += 2
+		}
+
+		if lo <= c && c <= hi {
+			matched = true
+		}
+	}
+
+	// Position of closing bracket relative to '['
+	return i + 1, matched != negate
+}
+
+// IsPattern reports whether s has special characters
+func IsPattern(s string) bool {
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '*', '?', '[', '\\':
+			return true
+		}
+	}
+
+	return false
+}
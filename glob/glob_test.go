@@ -0,0 +1,65 @@
+package glob
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMatch(t *testing.T) {
+	for _, c := range []struct {
+		pattern, name string
+		match         bool
+	}{
+		{"news", "news", true},
+		{"news", "new", false},
+		{"news.*", "news.sport", true},
+		{"news.*", "news.", true},
+		{"news.*", "weather", false},
+		{"*", "", true},
+		{"h?llo", "hello", true},
+		{"h?llo", "hllo", false},
+		{"h[ae]llo", "hallo", true},
+		{"h[ae]llo", "hillo", false},
+		{"h[^e]llo", "hallo", true},
+		{"h[^e]llo", "hello", false},
+		{"h[a-c]llo", "hbllo", true},
+		{"h[a-c]llo", "hdllo", false},
+		{"user:*:email", "user:42:email", true},
+		{"user:*:email", "user:42:name", false},
+		{`a\*b`, "a*b", true},
+		{`a\*b`, "axb", false},
+		{"*a*b", "xaybzb", true},
+		{"a*b?", "abbbc", true},
+		{"a*[0-9]", "abc", false},
+		{"*?", "", false},
+		{"a*", "a", true},
+	} {
+		if m := Match(c.pattern, c.name); m != c.match {
+			t.Errorf("Match(%q, %q) = %v, expected %v", c.pattern, c.name, m, c.match)
+		}
+	}
+}
+
+func TestMatchPathological(t *testing.T) {
+	pattern := strings.Repeat("*a", 12) + "b"
+	name := strings.Repeat("a", 40)
+
+	done := make(chan bool, 1)
+	go func() {
+		done <- Match(pattern, name)
+	}()
+
+	select {
+	case m := <-done:
+		if m {
+			t.Fatalf("Match(%q, %q) = true", pattern, name)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("pathological pattern is not matched in time")
+	}
+
+	if !Match(pattern, name+"b") {
+		t.Fatalf("Match(%q, %q) = false", pattern, name+"b")
+	}
+}
@@ -0,0 +1,185 @@
+package handler
+
+import (
+	"bytes"
+	"encoding/base64"
+	"strings"
+
+	"github.com/lukashes/db/acl"
+	"github.com/lukashes/db/tlsconfig"
+	"github.com/valyala/fasthttp"
+)
+
+// ACL is nil unless access control is enabled, then every
+// request is authenticated and checked against user rules
+var ACL *acl.ACL
+
+// Commands which manage server rather than keys,
+// they are allowed by admin rule
+var admin = map[string]bool{
+	"cluster": true,
+	"config":  true,
+	"db":      true,
+	"flushdb": true,
+	"swapdb":  true,
+	"script":  true,
+	"stats":   true,
+}
+
+// Keyless commands which could reveal any key, they are
+// allowed only to users with access to all keys. Results of
+// other keyless commands are filtered by patterns of user.
+var allKeys = map[string]bool{
+	"psubscribe":   true,
+	"index create": true,
+	"index drop":   true,
+}
+
+var (
+	basicPrefix  = []byte("Basic ")
+	bearerPrefix = []byte("Bearer ")
+)
+
+// Authenticates request and checks command with its keys,
+// returns false if request is already answered
+func authorize(ctx *fasthttp.RequestCtx, path [][]byte) bool {
+	if ACL == nil {
+		return true
+	}
+
+	user, err := authenticate(ctx)
+	if err == nil {
+		cmd := string(path[1])
+		if admin[cmd] {
+			cmd = acl.Admin
+		}
+		err = ACL.Check(user, cmd, requestKeys(ctx, path)...)
+	}
+	if err == nil {
+		err = ACL.CheckNamespace(user, requestNamespaces(ctx, path)...)
+	}
+	if err == nil && allKeys[subcommand(path)] {
+		err = ACL.CheckAllKeys(user)
+	}
+
+	switch err {
+	case nil:
+		ctx.SetUserValue("user", user)
+		return true
+	case acl.ErrForbidden:
+		ctx.Response.Header.SetStatusCode(fasthttp.StatusForbidden)
+	default:
+		ctx.Response.Header.Set("WWW-Authenticate", `Basic realm="db"`)
+		ctx.Response.Header.SetStatusCode(fasthttp.StatusUnauthorized)
+	}
+	ctx.WriteString(err.Error())
+
+	return false
+}
+
+// Returns name of user by basic or bearer authorization,
+// without them by common name of verified client certificate
+func authenticate(ctx *fasthttp.RequestCtx) (string, error) {
+	h := ctx.Request.Header.Peek("Authorization")
+
+	switch {
+	case len(h) == 0:
+		if ctx.IsTLS() {
+			if name, err := tlsconfig.Subject(ctx.TLSConnectionState()); err == nil && ACL.Exists(name) {
+				return name, nil
+			}
+		}
+		return ACL.Anonymous()
+	case bytes.HasPrefix(h, bearerPrefix):
+		return ACL.Token(string(h[len(bearerPrefix):]))
+	case bytes.HasPrefix(h, basicPrefix):
+		d, err := base64.StdEncoding.DecodeString(string(h[len(basicPrefix):]))
+		if err != nil {
+			return "", acl.ErrUnauthenticated
+		}
+		p := strings.SplitN(string(d), ":", 2)
+		if len(p) != 2 {
+			return "", acl.ErrUnauthenticated
+		}
+		return ACL.Password(p[0], p[1])
+	}
+
+	return "", acl.ErrUnauthenticated
+}
+
+// Returns keys touched by request: key in path
+// and keys listed in keys query argument
+func requestKeys(ctx *fasthttp.RequestCtx, path [][]byte) []string {
+	var keys []string
+
+	cmd := string(path[1])
+	if len(path) > 2 && !keyless[cmd] {
+		key := path[2]
+		// Json commands have key after command name
+		if cmd == "json" && len(path) > 3 {
+			key = path[3]
+		}
+		keys = append(keys, string(key))
+	}
+
+	if k := ctx.QueryArgs().Peek("keys"); len(k) > 0 {
+		keys = append(keys, strings.Split(string(k), ",")...)
+	}
+
+	return keys
+}
+
+// Returns namespaces touched by request: selected one
+// and swapped ones
+func requestNamespaces(ctx *fasthttp.RequestCtx, path [][]byte) []string {
+	names := []string{currentName(ctx)}
+	if string(path[1]) == "swapdb" && len(path) > 3 {
+		names = append(names, string(path[2]), string(path[3]))
+	}
+
+	return names
+}
+
+// Returns command with its subcommand if it has one, e.g.
+// index create
+func subcommand(path [][]byte) string {
+	cmd := string(path[1])
+	if cmd == "index" && len(path) > 2 {
+		return cmd + " " + string(path[2])
+	}
+
+	return cmd
+}
+
+// Returns filter of keys which user of request has access
+// to, see authorize
+func keyFilter(ctx *fasthttp.RequestCtx) func(key string) bool {
+	if ACL == nil {
+		return func(string) bool { return true }
+	}
+
+	// User is resolved now, filter could outlive handler
+	a := ACL
+	user, _ := ctx.UserValue("user").(string)
+
+	return func(key string) bool {
+		return a.CheckKeys(user, key) == nil
+	}
+}
+
+// Returns keys which user of request has access to
+func allowedKeys(ctx *fasthttp.RequestCtx, keys []string) []string {
+	if ACL == nil {
+		return keys
+	}
+
+	allowed := keyFilter(ctx)
+	filtered := make([]string, 0, len(keys))
+	for _, k := range keys {
+		if allowed(k) {
+			filtered = append(filtered, k)
+		}
+	}
+
+	return filtered
+}
@@ -0,0 +1,101 @@
+package handler
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/lukashes/db/db"
+	"github.com/valyala/fasthttp"
+)
+
+// Routes bitmap commands over hash values, path is command,
+// key and offset, bit or operation
+func bitmap(ctx *fasthttp.RequestCtx, path [][]byte) {
+	if len(path) < 3 {
+		ctx.Response.Header.SetStatusCode(fasthttp.StatusBadRequest)
+		return
+	}
+	cmd, key := string(path[1]), string(path[2])
+
+	var arg string
+	if len(path) > 3 {
+		arg = string(path[3])
+	}
+
+	start, ok := queryInt(ctx, "start")
+	if !ok {
+		return
+	}
+	end := -1
+	if len(ctx.QueryArgs().Peek("end")) > 0 {
+		if end, ok = queryInt(ctx, "end"); !ok {
+			return
+		}
+	}
+
+	var (
+		res int
+		err error
+	)
+
+	switch cmd {
+	case "setbit", "getbit":
+		offset, perr := strconv.ParseUint(arg, 10, 64)
+		if perr != nil {
+			ctx.Response.Header.SetStatusCode(fasthttp.StatusBadRequest)
+			return
+		}
+		if cmd == "getbit" {
+			res, err = current(ctx).GetBit(key, offset)
+			break
+		}
+		if !inPlace(ctx) {
+			return
+		}
+		bit, ok := queryInt(ctx, "value")
+		if !ok {
+			return
+		}
+		res, err = current(ctx).SetBit(key, offset, bit)
+	case "bitcount":
+		res, err = current(ctx).BitCount(key, start, end)
+	case "bitpos":
+		bit, perr := strconv.Atoi(arg)
+		if perr != nil {
+			ctx.Response.Header.SetStatusCode(fasthttp.StatusBadRequest)
+			return
+		}
+		res, err = current(ctx).BitPos(key, bit, start, end)
+	case "bitop":
+		op, ok := db.ParseBitOp(arg)
+		if !ok {
+			ctx.Response.Header.SetStatusCode(fasthttp.StatusBadRequest)
+			return
+		}
+		var keys []string
+		if k := ctx.QueryArgs().Peek("keys"); len(k) > 0 {
+			keys = strings.Split(string(k), ",")
+		}
+		if Cluster != nil && !routeAll(ctx, append([]string{key}, keys...)) {
+			return
+		}
+		if !inPlace(ctx) {
+			return
+		}
+		res, err = current(ctx).BitOp(op, key, keys...)
+	}
+
+	if err != nil {
+		switch err {
+		case db.ErrInvalidArgument:
+			ctx.Response.Header.SetStatusCode(fasthttp.StatusBadRequest)
+			ctx.WriteString(err.Error())
+		default:
+			typeError(ctx, cmd, err)
+		}
+		return
+	}
+
+	ctx.WriteString(strconv.Itoa(res))
+	ctx.Response.Header.SetStatusCode(fasthttp.StatusOK)
+}
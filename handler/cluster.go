@@ -0,0 +1,94 @@
+package handler
+
+import (
+	"github.com/lukashes/db/cluster"
+	"github.com/valyala/fasthttp"
+)
+
+// Commands which are not related to one key
+var keyless = map[string]bool{
+	"keys":    true,
+	"stats":   true,
+	"cluster": true,
+
+	// Channels are not keys and are served by every node
+	"publish":    true,
+	"subscribe":  true,
+	"psubscribe": true,
+
+	// Pattern of keys, events are reported by every node for own keys
+	"notify": true,
+
+	// Indexes are created on every node and find own keys
+	"index": true,
+
+	// Scripts are routed by keys in query, they should be in one slot
+	"eval":    true,
+	"evalsha": true,
+	"script":  true,
+
+	// Settings are changed on every node separately
+	"config": true,
+
+	// Namespaces are served only by standalone node
+	"db":      true,
+	"flushdb": true,
+	"swapdb":  true,
+}
+
+// Redirects request if key is served by other node,
+// returns true if request should be served here
+func route(ctx *fasthttp.RequestCtx, key string) bool {
+	node, r := Cluster.Route(key, ctx.QueryArgs().Has("asking"), func() bool {
+		ok, _ := current(ctx).Exists(key)
+		return ok
+	})
+
+	switch r {
+	case cluster.Moved:
+		redirect(ctx, node.Addr, "MOVED")
+	case cluster.Ask:
+		redirect(ctx, node.Addr, "ASK")
+	default:
+		return true
+	}
+
+	return false
+}
+
+// Routes request by keys which should be in one slot,
+// returns true if request should be served here
+func routeAll(ctx *fasthttp.RequestCtx, keys []string) bool {
+	if !cluster.SameSlot(keys...) {
+		ctx.Response.Header.SetStatusCode(fasthttp.StatusBadRequest)
+		ctx.WriteString(cluster.ErrCrossSlot.Error())
+		return false
+	}
+
+	return route(ctx, keys[0])
+}
+
+// Sends client to the same request at addr
+//
+// Asked node serves key only once, so asking flag is added
+// to query instead of changing topology on client.
+func redirect(ctx *fasthttp.RequestCtx, addr, kind string) {
+	u := fasthttp.AcquireURI()
+	defer fasthttp.ReleaseURI(u)
+
+	ctx.URI().CopyTo(u)
+	// Nodes share listener settings, so scheme is kept
+	if ctx.IsTLS() {
+		u.SetScheme("https")
+	} else {
+		u.SetScheme("http")
+	}
+	u.SetHost(addr)
+	if kind == "ASK" {
+		u.QueryArgs().Set("asking", "1")
+	}
+
+	ctx.Response.Header.Set("Location", u.String())
+	ctx.Response.Header.Set("X-Redirect", kind)
+	ctx.Response.Header.SetStatusCode(fasthttp.StatusTemporaryRedirect)
+}
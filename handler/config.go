@@ -0,0 +1,105 @@
+package handler
+
+import (
+	"encoding/json"
+	"strings"
+	"sync"
+
+	"github.com/labstack/gommon/log"
+	"github.com/lukashes/db/config"
+	"github.com/lukashes/db/db"
+	"github.com/lukashes/db/db/namespace"
+	"github.com/valyala/fasthttp"
+)
+
+// Settings of server, runtime ones are changed by config/set
+var (
+	Config   *config.Config
+	configMu sync.Mutex
+)
+
+var logLevels = map[string]log.Lvl{
+	"debug": log.DEBUG,
+	"info":  log.INFO,
+	"warn":  log.WARN,
+	"error": log.ERROR,
+	"off":   log.OFF,
+}
+
+// Configure applies settings of c, it should be called before
+// other setup of handler and serving
+func Configure(c *config.Config) {
+	configMu.Lock()
+	defer configMu.Unlock()
+
+	// Namespaces are created again with options of DB
+	if t := int(c.Memory.Compression); t > 0 {
+		Namespaces = namespace.New(db.WithCompression(t))
+		DB = Namespaces.Default()
+	}
+
+	Config = c
+	applyConfig("")
+}
+
+// Applies changed setting or all of them if name is empty,
+// should be called under configMu
+func applyConfig(name string) {
+	log.SetLevel(logLevels[Config.Log.Level])
+
+	// Memory limits are quota of default namespace, rate stays
+	if strings.HasPrefix(name, "memory.") || (name == "" && (Config.Memory.MaxKeys > 0 || Config.Memory.MaxBytes > 0)) {
+		q, _ := Namespaces.Quota(namespace.Default)
+		q.MaxKeys, q.MaxBytes = Config.Memory.MaxKeys, int64(Config.Memory.MaxBytes)
+		Namespaces.SetQuota(namespace.Default, q)
+	}
+}
+
+// Routes config commands: get with glob pattern of names
+// and set of runtime setting with value in body
+func settings(ctx *fasthttp.RequestCtx, path [][]byte) {
+	if Config == nil || len(path) < 3 {
+		ctx.Response.Header.SetStatusCode(fasthttp.StatusNotFound)
+		return
+	}
+
+	configMu.Lock()
+	defer configMu.Unlock()
+
+	switch string(path[2]) {
+	default:
+		ctx.Response.Header.SetStatusCode(fasthttp.StatusNotFound)
+	case "get":
+		pattern := "*"
+		if len(path) > 3 {
+			pattern = string(path[3])
+		}
+		d, err := json.Marshal(Config.Get(pattern))
+		if err != nil {
+			log.Errorf("config: %s", err)
+			ctx.Response.Header.SetStatusCode(fasthttp.StatusInternalServerError)
+			return
+		}
+		ctx.SetContentType("application/json")
+		ctx.Write(d)
+	case "set":
+		if len(path) < 4 {
+			ctx.Response.Header.SetStatusCode(fasthttp.StatusBadRequest)
+			return
+		}
+		name := string(path[3])
+		switch err := Config.Set(name, string(ctx.PostBody())); err {
+		case nil:
+			applyConfig(name)
+		case config.ErrUnknown:
+			ctx.Response.Header.SetStatusCode(fasthttp.StatusNotFound)
+			ctx.WriteString(err.Error())
+		case config.ErrNotRuntime:
+			ctx.Response.Header.SetStatusCode(fasthttp.StatusConflict)
+			ctx.WriteString(err.Error())
+		default:
+			ctx.Response.Header.SetStatusCode(fasthttp.StatusBadRequest)
+			ctx.WriteString(err.Error())
+		}
+	}
+}
@@ -1 +1,78 @@
 package handler
+
+import (
+	"bytes"
+
+	"github.com/lukashes/db/db"
+	"github.com/lukashes/db/db/namespace"
+	"github.com/valyala/fasthttp"
+)
+
+var dbPrefix = []byte("/v1/db/")
+
+// Strips /v1/db/{name}/ prefix and keeps name of namespace,
+// returns false if request is already answered
+func stripDB(ctx *fasthttp.RequestCtx) bool {
+	p := ctx.Path()
+	if !bytes.HasPrefix(p, dbPrefix) {
+		return true
+	}
+
+	rest := p[len(dbPrefix):]
+	i := bytes.IndexByte(rest, '/')
+	if i < 0 {
+		// Listing of namespaces is /v1/db
+		return true
+	}
+	name := string(rest[:i])
+
+	if !namespace.ValidName(name) {
+		ctx.Response.Header.SetStatusCode(fasthttp.StatusBadRequest)
+		ctx.WriteString(namespace.ErrInvalidName.Error())
+		return false
+	}
+
+	// Only default namespace is replicated and sharded
+	if name != namespace.Default && (Raft != nil || Cluster != nil) {
+		ctx.Response.Header.SetStatusCode(fasthttp.StatusNotImplemented)
+		ctx.WriteString("namespaces are not supported in cluster and consensus modes")
+		return false
+	}
+
+	ctx.SetUserValue("namespace", name)
+	ctx.URI().SetPathBytes(append([]byte("/v1/"), rest[i+1:]...))
+
+	return true
+}
+
+// Selects namespace kept by stripDB, it is created on first use,
+// returns false if request is already answered
+func selectDB(ctx *fasthttp.RequestCtx) bool {
+	d, err := Namespaces.Get(currentName(ctx))
+	if err != nil {
+		ctx.Response.Header.SetStatusCode(fasthttp.StatusInsufficientStorage)
+		ctx.WriteString(err.Error())
+		return false
+	}
+	ctx.SetUserValue("db", d)
+
+	return true
+}
+
+// Returns namespace selected by request, see selectDB
+func current(ctx *fasthttp.RequestCtx) *db.DB {
+	if d, ok := ctx.UserValue("db").(*db.DB); ok {
+		return d
+	}
+
+	return Namespaces.Default()
+}
+
+// Returns name of namespace selected by request
+func currentName(ctx *fasthttp.RequestCtx) string {
+	if name, ok := ctx.UserValue("namespace").(string); ok {
+		return name
+	}
+
+	return namespace.Default
+}
@@ -0,0 +1,112 @@
+package handler
+
+import (
+	"encoding/json"
+	"strings"
+
+	"github.com/lukashes/db/db"
+	"github.com/lukashes/db/script"
+	"github.com/valyala/fasthttp"
+)
+
+// Routes script commands: eval with source in body, evalsha
+// with hash in path and script load or flush
+//
+// Keys are in keys query argument separated by comma, every
+// argument is in own arg query argument. In cluster mode all keys
+// should be in one slot, request is routed by it.
+func eval(ctx *fasthttp.RequestCtx, path [][]byte) {
+	cmd := string(path[1])
+	if cmd == "script" {
+		scriptCmd(ctx, path)
+		return
+	}
+
+	var keys []string
+	if k := ctx.QueryArgs().Peek("keys"); len(k) > 0 {
+		keys = strings.Split(string(k), ",")
+	}
+	if Cluster != nil && len(keys) > 0 && !routeAll(ctx, keys) {
+		return
+	}
+
+	// Writes of scripts are not proposed through raft log
+	if !inPlace(ctx) {
+		return
+	}
+
+	var args []string
+	for _, a := range ctx.QueryArgs().PeekMulti("arg") {
+		args = append(args, string(a))
+	}
+
+	var (
+		res interface{}
+		err error
+	)
+	switch cmd {
+	case "eval":
+		res, err = current(ctx).Eval(string(ctx.PostBody()), keys, args)
+	case "evalsha":
+		if len(path) < 3 {
+			ctx.Response.Header.SetStatusCode(fasthttp.StatusBadRequest)
+			return
+		}
+		res, err = current(ctx).EvalSHA(string(path[2]), keys, args)
+	}
+	if err != nil {
+		scriptError(ctx, cmd, err)
+		return
+	}
+
+	d, err := json.Marshal(res)
+	if err != nil {
+		writeError(ctx, cmd, err)
+		return
+	}
+	ctx.SetContentType("application/json")
+	ctx.Write(d)
+}
+
+func scriptCmd(ctx *fasthttp.RequestCtx, path [][]byte) {
+	if len(path) < 3 {
+		ctx.Response.Header.SetStatusCode(fasthttp.StatusBadRequest)
+		return
+	}
+
+	switch string(path[2]) {
+	default:
+		ctx.Response.Header.SetStatusCode(fasthttp.StatusNotFound)
+	case "load":
+		sha, err := current(ctx).ScriptLoad(string(ctx.PostBody()))
+		if err != nil {
+			scriptError(ctx, "script load", err)
+			return
+		}
+		ctx.WriteString(sha)
+	case "flush":
+		current(ctx).ScriptFlush()
+	}
+}
+
+func scriptError(ctx *fasthttp.RequestCtx, op string, err error) {
+	if e, ok := err.(*script.Error); ok {
+		ctx.Response.Header.SetStatusCode(fasthttp.StatusBadRequest)
+		ctx.WriteString(e.Error())
+		return
+	}
+
+	switch err {
+	case db.ErrNoScript:
+		ctx.Response.Header.SetStatusCode(fasthttp.StatusNotFound)
+		ctx.WriteString(err.Error())
+	case db.ErrUndeclaredKey, db.ErrEmptyKey:
+		ctx.Response.Header.SetStatusCode(fasthttp.StatusBadRequest)
+		ctx.WriteString(err.Error())
+	case db.ErrTimeout:
+		ctx.Response.Header.SetStatusCode(fasthttp.StatusGatewayTimeout)
+		ctx.WriteString(err.Error())
+	default:
+		typeError(ctx, op, err)
+	}
+}
@@ -0,0 +1,92 @@
+package handler
+
+import (
+	"encoding/json"
+	"strconv"
+	"strings"
+
+	"github.com/lukashes/db/db"
+	"github.com/valyala/fasthttp"
+)
+
+// Routes geo commands, arguments are in query
+func geo(ctx *fasthttp.RequestCtx, path [][]byte) {
+	if len(path) < 3 {
+		ctx.Response.Header.SetStatusCode(fasthttp.StatusBadRequest)
+		return
+	}
+	cmd, key := string(path[1]), string(path[2])
+	args := ctx.QueryArgs()
+
+	var (
+		res interface{}
+		err error
+	)
+
+	switch cmd {
+	case "geoadd":
+		if !inPlace(ctx) {
+			return
+		}
+		var points []db.GeoPoint
+		if err := json.Unmarshal(ctx.PostBody(), &points); err != nil {
+			ctx.Response.Header.SetStatusCode(fasthttp.StatusBadRequest)
+			return
+		}
+		res, err = current(ctx).GeoAdd(key, points...)
+	case "geopos":
+		res, err = current(ctx).GeoPos(key, strings.Split(string(args.Peek("members")), ",")...)
+	case "geodist":
+		res, err = current(ctx).GeoDist(key, string(args.Peek("from")), string(args.Peek("to")), string(args.Peek("unit")))
+	case "geosearch":
+		q := db.GeoQuery{
+			Member: string(args.Peek("member")),
+			Unit:   string(args.Peek("unit")),
+			Desc:   string(args.Peek("sort")) == "desc",
+		}
+		for name, v := range map[string]*float64{
+			"lon":    &q.Lon,
+			"lat":    &q.Lat,
+			"radius": &q.Radius,
+			"width":  &q.Width,
+			"height": &q.Height,
+		} {
+			if a := args.Peek(name); len(a) > 0 {
+				f, err := strconv.ParseFloat(string(a), 64)
+				if err != nil {
+					ctx.Response.Header.SetStatusCode(fasthttp.StatusBadRequest)
+					return
+				}
+				*v = f
+			}
+		}
+		var ok bool
+		if q.Count, ok = queryInt(ctx, "count"); !ok {
+			return
+		}
+		res, err = current(ctx).GeoSearch(key, q)
+	}
+
+	if err != nil {
+		switch err {
+		case db.ErrInvalidArgument:
+			ctx.Response.Header.SetStatusCode(fasthttp.StatusBadRequest)
+			ctx.WriteString(err.Error())
+		case db.ErrInvalidIndex:
+			ctx.Response.Header.SetStatusCode(fasthttp.StatusNotFound)
+		default:
+			typeError(ctx, cmd, err)
+		}
+		return
+	}
+
+	d, err := json.Marshal(res)
+	if err != nil {
+		typeError(ctx, cmd, err)
+		return
+	}
+	ctx.SetContentType("application/json")
+	ctx.Write(d)
+
+	ctx.Response.Header.SetStatusCode(fasthttp.StatusOK)
+}
@@ -3,20 +3,37 @@ package handler
 import (
 	"bytes"
 	"strconv"
+	"strings"
 
 	"encoding/json"
 	"github.com/labstack/gommon/log"
+	"github.com/lukashes/db/cluster"
 	"github.com/lukashes/db/db"
+	"github.com/lukashes/db/db/namespace"
 	"github.com/valyala/fasthttp"
 )
 
-var DB *db.DB
+var (
+	// DB is default namespace, replication, raft
+	// and cluster work only with it
+	DB *db.DB
+
+	// Namespaces are selected by /v1/db/{name}/ prefix
+	Namespaces *namespace.Set
+
+	// Cluster is nil if node works standalone
+	Cluster *cluster.Cluster
+)
 
 func init() {
-	DB = db.New()
+	Namespaces = namespace.New()
+	DB = Namespaces.Default()
 }
 
 func Router(ctx *fasthttp.RequestCtx) {
+	if !stripDB(ctx) {
+		return
+	}
 
 	path := bytes.SplitN(bytes.Trim(ctx.Path(), "/"), []byte("/"), 4)
 
@@ -30,12 +47,30 @@ func Router(ctx *fasthttp.RequestCtx) {
 		return
 	}
 
+	if !authorize(ctx, path) || !selectDB(ctx) || !allow(ctx, path) {
+		return
+	}
+
+	// Keys owned by other nodes are redirected
+	if Cluster != nil && len(path) > 2 && !keyless[string(path[1])] {
+		key := path[2]
+		// Json commands have key after command name
+		if string(path[1]) == "json" && len(path) > 3 {
+			key = path[3]
+		}
+		if !route(ctx, string(key)) {
+			return
+		}
+	}
+
 	switch string(path[1]) {
 	default:
 		ctx.Response.Header.SetStatusCode(fasthttp.StatusNotFound)
 		return
 	case "hget":
-		d, err := DB.Read(string(path[2]))
+		// Version is read first, so watching it never misses the value
+		ctx.Response.Header.Set("X-Version", strconv.FormatUint(current(ctx).Version(string(path[2])), 10))
+		r, err := current(ctx).ReadStream(string(path[2]))
 		if err != nil {
 			switch err {
 			case db.ErrNotFound:
@@ -46,9 +81,13 @@ func Router(ctx *fasthttp.RequestCtx) {
 			}
 			return
 		}
-		ctx.Write(d)
+		ctx.SetBodyStream(r, r.Len())
 	case "hset":
-		d := ctx.PostBody()
+		// Body is streamed if server allows it
+		d := ctx.RequestBodyStream()
+		if d == nil {
+			d = bytes.NewReader(ctx.PostBody())
+		}
 		var ttl *int
 		t := ctx.QueryArgs().Peek("ttl")
 		if len(t) > 0 {
@@ -59,24 +98,172 @@ func Router(ctx *fasthttp.RequestCtx) {
 			}
 			ttl = &tt
 		}
-		if err := DB.Write(string(path[2]), d, ttl); err != nil {
+		var err error
+		if Raft != nil {
+			err = Raft.Write(string(path[2]), ctx.PostBody(), ttl)
+		} else {
+			err = current(ctx).WriteStream(string(path[2]), d, ttl)
+		}
+		if err != nil {
+			writeError(ctx, "hset", err)
+			return
+		}
+	case "watch":
+		if len(path) < 3 {
+			ctx.Response.Header.SetStatusCode(fasthttp.StatusBadRequest)
+			return
+		}
+		watch(ctx, string(path[2]))
+		return
+	case "xadd", "xlen", "xrange", "xrevrange", "xread", "xgroup", "xreadgroup", "xack", "xpending":
+		stream(ctx, path)
+		return
+	case "pfadd", "pfcount", "pfmerge", "bfreserve", "bfadd", "bfexists":
+		sketch(ctx, path)
+		return
+	case "setbit", "getbit", "bitcount", "bitpos", "bitop":
+		bitmap(ctx, path)
+		return
+	case "geoadd", "geopos", "geodist", "geosearch":
+		geo(ctx, path)
+		return
+	case "json":
+		document(ctx, path)
+		return
+	case "index":
+		index(ctx, path)
+		return
+	case "eval", "evalsha", "script":
+		eval(ctx, path)
+		return
+	case "config":
+		settings(ctx, path)
+		return
+	case "db":
+		d, err := json.Marshal(Namespaces.Stats())
+		if err != nil {
+			log.Errorf("db: %s", err)
 			ctx.Response.Header.SetStatusCode(fasthttp.StatusInternalServerError)
 			return
 		}
+		ctx.SetContentType("application/json")
+		ctx.Write(d)
+	case "flushdb":
+		if !inPlace(ctx) {
+			return
+		}
+		if err := current(ctx).Flush(); err != nil {
+			writeError(ctx, "flushdb", err)
+			return
+		}
+	case "swapdb":
+		if Raft != nil || Cluster != nil {
+			ctx.Response.Header.SetStatusCode(fasthttp.StatusNotImplemented)
+			return
+		}
+		if len(path) < 4 {
+			ctx.Response.Header.SetStatusCode(fasthttp.StatusBadRequest)
+			return
+		}
+		switch err := Namespaces.SwapDB(string(path[2]), string(path[3])); err {
+		case nil:
+		case db.ErrReadOnly:
+			writeError(ctx, "swapdb", err)
+			return
+		default:
+			ctx.Response.Header.SetStatusCode(fasthttp.StatusBadRequest)
+			ctx.WriteString(err.Error())
+			return
+		}
 	case "rm":
-		if err := DB.Delete(string(path[2])); err != nil {
-			ctx.Response.Header.SetStatusCode(fasthttp.StatusInternalServerError)
+		if err := remove(current(ctx), string(path[2])); err != nil {
+			writeError(ctx, "rm", err)
+			return
 		}
 	case "keys":
-		keys := DB.Keys()
+		keys := allowedKeys(ctx, current(ctx).Keys())
 		for k, v := range keys {
 			if k != 0 {
 				ctx.Write([]byte(","))
 			}
 			ctx.Write([]byte(v))
 		}
+	case "cluster":
+		if Cluster == nil || len(path) < 3 {
+			ctx.Response.Header.SetStatusCode(fasthttp.StatusNotFound)
+			return
+		}
+		switch string(path[2]) {
+		default:
+			ctx.Response.Header.SetStatusCode(fasthttp.StatusNotFound)
+			return
+		case "nodes":
+			d, err := json.Marshal(Cluster.Nodes())
+			if err != nil {
+				log.Errorf("cluster: %s", err)
+				ctx.Response.Header.SetStatusCode(fasthttp.StatusInternalServerError)
+				return
+			}
+			ctx.SetContentType("application/json")
+			ctx.Write(d)
+		case "migrate":
+			if len(path) < 4 {
+				ctx.Response.Header.SetStatusCode(fasthttp.StatusBadRequest)
+				return
+			}
+			slot, err := strconv.Atoi(string(path[3]))
+			if err != nil {
+				ctx.Response.Header.SetStatusCode(fasthttp.StatusBadRequest)
+				return
+			}
+			if err := Cluster.Migrate(DB, slot, string(ctx.QueryArgs().Peek("to"))); err != nil {
+				log.Errorf("cluster: migrate slot %d: %s", slot, err)
+				ctx.Response.Header.SetStatusCode(fasthttp.StatusConflict)
+				ctx.WriteString(err.Error())
+				return
+			}
+		}
+	case "publish":
+		if len(path) < 3 {
+			ctx.Response.Header.SetStatusCode(fasthttp.StatusBadRequest)
+			return
+		}
+		n := current(ctx).Publish(string(path[2]), ctx.PostBody())
+		ctx.WriteString(strconv.Itoa(n))
+	case "subscribe":
+		if len(path) < 3 {
+			ctx.Response.Header.SetStatusCode(fasthttp.StatusBadRequest)
+			return
+		}
+		subscribe(ctx, current(ctx).Subscribe(strings.Split(string(path[2]), ",")...))
+	case "psubscribe":
+		if len(path) < 3 {
+			ctx.Response.Header.SetStatusCode(fasthttp.StatusBadRequest)
+			return
+		}
+		subscribe(ctx, current(ctx).PSubscribe(strings.Split(string(path[2]), ",")...))
+	case "notify":
+		if len(path) < 3 {
+			ctx.Response.Header.SetStatusCode(fasthttp.StatusBadRequest)
+			return
+		}
+		c, ok := classes(string(ctx.QueryArgs().Peek("events")))
+		if !ok {
+			ctx.Response.Header.SetStatusCode(fasthttp.StatusBadRequest)
+			return
+		}
+		notify(ctx, current(ctx).Notify(string(path[2]), c), keyFilter(ctx))
+	case "stats":
+		d, err := json.Marshal(Namespaces.StatsOf(currentName(ctx)))
+		if err != nil {
+			log.Errorf("stats: %s", err)
+			ctx.Response.Header.SetStatusCode(fasthttp.StatusInternalServerError)
+			return
+		}
+		ctx.SetContentType("application/json")
+		ctx.Write(d)
 	case "lset":
-		var d []string
+		var d []db.Value
 		if err := json.Unmarshal(ctx.PostBody(), &d); err != nil {
 			ctx.Response.Header.SetStatusCode(fasthttp.StatusBadRequest)
 			return
@@ -91,8 +278,8 @@ func Router(ctx *fasthttp.RequestCtx) {
 			}
 			ttl = &tt
 		}
-		if err := DB.WriteList(string(path[2]), d, ttl); err != nil {
-			ctx.Response.Header.SetStatusCode(fasthttp.StatusInternalServerError)
+		if err := write(current(ctx), string(path[2]), d, ttl); err != nil {
+			writeError(ctx, "lset", err)
 			return
 		}
 	case "ladd":
@@ -105,7 +292,7 @@ func Router(ctx *fasthttp.RequestCtx) {
 				ctx.Response.Header.SetStatusCode(fasthttp.StatusNotFound)
 				return
 			}
-			d, err := DB.ReadListIndex(string(path[2]), i)
+			d, err := current(ctx).ReadListIndex(string(path[2]), i)
 			if err != nil {
 				switch err {
 				case db.ErrNotFound, db.ErrInvalidIndex:
@@ -120,7 +307,7 @@ func Router(ctx *fasthttp.RequestCtx) {
 			}
 			ctx.Write(d)
 		} else { // Get whole list
-			l, err := DB.ReadList(string(path[2]))
+			l, err := current(ctx).ReadListValues(string(path[2]))
 			if err != nil {
 				switch err {
 				case db.ErrNotFound, db.ErrInvalidIndex:
@@ -142,7 +329,7 @@ func Router(ctx *fasthttp.RequestCtx) {
 			ctx.Write(d)
 		}
 	case "dset":
-		d := map[string]string{}
+		d := map[string]db.Value{}
 		if err := json.Unmarshal(ctx.PostBody(), &d); err != nil {
 			ctx.Response.Header.SetStatusCode(fasthttp.StatusBadRequest)
 			return
@@ -157,8 +344,8 @@ func Router(ctx *fasthttp.RequestCtx) {
 			}
 			ttl = &tt
 		}
-		if err := DB.WriteDict(string(path[2]), d, ttl); err != nil {
-			ctx.Response.Header.SetStatusCode(fasthttp.StatusInternalServerError)
+		if err := write(current(ctx), string(path[2]), d, ttl); err != nil {
+			writeError(ctx, "dset", err)
 			return
 		}
 	case "dadd":
@@ -167,7 +354,7 @@ func Router(ctx *fasthttp.RequestCtx) {
 	case "dget":
 		// Get element by index
 		if len(path) == 4 {
-			d, err := DB.ReadDictIndex(string(path[2]), string(path[3]))
+			d, err := current(ctx).ReadDictIndex(string(path[2]), string(path[3]))
 			if err != nil {
 				switch err {
 				case db.ErrNotFound, db.ErrInvalidIndex:
@@ -182,7 +369,7 @@ func Router(ctx *fasthttp.RequestCtx) {
 			}
 			ctx.Write(d)
 		} else { // Get whole list
-			l, err := DB.ReadDict(string(path[2]))
+			l, err := current(ctx).ReadDictValues(string(path[2]))
 			if err != nil {
 				switch err {
 				case db.ErrNotFound, db.ErrInvalidIndex:
@@ -0,0 +1,164 @@
+package handler
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/lukashes/db/acl"
+	"github.com/lukashes/db/cluster"
+	"github.com/lukashes/db/db/namespace"
+	"github.com/valyala/fasthttp"
+)
+
+func TestShortPath(t *testing.T) {
+	for _, path := range []string{
+		"/v1/publish",
+		"/v1/subscribe",
+		"/v1/psubscribe",
+		"/v1/notify",
+		"/v1/watch",
+		"/v1/xadd",
+		"/v1/xlen",
+		"/v1/xgroup",
+		"/v1/pfadd",
+		"/v1/bfexists",
+		"/v1/setbit",
+		"/v1/bitop",
+		"/v1/geoadd",
+		"/v1/geosearch",
+	} {
+		var ctx fasthttp.RequestCtx
+		ctx.Request.SetRequestURI(path)
+		Router(&ctx)
+
+		if code := ctx.Response.StatusCode(); code != fasthttp.StatusBadRequest {
+			t.Errorf("%s: unexpected status %d", path, code)
+		}
+	}
+}
+
+func TestCrossSlot(t *testing.T) {
+	c, err := cluster.New(cluster.Topology{Nodes: []cluster.Node{
+		{ID: "a", Addr: "127.0.0.1:8080", Slots: [][2]int{{0, cluster.Slots - 1}}},
+	}}, "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	Cluster = c
+	defer func() { Cluster = nil }()
+
+	other := "b"
+	for i := 0; cluster.SameSlot("a", other); i++ {
+		other = fmt.Sprintf("b%d", i)
+	}
+
+	for _, path := range []string{
+		"/v1/eval?keys=a," + other,
+		"/v1/bitop/a/and?keys=" + other,
+		"/v1/pfmerge/a?keys=" + other,
+	} {
+		var ctx fasthttp.RequestCtx
+		ctx.Request.Header.SetMethod("POST")
+		ctx.Request.SetRequestURI(path)
+		ctx.Request.SetBodyString("return 1")
+		Router(&ctx)
+
+		if body := ctx.Response.Body(); string(body) != cluster.ErrCrossSlot.Error() {
+			t.Errorf("%s: unexpected response %d %q", path, ctx.Response.StatusCode(), body)
+		}
+	}
+}
+
+func TestByteQuota(t *testing.T) {
+	ns, d := Namespaces, DB
+	defer func() { Namespaces, DB = ns, d }()
+	Namespaces = namespace.New()
+	DB = Namespaces.Default()
+
+	if err := Namespaces.SetQuota(namespace.Default, namespace.Quota{MaxBytes: 100}); err != nil {
+		t.Fatal(err)
+	}
+
+	var ctx fasthttp.RequestCtx
+	ctx.Request.Header.SetMethod("POST")
+	ctx.Request.SetRequestURI("/v1/setbit/a/8000?value=1")
+	Router(&ctx)
+	if code := ctx.Response.StatusCode(); code != fasthttp.StatusInsufficientStorage {
+		t.Errorf("setbit: unexpected status %d", code)
+	}
+
+	ctx = fasthttp.RequestCtx{}
+	ctx.Request.Header.SetMethod("POST")
+	ctx.Request.SetRequestURI("/v1/hset/a")
+	ctx.Request.Header.SetContentLength(-1)
+	Router(&ctx)
+	if code := ctx.Response.StatusCode(); code != fasthttp.StatusLengthRequired {
+		t.Errorf("chunked hset: unexpected status %d", code)
+	}
+
+	ctx = fasthttp.RequestCtx{}
+	ctx.Request.Header.SetMethod("POST")
+	ctx.Request.SetRequestURI("/v1/setbit/a/80?value=1")
+	Router(&ctx)
+	if code := ctx.Response.StatusCode(); code != fasthttp.StatusOK {
+		t.Errorf("setbit: unexpected status %d", code)
+	}
+}
+
+func TestACL(t *testing.T) {
+	a, err := acl.New(acl.Config{Users: []acl.User{
+		{Name: "app", Tokens: []string{"app"}, Commands: []string{"hget", "hset", "swapdb"}, Keys: []string{"*"}, Namespaces: []string{"app-*"}},
+		{Name: "reader", Tokens: []string{"reader"}, Commands: []string{"keys", "psubscribe", "index"}, Keys: []string{"app:*"}},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ns, d := Namespaces, DB
+	defer func() { ACL, Namespaces, DB = nil, ns, d }()
+	ACL = a
+	Namespaces = namespace.New()
+	DB = Namespaces.Default()
+
+	request := func(token, path string) *fasthttp.RequestCtx {
+		ctx := &fasthttp.RequestCtx{}
+		ctx.Request.Header.SetMethod("POST")
+		ctx.Request.Header.Set("Authorization", "Bearer "+token)
+		ctx.Request.SetRequestURI(path)
+		Router(ctx)
+
+		return ctx
+	}
+
+	for path, code := range map[string]int{
+		"/v1/db/app-1/hset/a": fasthttp.StatusOK,
+		"/v1/hset/a":          fasthttp.StatusForbidden,
+		"/v1/db/other/hset/a": fasthttp.StatusForbidden,
+		"/v1/swapdb/app-1/0":  fasthttp.StatusForbidden,
+	} {
+		if c := request("app", path).Response.StatusCode(); c != code {
+			t.Errorf("%s: unexpected status %d", path, c)
+		}
+	}
+
+	// Keyless commands are filtered or require all keys
+	DB.WriteDict("app:1", map[string]string{"name": "donald"}, nil)
+	DB.WriteDict("other", map[string]string{"name": "donald"}, nil)
+	if err := DB.CreateIndex("name", "*", "name"); err != nil {
+		t.Fatal(err)
+	}
+
+	for path, body := range map[string]string{
+		"/v1/keys":                         "app:1",
+		"/v1/index/find/name?value=donald": `["app:1"]`,
+	} {
+		ctx := request("reader", path)
+		if b := ctx.Response.Body(); string(b) != body {
+			t.Errorf("%s: unexpected response %d %q", path, ctx.Response.StatusCode(), b)
+		}
+	}
+	for _, path := range []string{"/v1/psubscribe/*", "/v1/index/drop/name"} {
+		if c := request("reader", path).Response.StatusCode(); c != fasthttp.StatusForbidden {
+			t.Errorf("%s: unexpected status %d", path, c)
+		}
+	}
+}
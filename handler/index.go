@@ -0,0 +1,88 @@
+package handler
+
+import (
+	"encoding/json"
+
+	"github.com/lukashes/db/db"
+	"github.com/valyala/fasthttp"
+)
+
+// Routes secondary index commands, path is index, command and
+// name of index
+//
+// Indexes are local, in cluster mode every node finds only
+// own keys.
+func index(ctx *fasthttp.RequestCtx, path [][]byte) {
+	if len(path) < 4 {
+		ctx.Response.Header.SetStatusCode(fasthttp.StatusBadRequest)
+		return
+	}
+
+	cmd, name := string(path[2]), string(path[3])
+
+	var (
+		keys []string
+		err  error
+	)
+	switch cmd {
+	default:
+		ctx.Response.Header.SetStatusCode(fasthttp.StatusNotFound)
+		return
+	case "create":
+		args := ctx.QueryArgs()
+		err = current(ctx).CreateIndex(name, string(args.Peek("pattern")), string(args.Peek("field")))
+	case "drop":
+		err = current(ctx).DropIndex(name)
+	case "find":
+		keys, err = current(ctx).FindByIndex(name, queryValue(ctx.QueryArgs().Peek("value")))
+	case "range":
+		count, ok := queryInt(ctx, "count")
+		if !ok {
+			return
+		}
+		var min, max *db.Value
+		if v := ctx.QueryArgs().Peek("min"); len(v) > 0 {
+			m := queryValue(v)
+			min = &m
+		}
+		if v := ctx.QueryArgs().Peek("max"); len(v) > 0 {
+			m := queryValue(v)
+			max = &m
+		}
+		keys, err = current(ctx).FindRange(name, min, max, count)
+	}
+
+	if err != nil {
+		switch err {
+		case db.ErrInvalidArgument:
+			ctx.Response.Header.SetStatusCode(fasthttp.StatusBadRequest)
+			ctx.WriteString(err.Error())
+		default:
+			typeError(ctx, "index "+cmd, err)
+		}
+		return
+	}
+
+	if keys != nil {
+		d, err := json.Marshal(allowedKeys(ctx, keys))
+		if err != nil {
+			writeError(ctx, "index "+cmd, err)
+			return
+		}
+		ctx.SetContentType("application/json")
+		ctx.Write(d)
+	}
+
+	ctx.Response.Header.SetStatusCode(fasthttp.StatusOK)
+}
+
+// Decodes value in wire encoding of list elements,
+// text which is not json is taken as string
+func queryValue(b []byte) db.Value {
+	var v db.Value
+	if err := json.Unmarshal(b, &v); err != nil {
+		return db.String(string(b))
+	}
+
+	return v
+}
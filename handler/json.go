@@ -0,0 +1,94 @@
+package handler
+
+import (
+	"encoding/json"
+	"strconv"
+
+	"github.com/lukashes/db/db"
+	"github.com/valyala/fasthttp"
+)
+
+// Routes json document commands, path is json, command and key,
+// json path is in path query argument
+func document(ctx *fasthttp.RequestCtx, path [][]byte) {
+	if len(path) < 4 {
+		ctx.Response.Header.SetStatusCode(fasthttp.StatusBadRequest)
+		return
+	}
+
+	cmd, key := string(path[2]), string(path[3])
+	p := string(ctx.QueryArgs().Peek("path"))
+
+	var err error
+	switch cmd {
+	default:
+		ctx.Response.Header.SetStatusCode(fasthttp.StatusNotFound)
+		return
+	case "get":
+		var d []byte
+		if d, err = current(ctx).JSONGet(key, p); err == nil {
+			ctx.SetContentType("application/json")
+			ctx.Write(d)
+		}
+	case "type":
+		var t string
+		if t, err = current(ctx).JSONType(key); err == nil {
+			ctx.WriteString(t)
+		}
+	case "set":
+		if !inPlace(ctx) {
+			return
+		}
+		err = current(ctx).JSONSet(key, p, ctx.PostBody())
+	case "del":
+		if !inPlace(ctx) {
+			return
+		}
+		err = current(ctx).JSONDel(key, p)
+	case "arrappend":
+		if !inPlace(ctx) {
+			return
+		}
+		var vals []json.RawMessage
+		if err := json.Unmarshal(ctx.PostBody(), &vals); err != nil {
+			ctx.Response.Header.SetStatusCode(fasthttp.StatusBadRequest)
+			return
+		}
+		raw := make([][]byte, len(vals))
+		for i, v := range vals {
+			raw[i] = v
+		}
+		var l int
+		if l, err = current(ctx).JSONArrAppend(key, p, raw...); err == nil {
+			ctx.WriteString(strconv.Itoa(l))
+		}
+	case "numincrby":
+		if !inPlace(ctx) {
+			return
+		}
+		by, perr := strconv.ParseFloat(string(ctx.QueryArgs().Peek("by")), 64)
+		if perr != nil {
+			ctx.Response.Header.SetStatusCode(fasthttp.StatusBadRequest)
+			return
+		}
+		var n float64
+		if n, err = current(ctx).JSONNumIncrBy(key, p, by); err == nil {
+			ctx.WriteString(strconv.FormatFloat(n, 'g', -1, 64))
+		}
+	}
+
+	if err != nil {
+		switch err {
+		case db.ErrInvalidArgument:
+			ctx.Response.Header.SetStatusCode(fasthttp.StatusBadRequest)
+			ctx.WriteString(err.Error())
+		case db.ErrInvalidIndex:
+			ctx.Response.Header.SetStatusCode(fasthttp.StatusNotFound)
+		default:
+			typeError(ctx, "json "+cmd, err)
+		}
+		return
+	}
+
+	ctx.Response.Header.SetStatusCode(fasthttp.StatusOK)
+}
@@ -0,0 +1,138 @@
+package handler
+
+import (
+	"bufio"
+	"encoding/json"
+	"strings"
+	"time"
+
+	"github.com/labstack/gommon/log"
+	"github.com/lukashes/db/db"
+	"github.com/lukashes/db/pubsub"
+	"github.com/valyala/fasthttp"
+)
+
+// Comment is sent to idle streams to find closed connections
+const keepAlive = 15 * time.Second
+
+type message struct {
+	Channel string `json:"channel"`
+	Pattern string `json:"pattern,omitempty"`
+	Data    string `json:"data"`
+}
+
+// Streams messages of subscription as server-sent events
+//
+// Subscription is closed when client goes away or hub disconnects
+// it as slow consumer, the last case is reported by error event.
+func subscribe(ctx *fasthttp.RequestCtx, s *pubsub.Subscription) {
+	ctx.SetContentType("text/event-stream")
+	ctx.Response.Header.Set("Cache-Control", "no-cache")
+
+	ctx.SetBodyStreamWriter(func(w *bufio.Writer) {
+		defer s.Close()
+
+		t := time.NewTicker(keepAlive)
+		defer t.Stop()
+
+		for {
+			select {
+			case m, ok := <-s.C:
+				if !ok {
+					event(w, "error", s.Err().Error())
+					w.Flush()
+					return
+				}
+				event(w, "message", message{
+					Channel: m.Channel,
+					Pattern: m.Pattern,
+					Data:    string(m.Payload),
+				})
+			case <-t.C:
+				w.WriteString(": ping\n\n")
+			}
+
+			if err := w.Flush(); err != nil {
+				return
+			}
+		}
+	})
+}
+
+// Writes event with json encoded data
+func event(w *bufio.Writer, name string, v interface{}) {
+	d, err := json.Marshal(v)
+	if err != nil {
+		log.Errorf("event: %s", err)
+		return
+	}
+
+	w.WriteString("event: ")
+	w.WriteString(name)
+	w.WriteString("\ndata: ")
+	w.Write(d)
+	w.WriteString("\n\n")
+}
+
+type notification struct {
+	Event string `json:"event"`
+	Key   string `json:"key"`
+	Type  string `json:"type"`
+}
+
+// Streams keyspace events of listener as server-sent events,
+// events of keys which are not allowed are skipped
+func notify(ctx *fasthttp.RequestCtx, l *db.Listener, allowed func(key string) bool) {
+	ctx.SetContentType("text/event-stream")
+	ctx.Response.Header.Set("Cache-Control", "no-cache")
+
+	ctx.SetBodyStreamWriter(func(w *bufio.Writer) {
+		defer l.Close()
+
+		t := time.NewTicker(keepAlive)
+		defer t.Stop()
+
+		for {
+			select {
+			case e, ok := <-l.C:
+				if !ok {
+					event(w, "error", l.Err().Error())
+					w.Flush()
+					return
+				}
+				n := notification{Event: e.Type.String(), Key: e.Key}
+				if e.Type != db.EventFlush {
+					if !allowed(e.Key) {
+						continue
+					}
+					n.Type = e.DataType.String()
+				}
+				event(w, e.Type.String(), n)
+			case <-t.C:
+				w.WriteString(": ping\n\n")
+			}
+
+			if err := w.Flush(); err != nil {
+				return
+			}
+		}
+	})
+}
+
+// Parses comma separated event classes, empty means all
+func classes(s string) (db.Class, bool) {
+	if s == "" {
+		return db.ClassAll, true
+	}
+
+	var c db.Class
+	for _, name := range strings.Split(s, ",") {
+		cc, ok := db.ParseClass(name)
+		if !ok {
+			return 0, false
+		}
+		c |= cc
+	}
+
+	return c, true
+}
@@ -0,0 +1,90 @@
+package handler
+
+import (
+	"errors"
+	"math"
+	"strconv"
+
+	"github.com/lukashes/db/db/namespace"
+	"github.com/valyala/fasthttp"
+)
+
+var errLengthRequired = errors.New("content length is required by bytes quota")
+
+// Commands which could add keys or grow values,
+// they are checked against keys and bytes quota
+var growing = map[string]bool{
+	"hset":    true,
+	"lset":    true,
+	"dset":    true,
+	"xadd":    true,
+	"xgroup":  true,
+	"pfadd":   true,
+	"pfmerge": true,
+
+	"bfreserve": true,
+	"bfadd":     true,
+	"setbit":    true,
+	"bitop":     true,
+	"geoadd":    true,
+	"json":      true,
+	"eval":      true,
+	"evalsha":   true,
+}
+
+// Commands which replace value of key, so only
+// difference of sizes is checked against bytes quota
+var replacing = map[string]bool{
+	"hset": true,
+	"lset": true,
+	"dset": true,
+}
+
+// Checks request against quota of namespace,
+// returns false if request is already answered
+func allow(ctx *fasthttp.RequestCtx, path [][]byte) bool {
+	var key string
+	if keys := requestKeys(ctx, path); len(keys) > 0 {
+		key = keys[0]
+	}
+
+	name := currentName(ctx)
+
+	size := -1
+	if growing[string(path[1])] {
+		// Chunked body has unknown length, -2 is no body
+		size = ctx.Request.Header.ContentLength()
+		if q, ok := Namespaces.Quota(name); size == -1 && ok && q.MaxBytes > 0 {
+			ctx.Response.Header.SetStatusCode(fasthttp.StatusLengthRequired)
+			ctx.WriteString(errLengthRequired.Error())
+			return false
+		}
+		if size < 0 {
+			size = 0
+		}
+
+		// Bitmap grows up to offset regardless of body
+		if string(path[1]) == "setbit" && len(path) > 3 {
+			off, err := strconv.ParseUint(string(path[3]), 10, 64)
+			if err == nil && off/8 >= uint64(size) {
+				size = math.MaxInt32
+				if off/8 < math.MaxInt32 {
+					size = int(off/8 + 1)
+				}
+			}
+		}
+	}
+
+	switch err := Namespaces.Allow(name, key, size, replacing[string(path[1])]); err {
+	case nil:
+		return true
+	case namespace.ErrRateLimited:
+		ctx.Response.Header.SetStatusCode(fasthttp.StatusTooManyRequests)
+		ctx.WriteString(err.Error())
+	default:
+		ctx.Response.Header.SetStatusCode(fasthttp.StatusInsufficientStorage)
+		ctx.WriteString(err.Error())
+	}
+
+	return false
+}
@@ -0,0 +1,114 @@
+package handler
+
+import (
+	"encoding/json"
+	"strconv"
+	"strings"
+
+	"github.com/lukashes/db/db"
+	"github.com/valyala/fasthttp"
+)
+
+// Routes HyperLogLog and Bloom filter commands
+//
+// Other keys of multi key commands are in keys query argument,
+// in cluster mode they should be in the same slot as key.
+func sketch(ctx *fasthttp.RequestCtx, path [][]byte) {
+	if len(path) < 3 {
+		ctx.Response.Header.SetStatusCode(fasthttp.StatusBadRequest)
+		return
+	}
+	cmd, key := string(path[1]), string(path[2])
+
+	var item string
+	if len(path) > 3 {
+		item = string(path[3])
+	}
+
+	var others []string
+	if k := ctx.QueryArgs().Peek("keys"); len(k) > 0 {
+		others = strings.Split(string(k), ",")
+	}
+	if Cluster != nil && len(others) > 0 && !routeAll(ctx, append([]string{key}, others...)) {
+		return
+	}
+
+	var err error
+	switch cmd {
+	case "pfadd":
+		if !inPlace(ctx) {
+			return
+		}
+		var elems []string
+		if err := json.Unmarshal(ctx.PostBody(), &elems); err != nil {
+			ctx.Response.Header.SetStatusCode(fasthttp.StatusBadRequest)
+			return
+		}
+		var changed bool
+		if changed, err = current(ctx).PFAdd(key, elems...); err == nil {
+			ctx.WriteString(flag(changed))
+		}
+	case "pfcount":
+		var n uint64
+		if n, err = current(ctx).PFCount(append([]string{key}, others...)...); err == nil {
+			ctx.WriteString(strconv.FormatUint(n, 10))
+		}
+	case "pfmerge":
+		if !inPlace(ctx) {
+			return
+		}
+		err = current(ctx).PFMerge(key, others...)
+	case "bfreserve":
+		if !inPlace(ctx) {
+			return
+		}
+		rate, capacity := db.DefaultErrorRate, db.DefaultCapacity
+		if r := ctx.QueryArgs().Peek("error_rate"); len(r) > 0 {
+			if rate, err = strconv.ParseFloat(string(r), 64); err != nil {
+				ctx.Response.Header.SetStatusCode(fasthttp.StatusBadRequest)
+				return
+			}
+		}
+		if c := ctx.QueryArgs().Peek("capacity"); len(c) > 0 {
+			if capacity, err = strconv.Atoi(string(c)); err != nil {
+				ctx.Response.Header.SetStatusCode(fasthttp.StatusBadRequest)
+				return
+			}
+		}
+		err = current(ctx).BFReserve(key, rate, capacity)
+	case "bfadd":
+		if !inPlace(ctx) {
+			return
+		}
+		var added bool
+		if added, err = current(ctx).BFAdd(key, item); err == nil {
+			ctx.WriteString(flag(added))
+		}
+	case "bfexists":
+		var found bool
+		if found, err = current(ctx).BFExists(key, item); err == nil {
+			ctx.WriteString(flag(found))
+		}
+	}
+
+	if err != nil {
+		switch err {
+		case db.ErrInvalidArgument:
+			ctx.Response.Header.SetStatusCode(fasthttp.StatusBadRequest)
+			ctx.WriteString(err.Error())
+		default:
+			typeError(ctx, cmd, err)
+		}
+		return
+	}
+
+	ctx.Response.Header.SetStatusCode(fasthttp.StatusOK)
+}
+
+func flag(ok bool) string {
+	if ok {
+		return "1"
+	}
+
+	return "0"
+}
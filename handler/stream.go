@@ -0,0 +1,195 @@
+package handler
+
+import (
+	"encoding/json"
+	"strconv"
+	"time"
+
+	"github.com/lukashes/db/db"
+	"github.com/valyala/fasthttp"
+)
+
+// Longest wait of blocking stream reads
+const maxBlock = 10 * time.Minute
+
+// Routes stream commands, path is command, key and group
+func stream(ctx *fasthttp.RequestCtx, path [][]byte) {
+	if len(path) < 3 {
+		ctx.Response.Header.SetStatusCode(fasthttp.StatusBadRequest)
+		return
+	}
+	cmd, key := string(path[1]), string(path[2])
+
+	var group string
+	switch {
+	case len(path) > 3:
+		group = string(path[3])
+	case cmd == "xgroup", cmd == "xreadgroup", cmd == "xack", cmd == "xpending":
+		ctx.Response.Header.SetStatusCode(fasthttp.StatusBadRequest)
+		return
+	}
+
+	args := ctx.QueryArgs()
+	count, ok := queryInt(ctx, "count")
+	if !ok {
+		return
+	}
+	block, ok := queryDuration(ctx, "block")
+	if !ok {
+		return
+	}
+
+	var (
+		res interface{}
+		err error
+	)
+
+	switch cmd {
+	case "xadd":
+		if !inPlace(ctx) {
+			return
+		}
+		maxLen, ok := queryInt(ctx, "maxlen")
+		if !ok {
+			return
+		}
+		fields := map[string]string{}
+		if err := json.Unmarshal(ctx.PostBody(), &fields); err != nil {
+			ctx.Response.Header.SetStatusCode(fasthttp.StatusBadRequest)
+			return
+		}
+		id := string(args.Peek("id"))
+		if id == "" {
+			id = "*"
+		}
+		var next db.StreamID
+		if next, err = current(ctx).XAdd(key, id, fields, maxLen); err == nil {
+			ctx.WriteString(next.String())
+		}
+	case "xlen":
+		var l int
+		if l, err = current(ctx).XLen(key); err == nil {
+			ctx.WriteString(strconv.Itoa(l))
+		}
+	case "xrange", "xrevrange":
+		start, end := string(args.Peek("start")), string(args.Peek("end"))
+		if start == "" {
+			start = "-"
+		}
+		if end == "" {
+			end = "+"
+		}
+		if cmd == "xrange" {
+			res, err = current(ctx).XRange(key, start, end, count)
+		} else {
+			res, err = current(ctx).XRevRange(key, end, start, count)
+		}
+	case "xread":
+		id := string(args.Peek("id"))
+		if id == "" {
+			id = "$"
+		}
+		res, err = current(ctx).XRead(key, id, count, block)
+	case "xgroup":
+		if !inPlace(ctx) {
+			return
+		}
+		start := string(args.Peek("start"))
+		if start == "" {
+			start = "$"
+		}
+		err = current(ctx).XGroupCreate(key, group, start, args.Has("mkstream"))
+	case "xreadgroup":
+		if !inPlace(ctx) {
+			return
+		}
+		id := string(args.Peek("id"))
+		if id == "" {
+			id = ">"
+		}
+		res, err = current(ctx).XReadGroup(key, group, string(args.Peek("consumer")), id, count, block)
+	case "xack":
+		if !inPlace(ctx) {
+			return
+		}
+		var ids []db.StreamID
+		if err := json.Unmarshal(ctx.PostBody(), &ids); err != nil {
+			ctx.Response.Header.SetStatusCode(fasthttp.StatusBadRequest)
+			return
+		}
+		var n int
+		if n, err = current(ctx).XAck(key, group, ids...); err == nil {
+			ctx.WriteString(strconv.Itoa(n))
+		}
+	case "xpending":
+		res, err = current(ctx).XPending(key, group)
+	}
+
+	if err != nil {
+		typeError(ctx, cmd, err)
+		return
+	}
+
+	if res != nil {
+		d, err := json.Marshal(res)
+		if err != nil {
+			typeError(ctx, cmd, err)
+			return
+		}
+		ctx.SetContentType("application/json")
+		ctx.Write(d)
+	}
+
+	ctx.Response.Header.SetStatusCode(fasthttp.StatusOK)
+}
+
+// Maps errors of commands on typed values
+func typeError(ctx *fasthttp.RequestCtx, op string, err error) {
+	switch err {
+	case db.ErrNotFound, db.ErrNoGroup, db.ErrNoIndex:
+		ctx.Response.Header.SetStatusCode(fasthttp.StatusNotFound)
+	case db.ErrInvalidType, db.ErrExists:
+		ctx.Response.Header.SetStatusCode(fasthttp.StatusConflict)
+		ctx.WriteString(err.Error())
+	case db.ErrInvalidID:
+		ctx.Response.Header.SetStatusCode(fasthttp.StatusBadRequest)
+		ctx.WriteString(err.Error())
+	default:
+		writeError(ctx, op, err)
+	}
+}
+
+// Returns integer query argument, zero if it is not set
+func queryInt(ctx *fasthttp.RequestCtx, name string) (int, bool) {
+	v := ctx.QueryArgs().Peek(name)
+	if len(v) == 0 {
+		return 0, true
+	}
+
+	i, err := strconv.Atoi(string(v))
+	if err != nil {
+		ctx.Response.Header.SetStatusCode(fasthttp.StatusBadRequest)
+		return 0, false
+	}
+
+	return i, true
+}
+
+// Returns duration query argument limited by maxBlock
+func queryDuration(ctx *fasthttp.RequestCtx, name string) (time.Duration, bool) {
+	v := ctx.QueryArgs().Peek(name)
+	if len(v) == 0 {
+		return 0, true
+	}
+
+	d, err := time.ParseDuration(string(v))
+	if err != nil || d < 0 {
+		ctx.Response.Header.SetStatusCode(fasthttp.StatusBadRequest)
+		return 0, false
+	}
+	if d > maxBlock {
+		d = maxBlock
+	}
+
+	return d, true
+}
@@ -0,0 +1,81 @@
+package handler
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/labstack/gommon/log"
+	"github.com/lukashes/db/db"
+	"github.com/valyala/fasthttp"
+)
+
+const (
+	watchTimeout    = 30 * time.Second
+	maxWatchTimeout = 10 * time.Minute
+)
+
+// Waits until version of key differs from version query argument
+//
+// Responds with the new value and X-Version header, 404 if key
+// was deleted or 304 if nothing changed during timeout.
+func watch(ctx *fasthttp.RequestCtx, key string) {
+	var (
+		version uint64
+		timeout = watchTimeout
+		err     error
+	)
+
+	if v := ctx.QueryArgs().Peek("version"); len(v) > 0 {
+		if version, err = strconv.ParseUint(string(v), 10, 64); err != nil {
+			ctx.Response.Header.SetStatusCode(fasthttp.StatusBadRequest)
+			return
+		}
+	}
+
+	if t := ctx.QueryArgs().Peek("timeout"); len(t) > 0 {
+		if timeout, err = time.ParseDuration(string(t)); err != nil || timeout < 0 {
+			ctx.Response.Header.SetStatusCode(fasthttp.StatusBadRequest)
+			return
+		}
+		if timeout > maxWatchTimeout {
+			timeout = maxWatchTimeout
+		}
+	}
+
+	// Namespace could be swapped meanwhile, so value is
+	// read from DB which is selected by name after watch
+	name := currentName(ctx)
+	v, err := Namespaces.Watch(name, key, version, timeout)
+	ctx.Response.Header.Set("X-Version", strconv.FormatUint(v, 10))
+	if err == db.ErrTimeout {
+		ctx.Response.Header.SetStatusCode(fasthttp.StatusNotModified)
+		return
+	}
+	if v == 0 {
+		ctx.Response.Header.SetStatusCode(fasthttp.StatusNotFound)
+		return
+	}
+
+	// Key could change again, newer value is still fine for watcher
+	d, err := Namespaces.Get(name)
+	if err != nil {
+		ctx.Response.Header.SetStatusCode(fasthttp.StatusNotFound)
+		return
+	}
+	r, err := d.ReadStream(key)
+	switch err {
+	case nil:
+		ctx.SetBodyStream(r, r.Len())
+	case db.ErrNotFound:
+		ctx.Response.Header.SetStatusCode(fasthttp.StatusNotFound)
+		return
+	case db.ErrInvalidType:
+		// Version is enough for other types
+	default:
+		log.Errorf("watch: %s", err)
+		ctx.Response.Header.SetStatusCode(fasthttp.StatusInternalServerError)
+		return
+	}
+
+	ctx.Response.Header.SetStatusCode(fasthttp.StatusOK)
+}
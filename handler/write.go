@@ -0,0 +1,70 @@
+package handler
+
+import (
+	"github.com/labstack/gommon/log"
+	"github.com/lukashes/db/db"
+	"github.com/lukashes/db/raft"
+	"github.com/valyala/fasthttp"
+)
+
+// Raft is nil unless consensus mode is enabled,
+// then all writes are proposed through raft log
+var Raft *raft.Node
+
+// Writes list or dict
+func write(d *db.DB, key string, val interface{}, ttl *int) error {
+	if Raft != nil {
+		return Raft.Write(key, val, ttl)
+	}
+
+	switch t := val.(type) {
+	case []db.Value:
+		return d.WriteListValues(key, t, ttl)
+	case map[string]db.Value:
+		return d.WriteDictValues(key, t, ttl)
+	}
+
+	return db.ErrInvalidType
+}
+
+func remove(d *db.DB, key string) error {
+	if Raft != nil {
+		return Raft.Delete(key)
+	}
+
+	return d.Delete(key)
+}
+
+// Commands changing values in place are not proposed
+// through raft log, they are served only without it
+func inPlace(ctx *fasthttp.RequestCtx) bool {
+	if Raft != nil {
+		ctx.Response.Header.SetStatusCode(fasthttp.StatusNotImplemented)
+		ctx.WriteString("not supported in consensus mode")
+		return false
+	}
+
+	return true
+}
+
+func writeError(ctx *fasthttp.RequestCtx, op string, err error) {
+	switch err {
+	case db.ErrReadOnly:
+		ctx.Response.Header.SetStatusCode(fasthttp.StatusForbidden)
+		ctx.WriteString(err.Error())
+	case db.ErrEmptyKey, db.ErrInvalidType:
+		ctx.Response.Header.SetStatusCode(fasthttp.StatusBadRequest)
+	case raft.ErrNotLeader:
+		if id, _ := Raft.Leader(); id != "" {
+			ctx.Response.Header.Set("X-Raft-Leader", id)
+		}
+		ctx.Response.Header.SetStatusCode(fasthttp.StatusServiceUnavailable)
+		ctx.WriteString(err.Error())
+	case raft.ErrTimeout, raft.ErrLeadershipLost:
+		ctx.Response.Header.SetStatusCode(fasthttp.StatusGatewayTimeout)
+		ctx.WriteString(err.Error())
+	default:
+		log.Errorf("%s: %s", op, err)
+		ctx.Response.Header.SetStatusCode(fasthttp.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,105 @@
+// Package handshake authenticates connections between nodes by
+// shared secret
+//
+// Both sides send random challenge and answer challenges of both
+// sides by HMAC-SHA256 with the secret, so the secret is never
+// sent and answers could not be replayed. Answers are bound to
+// role of the side, so server could not be used to answer own
+// challenge. Data sent after handshake is not authenticated,
+// TLS should be used against tampering.
+package handshake
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"io"
+	"net"
+	"time"
+)
+
+const (
+	challengeSize = 32
+
+	// Handshake should fit in it, deadline is reset after
+	timeout = 5 * time.Second
+)
+
+var ErrDenied = errors.New("handshake: peer is not authenticated")
+
+// Client authenticates connection of dialing side
+func Client(conn net.Conn, secret []byte) error {
+	conn.SetDeadline(time.Now().Add(timeout))
+	defer conn.SetDeadline(time.Time{})
+
+	server := make([]byte, challengeSize)
+	if _, err := io.ReadFull(conn, server); err != nil {
+		return err
+	}
+
+	client, err := challenge()
+	if err != nil {
+		return err
+	}
+	msg := append(client, answer(secret, "client", server, client)...)
+	if _, err := conn.Write(msg); err != nil {
+		return err
+	}
+
+	got := make([]byte, sha256.Size)
+	if _, err := io.ReadFull(conn, got); err != nil {
+		// Server closes connection on wrong answer
+		return ErrDenied
+	}
+	if !hmac.Equal(got, answer(secret, "server", server, client)) {
+		return ErrDenied
+	}
+
+	return nil
+}
+
+// Server authenticates connection of accepting side
+func Server(conn net.Conn, secret []byte) error {
+	conn.SetDeadline(time.Now().Add(timeout))
+	defer conn.SetDeadline(time.Time{})
+
+	server, err := challenge()
+	if err != nil {
+		return err
+	}
+	if _, err := conn.Write(server); err != nil {
+		return err
+	}
+
+	msg := make([]byte, challengeSize+sha256.Size)
+	if _, err := io.ReadFull(conn, msg); err != nil {
+		return err
+	}
+	client := msg[:challengeSize]
+	if !hmac.Equal(msg[challengeSize:], answer(secret, "client", server, client)) {
+		return ErrDenied
+	}
+
+	_, err = conn.Write(answer(secret, "server", server, client))
+
+	return err
+}
+
+func challenge() ([]byte, error) {
+	b := make([]byte, challengeSize)
+	if _, err := rand.Read(b); err != nil {
+		return nil, err
+	}
+
+	return b, nil
+}
+
+func answer(secret []byte, role string, server, client []byte) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(role))
+	mac.Write(server)
+	mac.Write(client)
+
+	return mac.Sum(nil)
+}
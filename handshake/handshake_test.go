@@ -0,0 +1,33 @@
+package handshake
+
+import (
+	"net"
+	"testing"
+)
+
+func TestHandshake(t *testing.T) {
+	for _, c := range []struct {
+		client, server string
+		err            error
+	}{
+		{"secret", "secret", nil},
+		{"wrong", "secret", ErrDenied},
+	} {
+		a, b := net.Pipe()
+
+		done := make(chan error, 1)
+		go func() {
+			err := Server(b, []byte(c.server))
+			b.Close()
+			done <- err
+		}()
+
+		if err := Client(a, []byte(c.client)); err != c.err {
+			t.Errorf("%s/%s: expected client error %v, got %v", c.client, c.server, c.err, err)
+		}
+		if err := <-done; err != c.err {
+			t.Errorf("%s/%s: expected server error %v, got %v", c.client, c.server, c.err, err)
+		}
+		a.Close()
+	}
+}
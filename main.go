@@ -1,17 +1,330 @@
 package main
 
 import (
+	"crypto/tls"
+	"flag"
+	"fmt"
 	"log"
+	"net"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
 
+	"github.com/lukashes/db/acl"
+	"github.com/lukashes/db/cluster"
+	"github.com/lukashes/db/config"
+	"github.com/lukashes/db/db/namespace"
 	"github.com/lukashes/db/handler"
+	"github.com/lukashes/db/persist"
+	"github.com/lukashes/db/raft"
+	"github.com/lukashes/db/replication"
+	"github.com/lukashes/db/tlsconfig"
 	"github.com/valyala/fasthttp"
 )
 
-const (
-	addr = ":8080"
-)
-
 func main() {
-	log.Printf("Started on %s", addr)
-	fasthttp.ListenAndServe(addr, handler.Router)
+	cfg, err := config.Load(os.Args[1:], os.Getenv)
+	if err == flag.ErrHelp {
+		os.Exit(0)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	handler.Configure(cfg)
+
+	if cfg.ACL != "" {
+		a, err := acl.Load(cfg.ACL)
+		if err != nil {
+			log.Fatal(err)
+		}
+		handler.ACL = a
+	}
+
+	for _, i := range cfg.Indexes {
+		if err := handler.DB.CreateIndex(i.Name, i.Pattern, i.Field); err != nil {
+			log.Fatalf("index %s: %s", i.Name, err)
+		}
+	}
+
+	for _, q := range cfg.Quotas {
+		if err := handler.Namespaces.SetQuota(q.Name, q.Quota); err != nil {
+			log.Fatalf("quota %s: %s", q.Name, err)
+		}
+	}
+
+	var certs *tlsconfig.Store
+	if cfg.TLS.Cert != "" {
+		certs, err = tlsconfig.Load(tlsconfig.Config{
+			Cert:              cfg.TLS.Cert,
+			Key:               cfg.TLS.Key,
+			ClientCA:          cfg.TLS.ClientCA,
+			RequireClientCert: cfg.TLS.RequireClientCert,
+		})
+		if err != nil {
+			log.Fatal(err)
+		}
+		go reloadCerts(certs)
+	}
+
+	if cfg.Persistence.Path != "" {
+		if err := startPersistence(cfg); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if cfg.Cluster.Topology != "" {
+		c, err := cluster.Load(cfg.Cluster.Topology, cfg.Cluster.Node)
+		if err != nil {
+			log.Fatal(err)
+		}
+		handler.Cluster = c
+		log.Printf("Cluster node %s", cfg.Cluster.Node)
+
+		if bus := c.Self().Bus; bus != "" {
+			if cfg.Cluster.Secret == "" {
+				log.Fatal("config: cluster.secret: secret of nodes is required by bus")
+			}
+			c.SetSecret([]byte(cfg.Cluster.Secret))
+
+			ln, err := net.Listen("tcp", bus)
+			if err != nil {
+				log.Fatal(err)
+			}
+			if certs != nil {
+				ln = tls.NewListener(ln, certs.Server())
+				c.SetTLS(certs.Client())
+			}
+			go c.ServeBus(ln, handler.DB)
+			log.Printf("Cluster bus on %s", bus)
+		}
+	}
+
+	if cfg.Raft.Node != "" {
+		if err := startRaft(cfg, certs); err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("Raft node %s", cfg.Raft.Node)
+	}
+
+	startReplication(cfg, certs)
+
+	ln, err := net.Listen("tcp", cfg.Addr)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if certs != nil {
+		ln = tls.NewListener(ln, certs.Server())
+	}
+
+	log.Printf("Started on %s", cfg.Addr)
+	s := &fasthttp.Server{
+		Handler: handler.Router,
+
+		// Large values are read by chunks
+		StreamRequestBody: true,
+	}
+	s.Serve(ln)
+}
+
+// Reloads certificates on SIGHUP, new connections use them
+func reloadCerts(certs *tlsconfig.Store) {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGHUP)
+
+	for range c {
+		if err := certs.Reload(); err != nil {
+			log.Printf("Certificates are not reloaded: %s", err)
+			continue
+		}
+		log.Printf("Certificates are reloaded")
+	}
+}
+
+// Loads snapshot of namespaces and saves it by interval and on
+// shutdown or appends changes to log
+func startPersistence(cfg *config.Config) error {
+	var keys *persist.Keyring
+	if cfg.Persistence.KeyFile != "" || cfg.Persistence.KeyEnv != "" {
+		key, err := persist.LoadKey(cfg.Persistence.KeyFile, cfg.Persistence.KeyEnv)
+		if err != nil {
+			return err
+		}
+
+		var old []*persist.Key
+		for _, path := range cfg.Persistence.OldKeyFiles {
+			k, err := persist.LoadKey(path, "")
+			if err != nil {
+				return fmt.Errorf("old key %s: %s", path, err)
+			}
+			old = append(old, k)
+		}
+		keys = persist.NewKeyring(key, old...)
+		if cfg.Persistence.MigratePlaintext {
+			keys.AllowPlaintext()
+		}
+	}
+
+	path := cfg.Persistence.Path
+	if err := persist.LoadSnapshot(path, handler.Namespaces, keys); err != nil {
+		return fmt.Errorf("snapshot %s: %s", path, err)
+	}
+
+	if cfg.Persistence.Log != "" {
+		return startLog(path, cfg.Persistence.Log, keys)
+	}
+
+	save := func() {
+		if err := persist.SaveSnapshot(path, handler.Namespaces, keys); err != nil {
+			log.Printf("Snapshot is not saved: %s", err)
+		}
+	}
+
+	if interval := cfg.Persistence.Interval; interval > 0 {
+		go func() {
+			for range time.Tick(interval) {
+				save()
+			}
+		}()
+	}
+
+	go func() {
+		c := make(chan os.Signal, 1)
+		signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+		<-c
+
+		save()
+		log.Printf("Snapshot is saved to %s", path)
+		os.Exit(0)
+	}()
+
+	return nil
+}
+
+// Replays log over snapshot, saves both to snapshot and appends
+// changes to new log, it is synced every second and on shutdown
+//
+// Snapshot is not saved later, as it is not point in time and
+// log could not be replayed over it.
+func startLog(path, logPath string, keys *persist.Keyring) error {
+	if err := persist.ReplayLog(logPath, path, handler.Namespaces, keys); err != nil {
+		return fmt.Errorf("log %s: %s", logPath, err)
+	}
+	if err := persist.SaveSnapshot(path, handler.Namespaces, keys); err != nil {
+		return fmt.Errorf("snapshot %s: %s", path, err)
+	}
+
+	l, err := persist.CreateLog(logPath, path, keys)
+	if err != nil {
+		return fmt.Errorf("log %s: %s", logPath, err)
+	}
+	handler.Namespaces.OnMutation(l.Append)
+
+	go func() {
+		for range time.Tick(time.Second) {
+			if err := l.Sync(); err != nil {
+				log.Printf("Log is not synced: %s", err)
+			}
+		}
+	}()
+
+	go func() {
+		c := make(chan os.Signal, 1)
+		signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+		<-c
+
+		if err := l.Close(); err != nil {
+			log.Printf("Log is not synced: %s", err)
+		}
+		log.Printf("Log is synced to %s", logPath)
+		os.Exit(0)
+	}()
+
+	return nil
+}
+
+// Starts leader or follower of replication if it is configured
+func startReplication(cfg *config.Config, certs *tlsconfig.Store) {
+	r := cfg.Replication
+
+	if r.Listen != "" {
+		leader := replication.NewLeader(handler.DB, r.Backlog)
+		if certs != nil {
+			leader.SetTLS(certs.Server())
+		}
+		// Followers read all keys, so they should be admins
+		if a := handler.ACL; a != nil {
+			leader.SetAuth(func(user, password string) error {
+				if _, err := a.Password(user, password); err != nil {
+					return err
+				}
+				if err := a.Check(user, acl.Admin); err != nil {
+					return err
+				}
+				return a.CheckNamespace(user, namespace.Default)
+			})
+		}
+		go func() {
+			log.Fatal(leader.ListenAndServe(r.Listen))
+		}()
+		log.Printf("Replication leader on %s", r.Listen)
+	}
+
+	if r.Leader != "" {
+		follower := replication.NewFollower(handler.DB, r.Leader)
+		follower.SetAuth(r.User, r.Password)
+		if certs != nil {
+			follower.SetTLS(certs.Client())
+		}
+		go follower.Run()
+		log.Printf("Replication follower of %s", r.Leader)
+	}
+}
+
+func startRaft(c *config.Config, certs *tlsconfig.Store) error {
+	id, secret := c.Raft.Node, []byte(c.Raft.Secret)
+
+	addrs := make(map[string]string)
+	for _, p := range strings.Split(c.Raft.Peers, ",") {
+		kv := strings.SplitN(p, "=", 2)
+		if len(kv) != 2 {
+			return fmt.Errorf("invalid raft peer %q", p)
+		}
+		addrs[kv[0]] = kv[1]
+	}
+
+	self, ok := addrs[id]
+	if !ok {
+		return fmt.Errorf("raft node %s is not in peers", id)
+	}
+
+	cfg := raft.Config{ID: id, Dir: c.Raft.Dir}
+	for p := range addrs {
+		if p != id {
+			cfg.Peers = append(cfg.Peers, p)
+		}
+	}
+
+	ln, err := net.Listen("tcp", self)
+	if err != nil {
+		return err
+	}
+
+	t := raft.NewTCPTransport(addrs)
+	t.SetSecret(secret)
+	if certs != nil {
+		ln = tls.NewListener(ln, certs.Server())
+		t.SetTLS(certs.Client())
+	}
+
+	n, err := raft.New(cfg, handler.DB, t)
+	if err != nil {
+		ln.Close()
+		return err
+	}
+	handler.Raft = n
+	go raft.ServeTCP(ln, handler.Raft, secret)
+
+	return nil
 }
@@ -0,0 +1,397 @@
+package persist
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+)
+
+// Encrypted file format:
+//
+//	header: magic "LDBE", version byte, key id length byte,
+//	        key id, salt
+//	frames: flags byte, length uint32, sealed data
+//
+// Every file is sealed by its own AES-GCM key derived from the
+// key and random salt by HKDF-SHA256, so frame number is enough
+// for nonce. Additional data is the header, flags and frame
+// number. So header, order of frames and the end of file
+// are authenticated. The last frame is marked as final.
+const (
+	cryptMagic   = "LDBE"
+	cryptVersion = 2
+
+	saltSize  = 32
+	frameSize = 64 << 10
+
+	flagFinal = 1
+)
+
+// Info of HKDF binds derived keys to this format
+const fileKeyInfo = "LDBE file key"
+
+var (
+	ErrNoKey        = errors.New("encryption key is not provided")
+	ErrInvalidKey   = errors.New("encryption key should be 16, 24 or 32 bytes")
+	ErrUnknownKey   = errors.New("file is encrypted by unknown key")
+	ErrTampered     = errors.New("encrypted file is tampered or corrupted")
+	ErrTruncated    = errors.New("encrypted file is truncated")
+	ErrNotEncrypted = errors.New("file is not encrypted")
+)
+
+// Key is AES key with its identifier
+//
+// Identifier is derived from the key and stored in file
+// header, so reader knows which key to use.
+type Key struct {
+	ID     string
+	secret []byte
+}
+
+// NewKey returns AES-GCM key, secret should be 16, 24 or 32 bytes
+func NewKey(secret []byte) (*Key, error) {
+	if _, err := aes.NewCipher(secret); err != nil {
+		return nil, ErrInvalidKey
+	}
+
+	id := sha256.Sum256(secret)
+
+	return &Key{ID: hex.EncodeToString(id[:4]), secret: append([]byte(nil), secret...)}, nil
+}
+
+// Returns AES-GCM of file with salt, key has the size of secret
+func (k *Key) file(salt []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(hkdf(k.secret, salt, []byte(fileKeyInfo), len(k.secret)))
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
+
+// HKDF-SHA256 of RFC 5869, l should not exceed 255 hash sizes
+func hkdf(secret, salt, info []byte, l int) []byte {
+	extract := hmac.New(sha256.New, salt)
+	extract.Write(secret)
+	prk := extract.Sum(nil)
+
+	var (
+		out []byte
+		t   []byte
+	)
+	for i := byte(1); len(out) < l; i++ {
+		expand := hmac.New(sha256.New, prk)
+		expand.Write(t)
+		expand.Write(info)
+		expand.Write([]byte{i})
+		t = expand.Sum(nil)
+		out = append(out, t...)
+	}
+
+	return out[:l]
+}
+
+// LoadKey reads key from file or from environment variable
+//
+// File is used if path is not empty. Key could be raw bytes,
+// hex or base64 encoded, surrounding whitespace is trimmed.
+func LoadKey(path, env string) (*Key, error) {
+	var (
+		secret []byte
+		err    error
+	)
+
+	switch {
+	case path != "":
+		if secret, err = ioutil.ReadFile(path); err != nil {
+			return nil, err
+		}
+	case env != "" && os.Getenv(env) != "":
+		secret = []byte(os.Getenv(env))
+	default:
+		return nil, ErrNoKey
+	}
+
+	return NewKey(decodeSecret(secret))
+}
+
+// Surrounding whitespace is never part of key, so key from file
+// and environment is decoded equally: hex, base64, then raw bytes
+func decodeSecret(secret []byte) []byte {
+	validSize := func(b []byte) bool {
+		return len(b) == 16 || len(b) == 24 || len(b) == 32
+	}
+
+	s := string(bytes.TrimSpace(secret))
+	if b, err := hex.DecodeString(s); err == nil && validSize(b) {
+		return b
+	}
+	if b, err := base64.StdEncoding.DecodeString(s); err == nil && validSize(b) {
+		return b
+	}
+
+	return []byte(s)
+}
+
+// Keyring keeps current key for writing and old
+// keys for reading files written before rotation
+type Keyring struct {
+	current   *Key
+	keys      map[string]*Key
+	plaintext bool
+}
+
+// NewKeyring returns keyring, files encrypted by old keys
+// are readable and rewritten with current key next time
+func NewKeyring(current *Key, old ...*Key) *Keyring {
+	k := &Keyring{
+		current: current,
+		keys:    map[string]*Key{current.ID: current},
+	}
+
+	for _, o := range old {
+		k.keys[o.ID] = o
+	}
+
+	return k
+}
+
+// AllowPlaintext makes unencrypted files readable, so they
+// are encrypted on the next save
+func (k *Keyring) AllowPlaintext() {
+	k.plaintext = true
+}
+
+// Writer encrypts data by frames
+//
+// Flush seals buffered data as a frame, so it could be used
+// for logs. Close must be called to mark the end of data.
+type Writer struct {
+	w      io.Writer
+	aead   cipher.AEAD
+	header []byte
+	seq    uint64
+	buf    []byte
+	err    error
+}
+
+// NewWriter writes header and returns encrypting writer
+func NewWriter(w io.Writer, keys *Keyring) (*Writer, error) {
+	key := keys.current
+
+	salt := make([]byte, saltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	aead, err := key.file(salt)
+	if err != nil {
+		return nil, err
+	}
+
+	header := []byte(cryptMagic)
+	header = append(header, cryptVersion, byte(len(key.ID)))
+	header = append(header, key.ID...)
+	header = append(header, salt...)
+
+	if _, err := w.Write(header); err != nil {
+		return nil, err
+	}
+
+	return &Writer{
+		w:      w,
+		aead:   aead,
+		header: header,
+		buf:    make([]byte, 0, frameSize),
+	}, nil
+}
+
+func (w *Writer) Write(p []byte) (n int, err error) {
+	for len(p) > 0 {
+		if w.err != nil {
+			return n, w.err
+		}
+
+		c := frameSize - len(w.buf)
+		if c > len(p) {
+			c = len(p)
+		}
+
+		w.buf = append(w.buf, p[:c]...)
+		p = p[c:]
+		n += c
+
+		if len(w.buf) == frameSize {
+			w.seal(0)
+		}
+	}
+
+	return n, w.err
+}
+
+// Flush seals buffered data
+func (w *Writer) Flush() error {
+	if len(w.buf) > 0 {
+		w.seal(0)
+	}
+
+	return w.err
+}
+
+// Close seals the final frame, underlying writer is not closed
+func (w *Writer) Close() error {
+	w.seal(flagFinal)
+
+	return w.err
+}
+
+func (w *Writer) seal(flags byte) {
+	if w.err != nil {
+		return
+	}
+
+	nonce, ad := frameMeta(w.header, flags, w.seq)
+	sealed := w.aead.Seal(nil, nonce, w.buf, ad)
+
+	var head [5]byte
+	head[0] = flags
+	binary.BigEndian.PutUint32(head[1:], uint32(len(sealed)))
+
+	if _, w.err = w.w.Write(head[:]); w.err == nil {
+		_, w.err = w.w.Write(sealed)
+	}
+
+	w.seq++
+	w.buf = w.buf[:0]
+}
+
+// Reader decrypts and authenticates data written by Writer
+type Reader struct {
+	r      *bufio.Reader
+	key    *Key
+	aead   cipher.AEAD
+	header []byte
+	seq    uint64
+	buf    []byte
+	final  bool
+}
+
+// NewReader reads header and returns decrypting reader
+func NewReader(r io.Reader, keys *Keyring) (*Reader, error) {
+	br := bufio.NewReader(r)
+
+	header := make([]byte, len(cryptMagic)+2)
+	if _, err := io.ReadFull(br, header); err != nil {
+		return nil, ErrTruncated
+	}
+	if string(header[:len(cryptMagic)]) != cryptMagic {
+		return nil, ErrNotEncrypted
+	}
+	if header[len(cryptMagic)] != cryptVersion {
+		return nil, fmt.Errorf("unsupported encryption version %d", header[len(cryptMagic)])
+	}
+
+	rest := make([]byte, int(header[len(cryptMagic)+1])+saltSize)
+	if _, err := io.ReadFull(br, rest); err != nil {
+		return nil, ErrTruncated
+	}
+	header = append(header, rest...)
+
+	id := string(rest[:len(rest)-saltSize])
+	key, ok := keys.keys[id]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownKey, id)
+	}
+
+	// Wrong salt gives other key, so the first frame fails
+	aead, err := key.file(rest[len(rest)-saltSize:])
+	if err != nil {
+		return nil, err
+	}
+
+	return &Reader{
+		r:      br,
+		key:    key,
+		aead:   aead,
+		header: header,
+	}, nil
+}
+
+// KeyID returns identifier of key used for the file
+func (r *Reader) KeyID() string {
+	return r.key.ID
+}
+
+func (r *Reader) Read(p []byte) (n int, err error) {
+	for len(r.buf) == 0 {
+		if r.final {
+			// Nothing is allowed after the final frame
+			if _, err := r.r.ReadByte(); err != io.EOF {
+				return 0, ErrTampered
+			}
+			return 0, io.EOF
+		}
+
+		if err := r.open(); err != nil {
+			return 0, err
+		}
+	}
+
+	n = copy(p, r.buf)
+	r.buf = r.buf[n:]
+
+	return n, nil
+}
+
+func (r *Reader) open() error {
+	var head [5]byte
+	if _, err := io.ReadFull(r.r, head[:]); err != nil {
+		return ErrTruncated
+	}
+
+	l := binary.BigEndian.Uint32(head[1:])
+	if l > frameSize+uint32(r.aead.Overhead()) {
+		return ErrTampered
+	}
+
+	sealed := make([]byte, l)
+	if _, err := io.ReadFull(r.r, sealed); err != nil {
+		return ErrTruncated
+	}
+
+	nonce, ad := frameMeta(r.header, head[0], r.seq)
+	data, err := r.aead.Open(sealed[:0], nonce, sealed, ad)
+	if err != nil {
+		return ErrTampered
+	}
+
+	r.seq++
+	r.buf = data
+	r.final = head[0]&flagFinal != 0
+
+	return nil
+}
+
+// Nonce is frame number, it is unique as key is unique for file
+func frameMeta(header []byte, flags byte, seq uint64) (nonce, ad []byte) {
+	nonce = make([]byte, 12)
+	binary.BigEndian.PutUint64(nonce[4:], seq)
+
+	ad = make([]byte, 0, len(header)+9)
+	ad = append(ad, header...)
+	ad = append(ad, flags)
+	ad = append(ad, nonce[4:]...)
+
+	return nonce, ad
+}
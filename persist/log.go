@@ -0,0 +1,363 @@
+package persist
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/lukashes/db/db"
+)
+
+// Log file format:
+//
+//	header: magic "LDBL", version byte, flags byte
+//	body:   base, records (encrypted by Writer if flagged)
+//	record: length uvarint, payload, crc32 of payload
+//	payload: op byte, name, key, data with uvarint lengths
+//
+// Base is SHA-256 of snapshot file which log continues, so log
+// is replayed only over the same snapshot. Base is inside of
+// body, so it is authenticated in encrypted log.
+const (
+	logMagic   = "LDBL"
+	logVersion = 1
+
+	logEncrypted = 1
+)
+
+var (
+	ErrLogCorrupted = errors.New("log is corrupted")
+
+	// Record is cut by end of file, so it was never synced
+	errTorn = errors.New("log record is torn")
+)
+
+// Applier is namespace.Set or other set of DBs which takes
+// changes by name of DB
+type Applier interface {
+	Apply(name string, m db.Mutation) error
+}
+
+// Log appends mutations to file
+//
+// Records are buffered in memory and written by Sync, so
+// Append could be called under DB lock. Records not synced
+// before crash are lost.
+type Log struct {
+	mu  sync.Mutex
+	buf []byte
+
+	syncMu sync.Mutex
+	f      *os.File
+	w      io.Writer
+	enc    *Writer
+	err    error
+}
+
+// CreateLog replaces log by empty one which continues snapshot
+//
+// If keys is not nil the log is encrypted by the current key.
+func CreateLog(path, snapshot string, keys *Keyring) (*Log, error) {
+	base, err := fileHash(snapshot)
+	if err != nil {
+		return nil, err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return nil, err
+	}
+
+	l, err := startLog(tmp, base, keys)
+	if err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return nil, err
+	}
+
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return nil, err
+	}
+
+	return l, nil
+}
+
+func startLog(f *os.File, base []byte, keys *Keyring) (*Log, error) {
+	l := &Log{f: f, w: f}
+
+	var flags byte
+	if keys != nil {
+		flags |= logEncrypted
+	}
+	if _, err := f.Write([]byte{logMagic[0], logMagic[1], logMagic[2], logMagic[3], logVersion, flags}); err != nil {
+		return nil, err
+	}
+
+	if keys != nil {
+		enc, err := NewWriter(f, keys)
+		if err != nil {
+			return nil, err
+		}
+		l.w, l.enc = enc, enc
+	}
+
+	l.buf = append(l.buf, base...)
+	if err := l.Sync(); err != nil {
+		return nil, err
+	}
+
+	return l, nil
+}
+
+// Append adds mutation of DB named name to buffer
+func (l *Log) Append(name string, m db.Mutation) {
+	b := new(bytes.Buffer)
+	b.WriteByte(byte(m.Op))
+	writeBytes(b, []byte(name))
+	writeBytes(b, []byte(m.Key))
+	writeBytes(b, m.Data)
+
+	var sum [4]byte
+	binary.BigEndian.PutUint32(sum[:], crc32.ChecksumIEEE(b.Bytes()))
+
+	var size [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(size[:], uint64(b.Len()))
+
+	l.mu.Lock()
+	l.buf = append(l.buf, size[:n]...)
+	l.buf = append(l.buf, b.Bytes()...)
+	l.buf = append(l.buf, sum[:]...)
+	l.mu.Unlock()
+}
+
+// Sync writes buffered records and syncs file, the first
+// error is kept and returned by next calls
+func (l *Log) Sync() error {
+	l.syncMu.Lock()
+	defer l.syncMu.Unlock()
+
+	l.mu.Lock()
+	buf := l.buf
+	l.buf = nil
+	l.mu.Unlock()
+
+	if l.err != nil {
+		return l.err
+	}
+	if len(buf) == 0 {
+		return nil
+	}
+
+	if _, l.err = l.w.Write(buf); l.err != nil {
+		return l.err
+	}
+	if l.enc != nil {
+		if l.err = l.enc.Flush(); l.err != nil {
+			return l.err
+		}
+	}
+	l.err = l.f.Sync()
+
+	return l.err
+}
+
+// Close syncs records and closes file, encrypted log is
+// marked as complete
+func (l *Log) Close() error {
+	err := l.Sync()
+
+	l.syncMu.Lock()
+	defer l.syncMu.Unlock()
+
+	if err == nil && l.enc != nil {
+		if err = l.enc.Close(); err == nil {
+			err = l.f.Sync()
+		}
+	}
+	if cerr := l.f.Close(); err == nil {
+		err = cerr
+	}
+
+	return err
+}
+
+// ReplayLog applies records of log to d
+//
+// Log is skipped if it continues other snapshot, missing log
+// is not an error. Torn record at the end is dropped as it was
+// never synced, broken record followed by others is an error.
+// If keys is not nil only encrypted log is accepted, unless
+// keyring allows plaintext.
+func ReplayLog(path, snapshot string, d Applier, keys *Keyring) error {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	header := make([]byte, len(logMagic)+2)
+	if _, err := io.ReadFull(f, header); err != nil {
+		return ErrLogCorrupted
+	}
+	if string(header[:len(logMagic)]) != logMagic || header[len(logMagic)] != logVersion {
+		return ErrLogCorrupted
+	}
+
+	var r *bufio.Reader
+	switch encrypted := header[len(logMagic)+1]&logEncrypted != 0; {
+	case encrypted && keys == nil:
+		return ErrNoKey
+	case encrypted:
+		dec, err := NewReader(f, keys)
+		if err != nil {
+			return err
+		}
+		r = bufio.NewReader(dec)
+	case keys != nil && !keys.plaintext:
+		return ErrNotEncrypted
+	default:
+		r = bufio.NewReader(f)
+	}
+
+	want, err := fileHash(snapshot)
+	if err != nil {
+		return err
+	}
+	base := make([]byte, sha256.Size)
+	if _, err := io.ReadFull(r, base); err != nil {
+		if err = readErr(err); err == errTorn {
+			return nil
+		}
+		return err
+	}
+	if !bytes.Equal(base, want) {
+		return nil
+	}
+
+	for {
+		name, m, err := readLogRecord(r)
+		if err == io.EOF || err == errTorn {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		if err := d.Apply(name, m); err != nil {
+			return err
+		}
+	}
+}
+
+// End of file inside of record is torn record, tampered
+// data stays error, other errors mean broken record
+func readErr(err error) error {
+	switch err {
+	case io.EOF, io.ErrUnexpectedEOF, ErrTruncated:
+		return errTorn
+	case ErrTampered:
+		return err
+	}
+
+	return ErrLogCorrupted
+}
+
+func readLogRecord(r *bufio.Reader) (string, db.Mutation, error) {
+	var m db.Mutation
+
+	l, err := binary.ReadUvarint(r)
+	if err == io.EOF {
+		return "", m, err
+	}
+	if err != nil {
+		return "", m, readErr(err)
+	}
+	if l > math.MaxInt32 {
+		return "", m, ErrLogCorrupted
+	}
+
+	// Length could be broken, so buffer grows by read data
+	b := new(bytes.Buffer)
+	if _, err := io.CopyN(b, r, int64(l)+4); err != nil {
+		return "", m, readErr(err)
+	}
+	payload := b.Bytes()
+	if binary.BigEndian.Uint32(payload[l:]) != crc32.ChecksumIEEE(payload[:l]) {
+		// Only the last record could be partially synced
+		if _, err := r.Peek(1); err != nil {
+			return "", m, readErr(err)
+		}
+		return "", m, ErrLogCorrupted
+	}
+
+	p := bytes.NewReader(payload[:l])
+	op, _ := p.ReadByte()
+	name, err := readBytes(p)
+	if err != nil {
+		return "", m, err
+	}
+	key, err := readBytes(p)
+	if err != nil {
+		return "", m, err
+	}
+	data, err := readBytes(p)
+	if err != nil {
+		return "", m, err
+	}
+
+	m = db.Mutation{Op: db.Op(op), Key: string(key), Data: data}
+
+	return string(name), m, nil
+}
+
+// SHA-256 of file, missing file is empty
+func fileHash(path string) ([]byte, error) {
+	h := sha256.New()
+
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return h.Sum(nil), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	if _, err := io.Copy(h, f); err != nil {
+		return nil, err
+	}
+
+	return h.Sum(nil), nil
+}
+
+func writeBytes(w *bytes.Buffer, b []byte) {
+	var size [binary.MaxVarintLen64]byte
+	w.Write(size[:binary.PutUvarint(size[:], uint64(len(b)))])
+	w.Write(b)
+}
+
+func readBytes(r *bytes.Reader) ([]byte, error) {
+	l, err := binary.ReadUvarint(r)
+	if err != nil || l > uint64(r.Len()) {
+		return nil, ErrLogCorrupted
+	}
+
+	b := make([]byte, l)
+	r.Read(b)
+
+	return b, nil
+}
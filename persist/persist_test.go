@@ -0,0 +1,308 @@
+package persist
+
+import (
+	"bytes"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/lukashes/db/db"
+	"github.com/lukashes/db/db/namespace"
+)
+
+func testKey(t *testing.T, b byte) *Key {
+	k, err := NewKey(bytes.Repeat([]byte{b}, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return k
+}
+
+func TestEncryptedSnapshot(t *testing.T) {
+	dir, err := ioutil.TempDir("", "persist")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "dump.ldb")
+	old, current := testKey(t, 1), testKey(t, 2)
+
+	src := db.New()
+	src.Write("key", []byte("secret value"), nil)
+	src.WriteList("list", []string{"donald", "duck"}, nil)
+	src.WriteDict("dict", map[string]string{"name": "daisy"}, nil)
+
+	if err := SaveSnapshot(path, src, NewKeyring(old)); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(data, []byte("secret value")) {
+		t.Error("snapshot is not encrypted")
+	}
+
+	// Rotation: old key is still readable, next save uses new one
+	keys := NewKeyring(current, old)
+	dst := db.New()
+	if err := LoadSnapshot(path, dst, keys); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := dst.Read("key"); err != nil || string(v) != "secret value" {
+		t.Errorf("unexpected value %q: %v", v, err)
+	}
+	if v, err := dst.ReadDictIndex("dict", "name"); err != nil || string(v) != "daisy" {
+		t.Errorf("unexpected dict value %q: %v", v, err)
+	}
+
+	if err := SaveSnapshot(path, dst, keys); err != nil {
+		t.Fatal(err)
+	}
+	if err := LoadSnapshot(path, db.New(), NewKeyring(old)); err == nil {
+		t.Error("expected error for rotated key")
+	}
+	if err := LoadSnapshot(path, db.New(), NewKeyring(current)); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestMigratePlaintext(t *testing.T) {
+	dir, err := ioutil.TempDir("", "persist")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "dump.ldb")
+
+	src := db.New()
+	src.Write("key", []byte("secret value"), nil)
+	if err := SaveSnapshot(path, src, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	keys := NewKeyring(testKey(t, 1))
+	if err := LoadSnapshot(path, db.New(), keys); err != ErrNotEncrypted {
+		t.Fatalf("expected not encrypted error, got %v", err)
+	}
+
+	keys.AllowPlaintext()
+	dst := db.New()
+	if err := LoadSnapshot(path, dst, keys); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := dst.Read("key"); err != nil || string(v) != "secret value" {
+		t.Errorf("unexpected value %q: %v", v, err)
+	}
+
+	if err := SaveSnapshot(path, dst, keys); err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(data, []byte("secret value")) {
+		t.Error("snapshot is not encrypted")
+	}
+	if err := LoadSnapshot(path, db.New(), keys); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestTampered(t *testing.T) {
+	keys := NewKeyring(testKey(t, 1))
+
+	src := db.New()
+	src.Write("key", []byte("value"), nil)
+
+	b := new(bytes.Buffer)
+	if err := writeSnapshot(b, src, keys); err != nil {
+		t.Fatal(err)
+	}
+	data := b.Bytes()
+
+	for _, i := range []int{5, len(data) / 2, len(data) - 1} {
+		broken := append([]byte(nil), data...)
+		broken[i] ^= 0xff
+
+		r, err := NewReader(bytes.NewReader(broken), keys)
+		if err == nil {
+			_, err = ioutil.ReadAll(r)
+		}
+		if err == nil {
+			t.Errorf("tampered byte %d is not detected", i)
+		}
+	}
+
+	r, err := NewReader(bytes.NewReader(data[:len(data)-20]), keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ioutil.ReadAll(r); err != ErrTruncated {
+		t.Errorf("expected truncated error, got %v", err)
+	}
+}
+
+func TestHKDF(t *testing.T) {
+	// Test case 1 of RFC 5869
+	secret := bytes.Repeat([]byte{0x0b}, 22)
+	salt, _ := hex.DecodeString("000102030405060708090a0b0c")
+	info, _ := hex.DecodeString("f0f1f2f3f4f5f6f7f8f9")
+	want := "3cb25f25faacd57a90434f64d0362f2a2d2d0a90cf1a5a4c5db02d56ecc4c5bf34007208d5b887185865"
+
+	if got := hex.EncodeToString(hkdf(secret, salt, info, 42)); got != want {
+		t.Fatalf("unexpected key %s", got)
+	}
+}
+
+func TestDecodeSecret(t *testing.T) {
+	for _, c := range []struct {
+		secret string
+		size   int
+	}{
+		{"000102030405060708090a0b0c0d0e0f", 16},
+		{"AAECAwQFBgcICQoLDA0ODw==", 16},
+		{"sixteen byte key", 16},
+	} {
+		// Key from environment and file with newline is the same
+		plain, file := decodeSecret([]byte(c.secret)), decodeSecret([]byte(c.secret+"\n"))
+		if len(plain) != c.size || !bytes.Equal(plain, file) {
+			t.Errorf("%s: decoded as %x and %x", c.secret, plain, file)
+		}
+	}
+}
+
+func TestFileKeys(t *testing.T) {
+	keys := NewKeyring(testKey(t, 1))
+
+	// Same data under the same key is sealed by other file keys
+	var files [2][]byte
+	for i := range files {
+		b := new(bytes.Buffer)
+		w, err := NewWriter(b, keys)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write([]byte("same data"))
+		w.Close()
+		files[i] = b.Bytes()
+	}
+
+	header := len(cryptMagic) + 2 + len(keys.current.ID)
+	if bytes.Equal(files[0][header:], files[1][header:]) {
+		t.Fatal("files share salt or key")
+	}
+	for _, f := range files {
+		r, err := NewReader(bytes.NewReader(f), keys)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if data, err := ioutil.ReadAll(r); err != nil || string(data) != "same data" {
+			t.Fatalf("unexpected data %q: %v", data, err)
+		}
+	}
+}
+
+func TestLog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "persist")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	snapshot, path := filepath.Join(dir, "dump.ldb"), filepath.Join(dir, "dump.log")
+
+	for _, keys := range []*Keyring{nil, NewKeyring(testKey(t, 1))} {
+		src := namespace.New()
+		if err := SaveSnapshot(snapshot, src, keys); err != nil {
+			t.Fatal(err)
+		}
+		l, err := CreateLog(path, snapshot, keys)
+		if err != nil {
+			t.Fatal(err)
+		}
+		src.OnMutation(l.Append)
+
+		a, _ := src.Get("a")
+		a.Write("key", []byte("secret value"), nil)
+		a.WriteList("list", []string{"donald"}, nil)
+		a.SetBit("bits", 3, 1)
+		if err := src.SwapDB("a", "b"); err != nil {
+			t.Fatal(err)
+		}
+		if err := l.Sync(); err != nil {
+			t.Fatal(err)
+		}
+		a.Delete("list")
+		if err := l.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if keys != nil && bytes.Contains(data, []byte("secret value")) {
+			t.Error("log is not encrypted")
+		}
+
+		dst := namespace.New()
+		if err := ReplayLog(path, snapshot, dst, keys); err != nil {
+			t.Fatal(err)
+		}
+		b, _ := dst.Get("b")
+		if v, err := b.Read("key"); err != nil || string(v) != "secret value" {
+			t.Errorf("unexpected value %q: %v", v, err)
+		}
+		if bit, _ := b.GetBit("bits", 3); bit != 1 {
+			t.Error("bit is not replayed")
+		}
+		if _, err := b.ReadList("list"); err != db.ErrNotFound {
+			t.Errorf("deleted list is replayed: %v", err)
+		}
+
+		// Torn tail is dropped
+		if err := ioutil.WriteFile(path, data[:len(data)-3], 0600); err != nil {
+			t.Fatal(err)
+		}
+		dst = namespace.New()
+		if err := ReplayLog(path, snapshot, dst, keys); err != nil {
+			t.Fatal(err)
+		}
+		b, _ = dst.Get("b")
+		if v, err := b.Read("key"); err != nil || string(v) != "secret value" {
+			t.Errorf("unexpected value of torn log %q: %v", v, err)
+		}
+
+		// Broken record followed by others is not a torn tail
+		if i := bytes.Index(data, []byte("secret value")); keys == nil && i > 0 {
+			broken := append([]byte(nil), data...)
+			broken[i] = 'S'
+			if err := ioutil.WriteFile(path, broken, 0600); err != nil {
+				t.Fatal(err)
+			}
+			if err := ReplayLog(path, snapshot, namespace.New(), keys); err != ErrLogCorrupted {
+				t.Errorf("expected corrupted log, got %v", err)
+			}
+		}
+
+		// Log of other snapshot is skipped
+		if err := SaveSnapshot(snapshot, dst, keys); err != nil {
+			t.Fatal(err)
+		}
+		dst = namespace.New()
+		if err := ReplayLog(path, snapshot, dst, keys); err != nil {
+			t.Fatal(err)
+		}
+		if names := dst.Names(); len(names) != 1 {
+			t.Errorf("log of other snapshot is replayed to %q", names)
+		}
+	}
+}
@@ -0,0 +1,105 @@
+// Package persist stores DB snapshots on disk
+//
+// Files are encrypted when keyring is provided.
+package persist
+
+import (
+	"bufio"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// Snapshotter is DB or other set of data with snapshots,
+// e.g. namespace.Set
+type Snapshotter interface {
+	Snapshot(w io.Writer) error
+	Restore(r io.Reader) error
+}
+
+// SaveSnapshot writes snapshot to temporary file and renames it
+//
+// If keys is not nil the file is encrypted by the current key,
+// so rewriting the file rotates key.
+func SaveSnapshot(path string, d Snapshotter, keys *Keyring) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if err := writeSnapshot(tmp, d, keys); err != nil {
+		tmp.Close()
+		return err
+	}
+
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
+
+func writeSnapshot(f io.Writer, d Snapshotter, keys *Keyring) error {
+	if keys == nil {
+		return d.Snapshot(f)
+	}
+
+	w, err := NewWriter(f, keys)
+	if err != nil {
+		return err
+	}
+
+	if err := d.Snapshot(w); err != nil {
+		return err
+	}
+
+	return w.Close()
+}
+
+// LoadSnapshot restores DB from file
+//
+// If keys is not nil only encrypted files are accepted, unless
+// keyring allows plaintext. Missing file is not an error, DB
+// stays empty. On error DB could contain keys read before
+// the failure.
+func LoadSnapshot(path string, d Snapshotter, keys *Keyring) error {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if keys == nil {
+		return d.Restore(bufio.NewReader(f))
+	}
+
+	r, err := NewReader(f, keys)
+	if err == ErrNotEncrypted && keys.plaintext {
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		return d.Restore(bufio.NewReader(f))
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := d.Restore(r); err != nil {
+		return err
+	}
+
+	// Restore stops at the end record, check the rest is authentic
+	_, err = io.Copy(ioutil.Discard, r)
+
+	return err
+}
@@ -0,0 +1,278 @@
+// Package pubsub delivers messages published to channels
+// to subscribers of these channels or matching patterns
+//
+// Messages are not stored, subscriber receives only
+// messages published after subscription.
+package pubsub
+
+import (
+	"errors"
+	"sync"
+
+	"github.com/lukashes/db/glob"
+)
+
+const DefaultBuffer = 1024
+
+var (
+	ErrSlowConsumer = errors.New("subscriber is too slow")
+	ErrClosed       = errors.New("subscription is closed")
+)
+
+// Policy is what to do with subscriber whose buffer is full
+type Policy int
+
+const (
+	// Disconnect closes subscription with ErrSlowConsumer
+	Disconnect Policy = iota
+
+	// Drop skips messages until subscriber catches up
+	Drop
+)
+
+type Message struct {
+	Channel string
+
+	// Pattern matched channel, empty for channel subscriptions
+	Pattern string
+	Payload []byte
+}
+
+type Hub struct {
+	mu sync.RWMutex
+
+	channels map[string]map[*Subscription]bool
+	patterns map[string]map[*Subscription]bool
+
+	buffer int
+	policy Policy
+}
+
+// New creates hub with given subscriber buffer size
+func New(buffer int, policy Policy) *Hub {
+	if buffer <= 0 {
+		buffer = DefaultBuffer
+	}
+
+	return &Hub{
+		channels: make(map[string]map[*Subscription]bool),
+		patterns: make(map[string]map[*Subscription]bool),
+		buffer:   buffer,
+		policy:   policy,
+	}
+}
+
+// Publish sends message to subscribers and returns count of receivers
+//
+// It never blocks, slow subscribers are handled by hub policy.
+func (h *Hub) Publish(channel string, payload []byte) int {
+	var (
+		n    int
+		slow []*Subscription
+	)
+
+	h.mu.RLock()
+	for s := range h.channels[channel] {
+		if s.send(Message{Channel: channel, Payload: payload}, h.policy) {
+			n++
+		} else if h.policy == Disconnect {
+			slow = append(slow, s)
+		}
+	}
+	for p, subs := range h.patterns {
+		if !glob.Match(p, channel) {
+			continue
+		}
+		for s := range subs {
+			if s.send(Message{Channel: channel, Pattern: p, Payload: payload}, h.policy) {
+				n++
+			} else if h.policy == Disconnect {
+				slow = append(slow, s)
+			}
+		}
+	}
+	h.mu.RUnlock()
+
+	for _, s := range slow {
+		h.close(s, ErrSlowConsumer)
+	}
+
+	return n
+}
+
+// Subscribe creates subscription to channels
+func (h *Hub) Subscribe(channels ...string) *Subscription {
+	s := h.subscription()
+	s.Subscribe(channels...)
+
+	return s
+}
+
+// PSubscribe creates subscription to channels matching patterns
+func (h *Hub) PSubscribe(patterns ...string) *Subscription {
+	s := h.subscription()
+	s.PSubscribe(patterns...)
+
+	return s
+}
+
+// NumSub returns count of subscribers of channel
+// not including pattern subscribers
+func (h *Hub) NumSub(channel string) int {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	return len(h.channels[channel])
+}
+
+func (h *Hub) subscription() *Subscription {
+	c := make(chan Message, h.buffer)
+
+	return &Subscription{
+		C:        c,
+		c:        c,
+		hub:      h,
+		channels: make(map[string]bool),
+		patterns: make(map[string]bool),
+	}
+}
+
+func (h *Hub) add(to map[string]map[*Subscription]bool, names []string, s *Subscription, own map[string]bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if s.closed {
+		return
+	}
+
+	for _, name := range names {
+		subs, ok := to[name]
+		if !ok {
+			subs = make(map[*Subscription]bool)
+			to[name] = subs
+		}
+		subs[s] = true
+		own[name] = true
+	}
+}
+
+func (h *Hub) remove(from map[string]map[*Subscription]bool, names []string, s *Subscription, own map[string]bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for _, name := range names {
+		unlink(from, name, s)
+		delete(own, name)
+	}
+}
+
+// Channel is closed under write lock,
+// so no one publishes into it at the moment
+func (h *Hub) close(s *Subscription, err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if s.closed {
+		return
+	}
+
+	for name := range s.channels {
+		unlink(h.channels, name, s)
+	}
+	for name := range s.patterns {
+		unlink(h.patterns, name, s)
+	}
+
+	s.closed = true
+	s.err = err
+	close(s.c)
+}
+
+func unlink(m map[string]map[*Subscription]bool, name string, s *Subscription) {
+	subs := m[name]
+	delete(subs, s)
+	if len(subs) == 0 {
+		delete(m, name)
+	}
+}
+
+// Subscription receives messages from C until it is closed
+type Subscription struct {
+	// C is closed when subscription is closed
+	C <-chan Message
+	c chan Message
+
+	hub *Hub
+
+	// Guarded by hub lock
+	channels map[string]bool
+	patterns map[string]bool
+	closed   bool
+	err      error
+
+	// Count of messages dropped by Drop policy
+	dropped int64
+	mu      sync.Mutex
+}
+
+// Subscribe adds channels to subscription
+func (s *Subscription) Subscribe(channels ...string) {
+	s.hub.add(s.hub.channels, channels, s, s.channels)
+}
+
+// PSubscribe adds patterns to subscription
+func (s *Subscription) PSubscribe(patterns ...string) {
+	s.hub.add(s.hub.patterns, patterns, s, s.patterns)
+}
+
+// Unsubscribe removes channels from subscription
+func (s *Subscription) Unsubscribe(channels ...string) {
+	s.hub.remove(s.hub.channels, channels, s, s.channels)
+}
+
+// PUnsubscribe removes patterns from subscription
+func (s *Subscription) PUnsubscribe(patterns ...string) {
+	s.hub.remove(s.hub.patterns, patterns, s, s.patterns)
+}
+
+// Close stops delivery and closes C
+func (s *Subscription) Close() {
+	s.hub.close(s, ErrClosed)
+}
+
+// Err returns reason why subscription was closed
+func (s *Subscription) Err() error {
+	s.hub.mu.RLock()
+	defer s.hub.mu.RUnlock()
+
+	return s.err
+}
+
+// Dropped returns count of messages skipped because of full buffer
+func (s *Subscription) Dropped() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.dropped
+}
+
+// Called under hub read lock
+func (s *Subscription) send(m Message, p Policy) bool {
+	if s.closed {
+		return false
+	}
+
+	select {
+	case s.c <- m:
+		return true
+	default:
+	}
+
+	if p == Drop {
+		s.mu.Lock()
+		s.dropped++
+		s.mu.Unlock()
+	}
+
+	return false
+}
@@ -0,0 +1,79 @@
+package pubsub
+
+import (
+	"testing"
+)
+
+func TestPublish(t *testing.T) {
+	h := New(10, Disconnect)
+
+	s := h.Subscribe("news")
+	p := h.PSubscribe("news.*")
+	defer s.Close()
+	defer p.Close()
+
+	if n := h.Publish("news", []byte("a")); n != 1 {
+		t.Fatalf("expected 1 receiver, got %d", n)
+	}
+	if n := h.Publish("news.sport", []byte("b")); n != 1 {
+		t.Fatalf("expected 1 receiver, got %d", n)
+	}
+	if n := h.Publish("weather", []byte("c")); n != 0 {
+		t.Fatalf("expected no receivers, got %d", n)
+	}
+
+	if m := <-s.C; m.Channel != "news" || string(m.Payload) != "a" {
+		t.Fatalf("unexpected message %+v", m)
+	}
+	if m := <-p.C; m.Channel != "news.sport" || m.Pattern != "news.*" || string(m.Payload) != "b" {
+		t.Fatalf("unexpected message %+v", m)
+	}
+
+	s.Unsubscribe("news")
+	if n := h.Publish("news", []byte("d")); n != 0 {
+		t.Fatalf("expected no receivers after unsubscribe, got %d", n)
+	}
+}
+
+func TestSlowConsumer(t *testing.T) {
+	h := New(2, Disconnect)
+	s := h.Subscribe("ch")
+
+	for i := 0; i < 3; i++ {
+		h.Publish("ch", []byte{byte(i)})
+	}
+
+	var got int
+	for range s.C {
+		got++
+	}
+	if got != 2 {
+		t.Fatalf("expected 2 buffered messages, got %d", got)
+	}
+	if s.Err() != ErrSlowConsumer {
+		t.Fatalf("expected slow consumer error, got %v", s.Err())
+	}
+	if h.NumSub("ch") != 0 {
+		t.Fatal("slow subscriber is not removed")
+	}
+}
+
+func TestDrop(t *testing.T) {
+	h := New(2, Drop)
+	s := h.Subscribe("ch")
+	defer s.Close()
+
+	for i := 0; i < 5; i++ {
+		h.Publish("ch", []byte{byte(i)})
+	}
+
+	if d := s.Dropped(); d != 3 {
+		t.Fatalf("expected 3 dropped messages, got %d", d)
+	}
+	if m := <-s.C; m.Payload[0] != 0 {
+		t.Fatalf("expected the oldest message, got %v", m.Payload)
+	}
+	if n := h.Publish("ch", nil); n != 1 {
+		t.Fatal("subscriber must stay connected")
+	}
+}
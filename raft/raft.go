@@ -0,0 +1,809 @@
+// Package raft replicates DB mutations by Raft consensus
+//
+// Every mutation is appended to the log of the leader and
+// applied to DB of every node only after majority of nodes
+// stored it, so acknowledged writes survive loss of a minority.
+// DB is switched to read only mode, all writes should go
+// through Node. Log is compacted by DB snapshots.
+//
+// Term, vote, log and snapshot are kept in Config.Dir, they are
+// synced to disk before node answers, so restarted node keeps its
+// vote and entries. Without Dir they are kept in memory and
+// restarted node joins as an empty one.
+package raft
+
+import (
+	"bytes"
+	"errors"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/lukashes/db/db"
+)
+
+const (
+	DefaultHeartbeat         = 50 * time.Millisecond
+	DefaultElectionTimeout   = 300 * time.Millisecond
+	DefaultSnapshotThreshold = 10000
+	DefaultProposeTimeout    = 5 * time.Second
+
+	maxBatch = 256 // entries in one append request
+)
+
+var (
+	ErrNotLeader      = errors.New("node is not a leader")
+	ErrLeadershipLost = errors.New("leadership is lost, mutation could be applied or not")
+	ErrStopped        = errors.New("node is stopped")
+	ErrTimeout        = errors.New("mutation is not committed in time, it could be applied later")
+)
+
+type state int
+
+const (
+	follower state = iota
+	candidate
+	leader
+)
+
+// Config of a node
+type Config struct {
+	// Identifiers of this node and all other nodes
+	ID    string
+	Peers []string
+
+	// Election starts if there were no heartbeats during
+	// timeout, actual timeout is randomized up to twice
+	Heartbeat       time.Duration
+	ElectionTimeout time.Duration
+
+	// Log is compacted when it exceeds threshold entries
+	SnapshotThreshold int
+
+	// Proposal waits for commit no longer than timeout
+	ProposeTimeout time.Duration
+
+	// Directory of persistent state, empty keeps it in memory
+	Dir string
+}
+
+type waiter struct {
+	term uint64
+	done chan error
+}
+
+// Node is a member of raft group
+type Node struct {
+	cfg       Config
+	db        *db.DB
+	transport Transport
+	storage   *storage // nil if state is in memory
+
+	mu       sync.Mutex
+	state    state
+	term     uint64
+	votedFor string
+	leader   string
+	votes    int
+	deadline time.Time // of election
+
+	log           []Entry // entries after snapshot
+	snapshotIndex uint64
+	snapshotTerm  uint64
+	snapshot      []byte
+
+	commitIndex uint64
+	lastApplied uint64
+
+	nextIndex  map[string]uint64
+	matchIndex map[string]uint64
+	inflight   map[string]bool
+
+	waiters map[uint64]waiter
+	stopped bool
+	done    chan struct{}
+}
+
+// New starts node, d becomes read only
+//
+// State saved in Config.Dir is loaded, DB is restored
+// from saved snapshot.
+func New(cfg Config, d *db.DB, t Transport) (*Node, error) {
+	if cfg.Heartbeat == 0 {
+		cfg.Heartbeat = DefaultHeartbeat
+	}
+	if cfg.ElectionTimeout == 0 {
+		cfg.ElectionTimeout = DefaultElectionTimeout
+	}
+	if cfg.SnapshotThreshold == 0 {
+		cfg.SnapshotThreshold = DefaultSnapshotThreshold
+	}
+	if cfg.ProposeTimeout == 0 {
+		cfg.ProposeTimeout = DefaultProposeTimeout
+	}
+
+	d.SetReadOnly(true)
+
+	n := &Node{
+		cfg:        cfg,
+		db:         d,
+		transport:  t,
+		nextIndex:  make(map[string]uint64),
+		matchIndex: make(map[string]uint64),
+		inflight:   make(map[string]bool),
+		waiters:    make(map[uint64]waiter),
+		done:       make(chan struct{}),
+	}
+	n.resetDeadline()
+
+	if cfg.Dir != "" {
+		s, p, err := openStorage(cfg.Dir)
+		if err != nil {
+			return nil, err
+		}
+		if p.snapshot != nil {
+			if err := d.Restore(bytes.NewReader(p.snapshot)); err != nil {
+				s.close()
+				return nil, err
+			}
+		}
+
+		n.storage = s
+		n.term, n.votedFor = p.term, p.votedFor
+		n.log = p.log
+		n.snapshotIndex, n.snapshotTerm, n.snapshot = p.snapshotIndex, p.snapshotTerm, p.snapshot
+		n.commitIndex, n.lastApplied = p.snapshotIndex, p.snapshotIndex
+	}
+
+	go n.run()
+
+	return n, nil
+}
+
+// Stop stops timers and fails waiting proposals
+func (n *Node) Stop() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	n.halt(ErrStopped)
+}
+
+// Stops node and fails waiting proposals with err, should be called under lock
+func (n *Node) halt(err error) {
+	if n.stopped {
+		return
+	}
+
+	n.stopped = true
+	close(n.done)
+	n.failWaiters(err)
+
+	if n.storage != nil {
+		n.storage.close()
+	}
+}
+
+// Saves term and vote, node is stopped if it fails
+//
+// Methods saving state should be called under lock,
+// they report false if node is stopped.
+func (n *Node) saveState() bool {
+	if n.stopped {
+		return false
+	}
+	if n.storage == nil {
+		return true
+	}
+
+	return n.check(n.storage.saveState(n.term, n.votedFor))
+}
+
+// Appends the last entries to saved log
+func (n *Node) saveEntries(entries []Entry) bool {
+	if n.stopped {
+		return false
+	}
+	if n.storage == nil || len(entries) == 0 {
+		return true
+	}
+
+	return n.check(n.storage.append(entries))
+}
+
+// Replaces saved log, it is used when log is truncated
+func (n *Node) saveLog() bool {
+	if n.stopped {
+		return false
+	}
+	if n.storage == nil {
+		return true
+	}
+
+	return n.check(n.storage.rewrite(n.log))
+}
+
+// Saves snapshot and log after it
+func (n *Node) saveSnapshot() bool {
+	if n.stopped {
+		return false
+	}
+	if n.storage == nil {
+		return true
+	}
+
+	if !n.check(n.storage.saveSnapshot(n.snapshotIndex, n.snapshotTerm, n.snapshot)) {
+		return false
+	}
+
+	return n.saveLog()
+}
+
+// Node could not keep its promises without state, so it is stopped
+func (n *Node) check(err error) bool {
+	if err != nil {
+		n.halt(err)
+		return false
+	}
+
+	return true
+}
+
+// Leader returns id of known leader and reports if it is this node
+func (n *Node) Leader() (string, bool) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	return n.leader, n.state == leader
+}
+
+// Write proposes write of key and waits until it is applied
+func (n *Node) Write(key string, val interface{}, ttl *int) error {
+	m, err := db.NewWrite(key, val, ttl)
+	if err != nil {
+		return err
+	}
+
+	return n.Propose(m)
+}
+
+// Delete proposes removal of key and waits until it is applied
+func (n *Node) Delete(key string) error {
+	if len(key) == 0 {
+		return db.ErrEmptyKey
+	}
+
+	return n.Propose(db.Mutation{Op: db.OpDelete, Key: key})
+}
+
+// Propose appends mutation to the log and waits until it is applied
+func (n *Node) Propose(m db.Mutation) error {
+	n.mu.Lock()
+
+	if n.stopped {
+		n.mu.Unlock()
+		return ErrStopped
+	}
+	if n.state != leader {
+		n.mu.Unlock()
+		return ErrNotLeader
+	}
+
+	e := Entry{Term: n.term, Index: n.lastIndex() + 1, Mutation: m}
+	n.log = append(n.log, e)
+
+	// Leader counts itself in majority, so entry is saved first
+	if !n.saveEntries([]Entry{e}) {
+		n.mu.Unlock()
+		return ErrStopped
+	}
+
+	w := waiter{term: n.term, done: make(chan error, 1)}
+	n.waiters[e.Index] = w
+
+	n.advanceCommit()
+	n.broadcast()
+	n.mu.Unlock()
+
+	timer := time.NewTimer(n.cfg.ProposeTimeout)
+	defer timer.Stop()
+
+	select {
+	case err := <-w.done:
+		return err
+	case <-timer.C:
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if cur, ok := n.waiters[e.Index]; ok && cur.done == w.done {
+		delete(n.waiters, e.Index)
+		return ErrTimeout
+	}
+
+	// Result was sent right after timeout
+	return <-w.done
+}
+
+func (n *Node) run() {
+	ticker := time.NewTicker(n.cfg.Heartbeat / 5)
+	defer ticker.Stop()
+
+	lastHeartbeat := time.Now()
+	for {
+		select {
+		case <-n.done:
+			return
+		case now := <-ticker.C:
+			n.mu.Lock()
+			switch {
+			case n.state == leader && now.Sub(lastHeartbeat) >= n.cfg.Heartbeat:
+				lastHeartbeat = now
+				n.broadcast()
+			case n.state != leader && now.After(n.deadline):
+				n.startElection()
+			}
+			n.mu.Unlock()
+		}
+	}
+}
+
+func (n *Node) resetDeadline() {
+	timeout := n.cfg.ElectionTimeout + time.Duration(rand.Int63n(int64(n.cfg.ElectionTimeout)))
+	n.deadline = time.Now().Add(timeout)
+}
+
+func (n *Node) lastIndex() uint64 {
+	return n.snapshotIndex + uint64(len(n.log))
+}
+
+func (n *Node) lastTerm() uint64 {
+	return n.termAt(n.lastIndex())
+}
+
+// Returns term of entry or zero if it is compacted or missing
+func (n *Node) termAt(index uint64) uint64 {
+	if index == n.snapshotIndex {
+		return n.snapshotTerm
+	}
+
+	if index < n.snapshotIndex || index > n.lastIndex() {
+		return 0
+	}
+
+	return n.log[index-n.snapshotIndex-1].Term
+}
+
+func (n *Node) entry(index uint64) Entry {
+	return n.log[index-n.snapshotIndex-1]
+}
+
+// Should be called under lock
+//
+// Election deadline is not moved for followers, otherwise
+// stale candidate could suppress elections forever.
+func (n *Node) becomeFollower(term uint64) {
+	if n.state == leader {
+		n.failWaiters(ErrLeadershipLost)
+	}
+	if n.state != follower {
+		n.resetDeadline()
+	}
+
+	if term > n.term {
+		n.term = term
+		n.votedFor = ""
+		n.saveState()
+	}
+
+	n.state = follower
+}
+
+func (n *Node) startElection() {
+	n.state = candidate
+	n.term++
+	n.votedFor = n.cfg.ID
+	n.votes = 1
+	n.leader = ""
+	n.resetDeadline()
+
+	if !n.saveState() {
+		return
+	}
+
+	if n.quorum(n.votes) {
+		n.becomeLeader()
+		return
+	}
+
+	req := &VoteRequest{
+		Term:         n.term,
+		Candidate:    n.cfg.ID,
+		LastLogIndex: n.lastIndex(),
+		LastLogTerm:  n.lastTerm(),
+	}
+
+	for _, p := range n.cfg.Peers {
+		go func(p string) {
+			res, err := n.transport.RequestVote(p, req)
+			if err != nil {
+				return
+			}
+
+			n.mu.Lock()
+			defer n.mu.Unlock()
+
+			if res.Term > n.term {
+				n.becomeFollower(res.Term)
+				return
+			}
+
+			if n.state != candidate || n.term != req.Term || !res.Granted {
+				return
+			}
+
+			if n.votes++; n.quorum(n.votes) {
+				n.becomeLeader()
+			}
+		}(p)
+	}
+}
+
+func (n *Node) quorum(cnt int) bool {
+	return cnt > (len(n.cfg.Peers)+1)/2
+}
+
+func (n *Node) becomeLeader() {
+	n.state = leader
+	n.leader = n.cfg.ID
+
+	for _, p := range n.cfg.Peers {
+		n.nextIndex[p] = n.lastIndex() + 1
+		n.matchIndex[p] = 0
+	}
+
+	// Empty entry commits entries of previous terms
+	e := Entry{Term: n.term, Index: n.lastIndex() + 1}
+	n.log = append(n.log, e)
+	if !n.saveEntries([]Entry{e}) {
+		return
+	}
+
+	n.advanceCommit()
+	n.broadcast()
+}
+
+// Sends entries or heartbeats to all peers, should be called under lock
+func (n *Node) broadcast() {
+	for _, p := range n.cfg.Peers {
+		if n.inflight[p] {
+			continue
+		}
+		n.inflight[p] = true
+
+		if n.nextIndex[p] <= n.snapshotIndex {
+			go n.sendSnapshot(p, &SnapshotRequest{
+				Term:      n.term,
+				Leader:    n.cfg.ID,
+				LastIndex: n.snapshotIndex,
+				LastTerm:  n.snapshotTerm,
+				Data:      n.snapshot,
+			})
+			continue
+		}
+
+		prev := n.nextIndex[p] - 1
+		last := n.lastIndex()
+		if last-prev > maxBatch {
+			last = prev + maxBatch
+		}
+
+		entries := make([]Entry, 0, last-prev)
+		for i := prev + 1; i <= last; i++ {
+			entries = append(entries, n.entry(i))
+		}
+
+		go n.sendEntries(p, &AppendRequest{
+			Term:         n.term,
+			Leader:       n.cfg.ID,
+			PrevLogIndex: prev,
+			PrevLogTerm:  n.termAt(prev),
+			Entries:      entries,
+			LeaderCommit: n.commitIndex,
+		})
+	}
+}
+
+func (n *Node) sendEntries(p string, req *AppendRequest) {
+	res, err := n.transport.AppendEntries(p, req)
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	n.inflight[p] = false
+
+	if err != nil {
+		return
+	}
+
+	if res.Term > n.term {
+		n.becomeFollower(res.Term)
+		return
+	}
+
+	if n.state != leader || n.term != req.Term {
+		return
+	}
+
+	if !res.Success {
+		next := res.ConflictIndex
+		if next < 1 {
+			next = 1
+		}
+		if next > n.lastIndex()+1 {
+			next = n.lastIndex() + 1
+		}
+		n.nextIndex[p] = next
+		n.broadcast()
+		return
+	}
+
+	if res.MatchIndex > n.matchIndex[p] {
+		n.matchIndex[p] = res.MatchIndex
+	}
+	n.nextIndex[p] = n.matchIndex[p] + 1
+
+	n.advanceCommit()
+
+	// Peer is behind, do not wait for the next heartbeat
+	if n.nextIndex[p] <= n.lastIndex() {
+		n.broadcast()
+	}
+}
+
+func (n *Node) sendSnapshot(p string, req *SnapshotRequest) {
+	res, err := n.transport.InstallSnapshot(p, req)
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	n.inflight[p] = false
+
+	if err != nil {
+		return
+	}
+
+	if res.Term > n.term {
+		n.becomeFollower(res.Term)
+		return
+	}
+
+	if n.state != leader || n.term != req.Term {
+		return
+	}
+
+	if req.LastIndex > n.matchIndex[p] {
+		n.matchIndex[p] = req.LastIndex
+	}
+	n.nextIndex[p] = n.matchIndex[p] + 1
+}
+
+// Commits entries of current term stored by majority
+func (n *Node) advanceCommit() {
+	for i := n.lastIndex(); i > n.commitIndex && i > n.snapshotIndex; i-- {
+		if n.termAt(i) != n.term {
+			break
+		}
+
+		cnt := 1
+		for _, p := range n.cfg.Peers {
+			if n.matchIndex[p] >= i {
+				cnt++
+			}
+		}
+
+		if n.quorum(cnt) {
+			n.commitIndex = i
+			n.apply()
+			return
+		}
+	}
+}
+
+// Applies committed entries, should be called under lock
+func (n *Node) apply() {
+	for n.lastApplied < n.commitIndex {
+		n.lastApplied++
+		e := n.entry(n.lastApplied)
+
+		var err error
+		if e.Mutation.Op != 0 {
+			err = n.db.Apply(e.Mutation)
+		}
+
+		if w, ok := n.waiters[e.Index]; ok {
+			delete(n.waiters, e.Index)
+			if w.term != e.Term {
+				err = ErrLeadershipLost
+			}
+			w.done <- err
+		}
+	}
+
+	if len(n.log) > n.cfg.SnapshotThreshold {
+		n.compact()
+	}
+}
+
+// Replaces applied entries by DB snapshot
+func (n *Node) compact() {
+	b := new(bytes.Buffer)
+	if err := n.db.Snapshot(b); err != nil {
+		return
+	}
+
+	term := n.termAt(n.lastApplied)
+	n.log = append([]Entry(nil), n.log[n.lastApplied-n.snapshotIndex:]...)
+	n.snapshotIndex, n.snapshotTerm = n.lastApplied, term
+	n.snapshot = b.Bytes()
+	n.saveSnapshot()
+}
+
+func (n *Node) failWaiters(err error) {
+	for i, w := range n.waiters {
+		delete(n.waiters, i)
+		w.done <- err
+	}
+}
+
+// HandleVote processes vote request of candidate
+func (n *Node) HandleVote(req *VoteRequest) *VoteResponse {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if req.Term > n.term {
+		n.becomeFollower(req.Term)
+	}
+
+	res := &VoteResponse{Term: n.term}
+	if req.Term < n.term {
+		return res
+	}
+
+	upToDate := req.LastLogTerm > n.lastTerm() ||
+		req.LastLogTerm == n.lastTerm() && req.LastLogIndex >= n.lastIndex()
+
+	if (n.votedFor == "" || n.votedFor == req.Candidate) && upToDate {
+		n.votedFor = req.Candidate
+		n.resetDeadline()
+		res.Granted = n.saveState()
+	}
+
+	return res
+}
+
+// HandleAppend processes entries or heartbeat of leader
+func (n *Node) HandleAppend(req *AppendRequest) *AppendResponse {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	res := &AppendResponse{Term: n.term}
+	if req.Term < n.term {
+		return res
+	}
+
+	n.becomeFollower(req.Term)
+	n.leader = req.Leader
+	n.resetDeadline()
+	res.Term = n.term
+
+	// Compacted entries are committed, so they match
+	prev, prevTerm, entries := req.PrevLogIndex, req.PrevLogTerm, req.Entries
+	if prev < n.snapshotIndex {
+		for len(entries) > 0 && entries[0].Index <= n.snapshotIndex {
+			entries = entries[1:]
+		}
+		prev, prevTerm = n.snapshotIndex, n.snapshotTerm
+	}
+
+	if prev > n.lastIndex() {
+		res.ConflictIndex = n.lastIndex() + 1
+		return res
+	}
+
+	if t := n.termAt(prev); t != prevTerm {
+		// Skip the whole conflicting term
+		i := prev
+		for i > n.snapshotIndex+1 && n.termAt(i-1) == t {
+			i--
+		}
+		res.ConflictIndex = i
+		return res
+	}
+
+	truncated := false
+	from := len(n.log)
+	for _, e := range entries {
+		if e.Index <= n.lastIndex() {
+			if n.termAt(e.Index) == e.Term {
+				continue
+			}
+			n.log = n.log[:e.Index-n.snapshotIndex-1]
+			truncated = true
+		}
+		n.log = append(n.log, e)
+	}
+
+	// Entries are saved before they are acknowledged
+	var saved bool
+	if truncated {
+		saved = n.saveLog()
+	} else {
+		saved = n.saveEntries(n.log[from:])
+	}
+	if !saved {
+		return res
+	}
+
+	last := prev + uint64(len(entries))
+	if req.LeaderCommit > n.commitIndex {
+		n.commitIndex = req.LeaderCommit
+		if n.commitIndex > last {
+			n.commitIndex = last
+		}
+		n.apply()
+	}
+
+	res.Success = true
+	res.MatchIndex = last
+
+	return res
+}
+
+// HandleSnapshot replaces DB by leader snapshot
+func (n *Node) HandleSnapshot(req *SnapshotRequest) *SnapshotResponse {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	res := &SnapshotResponse{Term: n.term}
+	if req.Term < n.term {
+		return res
+	}
+
+	n.becomeFollower(req.Term)
+	n.leader = req.Leader
+	n.resetDeadline()
+	res.Term = n.term
+
+	if req.LastIndex <= n.snapshotIndex || req.LastIndex <= n.lastApplied {
+		return res
+	}
+
+	// Broken snapshot is rejected before DB is flushed
+	if err := db.New().Restore(bytes.NewReader(req.Data)); err != nil {
+		return res
+	}
+	n.db.Apply(db.Mutation{Op: db.OpFlush})
+	if err := n.db.Restore(bytes.NewReader(req.Data)); err != nil {
+		// DB is partially restored, so entries could not be applied
+		n.halt(err)
+		return res
+	}
+
+	// Keep entries after snapshot if log matches it
+	if req.LastIndex < n.lastIndex() && n.termAt(req.LastIndex) == req.LastTerm {
+		n.log = append([]Entry(nil), n.log[req.LastIndex-n.snapshotIndex:]...)
+	} else {
+		n.log = nil
+	}
+
+	n.snapshotIndex, n.snapshotTerm = req.LastIndex, req.LastTerm
+	n.snapshot = req.Data
+	n.lastApplied = req.LastIndex
+	if n.commitIndex < req.LastIndex {
+		n.commitIndex = req.LastIndex
+	}
+	n.saveSnapshot()
+
+	return res
+}
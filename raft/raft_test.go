@@ -0,0 +1,371 @@
+package raft
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/lukashes/db/db"
+)
+
+var errUnreachable = errors.New("node is unreachable")
+
+// Simulated network of in-process nodes
+type network struct {
+	mu    sync.Mutex
+	nodes map[string]*Node
+	cut   map[string]bool // isolated nodes
+}
+
+func (net *network) reachable(from, to string) (*Node, error) {
+	net.mu.Lock()
+	defer net.mu.Unlock()
+
+	if net.cut[from] || net.cut[to] {
+		return nil, errUnreachable
+	}
+
+	return net.nodes[to], nil
+}
+
+func (net *network) isolate(id string, cut bool) {
+	net.mu.Lock()
+	net.cut[id] = cut
+	net.mu.Unlock()
+}
+
+type transport struct {
+	net  *network
+	from string
+}
+
+func (t *transport) RequestVote(to string, req *VoteRequest) (*VoteResponse, error) {
+	n, err := t.net.reachable(t.from, to)
+	if err != nil {
+		return nil, err
+	}
+	return n.HandleVote(req), nil
+}
+
+func (t *transport) AppendEntries(to string, req *AppendRequest) (*AppendResponse, error) {
+	n, err := t.net.reachable(t.from, to)
+	if err != nil {
+		return nil, err
+	}
+	return n.HandleAppend(req), nil
+}
+
+func (t *transport) InstallSnapshot(to string, req *SnapshotRequest) (*SnapshotResponse, error) {
+	n, err := t.net.reachable(t.from, to)
+	if err != nil {
+		return nil, err
+	}
+	return n.HandleSnapshot(req), nil
+}
+
+type group struct {
+	net   *network
+	nodes map[string]*Node
+	dbs   map[string]*db.DB
+	cfgs  map[string]Config
+}
+
+// Creates group of nodes, state of nodes is saved
+// in subdirectories of dir if it is set
+func newGroup(t *testing.T, size, threshold int, dir string) *group {
+	g := &group{
+		net:   &network{nodes: make(map[string]*Node), cut: make(map[string]bool)},
+		nodes: make(map[string]*Node),
+		dbs:   make(map[string]*db.DB),
+		cfgs:  make(map[string]Config),
+	}
+
+	var ids []string
+	for i := 0; i < size; i++ {
+		ids = append(ids, fmt.Sprintf("n%d", i))
+	}
+
+	g.net.mu.Lock()
+	defer g.net.mu.Unlock()
+
+	for _, id := range ids {
+		var peers []string
+		for _, p := range ids {
+			if p != id {
+				peers = append(peers, p)
+			}
+		}
+
+		cfg := Config{
+			ID:                id,
+			Peers:             peers,
+			Heartbeat:         10 * time.Millisecond,
+			ElectionTimeout:   50 * time.Millisecond,
+			SnapshotThreshold: threshold,
+			ProposeTimeout:    500 * time.Millisecond,
+		}
+		if dir != "" {
+			cfg.Dir = filepath.Join(dir, id)
+		}
+
+		g.cfgs[id] = cfg
+		g.start(t, id)
+	}
+
+	return g
+}
+
+// Starts node with empty DB, net.mu should be held
+func (g *group) start(t *testing.T, id string) {
+	d := db.New()
+	n, err := New(g.cfgs[id], d, &transport{net: g.net, from: id})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	g.dbs[id], g.nodes[id] = d, n
+	g.net.nodes[id] = n
+}
+
+// Stops all nodes and starts them again
+func (g *group) restart(t *testing.T) {
+	g.stop()
+
+	g.net.mu.Lock()
+	defer g.net.mu.Unlock()
+
+	for id := range g.nodes {
+		g.start(t, id)
+	}
+}
+
+func (g *group) stop() {
+	for _, n := range g.nodes {
+		n.Stop()
+	}
+}
+
+// Waits for the single leader among not isolated nodes
+func (g *group) leader(t *testing.T) *Node {
+	for i := 0; i < 200; i++ {
+		var leaders []*Node
+		for id, n := range g.nodes {
+			g.net.mu.Lock()
+			cut := g.net.cut[id]
+			g.net.mu.Unlock()
+
+			if _, ok := n.Leader(); ok && !cut {
+				leaders = append(leaders, n)
+			}
+		}
+
+		if len(leaders) == 1 {
+			return leaders[0]
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	t.Fatal("leader is not elected")
+	return nil
+}
+
+func waitValue(t *testing.T, d *db.DB, key, expected string) {
+	for i := 0; i < 200; i++ {
+		if v, err := d.Read(key); err == nil && string(v) == expected {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	v, err := d.Read(key)
+	t.Fatalf("key %s: expected %q, got %q %v", key, expected, v, err)
+}
+
+func TestReplication(t *testing.T) {
+	g := newGroup(t, 3, 0, "")
+	defer g.stop()
+
+	l := g.leader(t)
+	if err := l.Write("config", []byte("v1"), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, d := range g.dbs {
+		waitValue(t, d, "config", "v1")
+	}
+
+	for id, n := range g.nodes {
+		if n != l {
+			if err := n.Write("config", []byte("v2"), nil); err != ErrNotLeader {
+				t.Errorf("follower %s accepted write: %v", id, err)
+			}
+			if err := g.dbs[id].Write("config", []byte("v2"), nil); err != db.ErrReadOnly {
+				t.Errorf("db of %s accepted direct write: %v", id, err)
+			}
+		}
+	}
+}
+
+func TestPartition(t *testing.T) {
+	g := newGroup(t, 5, 0, "")
+	defer g.stop()
+
+	old := g.leader(t)
+	if err := old.Write("key", []byte("v1"), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// Isolated leader can not commit
+	g.net.isolate(old.cfg.ID, true)
+	if err := old.Write("key", []byte("lost"), nil); err != ErrTimeout && err != ErrLeadershipLost {
+		t.Errorf("isolated leader committed write: %v", err)
+	}
+
+	l := g.leader(t)
+	if l == old {
+		t.Fatal("isolated node is still the only leader")
+	}
+	if err := l.Write("key", []byte("v2"), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	g.net.isolate(old.cfg.ID, false)
+
+	for _, d := range g.dbs {
+		waitValue(t, d, "key", "v2")
+	}
+	if _, ok := old.Leader(); ok {
+		t.Error("old leader has not stepped down")
+	}
+}
+
+func TestCompaction(t *testing.T) {
+	g := newGroup(t, 3, 10, "")
+	defer g.stop()
+
+	l := g.leader(t)
+
+	var lagging string
+	for id, n := range g.nodes {
+		if n != l {
+			lagging = id
+			break
+		}
+	}
+	g.net.isolate(lagging, true)
+
+	for i := 0; i < 50; i++ {
+		if err := l.Write(fmt.Sprintf("key_%d", i), []byte(fmt.Sprint(i)), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := l.Delete("key_0"); err != nil {
+		t.Fatal(err)
+	}
+
+	l.mu.Lock()
+	compacted := l.snapshotIndex > 0
+	l.mu.Unlock()
+	if !compacted {
+		t.Error("log is not compacted")
+	}
+
+	g.net.isolate(lagging, false)
+
+	waitValue(t, g.dbs[lagging], "key_49", "49")
+	if _, err := g.dbs[lagging].Read("key_0"); err != db.ErrNotFound {
+		t.Errorf("removed key is restored: %v", err)
+	}
+}
+
+func TestRestart(t *testing.T) {
+	dir, err := ioutil.TempDir("", "raft")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	g := newGroup(t, 3, 10, dir)
+	defer g.stop()
+
+	l := g.leader(t)
+	for i := 0; i < 25; i++ {
+		if err := l.Write(fmt.Sprintf("key_%d", i), []byte(fmt.Sprint(i)), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Followers apply and compact after leader commits
+	terms := make(map[string]uint64)
+	for id, n := range g.nodes {
+		for i := 0; ; i++ {
+			n.mu.Lock()
+			term, snapshot := n.term, n.snapshotIndex
+			n.mu.Unlock()
+			if snapshot > 0 {
+				terms[id] = term
+				break
+			}
+			if i == 200 {
+				t.Fatalf("%s: log is not compacted", id)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	// Whole group is restarted, so data is only on disk
+	g.restart(t)
+
+	for id, n := range g.nodes {
+		n.mu.Lock()
+		term, snapshot := n.term, n.snapshotIndex
+		n.mu.Unlock()
+		if term < terms[id] {
+			t.Errorf("%s: term %d is lost, got %d", id, terms[id], term)
+		}
+		if snapshot == 0 {
+			t.Errorf("%s: snapshot is not loaded", id)
+		}
+	}
+
+	g.leader(t)
+	for id, d := range g.dbs {
+		waitValue(t, d, "key_0", "0")
+		waitValue(t, d, "key_24", "24")
+		if _, err := d.Read("missing"); err != db.ErrNotFound {
+			t.Errorf("%s: unexpected key", id)
+		}
+	}
+}
+
+func TestBrokenSnapshot(t *testing.T) {
+	g := newGroup(t, 3, 0, "")
+	defer g.stop()
+
+	l := g.leader(t)
+	if err := l.Write("key", []byte("value"), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	for id, n := range g.nodes {
+		if n == l {
+			continue
+		}
+		waitValue(t, g.dbs[id], "key", "value")
+
+		n.mu.Lock()
+		term, last := n.term, n.lastIndex()
+		n.mu.Unlock()
+
+		n.HandleSnapshot(&SnapshotRequest{Term: term, Leader: "n9", LastIndex: last + 10, LastTerm: term, Data: []byte("broken")})
+		if v, err := g.dbs[id].Read("key"); err != nil || string(v) != "value" {
+			t.Errorf("%s: DB is changed by broken snapshot %q %v", id, v, err)
+		}
+		break
+	}
+}
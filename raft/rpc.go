@@ -0,0 +1,66 @@
+package raft
+
+import (
+	"github.com/lukashes/db/db"
+)
+
+// Entry is a record of replicated log
+//
+// Entry with empty mutation is appended by new leader
+// to commit entries of previous terms.
+type Entry struct {
+	Term     uint64
+	Index    uint64
+	Mutation db.Mutation
+}
+
+type VoteRequest struct {
+	Term         uint64
+	Candidate    string
+	LastLogIndex uint64
+	LastLogTerm  uint64
+}
+
+type VoteResponse struct {
+	Term    uint64
+	Granted bool
+}
+
+type AppendRequest struct {
+	Term         uint64
+	Leader       string
+	PrevLogIndex uint64
+	PrevLogTerm  uint64
+	Entries      []Entry
+	LeaderCommit uint64
+}
+
+type AppendResponse struct {
+	Term    uint64
+	Success bool
+
+	// Last matched index on success, otherwise
+	// index from which leader should retry
+	MatchIndex    uint64
+	ConflictIndex uint64
+}
+
+// SnapshotRequest carries DB snapshot replacing compacted log
+type SnapshotRequest struct {
+	Term      uint64
+	Leader    string
+	LastIndex uint64
+	LastTerm  uint64
+	Data      []byte
+}
+
+type SnapshotResponse struct {
+	Term uint64
+}
+
+// Transport delivers requests to other nodes by their id
+type Transport interface {
+	RequestVote(to string, req *VoteRequest) (*VoteResponse, error)
+	AppendEntries(to string, req *AppendRequest) (*AppendResponse, error)
+	InstallSnapshot(to string, req *SnapshotRequest) (*SnapshotResponse, error)
+}
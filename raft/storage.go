@@ -0,0 +1,329 @@
+package raft
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/lukashes/db/db"
+)
+
+const (
+	stateFile    = "state"
+	logFile      = "log"
+	snapshotFile = "snapshot"
+)
+
+var ErrCorrupted = errors.New("raft state is corrupted")
+
+// Keeps term, vote, log and snapshot of node in directory
+//
+// Every change is synced to disk before it returns. Log is
+// appended by records with checksums, torn record at the end
+// is dropped on load as it was never acknowledged.
+type storage struct {
+	dir string
+	log *os.File
+}
+
+// State loaded at start
+type persisted struct {
+	term     uint64
+	votedFor string
+
+	snapshotIndex uint64
+	snapshotTerm  uint64
+	snapshot      []byte
+
+	log []Entry
+}
+
+func openStorage(dir string) (*storage, *persisted, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, nil, err
+	}
+
+	s := &storage{dir: dir}
+	p := &persisted{}
+
+	if err := s.loadState(p); err != nil {
+		return nil, nil, err
+	}
+	if err := s.loadSnapshot(p); err != nil {
+		return nil, nil, err
+	}
+	if err := s.loadLog(p); err != nil {
+		return nil, nil, err
+	}
+
+	return s, p, nil
+}
+
+func (s *storage) close() error {
+	if s.log == nil {
+		return nil
+	}
+
+	return s.log.Close()
+}
+
+// State file: term and vote
+func (s *storage) saveState(term uint64, votedFor string) error {
+	b := new(bytes.Buffer)
+	writeUvarint(b, term)
+	writeBytes(b, []byte(votedFor))
+
+	return s.writeFile(stateFile, b.Bytes())
+}
+
+func (s *storage) loadState(p *persisted) error {
+	data, err := ioutil.ReadFile(filepath.Join(s.dir, stateFile))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	r := bytes.NewReader(data)
+	if p.term, err = binary.ReadUvarint(r); err != nil {
+		return ErrCorrupted
+	}
+	vote, err := readBytes(r)
+	if err != nil {
+		return err
+	}
+	p.votedFor = string(vote)
+
+	return nil
+}
+
+// Snapshot file: last index, last term and DB snapshot
+func (s *storage) saveSnapshot(index, term uint64, data []byte) error {
+	b := new(bytes.Buffer)
+	writeUvarint(b, index)
+	writeUvarint(b, term)
+	writeBytes(b, data)
+
+	return s.writeFile(snapshotFile, b.Bytes())
+}
+
+func (s *storage) loadSnapshot(p *persisted) error {
+	data, err := ioutil.ReadFile(filepath.Join(s.dir, snapshotFile))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	r := bytes.NewReader(data)
+	if p.snapshotIndex, err = binary.ReadUvarint(r); err != nil {
+		return ErrCorrupted
+	}
+	if p.snapshotTerm, err = binary.ReadUvarint(r); err != nil {
+		return ErrCorrupted
+	}
+	p.snapshot, err = readBytes(r)
+
+	return err
+}
+
+// Appends entries to log file
+func (s *storage) append(entries []Entry) error {
+	w := bufio.NewWriter(s.log)
+	for _, e := range entries {
+		writeRecord(w, e)
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+
+	return s.log.Sync()
+}
+
+// Replaces log file by entries
+func (s *storage) rewrite(entries []Entry) error {
+	b := new(bytes.Buffer)
+	for _, e := range entries {
+		writeRecord(b, e)
+	}
+
+	if err := s.writeFile(logFile, b.Bytes()); err != nil {
+		return err
+	}
+
+	return s.openLog()
+}
+
+// Reads log, entries compacted by snapshot are skipped
+func (s *storage) loadLog(p *persisted) error {
+	path := filepath.Join(s.dir, logFile)
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	r := bytes.NewReader(data)
+	valid := int64(0)
+	for r.Len() > 0 {
+		e, err := readRecord(r)
+		if err != nil {
+			break
+		}
+		valid = int64(len(data) - r.Len())
+
+		if e.Index <= p.snapshotIndex {
+			continue
+		}
+		if e.Index != p.snapshotIndex+uint64(len(p.log))+1 {
+			return ErrCorrupted
+		}
+		p.log = append(p.log, e)
+	}
+
+	if valid < int64(len(data)) {
+		if err := os.Truncate(path, valid); err != nil {
+			return err
+		}
+	}
+
+	return s.openLog()
+}
+
+func (s *storage) openLog() error {
+	f, err := os.OpenFile(filepath.Join(s.dir, logFile), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+
+	if s.log != nil {
+		s.log.Close()
+	}
+	s.log = f
+
+	return nil
+}
+
+// Replaces file atomically, it is synced with directory
+func (s *storage) writeFile(name string, data []byte) error {
+	path := filepath.Join(s.dir, name)
+	tmp := path + ".tmp"
+
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return err
+	}
+
+	d, err := os.Open(s.dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+
+	return d.Sync()
+}
+
+// Record: length, payload and its checksum, payload is
+// term, index, op, key and data of mutation
+func writeRecord(w io.Writer, e Entry) {
+	b := new(bytes.Buffer)
+	writeUvarint(b, e.Term)
+	writeUvarint(b, e.Index)
+	b.WriteByte(byte(e.Mutation.Op))
+	writeBytes(b, []byte(e.Mutation.Key))
+	writeBytes(b, e.Mutation.Data)
+
+	var sum [4]byte
+	binary.BigEndian.PutUint32(sum[:], crc32.ChecksumIEEE(b.Bytes()))
+
+	hdr := new(bytes.Buffer)
+	writeUvarint(hdr, uint64(b.Len()))
+
+	w.Write(hdr.Bytes())
+	w.Write(b.Bytes())
+	w.Write(sum[:])
+}
+
+func readRecord(r *bytes.Reader) (Entry, error) {
+	var e Entry
+
+	payload, err := readBytes(r)
+	if err != nil {
+		return e, err
+	}
+	var sum [4]byte
+	if _, err := io.ReadFull(r, sum[:]); err != nil {
+		return e, ErrCorrupted
+	}
+	if binary.BigEndian.Uint32(sum[:]) != crc32.ChecksumIEEE(payload) {
+		return e, ErrCorrupted
+	}
+
+	p := bytes.NewReader(payload)
+	if e.Term, err = binary.ReadUvarint(p); err != nil {
+		return e, ErrCorrupted
+	}
+	if e.Index, err = binary.ReadUvarint(p); err != nil {
+		return e, ErrCorrupted
+	}
+	op, err := p.ReadByte()
+	if err != nil {
+		return e, ErrCorrupted
+	}
+	key, err := readBytes(p)
+	if err != nil {
+		return e, err
+	}
+	data, err := readBytes(p)
+	if err != nil {
+		return e, err
+	}
+
+	e.Mutation = db.Mutation{Op: db.Op(op), Key: string(key), Data: data}
+
+	return e, nil
+}
+
+func writeUvarint(w io.Writer, v uint64) {
+	var b [binary.MaxVarintLen64]byte
+	w.Write(b[:binary.PutUvarint(b[:], v)])
+}
+
+func writeBytes(w io.Writer, b []byte) {
+	writeUvarint(w, uint64(len(b)))
+	w.Write(b)
+}
+
+func readBytes(r *bytes.Reader) ([]byte, error) {
+	l, err := binary.ReadUvarint(r)
+	if err != nil || l > uint64(r.Len()) {
+		return nil, ErrCorrupted
+	}
+
+	b := make([]byte, l)
+	r.Read(b)
+
+	return b, nil
+}
@@ -0,0 +1,229 @@
+package raft
+
+import (
+	"crypto/tls"
+	"encoding/gob"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/labstack/gommon/log"
+	"github.com/lukashes/db/handshake"
+)
+
+const (
+	dialTimeout = time.Second
+	callTimeout = 5 * time.Second
+)
+
+type kind uint8
+
+const (
+	kindVote kind = iota + 1
+	kindAppend
+	kindSnapshot
+)
+
+type envelope struct {
+	Kind     kind
+	Vote     *VoteRequest
+	Append   *AppendRequest
+	Snapshot *SnapshotRequest
+}
+
+type reply struct {
+	Vote     *VoteResponse
+	Append   *AppendResponse
+	Snapshot *SnapshotResponse
+}
+
+// TCPTransport sends gob encoded requests, one connection per peer
+type TCPTransport struct {
+	addrs map[string]string
+
+	// Connections are encrypted if it is set
+	tls *tls.Config
+
+	// Connections are authenticated if it is set
+	secret []byte
+
+	mu    sync.Mutex
+	conns map[string]*conn
+}
+
+type conn struct {
+	mu  sync.Mutex
+	c   net.Conn
+	enc *gob.Encoder
+	dec *gob.Decoder
+}
+
+// NewTCPTransport returns transport, addrs maps node id to address
+func NewTCPTransport(addrs map[string]string) *TCPTransport {
+	return &TCPTransport{
+		addrs: addrs,
+		conns: make(map[string]*conn),
+	}
+}
+
+func (t *TCPTransport) RequestVote(to string, req *VoteRequest) (*VoteResponse, error) {
+	var r reply
+	err := t.call(to, &envelope{Kind: kindVote, Vote: req}, &r)
+	return r.Vote, err
+}
+
+func (t *TCPTransport) AppendEntries(to string, req *AppendRequest) (*AppendResponse, error) {
+	var r reply
+	err := t.call(to, &envelope{Kind: kindAppend, Append: req}, &r)
+	return r.Append, err
+}
+
+func (t *TCPTransport) InstallSnapshot(to string, req *SnapshotRequest) (*SnapshotResponse, error) {
+	var r reply
+	err := t.call(to, &envelope{Kind: kindSnapshot, Snapshot: req}, &r)
+	return r.Snapshot, err
+}
+
+func (t *TCPTransport) call(to string, req *envelope, res *reply) error {
+	c, err := t.conn(to)
+	if err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.c == nil {
+		return fmt.Errorf("raft: connection to %s is closed", to)
+	}
+
+	c.c.SetDeadline(time.Now().Add(callTimeout))
+	if err = c.enc.Encode(req); err == nil {
+		err = c.dec.Decode(res)
+	}
+
+	if err != nil {
+		// Broken stream could not be reused
+		c.c.Close()
+		c.c = nil
+
+		t.mu.Lock()
+		if t.conns[to] == c {
+			delete(t.conns, to)
+		}
+		t.mu.Unlock()
+	}
+
+	return err
+}
+
+// SetTLS encrypts connections to peers, listener of ServeTCP
+// should be wrapped by tls.NewListener
+func (t *TCPTransport) SetTLS(cfg *tls.Config) {
+	t.mu.Lock()
+	t.tls = cfg
+	t.mu.Unlock()
+}
+
+// SetSecret authenticates connections to peers, ServeTCP
+// should be called with the same secret
+func (t *TCPTransport) SetSecret(secret []byte) {
+	t.mu.Lock()
+	t.secret = secret
+	t.mu.Unlock()
+}
+
+func (t *TCPTransport) conn(to string) (*conn, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if c, ok := t.conns[to]; ok {
+		return c, nil
+	}
+
+	addr, ok := t.addrs[to]
+	if !ok {
+		return nil, fmt.Errorf("raft: unknown node %s", to)
+	}
+
+	var (
+		nc  net.Conn
+		err error
+	)
+	if t.tls != nil {
+		nc, err = tls.DialWithDialer(&net.Dialer{Timeout: dialTimeout}, "tcp", addr, t.tls)
+	} else {
+		nc, err = net.DialTimeout("tcp", addr, dialTimeout)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// Handshake is under lock as dial, it has own timeout
+	if t.secret != nil {
+		if err := handshake.Client(nc, t.secret); err != nil {
+			nc.Close()
+			return nil, err
+		}
+	}
+
+	c := &conn{c: nc, enc: gob.NewEncoder(nc), dec: gob.NewDecoder(nc)}
+	t.conns[to] = c
+
+	return c, nil
+}
+
+// ServeTCP accepts requests of other nodes for n, if secret
+// is not nil only nodes with the same secret are accepted
+func ServeTCP(ln net.Listener, n *Node, secret []byte) error {
+	for {
+		c, err := ln.Accept()
+		if err != nil {
+			return err
+		}
+
+		go func() {
+			defer c.Close()
+
+			if secret != nil {
+				if err := handshake.Server(c, secret); err != nil {
+					log.Warnf("raft: %s: %s", c.RemoteAddr(), err)
+					return
+				}
+			}
+
+			if err := serveConn(c, n); err != nil {
+				log.Debugf("raft: %s: %s", c.RemoteAddr(), err)
+			}
+		}()
+	}
+}
+
+func serveConn(c net.Conn, n *Node) error {
+	dec := gob.NewDecoder(c)
+	enc := gob.NewEncoder(c)
+
+	for {
+		var req envelope
+		if err := dec.Decode(&req); err != nil {
+			return err
+		}
+
+		var res reply
+		switch req.Kind {
+		case kindVote:
+			res.Vote = n.HandleVote(req.Vote)
+		case kindAppend:
+			res.Append = n.HandleAppend(req.Append)
+		case kindSnapshot:
+			res.Snapshot = n.HandleSnapshot(req.Snapshot)
+		default:
+			return fmt.Errorf("unknown request %d", req.Kind)
+		}
+
+		if err := enc.Encode(&res); err != nil {
+			return err
+		}
+	}
+}
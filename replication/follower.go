@@ -0,0 +1,226 @@
+package replication
+
+import (
+	"crypto/tls"
+	"encoding/gob"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/labstack/gommon/log"
+	"github.com/lukashes/db/db"
+)
+
+const (
+	minBackoff = 100 * time.Millisecond
+	maxBackoff = 5 * time.Second
+)
+
+// Follower keeps DB as a read only copy of leader
+type Follower struct {
+	db   *db.DB
+	addr string
+
+	// Credentials sent to leader
+	user     string
+	password string
+
+	// Connection is encrypted if it is set
+	tls *tls.Config
+
+	mu     sync.Mutex
+	runID  string
+	offset uint64
+	conn   net.Conn
+	closed bool
+}
+
+// NewFollower switches d to read only mode, call Run to start syncing
+func NewFollower(d *db.DB, addr string) *Follower {
+	d.SetReadOnly(true)
+
+	return &Follower{
+		db:   d,
+		addr: addr,
+	}
+}
+
+// SetAuth sets credentials sent to leader, it should be called before Run
+func (f *Follower) SetAuth(user, password string) {
+	f.user, f.password = user, password
+}
+
+// SetTLS encrypts connection to leader, it should be called before Run
+func (f *Follower) SetTLS(cfg *tls.Config) {
+	f.tls = cfg
+}
+
+// Offset returns offset of the last applied mutation
+func (f *Follower) Offset() uint64 {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.offset
+}
+
+// Run syncs with leader and reconnects until Close is called
+func (f *Follower) Run() error {
+	backoff := minBackoff
+
+	for {
+		connected, err := f.sync()
+		if f.isClosed() {
+			return ErrClosed
+		}
+
+		if connected {
+			backoff = minBackoff
+		}
+		log.Warnf("replication: leader %s: %s, reconnecting in %s", f.addr, err, backoff)
+
+		time.Sleep(backoff)
+
+		if backoff *= 2; backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+}
+
+// Close disconnects from leader, DB stays read only
+func (f *Follower) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.closed = true
+	if f.conn != nil {
+		return f.conn.Close()
+	}
+
+	return nil
+}
+
+func (f *Follower) isClosed() bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.closed
+}
+
+// Handles one connection, reports if connection was established
+func (f *Follower) sync() (bool, error) {
+	var (
+		conn net.Conn
+		err  error
+	)
+	if f.tls != nil {
+		conn, err = tls.Dial("tcp", f.addr, f.tls)
+	} else {
+		conn, err = net.Dial("tcp", f.addr)
+	}
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+
+	f.mu.Lock()
+	if f.closed {
+		f.mu.Unlock()
+		return false, ErrClosed
+	}
+	f.conn = conn
+	h := hello{RunID: f.runID, Offset: f.offset, User: f.user, Password: f.password}
+	f.mu.Unlock()
+
+	if err := gob.NewEncoder(conn).Encode(&h); err != nil {
+		return true, err
+	}
+
+	var (
+		dec     = gob.NewDecoder(conn)
+		restore *restorer
+	)
+	defer func() {
+		if restore != nil {
+			restore.abort()
+		}
+	}()
+
+	for {
+		var m message
+		if err := dec.Decode(&m); err != nil {
+			return true, err
+		}
+
+		switch m.Kind {
+		case kindSnapshot:
+			if restore == nil {
+				restore = newRestorer(f.db)
+			}
+			if _, err := restore.w.Write(m.Data); err != nil {
+				return true, err
+			}
+		case kindSnapshotEnd:
+			if restore == nil {
+				restore = newRestorer(f.db)
+			}
+			err := restore.finish()
+			restore = nil
+			if err != nil {
+				return true, err
+			}
+
+			f.mu.Lock()
+			f.runID, f.offset = m.RunID, m.Offset
+			f.mu.Unlock()
+		case kindError:
+			// Rejected follower backs off as if it is not connected
+			return false, errors.New(m.Error)
+		case kindMutation:
+			if err := f.db.Apply(m.Mutation); err != nil {
+				// Mutation would fail again after reconnect,
+				// so follower is synced from snapshot instead
+				f.mu.Lock()
+				f.runID = ""
+				f.mu.Unlock()
+				return true, err
+			}
+
+			f.mu.Lock()
+			f.offset = m.Offset
+			f.mu.Unlock()
+		}
+	}
+}
+
+// Loads snapshot into empty DB while it is received
+type restorer struct {
+	w    *io.PipeWriter
+	done chan error
+}
+
+func newRestorer(d *db.DB) *restorer {
+	d.Apply(db.Mutation{Op: db.OpFlush})
+
+	r, w := io.Pipe()
+	res := &restorer{w: w, done: make(chan error, 1)}
+
+	go func() {
+		err := d.Restore(r)
+		r.CloseWithError(err)
+		res.done <- err
+	}()
+
+	return res
+}
+
+func (r *restorer) finish() error {
+	r.w.Close()
+	return <-r.done
+}
+
+func (r *restorer) abort() {
+	r.w.CloseWithError(io.ErrUnexpectedEOF)
+	<-r.done
+}
@@ -0,0 +1,281 @@
+package replication
+
+import (
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/gob"
+	"encoding/hex"
+	"errors"
+	"net"
+	"sync"
+
+	"github.com/labstack/gommon/log"
+	"github.com/lukashes/db/db"
+)
+
+const (
+	DefaultBacklog = 1 << 16 // mutations kept for resuming followers
+)
+
+var (
+	ErrClosed  = errors.New("replication is closed")
+	ErrLagging = errors.New("follower is out of backlog")
+)
+
+// Leader streams mutations of DB to followers
+type Leader struct {
+	db    *db.DB
+	runID string
+
+	mu      sync.Mutex
+	cond    *sync.Cond
+	backlog []entry // ring buffer
+	offset  uint64  // offset of the last mutation
+	closed  bool
+
+	lmu       sync.Mutex
+	listeners []net.Listener
+	conns     map[net.Conn]bool
+
+	// Checks credentials of followers, nil accepts everyone
+	auth func(user, password string) error
+
+	// Listener of ListenAndServe is encrypted if it is set
+	tls *tls.Config
+}
+
+// NewLeader starts recording mutations of d
+//
+// Backlog is the number of mutations kept for followers
+// which reconnect, DefaultBacklog is used if it is zero.
+func NewLeader(d *db.DB, backlog int) *Leader {
+	if backlog <= 0 {
+		backlog = DefaultBacklog
+	}
+
+	id := make([]byte, 8)
+	rand.Read(id)
+
+	l := &Leader{
+		db:      d,
+		runID:   hex.EncodeToString(id),
+		backlog: make([]entry, backlog),
+		conns:   make(map[net.Conn]bool),
+	}
+	l.cond = sync.NewCond(&l.mu)
+
+	d.OnMutation(l.append)
+
+	return l
+}
+
+// SetAuth makes leader accept only followers whose credentials
+// pass check, it should be called before serving
+func (l *Leader) SetAuth(check func(user, password string) error) {
+	l.auth = check
+}
+
+// SetTLS encrypts listener of ListenAndServe, listener
+// given to Serve should be wrapped by tls.NewListener
+func (l *Leader) SetTLS(cfg *tls.Config) {
+	l.tls = cfg
+}
+
+// Offset returns offset of the last mutation
+func (l *Leader) Offset() uint64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.offset
+}
+
+// ListenAndServe accepts followers on addr
+func (l *Leader) ListenAndServe(addr string) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	if l.tls != nil {
+		ln = tls.NewListener(ln, l.tls)
+	}
+
+	return l.Serve(ln)
+}
+
+// Serve accepts followers until listener is closed
+func (l *Leader) Serve(ln net.Listener) error {
+	l.lmu.Lock()
+	l.listeners = append(l.listeners, ln)
+	l.lmu.Unlock()
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if l.isClosed() {
+				return ErrClosed
+			}
+			return err
+		}
+
+		l.lmu.Lock()
+		l.conns[conn] = true
+		l.lmu.Unlock()
+
+		go func() {
+			if err := l.serve(conn); err != nil && !l.isClosed() {
+				log.Warnf("replication: follower %s: %s", conn.RemoteAddr(), err)
+			}
+
+			l.lmu.Lock()
+			delete(l.conns, conn)
+			l.lmu.Unlock()
+
+			conn.Close()
+		}()
+	}
+}
+
+// Close stops listeners and disconnects followers
+func (l *Leader) Close() error {
+	l.mu.Lock()
+	l.closed = true
+	l.cond.Broadcast()
+	l.mu.Unlock()
+
+	l.lmu.Lock()
+	defer l.lmu.Unlock()
+
+	for _, ln := range l.listeners {
+		ln.Close()
+	}
+	for c := range l.conns {
+		c.Close()
+	}
+
+	return nil
+}
+
+func (l *Leader) isClosed() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.closed
+}
+
+// Called by DB under bucket lock
+func (l *Leader) append(m db.Mutation) {
+	l.mu.Lock()
+
+	l.offset++
+	l.backlog[l.offset%uint64(len(l.backlog))] = entry{offset: l.offset, mutation: m}
+
+	l.mu.Unlock()
+
+	l.cond.Broadcast()
+}
+
+func (l *Leader) serve(conn net.Conn) error {
+	dec := gob.NewDecoder(conn)
+	enc := gob.NewEncoder(conn)
+
+	var h hello
+	if err := dec.Decode(&h); err != nil {
+		return err
+	}
+
+	if l.auth != nil {
+		if err := l.auth(h.User, h.Password); err != nil {
+			enc.Encode(&message{Kind: kindError, Error: err.Error()})
+			return err
+		}
+	}
+
+	next := h.Offset + 1
+	if h.RunID != l.runID || !l.inBacklog(next) {
+		offset, err := l.fullSync(enc)
+		if err != nil {
+			return err
+		}
+		next = offset + 1
+	}
+
+	for {
+		batch, err := l.wait(next)
+		if err != nil {
+			return err
+		}
+
+		for _, e := range batch {
+			if err := enc.Encode(&message{Kind: kindMutation, Offset: e.offset, Mutation: e.mutation}); err != nil {
+				return err
+			}
+		}
+
+		next += uint64(len(batch))
+	}
+}
+
+// Checks mutations from offset are still in backlog,
+// offset next to the last one is valid as well
+func (l *Leader) inBacklog(offset uint64) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if offset == 0 || offset > l.offset+1 {
+		return false
+	}
+
+	return l.offset+1-offset <= uint64(len(l.backlog))
+}
+
+// Sends snapshot, returns offset which is included
+func (l *Leader) fullSync(enc *gob.Encoder) (uint64, error) {
+	// Offset is taken at point of snapshot, so updates which
+	// are not idempotent are never applied twice
+	var offset uint64
+	w := &snapshotWriter{enc: enc}
+	if err := l.db.SnapshotAt(w, func() { offset = l.Offset() }); err != nil {
+		return 0, err
+	}
+
+	return offset, enc.Encode(&message{Kind: kindSnapshotEnd, RunID: l.runID, Offset: offset})
+}
+
+// Blocks until mutations from offset appear
+func (l *Leader) wait(offset uint64) ([]entry, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for l.offset < offset && !l.closed {
+		l.cond.Wait()
+	}
+
+	if l.closed {
+		return nil, ErrClosed
+	}
+
+	size := uint64(len(l.backlog))
+	if l.offset-offset+1 > size {
+		return nil, ErrLagging
+	}
+
+	batch := make([]entry, 0, l.offset-offset+1)
+	for o := offset; o <= l.offset; o++ {
+		batch = append(batch, l.backlog[o%size])
+	}
+
+	return batch, nil
+}
+
+// Sends snapshot by parts
+type snapshotWriter struct {
+	enc *gob.Encoder
+}
+
+func (w *snapshotWriter) Write(p []byte) (int, error) {
+	if err := w.enc.Encode(&message{Kind: kindSnapshot, Data: p}); err != nil {
+		return 0, err
+	}
+
+	return len(p), nil
+}
@@ -0,0 +1,46 @@
+// Package replication keeps follower DB in sync with leader
+//
+// Follower connects to leader by TCP and sends its position:
+// identifier of leader run and offset of the last applied
+// mutation with optional credentials. If leader still keeps the next mutations in its
+// backlog it continues streaming from that offset, otherwise
+// it sends full snapshot of keyspace followed by the stream.
+// Messages are gob encoded.
+package replication
+
+import (
+	"github.com/lukashes/db/db"
+)
+
+type kind uint8
+
+const (
+	kindSnapshot kind = iota + 1 // part of snapshot
+	kindSnapshotEnd
+	kindMutation
+	kindError // follower is rejected
+)
+
+// First message from follower
+type hello struct {
+	RunID  string
+	Offset uint64
+
+	User     string
+	Password string
+}
+
+// Messages from leader
+type message struct {
+	Kind     kind
+	RunID    string
+	Offset   uint64
+	Data     []byte
+	Mutation db.Mutation
+	Error    string
+}
+
+type entry struct {
+	offset   uint64
+	mutation db.Mutation
+}
@@ -0,0 +1,150 @@
+package replication
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/lukashes/db/db"
+)
+
+func waitFor(t *testing.T, cond func() bool) {
+	for i := 0; i < 200; i++ {
+		if cond() {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	t.Fatal("timeout")
+}
+
+func TestReplication(t *testing.T) {
+	src := db.New()
+	src.Write("before", []byte("snapshot"), nil)
+
+	leader := NewLeader(src, 16)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go leader.Serve(ln)
+	defer leader.Close()
+
+	dst := db.New()
+	follower := NewFollower(dst, ln.Addr().String())
+	go follower.Run()
+	defer follower.Close()
+
+	waitFor(t, func() bool {
+		v, err := dst.Read("before")
+		return err == nil && string(v) == "snapshot"
+	})
+
+	src.Write("after", []byte("stream"), nil)
+	src.WriteList("list", []string{"donald", "duck"}, nil)
+	src.Delete("before")
+
+	waitFor(t, func() bool { return follower.Offset() == leader.Offset() })
+
+	if v, err := dst.Read("after"); err != nil || string(v) != "stream" {
+		t.Errorf("unexpected value %q: %v", v, err)
+	}
+	if v, err := dst.ReadListIndex("list", 1); err != nil || string(v) != "duck" {
+		t.Errorf("unexpected list item %q: %v", v, err)
+	}
+	if _, err := dst.Read("before"); err != db.ErrNotFound {
+		t.Errorf("deleted key is replicated: %v", err)
+	}
+
+	if err := dst.Write("key", []byte("value"), nil); err != db.ErrReadOnly {
+		t.Errorf("expected read only error, got %v", err)
+	}
+
+	// Resume after disconnect
+	follower.mu.Lock()
+	follower.conn.Close()
+	follower.mu.Unlock()
+
+	src.Write("resumed", []byte("value"), nil)
+
+	waitFor(t, func() bool {
+		_, err := dst.Read("resumed")
+		return err == nil
+	})
+}
+
+func TestAuth(t *testing.T) {
+	src := db.New()
+	src.Write("key", []byte("value"), nil)
+
+	leader := NewLeader(src, 16)
+	leader.SetAuth(func(user, password string) error {
+		if user != "replica" || password != "secret" {
+			return errors.New("access denied")
+		}
+		return nil
+	})
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go leader.Serve(ln)
+	defer leader.Close()
+
+	rejected := NewFollower(db.New(), ln.Addr().String())
+	if _, err := rejected.sync(); err == nil || err.Error() != "access denied" {
+		t.Fatalf("expected access error, got %v", err)
+	}
+
+	dst := db.New()
+	follower := NewFollower(dst, ln.Addr().String())
+	follower.SetAuth("replica", "secret")
+	go follower.Run()
+	defer follower.Close()
+
+	waitFor(t, func() bool {
+		v, err := dst.Read("key")
+		return err == nil && string(v) == "value"
+	})
+}
+
+func TestFailedMutation(t *testing.T) {
+	src := db.New()
+	src.XAdd("stream", "1-1", map[string]string{"field": "value"}, 0)
+
+	leader := NewLeader(src, 16)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go leader.Serve(ln)
+	defer leader.Close()
+
+	dst := db.New()
+	follower := NewFollower(dst, ln.Addr().String())
+	go follower.Run()
+	defer follower.Close()
+
+	waitFor(t, func() bool {
+		n, err := dst.XLen("stream")
+		return err == nil && n == 1
+	})
+
+	// Key of follower diverges, so next update of it fails
+	var diverged db.Mutation
+	other := db.New()
+	other.OnMutation(func(m db.Mutation) { diverged = m })
+	other.Write("stream", []byte("string"), nil)
+	if err := dst.Apply(diverged); err != nil {
+		t.Fatal(err)
+	}
+
+	src.XAdd("stream", "2-1", map[string]string{"field": "value"}, 0)
+
+	waitFor(t, func() bool {
+		n, err := dst.XLen("stream")
+		return err == nil && n == 2
+	})
+}
@@ -0,0 +1,155 @@
+package script
+
+// Expressions
+
+type expr interface{}
+
+type constExpr struct {
+	v interface{}
+}
+
+// Variable of current function
+type localExpr struct {
+	slot int
+}
+
+// Variable of enclosing function
+type upvalExpr struct {
+	idx int
+}
+
+type globalExpr struct {
+	name string
+}
+
+type indexExpr struct {
+	obj, key expr
+	line     int
+}
+
+type callExpr struct {
+	fn   expr
+	args []expr
+	line int
+
+	// Method call obj:name(args), fn is obj
+	method string
+}
+
+type funcExpr struct {
+	proto *proto
+}
+
+type binExpr struct {
+	op   token
+	l, r expr
+	line int
+}
+
+type logicExpr struct {
+	and  bool
+	l, r expr
+}
+
+type unExpr struct {
+	op   token
+	x    expr
+	line int
+}
+
+type tableExpr struct {
+	items []tableItem
+	line  int
+}
+
+type tableItem struct {
+	key expr // nil for positional item
+	val expr
+}
+
+// Parentheses truncate results of call to one value
+type parenExpr struct {
+	x expr
+}
+
+// Statements
+
+type stat interface{}
+
+type block struct {
+	stats []stat
+}
+
+type localStat struct {
+	slots []int
+	exprs []expr
+}
+
+type localFuncStat struct {
+	slot  int
+	proto *proto
+}
+
+type assignStat struct {
+	targets []expr
+	exprs   []expr
+}
+
+type callStat struct {
+	call *callExpr
+}
+
+type ifStat struct {
+	conds  []expr
+	blocks []*block
+	els    *block
+}
+
+type whileStat struct {
+	cond expr
+	body *block
+}
+
+type repeatStat struct {
+	body *block
+	cond expr
+}
+
+type numForStat struct {
+	slot               int
+	start, limit, step expr
+	body               *block
+	line               int
+}
+
+type genForStat struct {
+	slots []int
+	exprs []expr
+	body  *block
+	line  int
+}
+
+type doStat struct {
+	body *block
+}
+
+type returnStat struct {
+	exprs []expr
+}
+
+type breakStat struct{}
+
+// Compiled function
+type proto struct {
+	params []int
+	slots  int
+	upvals []upval
+	body   *block
+}
+
+// Where closure takes upvalue from: local slot of
+// enclosing function or its upvalue
+type upval struct {
+	local bool
+	idx   int
+}
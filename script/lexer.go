@@ -0,0 +1,360 @@
+package script
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+type token int
+
+const (
+	tokEOF token = iota
+	tokName
+	tokNumber
+	tokString
+
+	// Keywords
+	tokAnd
+	tokBreak
+	tokDo
+	tokElse
+	tokElseif
+	tokEnd
+	tokFalse
+	tokFor
+	tokFunction
+	tokIf
+	tokIn
+	tokLocal
+	tokNil
+	tokNot
+	tokOr
+	tokRepeat
+	tokReturn
+	tokThen
+	tokTrue
+	tokUntil
+	tokWhile
+
+	// Operators and punctuation
+	tokPlus
+	tokMinus
+	tokStar
+	tokSlash
+	tokDSlash
+	tokPercent
+	tokCaret
+	tokHash
+	tokEq
+	tokNe
+	tokLe
+	tokGe
+	tokLt
+	tokGt
+	tokAssign
+	tokLParen
+	tokRParen
+	tokLBrace
+	tokRBrace
+	tokLBracket
+	tokRBracket
+	tokSemi
+	tokColon
+	tokComma
+	tokDot
+	tokConcat
+)
+
+var keywords = map[string]token{
+	"and":      tokAnd,
+	"break":    tokBreak,
+	"do":       tokDo,
+	"else":     tokElse,
+	"elseif":   tokElseif,
+	"end":      tokEnd,
+	"false":    tokFalse,
+	"for":      tokFor,
+	"function": tokFunction,
+	"if":       tokIf,
+	"in":       tokIn,
+	"local":    tokLocal,
+	"nil":      tokNil,
+	"not":      tokNot,
+	"or":       tokOr,
+	"repeat":   tokRepeat,
+	"return":   tokReturn,
+	"then":     tokThen,
+	"true":     tokTrue,
+	"until":    tokUntil,
+	"while":    tokWhile,
+}
+
+var symbols = []struct {
+	s string
+	t token
+}{
+	// Longer first
+	{"//", tokDSlash},
+	{"==", tokEq},
+	{"~=", tokNe},
+	{"<=", tokLe},
+	{">=", tokGe},
+	{"..", tokConcat},
+	{"+", tokPlus},
+	{"-", tokMinus},
+	{"*", tokStar},
+	{"/", tokSlash},
+	{"%", tokPercent},
+	{"^", tokCaret},
+	{"#", tokHash},
+	{"<", tokLt},
+	{">", tokGt},
+	{"=", tokAssign},
+	{"(", tokLParen},
+	{")", tokRParen},
+	{"{", tokLBrace},
+	{"}", tokRBrace},
+	{"[", tokLBracket},
+	{"]", tokRBracket},
+	{";", tokSemi},
+	{":", tokColon},
+	{",", tokComma},
+	{".", tokDot},
+}
+
+type lexer struct {
+	src  string
+	pos  int
+	line int
+
+	// Current token
+	tok  token
+	text string
+	num  float64
+	at   int // line of token
+}
+
+func newLexer(src string) *lexer {
+	return &lexer{src: src, line: 1}
+}
+
+func (l *lexer) errorf(format string, args ...interface{}) error {
+	return &Error{Line: l.at, Msg: fmt.Sprintf(format, args...)}
+}
+
+// Reads next token
+func (l *lexer) next() error {
+	if err := l.skip(); err != nil {
+		return err
+	}
+
+	l.at = l.line
+	l.text = ""
+
+	if l.pos >= len(l.src) {
+		l.tok = tokEOF
+		return nil
+	}
+
+	c := l.src[l.pos]
+	switch {
+	case isLetter(c):
+		start := l.pos
+		for l.pos < len(l.src) && (isLetter(l.src[l.pos]) || isDigit(l.src[l.pos])) {
+			l.pos++
+		}
+		l.text = l.src[start:l.pos]
+		if t, ok := keywords[l.text]; ok {
+			l.tok = t
+		} else {
+			l.tok = tokName
+		}
+		return nil
+	case isDigit(c) || c == '.' && l.pos+1 < len(l.src) && isDigit(l.src[l.pos+1]):
+		return l.number()
+	case c == '"' || c == '\'':
+		return l.quoted(c)
+	case c == '[' && l.longBracket() >= 0:
+		s, err := l.long()
+		if err != nil {
+			return err
+		}
+		l.tok, l.text = tokString, s
+		return nil
+	}
+
+	for _, s := range symbols {
+		if strings.HasPrefix(l.src[l.pos:], s.s) {
+			l.pos += len(s.s)
+			l.tok = s.t
+			l.text = s.s
+			return nil
+		}
+	}
+
+	return l.errorf("unexpected symbol %q", c)
+}
+
+// Skips spaces and comments
+func (l *lexer) skip() error {
+	for l.pos < len(l.src) {
+		switch c := l.src[l.pos]; {
+		case c == '\n':
+			l.line++
+			l.pos++
+		case c == ' ' || c == '\t' || c == '\r':
+			l.pos++
+		case strings.HasPrefix(l.src[l.pos:], "--"):
+			l.pos += 2
+			if l.pos < len(l.src) && l.src[l.pos] == '[' && l.longBracket() >= 0 {
+				if _, err := l.long(); err != nil {
+					return err
+				}
+				continue
+			}
+			for l.pos < len(l.src) && l.src[l.pos] != '\n' {
+				l.pos++
+			}
+		default:
+			return nil
+		}
+	}
+
+	return nil
+}
+
+// Returns level of long bracket at position or -1
+func (l *lexer) longBracket() int {
+	i := l.pos + 1
+	for i < len(l.src) && l.src[i] == '=' {
+		i++
+	}
+	if i < len(l.src) && l.src[i] == '[' {
+		return i - l.pos - 1
+	}
+
+	return -1
+}
+
+// Reads long string like [[text]] or [==[text]==]
+func (l *lexer) long() (string, error) {
+	level := l.longBracket()
+	l.pos += level + 2
+
+	// First newline is skipped
+	if l.pos < len(l.src) && l.src[l.pos] == '\n' {
+		l.line++
+		l.pos++
+	}
+
+	end := "]" + strings.Repeat("=", level) + "]"
+	i := strings.Index(l.src[l.pos:], end)
+	if i < 0 {
+		return "", l.errorf("unfinished long string")
+	}
+
+	s := l.src[l.pos : l.pos+i]
+	l.line += strings.Count(s, "\n")
+	l.pos += i + len(end)
+
+	return s, nil
+}
+
+func (l *lexer) number() error {
+	start := l.pos
+	if strings.HasPrefix(l.src[l.pos:], "0x") || strings.HasPrefix(l.src[l.pos:], "0X") {
+		l.pos += 2
+		for l.pos < len(l.src) && isHex(l.src[l.pos]) {
+			l.pos++
+		}
+		n, err := strconv.ParseUint(l.src[start+2:l.pos], 16, 64)
+		if err != nil {
+			return l.errorf("malformed number %q", l.src[start:l.pos])
+		}
+		l.tok, l.num = tokNumber, float64(n)
+		return nil
+	}
+
+	for l.pos < len(l.src) {
+		c := l.src[l.pos]
+		if isDigit(c) || c == '.' {
+			l.pos++
+		} else if (c == 'e' || c == 'E') && l.pos+1 < len(l.src) {
+			l.pos++
+			if l.src[l.pos] == '+' || l.src[l.pos] == '-' {
+				l.pos++
+			}
+		} else {
+			break
+		}
+	}
+
+	n, err := strconv.ParseFloat(l.src[start:l.pos], 64)
+	if err != nil || l.pos < len(l.src) && isLetter(l.src[l.pos]) {
+		return l.errorf("malformed number %q", l.src[start:l.pos])
+	}
+	l.tok, l.num = tokNumber, n
+
+	return nil
+}
+
+func (l *lexer) quoted(q byte) error {
+	l.pos++
+
+	var b strings.Builder
+	for {
+		if l.pos >= len(l.src) || l.src[l.pos] == '\n' {
+			return l.errorf("unfinished string")
+		}
+
+		c := l.src[l.pos]
+		l.pos++
+		if c == q {
+			break
+		}
+		if c != '\\' {
+			b.WriteByte(c)
+			continue
+		}
+
+		if l.pos >= len(l.src) {
+			return l.errorf("unfinished string")
+		}
+		c = l.src[l.pos]
+		l.pos++
+		switch c {
+		case 'n':
+			b.WriteByte('\n')
+		case 't':
+			b.WriteByte('\t')
+		case 'r':
+			b.WriteByte('\r')
+		case '0':
+			b.WriteByte(0)
+		case '\\', '"', '\'':
+			b.WriteByte(c)
+		case '\n':
+			l.line++
+			b.WriteByte('\n')
+		default:
+			return l.errorf("invalid escape sequence \\%c", c)
+		}
+	}
+
+	l.tok, l.text = tokString, b.String()
+
+	return nil
+}
+
+func isLetter(c byte) bool {
+	return c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z'
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func isHex(c byte) bool {
+	return isDigit(c) || c >= 'a' && c <= 'f' || c >= 'A' && c <= 'F'
+}
@@ -0,0 +1,470 @@
+package script
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// NewGlobals returns globals with base functions and string,
+// table and math libraries
+func NewGlobals() *Table {
+	g := NewTable()
+
+	register(g, map[string]func(args []interface{}) ([]interface{}, error){
+		"type": func(args []interface{}) ([]interface{}, error) {
+			if len(args) == 0 {
+				return nil, argError(1, "type", "value expected")
+			}
+			return one(typeName(args[0]))
+		},
+		"tostring": func(args []interface{}) ([]interface{}, error) {
+			return one(ToString(arg(args, 0)))
+		},
+		"tonumber": func(args []interface{}) ([]interface{}, error) {
+			if n, ok := toNumber(arg(args, 0)); ok {
+				return one(n)
+			}
+			return one(nil)
+		},
+		"error": func(args []interface{}) ([]interface{}, error) {
+			return nil, &Error{Msg: ToString(arg(args, 0))}
+		},
+		"assert": func(args []interface{}) ([]interface{}, error) {
+			if !truth(arg(args, 0)) {
+				msg := "assertion failed!"
+				if len(args) > 1 {
+					msg = ToString(args[1])
+				}
+				return nil, &Error{Msg: msg}
+			}
+			return args, nil
+		},
+		"pairs": func(args []interface{}) ([]interface{}, error) {
+			t, err := tableArg(args, 0, "pairs")
+			if err != nil {
+				return nil, err
+			}
+			it := t.iter()
+			next := &Function{Name: "next", Fn: func([]interface{}) ([]interface{}, error) {
+				k, v := it()
+				return []interface{}{k, v}, nil
+			}}
+			return []interface{}{next, t, nil}, nil
+		},
+		"ipairs": func(args []interface{}) ([]interface{}, error) {
+			t, err := tableArg(args, 0, "ipairs")
+			if err != nil {
+				return nil, err
+			}
+			i := 0
+			next := &Function{Name: "next", Fn: func([]interface{}) ([]interface{}, error) {
+				i++
+				v := t.Get(float64(i))
+				if v == nil {
+					return one(nil)
+				}
+				return []interface{}{float64(i), v}, nil
+			}}
+			return []interface{}{next, t, nil}, nil
+		},
+		"unpack": unpack,
+	})
+
+	str := NewTable()
+	register(str, map[string]func(args []interface{}) ([]interface{}, error){
+		"len": func(args []interface{}) ([]interface{}, error) {
+			s, err := stringArg(args, 0, "len")
+			if err != nil {
+				return nil, err
+			}
+			return one(float64(len(s)))
+		},
+		"sub": func(args []interface{}) ([]interface{}, error) {
+			s, err := stringArg(args, 0, "sub")
+			if err != nil {
+				return nil, err
+			}
+			i, j := optInt(args, 1, 1), optInt(args, 2, -1)
+			i, j = strIndex(i, len(s)), strIndex(j, len(s))
+			if i < 1 {
+				i = 1
+			}
+			if j > len(s) {
+				j = len(s)
+			}
+			if i > j {
+				return one("")
+			}
+			return one(s[i-1 : j])
+		},
+		"upper": func(args []interface{}) ([]interface{}, error) {
+			s, err := stringArg(args, 0, "upper")
+			if err != nil {
+				return nil, err
+			}
+			return one(strings.ToUpper(s))
+		},
+		"lower": func(args []interface{}) ([]interface{}, error) {
+			s, err := stringArg(args, 0, "lower")
+			if err != nil {
+				return nil, err
+			}
+			return one(strings.ToLower(s))
+		},
+		"rep": func(args []interface{}) ([]interface{}, error) {
+			s, err := stringArg(args, 0, "rep")
+			if err != nil {
+				return nil, err
+			}
+			n := optInt(args, 1, 0)
+			if n <= 0 {
+				return one("")
+			}
+			if len(s)*n > maxString || len(s) > 0 && len(s)*n/len(s) != n {
+				return nil, &Error{Msg: "string is too long"}
+			}
+			return one(strings.Repeat(s, n))
+		},
+		// Patterns are not supported, substring is searched as is
+		"find": func(args []interface{}) ([]interface{}, error) {
+			s, err := stringArg(args, 0, "find")
+			if err != nil {
+				return nil, err
+			}
+			sub, err := stringArg(args, 1, "find")
+			if err != nil {
+				return nil, err
+			}
+			init := strIndex(optInt(args, 2, 1), len(s))
+			if init < 1 {
+				init = 1
+			}
+			if init > len(s)+1 {
+				return one(nil)
+			}
+			i := strings.Index(s[init-1:], sub)
+			if i < 0 {
+				return one(nil)
+			}
+			start := init + i
+			return []interface{}{float64(start), float64(start + len(sub) - 1)}, nil
+		},
+		"format": format,
+	})
+	g.Set("string", str)
+
+	tbl := NewTable()
+	register(tbl, map[string]func(args []interface{}) ([]interface{}, error){
+		"insert": func(args []interface{}) ([]interface{}, error) {
+			t, err := tableArg(args, 0, "insert")
+			if err != nil {
+				return nil, err
+			}
+			switch len(args) {
+			case 2:
+				t.Append(args[1])
+			case 3:
+				n := t.Len()
+				pos, ok := args[1].(float64)
+				if !ok || pos != math.Trunc(pos) || pos < 1 || int(pos) > n+1 {
+					return nil, argError(2, "insert", "position out of bounds")
+				}
+				for i := n; i >= int(pos); i-- {
+					t.Set(float64(i+1), t.Get(float64(i)))
+				}
+				t.Set(pos, args[2])
+			default:
+				return nil, &Error{Msg: "wrong number of arguments to 'insert'"}
+			}
+			return nil, nil
+		},
+		"remove": func(args []interface{}) ([]interface{}, error) {
+			t, err := tableArg(args, 0, "remove")
+			if err != nil {
+				return nil, err
+			}
+			n := t.Len()
+			pos := optInt(args, 1, n)
+			if n == 0 {
+				return one(nil)
+			}
+			if pos < 1 || pos > n {
+				return nil, argError(2, "remove", "position out of bounds")
+			}
+			v := t.Get(float64(pos))
+			for i := pos; i < n; i++ {
+				t.Set(float64(i), t.Get(float64(i+1)))
+			}
+			t.Set(float64(n), nil)
+			return one(v)
+		},
+		"concat": func(args []interface{}) ([]interface{}, error) {
+			t, err := tableArg(args, 0, "concat")
+			if err != nil {
+				return nil, err
+			}
+			sep := ""
+			if s, ok := arg(args, 1).(string); ok {
+				sep = s
+			}
+			i, j := optInt(args, 2, 1), optInt(args, 3, t.Len())
+			var b strings.Builder
+			for k := i; k <= j; k++ {
+				s, ok := concatString(t.Get(float64(k)))
+				if !ok {
+					return nil, &Error{Msg: fmt.Sprintf("invalid value (at index %d) in table for 'concat'", k)}
+				}
+				if k > i {
+					b.WriteString(sep)
+				}
+				b.WriteString(s)
+				if b.Len() > maxString {
+					return nil, &Error{Msg: "string is too long"}
+				}
+			}
+			return one(b.String())
+		},
+		// Only numbers or only strings are sorted, in ascending order
+		"sort": func(args []interface{}) ([]interface{}, error) {
+			t, err := tableArg(args, 0, "sort")
+			if err != nil {
+				return nil, err
+			}
+			var cerr error
+			sort.SliceStable(t.arr, func(i, j int) bool {
+				c, err := compare(t.arr[i], t.arr[j], 0)
+				if err != nil {
+					cerr = err
+				}
+				return c < 0
+			})
+			return nil, cerr
+		},
+		"unpack": unpack,
+	})
+	g.Set("table", tbl)
+
+	mth := NewTable()
+	unaryMath := map[string]func(float64) float64{
+		"floor": math.Floor,
+		"ceil":  math.Ceil,
+		"abs":   math.Abs,
+		"sqrt":  math.Sqrt,
+	}
+	for name, f := range unaryMath {
+		name, f := name, f
+		mth.Set(name, &Function{Name: name, Fn: func(args []interface{}) ([]interface{}, error) {
+			n, ok := toNumber(arg(args, 0))
+			if !ok {
+				return nil, argError(1, name, "number expected")
+			}
+			return one(f(n))
+		}})
+	}
+	register(mth, map[string]func(args []interface{}) ([]interface{}, error){
+		"max": func(args []interface{}) ([]interface{}, error) {
+			return extreme(args, "max", func(a, b float64) bool { return a > b })
+		},
+		"min": func(args []interface{}) ([]interface{}, error) {
+			return extreme(args, "min", func(a, b float64) bool { return a < b })
+		},
+	})
+	mth.Set("huge", math.Inf(1))
+	mth.Set("pi", math.Pi)
+	g.Set("math", mth)
+
+	return g
+}
+
+func register(t *Table, fns map[string]func(args []interface{}) ([]interface{}, error)) {
+	for name, fn := range fns {
+		t.Set(name, &Function{Name: name, Fn: fn})
+	}
+}
+
+func one(v interface{}) ([]interface{}, error) {
+	return []interface{}{v}, nil
+}
+
+func arg(args []interface{}, i int) interface{} {
+	if i < len(args) {
+		return args[i]
+	}
+
+	return nil
+}
+
+func argError(n int, fn, msg string) error {
+	return &Error{Msg: fmt.Sprintf("bad argument #%d to '%s' (%s)", n, fn, msg)}
+}
+
+func tableArg(args []interface{}, i int, fn string) (*Table, error) {
+	t, ok := arg(args, i).(*Table)
+	if !ok {
+		return nil, argError(i+1, fn, "table expected")
+	}
+
+	return t, nil
+}
+
+// Numbers are converted to strings
+func stringArg(args []interface{}, i int, fn string) (string, error) {
+	s, ok := concatString(arg(args, i))
+	if !ok {
+		return "", argError(i+1, fn, "string expected")
+	}
+
+	return s, nil
+}
+
+func optInt(args []interface{}, i int, def int) int {
+	n, ok := toNumber(arg(args, i))
+	if !ok || math.IsNaN(n) {
+		return def
+	}
+	if n > math.MaxInt32 {
+		return math.MaxInt32
+	}
+	if n < math.MinInt32 {
+		return math.MinInt32
+	}
+
+	return int(n)
+}
+
+// Converts negative position from the end to positive one
+func strIndex(i, n int) int {
+	if i < 0 {
+		return n + i + 1
+	}
+
+	return i
+}
+
+func unpack(args []interface{}) ([]interface{}, error) {
+	t, err := tableArg(args, 0, "unpack")
+	if err != nil {
+		return nil, err
+	}
+
+	i, j := optInt(args, 1, 1), optInt(args, 2, t.Len())
+	if j-i >= maxCalls*1000 {
+		return nil, &Error{Msg: "too many results to unpack"}
+	}
+
+	var res []interface{}
+	for k := i; k <= j; k++ {
+		res = append(res, t.Get(float64(k)))
+	}
+
+	return res, nil
+}
+
+func extreme(args []interface{}, fn string, better func(a, b float64) bool) ([]interface{}, error) {
+	if len(args) == 0 {
+		return nil, argError(1, fn, "number expected")
+	}
+
+	var res float64
+	for i, a := range args {
+		n, ok := toNumber(a)
+		if !ok {
+			return nil, argError(i+1, fn, "number expected")
+		}
+		if i == 0 || better(n, res) {
+			res = n
+		}
+	}
+
+	return one(res)
+}
+
+// Supports verbs d, i, x, X, o, c, e, f, g, s and q with flags,
+// width and precision
+func format(args []interface{}) ([]interface{}, error) {
+	f, err := stringArg(args, 0, "format")
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		b strings.Builder
+		n = 1
+	)
+	for i := 0; i < len(f); i++ {
+		if f[i] != '%' {
+			b.WriteByte(f[i])
+			continue
+		}
+
+		j := i + 1
+		for j < len(f) && strings.IndexByte("-+ #0123456789.", f[j]) >= 0 {
+			j++
+		}
+		if j == len(f) {
+			return nil, &Error{Msg: "invalid conversion '" + f[i:] + "' to 'format'"}
+		}
+
+		spec, verb := f[i:j], f[j]
+		i = j
+		if longWidth(spec) {
+			return nil, &Error{Msg: "invalid conversion '" + spec + string(verb) + "' to 'format'"}
+		}
+		if verb == '%' {
+			b.WriteByte('%')
+			continue
+		}
+
+		a := arg(args, n)
+		n++
+		switch verb {
+		case 'd', 'i', 'x', 'X', 'o', 'c':
+			v, ok := toNumber(a)
+			if !ok || v != math.Trunc(v) {
+				return nil, argError(n, "format", "number has no integer representation")
+			}
+			if verb == 'i' {
+				verb = 'd'
+			}
+			fmt.Fprintf(&b, spec+string(verb), int64(v))
+		case 'e', 'E', 'f', 'g', 'G':
+			v, ok := toNumber(a)
+			if !ok {
+				return nil, argError(n, "format", "number expected")
+			}
+			fmt.Fprintf(&b, spec+string(verb), v)
+		case 's':
+			fmt.Fprintf(&b, spec+"s", ToString(a))
+		case 'q':
+			b.WriteString(strconv.Quote(ToString(a)))
+		default:
+			return nil, &Error{Msg: "invalid conversion '" + spec + string(verb) + "' to 'format'"}
+		}
+
+		if b.Len() > maxString {
+			return nil, &Error{Msg: "string is too long"}
+		}
+	}
+
+	return one(b.String())
+}
+
+// Width and precision are limited to two digits like in Lua
+func longWidth(spec string) bool {
+	digits := 0
+	for i := 0; i < len(spec); i++ {
+		if spec[i] >= '0' && spec[i] <= '9' {
+			digits++
+			if digits > 2 {
+				return true
+			}
+		} else {
+			digits = 0
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,897 @@
+package script
+
+// Limit of nested blocks and expressions
+const maxNesting = 200
+
+// Binary operators with left and right priority,
+// right associative ones have lower right priority
+var priority = map[token][2]int{
+	tokOr:      {1, 1},
+	tokAnd:     {2, 2},
+	tokLt:      {3, 3},
+	tokGt:      {3, 3},
+	tokLe:      {3, 3},
+	tokGe:      {3, 3},
+	tokNe:      {3, 3},
+	tokEq:      {3, 3},
+	tokConcat:  {9, 8},
+	tokPlus:    {10, 10},
+	tokMinus:   {10, 10},
+	tokStar:    {11, 11},
+	tokSlash:   {11, 11},
+	tokDSlash:  {11, 11},
+	tokPercent: {11, 11},
+	tokCaret:   {14, 13},
+}
+
+const unaryPriority = 12
+
+type parser struct {
+	lex   *lexer
+	fs    *funcState
+	depth int
+}
+
+// Scopes of function being parsed
+type funcState struct {
+	parent  *funcState
+	proto   *proto
+	scopes  []map[string]int
+	upnames map[string]int
+	loops   int
+}
+
+func parse(src string) (*proto, error) {
+	p := &parser{lex: newLexer(src)}
+	if err := p.lex.next(); err != nil {
+		return nil, err
+	}
+
+	fs := p.open(nil)
+	body, err := p.block()
+	if err != nil {
+		return nil, err
+	}
+	if p.lex.tok != tokEOF {
+		return nil, p.lex.errorf("unexpected %q", p.lex.text)
+	}
+	fs.proto.body = body
+	p.fs = nil
+
+	return fs.proto, nil
+}
+
+func (p *parser) open(parent *funcState) *funcState {
+	fs := &funcState{
+		parent:  parent,
+		proto:   new(proto),
+		scopes:  []map[string]int{{}},
+		upnames: make(map[string]int),
+	}
+	p.fs = fs
+
+	return fs
+}
+
+func (p *parser) declare(name string) int {
+	fs := p.fs
+	slot := fs.proto.slots
+	fs.proto.slots++
+	fs.scopes[len(fs.scopes)-1][name] = slot
+
+	return slot
+}
+
+// Returns local, upvalue or nil if name is global
+func (fs *funcState) find(name string) expr {
+	for i := len(fs.scopes) - 1; i >= 0; i-- {
+		if slot, ok := fs.scopes[i][name]; ok {
+			return &localExpr{slot: slot}
+		}
+	}
+
+	if idx, ok := fs.upnames[name]; ok {
+		return &upvalExpr{idx: idx}
+	}
+
+	if fs.parent == nil {
+		return nil
+	}
+
+	var u upval
+	switch e := fs.parent.find(name).(type) {
+	case *localExpr:
+		u = upval{local: true, idx: e.slot}
+	case *upvalExpr:
+		u = upval{idx: e.idx}
+	default:
+		return nil
+	}
+
+	idx := len(fs.proto.upvals)
+	fs.proto.upvals = append(fs.proto.upvals, u)
+	fs.upnames[name] = idx
+
+	return &upvalExpr{idx: idx}
+}
+
+func (p *parser) enter() error {
+	p.depth++
+	if p.depth > maxNesting {
+		return p.lex.errorf("too deep nesting")
+	}
+
+	return nil
+}
+
+func (p *parser) leave() {
+	p.depth--
+}
+
+func (p *parser) expect(t token, what string) error {
+	if p.lex.tok != t {
+		return p.lex.errorf("%s expected near %q", what, p.near())
+	}
+
+	return p.lex.next()
+}
+
+func (p *parser) near() string {
+	switch p.lex.tok {
+	case tokEOF:
+		return "<eof>"
+	case tokNumber:
+		return "number"
+	case tokString:
+		return "string"
+	}
+
+	return p.lex.text
+}
+
+func (p *parser) name() (string, error) {
+	if p.lex.tok != tokName {
+		return "", p.lex.errorf("name expected near %q", p.near())
+	}
+	s := p.lex.text
+
+	return s, p.lex.next()
+}
+
+func blockEnd(t token) bool {
+	switch t {
+	case tokEOF, tokEnd, tokElse, tokElseif, tokUntil:
+		return true
+	}
+
+	return false
+}
+
+// Parses statements in new scope
+func (p *parser) block() (*block, error) {
+	if err := p.enter(); err != nil {
+		return nil, err
+	}
+	defer p.leave()
+
+	fs := p.fs
+	fs.scopes = append(fs.scopes, map[string]int{})
+	defer func() { fs.scopes = fs.scopes[:len(fs.scopes)-1] }()
+
+	return p.stats()
+}
+
+// Parses statements of current scope
+func (p *parser) stats() (*block, error) {
+	b := new(block)
+	for !blockEnd(p.lex.tok) {
+		if p.lex.tok == tokReturn {
+			s, err := p.ret()
+			if err != nil {
+				return nil, err
+			}
+			b.stats = append(b.stats, s)
+			if !blockEnd(p.lex.tok) {
+				return nil, p.lex.errorf("end expected after return near %q", p.near())
+			}
+			break
+		}
+
+		s, err := p.stat()
+		if err != nil {
+			return nil, err
+		}
+		if s != nil {
+			b.stats = append(b.stats, s)
+		}
+	}
+
+	return b, nil
+}
+
+func (p *parser) ret() (stat, error) {
+	if err := p.lex.next(); err != nil {
+		return nil, err
+	}
+
+	s := new(returnStat)
+	if !blockEnd(p.lex.tok) && p.lex.tok != tokSemi {
+		exprs, err := p.exprList()
+		if err != nil {
+			return nil, err
+		}
+		s.exprs = exprs
+	}
+	if p.lex.tok == tokSemi {
+		if err := p.lex.next(); err != nil {
+			return nil, err
+		}
+	}
+
+	return s, nil
+}
+
+func (p *parser) stat() (stat, error) {
+	line := p.lex.at
+
+	switch p.lex.tok {
+	case tokSemi:
+		return nil, p.lex.next()
+	case tokIf:
+		return p.ifStat()
+	case tokWhile:
+		if err := p.lex.next(); err != nil {
+			return nil, err
+		}
+		cond, err := p.expr()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expect(tokDo, "do"); err != nil {
+			return nil, err
+		}
+		body, err := p.loop()
+		if err != nil {
+			return nil, err
+		}
+		return &whileStat{cond: cond, body: body}, p.expect(tokEnd, "end")
+	case tokRepeat:
+		return p.repeatStat()
+	case tokFor:
+		return p.forStat(line)
+	case tokDo:
+		if err := p.lex.next(); err != nil {
+			return nil, err
+		}
+		body, err := p.block()
+		if err != nil {
+			return nil, err
+		}
+		return &doStat{body: body}, p.expect(tokEnd, "end")
+	case tokFunction:
+		return p.funcStat()
+	case tokLocal:
+		if err := p.lex.next(); err != nil {
+			return nil, err
+		}
+		if p.lex.tok == tokFunction {
+			return p.localFunc()
+		}
+		return p.local()
+	case tokBreak:
+		if p.fs.loops == 0 {
+			return nil, p.lex.errorf("break outside loop")
+		}
+		return &breakStat{}, p.lex.next()
+	}
+
+	return p.exprStat()
+}
+
+// Parses loop body
+func (p *parser) loop() (*block, error) {
+	p.fs.loops++
+	defer func() { p.fs.loops-- }()
+
+	return p.block()
+}
+
+func (p *parser) ifStat() (stat, error) {
+	s := new(ifStat)
+	for {
+		// Skips if or elseif
+		if err := p.lex.next(); err != nil {
+			return nil, err
+		}
+		cond, err := p.expr()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expect(tokThen, "then"); err != nil {
+			return nil, err
+		}
+		body, err := p.block()
+		if err != nil {
+			return nil, err
+		}
+		s.conds = append(s.conds, cond)
+		s.blocks = append(s.blocks, body)
+
+		if p.lex.tok != tokElseif {
+			break
+		}
+	}
+
+	if p.lex.tok == tokElse {
+		if err := p.lex.next(); err != nil {
+			return nil, err
+		}
+		body, err := p.block()
+		if err != nil {
+			return nil, err
+		}
+		s.els = body
+	}
+
+	return s, p.expect(tokEnd, "end")
+}
+
+// Condition sees locals of body, so scope is closed after it
+func (p *parser) repeatStat() (stat, error) {
+	if err := p.lex.next(); err != nil {
+		return nil, err
+	}
+	if err := p.enter(); err != nil {
+		return nil, err
+	}
+	defer p.leave()
+
+	fs := p.fs
+	fs.scopes = append(fs.scopes, map[string]int{})
+	defer func() { fs.scopes = fs.scopes[:len(fs.scopes)-1] }()
+
+	fs.loops++
+	body, err := p.stats()
+	fs.loops--
+	if err != nil {
+		return nil, err
+	}
+
+	if err := p.expect(tokUntil, "until"); err != nil {
+		return nil, err
+	}
+	cond, err := p.expr()
+	if err != nil {
+		return nil, err
+	}
+
+	return &repeatStat{body: body, cond: cond}, nil
+}
+
+func (p *parser) forStat(line int) (stat, error) {
+	if err := p.lex.next(); err != nil {
+		return nil, err
+	}
+	first, err := p.name()
+	if err != nil {
+		return nil, err
+	}
+
+	// Loop variables are in own scope around body
+	fs := p.fs
+	fs.scopes = append(fs.scopes, map[string]int{})
+	defer func() { fs.scopes = fs.scopes[:len(fs.scopes)-1] }()
+
+	if p.lex.tok == tokAssign {
+		if err := p.lex.next(); err != nil {
+			return nil, err
+		}
+		s := &numForStat{line: line}
+		if s.start, err = p.expr(); err != nil {
+			return nil, err
+		}
+		if err := p.expect(tokComma, "','"); err != nil {
+			return nil, err
+		}
+		if s.limit, err = p.expr(); err != nil {
+			return nil, err
+		}
+		if p.lex.tok == tokComma {
+			if err := p.lex.next(); err != nil {
+				return nil, err
+			}
+			if s.step, err = p.expr(); err != nil {
+				return nil, err
+			}
+		}
+		if err := p.expect(tokDo, "do"); err != nil {
+			return nil, err
+		}
+		s.slot = p.declare(first)
+		if s.body, err = p.loop(); err != nil {
+			return nil, err
+		}
+		return s, p.expect(tokEnd, "end")
+	}
+
+	names := []string{first}
+	for p.lex.tok == tokComma {
+		if err := p.lex.next(); err != nil {
+			return nil, err
+		}
+		n, err := p.name()
+		if err != nil {
+			return nil, err
+		}
+		names = append(names, n)
+	}
+	if err := p.expect(tokIn, "in"); err != nil {
+		return nil, err
+	}
+
+	s := &genForStat{line: line}
+	if s.exprs, err = p.exprList(); err != nil {
+		return nil, err
+	}
+	if err := p.expect(tokDo, "do"); err != nil {
+		return nil, err
+	}
+	for _, n := range names {
+		s.slots = append(s.slots, p.declare(n))
+	}
+	if s.body, err = p.loop(); err != nil {
+		return nil, err
+	}
+
+	return s, p.expect(tokEnd, "end")
+}
+
+// Function name could be a.b.c, it is assigned like index
+func (p *parser) funcStat() (stat, error) {
+	line := p.lex.at
+	if err := p.lex.next(); err != nil {
+		return nil, err
+	}
+
+	n, err := p.name()
+	if err != nil {
+		return nil, err
+	}
+	target := p.variable(n)
+	for p.lex.tok == tokDot {
+		if err := p.lex.next(); err != nil {
+			return nil, err
+		}
+		key, err := p.name()
+		if err != nil {
+			return nil, err
+		}
+		target = &indexExpr{obj: target, key: &constExpr{v: key}, line: line}
+	}
+
+	f, err := p.body()
+	if err != nil {
+		return nil, err
+	}
+
+	return &assignStat{targets: []expr{target}, exprs: []expr{f}}, nil
+}
+
+// Name is declared before body, so function could call itself
+func (p *parser) localFunc() (stat, error) {
+	if err := p.lex.next(); err != nil {
+		return nil, err
+	}
+
+	n, err := p.name()
+	if err != nil {
+		return nil, err
+	}
+	slot := p.declare(n)
+
+	f, err := p.body()
+	if err != nil {
+		return nil, err
+	}
+
+	return &localFuncStat{slot: slot, proto: f.proto}, nil
+}
+
+// Names are declared after values, so they see previous variables
+func (p *parser) local() (stat, error) {
+	var names []string
+	for {
+		n, err := p.name()
+		if err != nil {
+			return nil, err
+		}
+		names = append(names, n)
+
+		if p.lex.tok != tokComma {
+			break
+		}
+		if err := p.lex.next(); err != nil {
+			return nil, err
+		}
+	}
+
+	s := new(localStat)
+	if p.lex.tok == tokAssign {
+		if err := p.lex.next(); err != nil {
+			return nil, err
+		}
+		exprs, err := p.exprList()
+		if err != nil {
+			return nil, err
+		}
+		s.exprs = exprs
+	}
+
+	for _, n := range names {
+		s.slots = append(s.slots, p.declare(n))
+	}
+
+	return s, nil
+}
+
+func (p *parser) exprStat() (stat, error) {
+	e, err := p.suffixed()
+	if err != nil {
+		return nil, err
+	}
+
+	if p.lex.tok != tokAssign && p.lex.tok != tokComma {
+		call, ok := e.(*callExpr)
+		if !ok {
+			return nil, p.lex.errorf("syntax error near %q", p.near())
+		}
+		return &callStat{call: call}, nil
+	}
+
+	targets := []expr{e}
+	for p.lex.tok == tokComma {
+		if err := p.lex.next(); err != nil {
+			return nil, err
+		}
+		t, err := p.suffixed()
+		if err != nil {
+			return nil, err
+		}
+		targets = append(targets, t)
+	}
+	for _, t := range targets {
+		switch t.(type) {
+		case *localExpr, *upvalExpr, *globalExpr, *indexExpr:
+		default:
+			return nil, p.lex.errorf("cannot assign to expression")
+		}
+	}
+
+	if err := p.expect(tokAssign, "'='"); err != nil {
+		return nil, err
+	}
+	exprs, err := p.exprList()
+	if err != nil {
+		return nil, err
+	}
+
+	return &assignStat{targets: targets, exprs: exprs}, nil
+}
+
+func (p *parser) variable(name string) expr {
+	if e := p.fs.find(name); e != nil {
+		return e
+	}
+
+	return &globalExpr{name: name}
+}
+
+func (p *parser) exprList() ([]expr, error) {
+	var exprs []expr
+	for {
+		e, err := p.expr()
+		if err != nil {
+			return nil, err
+		}
+		exprs = append(exprs, e)
+
+		if p.lex.tok != tokComma {
+			return exprs, nil
+		}
+		if err := p.lex.next(); err != nil {
+			return nil, err
+		}
+	}
+}
+
+func (p *parser) expr() (expr, error) {
+	return p.sub(0)
+}
+
+// Parses expression with operators of priority above limit
+func (p *parser) sub(limit int) (expr, error) {
+	if err := p.enter(); err != nil {
+		return nil, err
+	}
+	defer p.leave()
+
+	var (
+		e   expr
+		err error
+	)
+	switch op := p.lex.tok; op {
+	case tokNot, tokMinus, tokHash:
+		line := p.lex.at
+		if err := p.lex.next(); err != nil {
+			return nil, err
+		}
+		x, err := p.sub(unaryPriority)
+		if err != nil {
+			return nil, err
+		}
+		e = &unExpr{op: op, x: x, line: line}
+	default:
+		if e, err = p.simple(); err != nil {
+			return nil, err
+		}
+	}
+
+	for {
+		op := p.lex.tok
+		prio, ok := priority[op]
+		if !ok || prio[0] <= limit {
+			return e, nil
+		}
+
+		line := p.lex.at
+		if err := p.lex.next(); err != nil {
+			return nil, err
+		}
+		r, err := p.sub(prio[1])
+		if err != nil {
+			return nil, err
+		}
+
+		switch op {
+		case tokAnd, tokOr:
+			e = &logicExpr{and: op == tokAnd, l: e, r: r}
+		default:
+			e = &binExpr{op: op, l: e, r: r, line: line}
+		}
+	}
+}
+
+func (p *parser) simple() (expr, error) {
+	var e expr
+	switch p.lex.tok {
+	case tokNumber:
+		e = &constExpr{v: p.lex.num}
+	case tokString:
+		e = &constExpr{v: p.lex.text}
+	case tokNil:
+		e = &constExpr{}
+	case tokTrue:
+		e = &constExpr{v: true}
+	case tokFalse:
+		e = &constExpr{v: false}
+	case tokLBrace:
+		return p.table()
+	case tokFunction:
+		if err := p.lex.next(); err != nil {
+			return nil, err
+		}
+		return p.body()
+	default:
+		return p.suffixed()
+	}
+
+	return e, p.lex.next()
+}
+
+func (p *parser) primary() (expr, error) {
+	switch p.lex.tok {
+	case tokName:
+		n, err := p.name()
+		if err != nil {
+			return nil, err
+		}
+		return p.variable(n), nil
+	case tokLParen:
+		if err := p.lex.next(); err != nil {
+			return nil, err
+		}
+		e, err := p.expr()
+		if err != nil {
+			return nil, err
+		}
+		return &parenExpr{x: e}, p.expect(tokRParen, "')'")
+	}
+
+	return nil, p.lex.errorf("unexpected symbol near %q", p.near())
+}
+
+func (p *parser) suffixed() (expr, error) {
+	e, err := p.primary()
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		line := p.lex.at
+		switch p.lex.tok {
+		case tokDot:
+			if err := p.lex.next(); err != nil {
+				return nil, err
+			}
+			key, err := p.name()
+			if err != nil {
+				return nil, err
+			}
+			e = &indexExpr{obj: e, key: &constExpr{v: key}, line: line}
+		case tokLBracket:
+			if err := p.lex.next(); err != nil {
+				return nil, err
+			}
+			key, err := p.expr()
+			if err != nil {
+				return nil, err
+			}
+			if err := p.expect(tokRBracket, "']'"); err != nil {
+				return nil, err
+			}
+			e = &indexExpr{obj: e, key: key, line: line}
+		case tokColon:
+			if err := p.lex.next(); err != nil {
+				return nil, err
+			}
+			m, err := p.name()
+			if err != nil {
+				return nil, err
+			}
+			args, err := p.args()
+			if err != nil {
+				return nil, err
+			}
+			e = &callExpr{fn: e, args: args, line: line, method: m}
+		case tokLParen, tokString, tokLBrace:
+			args, err := p.args()
+			if err != nil {
+				return nil, err
+			}
+			e = &callExpr{fn: e, args: args, line: line}
+		default:
+			return e, nil
+		}
+	}
+}
+
+func (p *parser) args() ([]expr, error) {
+	switch p.lex.tok {
+	case tokString:
+		s := p.lex.text
+		return []expr{&constExpr{v: s}}, p.lex.next()
+	case tokLBrace:
+		t, err := p.table()
+		if err != nil {
+			return nil, err
+		}
+		return []expr{t}, nil
+	case tokLParen:
+		if err := p.lex.next(); err != nil {
+			return nil, err
+		}
+		if p.lex.tok == tokRParen {
+			return nil, p.lex.next()
+		}
+		args, err := p.exprList()
+		if err != nil {
+			return nil, err
+		}
+		return args, p.expect(tokRParen, "')'")
+	}
+
+	return nil, p.lex.errorf("function arguments expected near %q", p.near())
+}
+
+func (p *parser) table() (expr, error) {
+	t := &tableExpr{line: p.lex.at}
+	if err := p.expect(tokLBrace, "'{'"); err != nil {
+		return nil, err
+	}
+
+	for p.lex.tok != tokRBrace {
+		var item tableItem
+		switch {
+		case p.lex.tok == tokLBracket:
+			if err := p.lex.next(); err != nil {
+				return nil, err
+			}
+			key, err := p.expr()
+			if err != nil {
+				return nil, err
+			}
+			if err := p.expect(tokRBracket, "']'"); err != nil {
+				return nil, err
+			}
+			if err := p.expect(tokAssign, "'='"); err != nil {
+				return nil, err
+			}
+			item.key = key
+		case p.lex.tok == tokName && p.peekAssign():
+			item.key = &constExpr{v: p.lex.text}
+			if err := p.lex.next(); err != nil {
+				return nil, err
+			}
+			if err := p.lex.next(); err != nil {
+				return nil, err
+			}
+		}
+
+		val, err := p.expr()
+		if err != nil {
+			return nil, err
+		}
+		item.val = val
+		t.items = append(t.items, item)
+
+		if p.lex.tok != tokComma && p.lex.tok != tokSemi {
+			break
+		}
+		if err := p.lex.next(); err != nil {
+			return nil, err
+		}
+	}
+
+	return t, p.expect(tokRBrace, "'}'")
+}
+
+// Checks name is followed by single '=' without reading it
+func (p *parser) peekAssign() bool {
+	i := p.lex.pos
+	for i < len(p.lex.src) && (p.lex.src[i] == ' ' || p.lex.src[i] == '\t' || p.lex.src[i] == '\r' || p.lex.src[i] == '\n') {
+		i++
+	}
+
+	return i < len(p.lex.src) && p.lex.src[i] == '=' && (i+1 == len(p.lex.src) || p.lex.src[i+1] != '=')
+}
+
+// Parses parameters and body of function
+func (p *parser) body() (*funcExpr, error) {
+	if err := p.enter(); err != nil {
+		return nil, err
+	}
+	defer p.leave()
+
+	parent := p.fs
+	fs := p.open(parent)
+	defer func() { p.fs = parent }()
+
+	if err := p.expect(tokLParen, "'('"); err != nil {
+		return nil, err
+	}
+	for p.lex.tok != tokRParen {
+		n, err := p.name()
+		if err != nil {
+			return nil, err
+		}
+		fs.proto.params = append(fs.proto.params, p.declare(n))
+
+		if p.lex.tok != tokComma {
+			break
+		}
+		if err := p.lex.next(); err != nil {
+			return nil, err
+		}
+	}
+	if err := p.expect(tokRParen, "')'"); err != nil {
+		return nil, err
+	}
+
+	body, err := p.block()
+	if err != nil {
+		return nil, err
+	}
+	fs.proto.body = body
+
+	return &funcExpr{proto: fs.proto}, p.expect(tokEnd, "end")
+}
@@ -0,0 +1,811 @@
+// Package script runs small scripts in a subset of Lua
+//
+// Supported are local and global variables, functions with
+// closures, tables, if, while, repeat, numeric and generic for,
+// multiple assignment and results, and method calls of strings.
+// Numbers are float64. Metatables, coroutines, varargs and goto
+// are not supported. Scripts have no access to files, network
+// or other state of process except of globals given to Run.
+package script
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// Limit of nested calls
+	maxCalls = 200
+
+	// Limit of string length made by script
+	maxString = 64 << 20
+
+	// Deadline is checked once per this count of steps
+	checkSteps = 1024
+)
+
+var ErrTimeout = errors.New("script execution time limit exceeded")
+
+// Error is compilation or runtime error
+type Error struct {
+	Line int
+	Msg  string
+}
+
+func (e *Error) Error() string {
+	if e.Line == 0 {
+		return e.Msg
+	}
+
+	return fmt.Sprintf("line %d: %s", e.Line, e.Msg)
+}
+
+// Function is callable from script
+type Function struct {
+	Name string
+	Fn   func(args []interface{}) ([]interface{}, error)
+}
+
+// Program is compiled script, it could be run concurrently
+type Program struct {
+	proto *proto
+}
+
+// Compile parses script
+func Compile(src string) (*Program, error) {
+	p, err := parse(src)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Program{proto: p}, nil
+}
+
+// Run executes program with globals and returns values of
+// its return statement
+//
+// Values are nil, bool, float64, string, *Table and functions.
+// Globals are changed by script, so they should not be shared.
+// Execution is stopped with ErrTimeout after timeout.
+func (p *Program) Run(globals *Table, timeout time.Duration) ([]interface{}, error) {
+	m := &machine{
+		globals:  globals,
+		deadline: time.Now().Add(timeout),
+	}
+	if s, ok := globals.Get("string").(*Table); ok {
+		m.strings = s
+	}
+
+	return m.call(&closure{proto: p.proto}, nil, 0)
+}
+
+type cell struct {
+	v interface{}
+}
+
+type closure struct {
+	proto *proto
+	up    []*cell
+}
+
+type frame struct {
+	slots []*cell
+	up    []*cell
+}
+
+type ctrl int
+
+const (
+	ctrlNone ctrl = iota
+	ctrlBreak
+	ctrlReturn
+)
+
+type machine struct {
+	globals  *Table
+	strings  *Table
+	deadline time.Time
+	steps    int
+	calls    int
+}
+
+func (m *machine) step() error {
+	m.steps++
+	if m.steps%checkSteps == 0 && time.Now().After(m.deadline) {
+		return ErrTimeout
+	}
+
+	return nil
+}
+
+func (m *machine) call(fn interface{}, args []interface{}, line int) ([]interface{}, error) {
+	if err := m.step(); err != nil {
+		return nil, err
+	}
+
+	switch f := fn.(type) {
+	case *Function:
+		res, err := f.Fn(args)
+		if err != nil {
+			return nil, wrap(err, line)
+		}
+		return res, nil
+	case *closure:
+		m.calls++
+		defer func() { m.calls-- }()
+		if m.calls > maxCalls {
+			return nil, &Error{Line: line, Msg: "stack overflow"}
+		}
+
+		fr := &frame{slots: make([]*cell, f.proto.slots), up: f.up}
+		for i, slot := range f.proto.params {
+			c := new(cell)
+			if i < len(args) {
+				c.v = args[i]
+			}
+			fr.slots[slot] = c
+		}
+
+		_, res, err := m.exec(fr, f.proto.body)
+		return res, err
+	}
+
+	return nil, &Error{Line: line, Msg: "attempt to call a " + typeName(fn) + " value"}
+}
+
+// Adds line to errors of functions
+func wrap(err error, line int) error {
+	if err == ErrTimeout {
+		return err
+	}
+
+	if e, ok := err.(*Error); ok {
+		if e.Line == 0 {
+			return &Error{Line: line, Msg: e.Msg}
+		}
+		return e
+	}
+
+	return &Error{Line: line, Msg: err.Error()}
+}
+
+func (m *machine) exec(fr *frame, b *block) (ctrl, []interface{}, error) {
+	for _, s := range b.stats {
+		if err := m.step(); err != nil {
+			return ctrlNone, nil, err
+		}
+
+		c, res, err := m.stat(fr, s)
+		if err != nil || c != ctrlNone {
+			return c, res, err
+		}
+	}
+
+	return ctrlNone, nil, nil
+}
+
+func (m *machine) stat(fr *frame, s stat) (ctrl, []interface{}, error) {
+	switch s := s.(type) {
+	case *localStat:
+		vals, err := m.list(fr, s.exprs)
+		if err != nil {
+			return ctrlNone, nil, err
+		}
+		for i, slot := range s.slots {
+			c := new(cell)
+			if i < len(vals) {
+				c.v = vals[i]
+			}
+			fr.slots[slot] = c
+		}
+	case *localFuncStat:
+		c := new(cell)
+		fr.slots[s.slot] = c
+		c.v = m.closure(fr, s.proto)
+	case *assignStat:
+		vals, err := m.list(fr, s.exprs)
+		if err != nil {
+			return ctrlNone, nil, err
+		}
+		for i, t := range s.targets {
+			var v interface{}
+			if i < len(vals) {
+				v = vals[i]
+			}
+			if err := m.assign(fr, t, v); err != nil {
+				return ctrlNone, nil, err
+			}
+		}
+	case *callStat:
+		if _, err := m.multi(fr, s.call); err != nil {
+			return ctrlNone, nil, err
+		}
+	case *ifStat:
+		for i, cond := range s.conds {
+			v, err := m.eval(fr, cond)
+			if err != nil {
+				return ctrlNone, nil, err
+			}
+			if truth(v) {
+				return m.exec(fr, s.blocks[i])
+			}
+		}
+		if s.els != nil {
+			return m.exec(fr, s.els)
+		}
+	case *whileStat:
+		for {
+			if err := m.step(); err != nil {
+				return ctrlNone, nil, err
+			}
+			v, err := m.eval(fr, s.cond)
+			if err != nil {
+				return ctrlNone, nil, err
+			}
+			if !truth(v) {
+				break
+			}
+			c, res, err := m.exec(fr, s.body)
+			if err != nil || c == ctrlReturn {
+				return c, res, err
+			}
+			if c == ctrlBreak {
+				break
+			}
+		}
+	case *repeatStat:
+		for {
+			if err := m.step(); err != nil {
+				return ctrlNone, nil, err
+			}
+			c, res, err := m.exec(fr, s.body)
+			if err != nil || c == ctrlReturn {
+				return c, res, err
+			}
+			if c == ctrlBreak {
+				break
+			}
+			v, err := m.eval(fr, s.cond)
+			if err != nil {
+				return ctrlNone, nil, err
+			}
+			if truth(v) {
+				break
+			}
+		}
+	case *numForStat:
+		return m.numFor(fr, s)
+	case *genForStat:
+		return m.genFor(fr, s)
+	case *doStat:
+		return m.exec(fr, s.body)
+	case *returnStat:
+		vals, err := m.list(fr, s.exprs)
+		if err != nil {
+			return ctrlNone, nil, err
+		}
+		return ctrlReturn, vals, nil
+	case *breakStat:
+		return ctrlBreak, nil, nil
+	}
+
+	return ctrlNone, nil, nil
+}
+
+func (m *machine) numFor(fr *frame, s *numForStat) (ctrl, []interface{}, error) {
+	var bounds [3]float64
+	for i, e := range []expr{s.start, s.limit, s.step} {
+		if e == nil {
+			bounds[i] = 1
+			continue
+		}
+		v, err := m.eval(fr, e)
+		if err != nil {
+			return ctrlNone, nil, err
+		}
+		n, ok := toNumber(v)
+		if !ok {
+			return ctrlNone, nil, &Error{Line: s.line, Msg: "'for' value must be a number"}
+		}
+		bounds[i] = n
+	}
+
+	start, limit, step := bounds[0], bounds[1], bounds[2]
+	if step == 0 {
+		return ctrlNone, nil, &Error{Line: s.line, Msg: "'for' step is zero"}
+	}
+
+	for i := start; step > 0 && i <= limit || step < 0 && i >= limit; i += step {
+		if err := m.step(); err != nil {
+			return ctrlNone, nil, err
+		}
+
+		// Every iteration has own variable for closures
+		fr.slots[s.slot] = &cell{v: i}
+		c, res, err := m.exec(fr, s.body)
+		if err != nil || c == ctrlReturn {
+			return c, res, err
+		}
+		if c == ctrlBreak {
+			break
+		}
+	}
+
+	return ctrlNone, nil, nil
+}
+
+func (m *machine) genFor(fr *frame, s *genForStat) (ctrl, []interface{}, error) {
+	vals, err := m.list(fr, s.exprs)
+	if err != nil {
+		return ctrlNone, nil, err
+	}
+	vals = append(vals, nil, nil, nil)
+	f, state, ctl := vals[0], vals[1], vals[2]
+
+	for {
+		res, err := m.call(f, []interface{}{state, ctl}, s.line)
+		if err != nil {
+			return ctrlNone, nil, err
+		}
+		if len(res) == 0 || res[0] == nil {
+			break
+		}
+		ctl = res[0]
+
+		for i, slot := range s.slots {
+			c := new(cell)
+			if i < len(res) {
+				c.v = res[i]
+			}
+			fr.slots[slot] = c
+		}
+
+		c, res, err := m.exec(fr, s.body)
+		if err != nil || c == ctrlReturn {
+			return c, res, err
+		}
+		if c == ctrlBreak {
+			break
+		}
+	}
+
+	return ctrlNone, nil, nil
+}
+
+func (m *machine) closure(fr *frame, p *proto) *closure {
+	c := &closure{proto: p, up: make([]*cell, len(p.upvals))}
+	for i, u := range p.upvals {
+		if !u.local {
+			c.up[i] = fr.up[u.idx]
+			continue
+		}
+		if fr.slots[u.idx] == nil {
+			fr.slots[u.idx] = new(cell)
+		}
+		c.up[i] = fr.slots[u.idx]
+	}
+
+	return c
+}
+
+func (m *machine) assign(fr *frame, t expr, v interface{}) error {
+	switch t := t.(type) {
+	case *localExpr:
+		if fr.slots[t.slot] == nil {
+			fr.slots[t.slot] = new(cell)
+		}
+		fr.slots[t.slot].v = v
+	case *upvalExpr:
+		fr.up[t.idx].v = v
+	case *globalExpr:
+		m.globals.Set(t.name, v)
+	case *indexExpr:
+		obj, err := m.eval(fr, t.obj)
+		if err != nil {
+			return err
+		}
+		key, err := m.eval(fr, t.key)
+		if err != nil {
+			return err
+		}
+		tbl, ok := obj.(*Table)
+		if !ok {
+			return &Error{Line: t.line, Msg: "attempt to index a " + typeName(obj) + " value"}
+		}
+		return setKey(tbl, key, v, t.line)
+	}
+
+	return nil
+}
+
+func setKey(t *Table, k, v interface{}, line int) error {
+	if k == nil {
+		return &Error{Line: line, Msg: "table index is nil"}
+	}
+	if f, ok := k.(float64); ok && math.IsNaN(f) {
+		return &Error{Line: line, Msg: "table index is NaN"}
+	}
+	t.Set(k, v)
+
+	return nil
+}
+
+// Evaluates expressions, the last one gives all its values
+func (m *machine) list(fr *frame, exprs []expr) ([]interface{}, error) {
+	vals := make([]interface{}, 0, len(exprs))
+	for i, e := range exprs {
+		if i == len(exprs)-1 {
+			res, err := m.multi(fr, e)
+			if err != nil {
+				return nil, err
+			}
+			return append(vals, res...), nil
+		}
+
+		v, err := m.eval(fr, e)
+		if err != nil {
+			return nil, err
+		}
+		vals = append(vals, v)
+	}
+
+	return vals, nil
+}
+
+// Returns all values of call or value of other expression
+func (m *machine) multi(fr *frame, e expr) ([]interface{}, error) {
+	c, ok := e.(*callExpr)
+	if !ok {
+		v, err := m.eval(fr, e)
+		if err != nil {
+			return nil, err
+		}
+		return []interface{}{v}, nil
+	}
+
+	fn, err := m.eval(fr, c.fn)
+	if err != nil {
+		return nil, err
+	}
+
+	args, err := m.list(fr, c.args)
+	if err != nil {
+		return nil, err
+	}
+
+	if c.method != "" {
+		obj := fn
+		if fn, err = m.index(obj, c.method, c.line); err != nil {
+			return nil, err
+		}
+		args = append([]interface{}{obj}, args...)
+	}
+
+	return m.call(fn, args, c.line)
+}
+
+func (m *machine) eval(fr *frame, e expr) (interface{}, error) {
+	switch e := e.(type) {
+	case *constExpr:
+		return e.v, nil
+	case *localExpr:
+		if c := fr.slots[e.slot]; c != nil {
+			return c.v, nil
+		}
+		return nil, nil
+	case *upvalExpr:
+		return fr.up[e.idx].v, nil
+	case *globalExpr:
+		return m.globals.Get(e.name), nil
+	case *indexExpr:
+		obj, err := m.eval(fr, e.obj)
+		if err != nil {
+			return nil, err
+		}
+		key, err := m.eval(fr, e.key)
+		if err != nil {
+			return nil, err
+		}
+		return m.index(obj, key, e.line)
+	case *callExpr:
+		res, err := m.multi(fr, e)
+		if err != nil || len(res) == 0 {
+			return nil, err
+		}
+		return res[0], nil
+	case *parenExpr:
+		return m.eval(fr, e.x)
+	case *funcExpr:
+		return m.closure(fr, e.proto), nil
+	case *logicExpr:
+		l, err := m.eval(fr, e.l)
+		if err != nil {
+			return nil, err
+		}
+		if truth(l) != e.and {
+			return l, nil
+		}
+		return m.eval(fr, e.r)
+	case *unExpr:
+		x, err := m.eval(fr, e.x)
+		if err != nil {
+			return nil, err
+		}
+		return unary(e.op, x, e.line)
+	case *binExpr:
+		l, err := m.eval(fr, e.l)
+		if err != nil {
+			return nil, err
+		}
+		r, err := m.eval(fr, e.r)
+		if err != nil {
+			return nil, err
+		}
+		return binary(e.op, l, r, e.line)
+	case *tableExpr:
+		return m.table(fr, e)
+	}
+
+	return nil, fmt.Errorf("unknown expression %T", e)
+}
+
+func (m *machine) index(obj, key interface{}, line int) (interface{}, error) {
+	switch o := obj.(type) {
+	case *Table:
+		return o.Get(key), nil
+	case string:
+		if m.strings != nil {
+			return m.strings.Get(key), nil
+		}
+	}
+
+	return nil, &Error{Line: line, Msg: "attempt to index a " + typeName(obj) + " value"}
+}
+
+func (m *machine) table(fr *frame, e *tableExpr) (interface{}, error) {
+	t := NewTable()
+	n := 0
+	for i, item := range e.items {
+		if item.key != nil {
+			k, err := m.eval(fr, item.key)
+			if err != nil {
+				return nil, err
+			}
+			v, err := m.eval(fr, item.val)
+			if err != nil {
+				return nil, err
+			}
+			if err := setKey(t, k, v, e.line); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		// The last positional call gives all its values
+		vals := make([]interface{}, 1)
+		if i == len(e.items)-1 {
+			res, err := m.multi(fr, item.val)
+			if err != nil {
+				return nil, err
+			}
+			vals = res
+		} else {
+			v, err := m.eval(fr, item.val)
+			if err != nil {
+				return nil, err
+			}
+			vals[0] = v
+		}
+		for _, v := range vals {
+			n++
+			t.Set(float64(n), v)
+		}
+	}
+
+	return t, nil
+}
+
+func unary(op token, x interface{}, line int) (interface{}, error) {
+	switch op {
+	case tokNot:
+		return !truth(x), nil
+	case tokMinus:
+		if n, ok := toNumber(x); ok {
+			return -n, nil
+		}
+		return nil, &Error{Line: line, Msg: "attempt to perform arithmetic on a " + typeName(x) + " value"}
+	case tokHash:
+		switch v := x.(type) {
+		case string:
+			return float64(len(v)), nil
+		case *Table:
+			return float64(v.Len()), nil
+		}
+		return nil, &Error{Line: line, Msg: "attempt to get length of a " + typeName(x) + " value"}
+	}
+
+	return nil, &Error{Line: line, Msg: "unknown operator"}
+}
+
+func binary(op token, l, r interface{}, line int) (interface{}, error) {
+	switch op {
+	case tokEq:
+		return l == r, nil
+	case tokNe:
+		return l != r, nil
+	case tokLt, tokLe, tokGt, tokGe:
+		if op == tokGt || op == tokGe {
+			l, r = r, l
+		}
+		c, err := compare(l, r, line)
+		if err != nil {
+			return nil, err
+		}
+		if op == tokLt || op == tokGt {
+			return c < 0, nil
+		}
+		return c <= 0, nil
+	case tokConcat:
+		ls, lok := concatString(l)
+		rs, rok := concatString(r)
+		if !lok || !rok {
+			bad := l
+			if lok {
+				bad = r
+			}
+			return nil, &Error{Line: line, Msg: "attempt to concatenate a " + typeName(bad) + " value"}
+		}
+		if len(ls)+len(rs) > maxString {
+			return nil, &Error{Line: line, Msg: "string is too long"}
+		}
+		return ls + rs, nil
+	}
+
+	a, aok := toNumber(l)
+	b, bok := toNumber(r)
+	if !aok || !bok {
+		bad := l
+		if aok {
+			bad = r
+		}
+		return nil, &Error{Line: line, Msg: "attempt to perform arithmetic on a " + typeName(bad) + " value"}
+	}
+
+	switch op {
+	case tokPlus:
+		return a + b, nil
+	case tokMinus:
+		return a - b, nil
+	case tokStar:
+		return a * b, nil
+	case tokSlash:
+		return a / b, nil
+	case tokDSlash:
+		return math.Floor(a / b), nil
+	case tokPercent:
+		return a - math.Floor(a/b)*b, nil
+	case tokCaret:
+		return math.Pow(a, b), nil
+	}
+
+	return nil, &Error{Line: line, Msg: "unknown operator"}
+}
+
+func compare(l, r interface{}, line int) (int, error) {
+	switch a := l.(type) {
+	case float64:
+		if b, ok := r.(float64); ok {
+			switch {
+			case a < b:
+				return -1, nil
+			case a == b:
+				return 0, nil
+			}
+			return 1, nil
+		}
+	case string:
+		if b, ok := r.(string); ok {
+			return strings.Compare(a, b), nil
+		}
+	}
+
+	return 0, &Error{Line: line, Msg: "attempt to compare " + typeName(l) + " with " + typeName(r)}
+}
+
+func concatString(v interface{}) (string, bool) {
+	switch v := v.(type) {
+	case string:
+		return v, true
+	case float64:
+		return formatNumber(v), true
+	}
+
+	return "", false
+}
+
+func truth(v interface{}) bool {
+	switch v := v.(type) {
+	case nil:
+		return false
+	case bool:
+		return v
+	}
+
+	return true
+}
+
+// Converts number or numeric string
+func toNumber(v interface{}) (float64, bool) {
+	switch v := v.(type) {
+	case float64:
+		return v, true
+	case string:
+		return parseNumber(v)
+	}
+
+	return 0, false
+}
+
+func parseNumber(s string) (float64, bool) {
+	s = strings.TrimSpace(s)
+	if strings.HasPrefix(s, "0x") || strings.HasPrefix(s, "0X") {
+		n, err := strconv.ParseUint(s[2:], 16, 64)
+		return float64(n), err == nil
+	}
+
+	n, err := strconv.ParseFloat(s, 64)
+	if err != nil || strings.ContainsAny(s, "nN") {
+		// Inf and NaN are not numerals
+		return 0, false
+	}
+
+	return n, true
+}
+
+// Integers are formatted without fraction
+func formatNumber(n float64) string {
+	if n == math.Trunc(n) && math.Abs(n) < 1e15 {
+		return strconv.FormatInt(int64(n), 10)
+	}
+
+	return strconv.FormatFloat(n, 'g', 14, 64)
+}
+
+func typeName(v interface{}) string {
+	switch v.(type) {
+	case nil:
+		return "nil"
+	case bool:
+		return "boolean"
+	case float64:
+		return "number"
+	case string:
+		return "string"
+	case *Table:
+		return "table"
+	case *Function, *closure:
+		return "function"
+	}
+
+	return "userdata"
+}
+
+// ToString formats value like tostring function of script
+func ToString(v interface{}) string {
+	switch v := v.(type) {
+	case nil:
+		return "nil"
+	case bool:
+		return strconv.FormatBool(v)
+	case float64:
+		return formatNumber(v)
+	case string:
+		return v
+	}
+
+	return fmt.Sprintf("%s: %p", typeName(v), v)
+}
@@ -0,0 +1,139 @@
+package script
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func run(t *testing.T, src string) []interface{} {
+	t.Helper()
+
+	p, err := Compile(src)
+	if err != nil {
+		t.Fatalf("compile %q: %s", src, err)
+	}
+
+	res, err := p.Run(NewGlobals(), time.Second)
+	if err != nil {
+		t.Fatalf("run %q: %s", src, err)
+	}
+
+	return res
+}
+
+func TestRun(t *testing.T) {
+	cases := []struct {
+		src  string
+		want string
+	}{
+		{`return 1 + 2 * 3 ^ 2 // 4`, "5"},
+		{`return 7 % -3, -7 % 3, 2^3^2`, "-2 2 512"},
+		{`return "a" .. 1 .. 2.5, #"abc", "10" + 1`, "a12.5 3 11"},
+		{`return 1 < 2 and "yes" or "no", nil or false, not nil`, "yes false true"},
+		{`local a, b = 1 b = a + 1 return a, b`, "1 2"},
+		{`local a, b = 1, 2 a, b = b, a return a, b`, "2 1"},
+		{`local s = 0 for i = 1, 10 do s = s + i end return s`, "55"},
+		{`local s = 0 for i = 10, 1, -3 do s = s + i end return s`, "22"},
+		{`local i = 0 while true do i = i + 1 if i == 5 then break end end return i`, "5"},
+		{`local i = 0 repeat local j = i i = i + 1 until j >= 3 return i`, "4"},
+		{`local t = {1, 2, x = "y", [10] = 3} return #t, t.x, t[10], t[3]`, "2 y 3 nil"},
+		{`local t = {} for i = 1, 3 do t[#t + 1] = i * i end return table.concat(t, ",")`, "1,4,9"},
+		{`local t, s = {a = 1, b = 2, 5}, 0 for k, v in pairs(t) do s = s + v end return s`, "8"},
+		{`local r = {} for i, v in ipairs({"a", "b", nil, "c"}) do r[i] = v end return #r`, "2"},
+		{`local function fib(n) if n < 2 then return n end return fib(n - 1) + fib(n - 2) end return fib(15)`, "610"},
+		{`local function counter() local n = 0 return function() n = n + 1 return n end end
+		  local c = counter() c() c() return c()`, "3"},
+		{`local fs = {} for i = 1, 3 do fs[i] = function() return i end end return fs[1]() + fs[3]()`, "4"},
+		{`local function two() return 1, 2 end local t = {two(), two()} return #t, (two())`, "3 1"},
+		{`t = {n = {}} function t.n.f(x) return x * 2 end return t.n.f(21)`, "42"},
+		{`local s = "Hello" return s:upper(), s:sub(2, -2), s:len(), ("x"):rep(3)`, "HELLO ell 5 xxx"},
+		{`local i, j = string.find("hello world", "o w") return i, j, string.find("abc", "z")`, "5 7 nil"},
+		{`return string.format("%d-%5.2f-%s-%x", 42, 3.14159, true, 255)`, "42- 3.14-true-ff"},
+		{`local t = {3, 1, 2} table.sort(t) table.insert(t, 1, 0) return table.remove(t), table.concat(t, " ")`, "3 0 1 2"},
+		{`return math.max(1, 5, 3), math.floor(-1.5), tonumber("0x10"), tonumber("z")`, "5 -2 16 nil"},
+		{`return type(nil), type({}), type(print), type(type), tostring(1e100)`, "nil table nil function 1e+100"},
+		{`-- comment
+		  --[[ long
+		  comment ]] return [[long
+string]]`, "long\nstring"},
+	}
+
+	for _, c := range cases {
+		res := run(t, c.src)
+		s := make([]string, len(res))
+		for i, v := range res {
+			s[i] = ToString(v)
+		}
+		if got := strings.Join(s, " "); got != c.want {
+			t.Errorf("%q: got %q, want %q", c.src, got, c.want)
+		}
+	}
+}
+
+func TestErrors(t *testing.T) {
+	cases := []struct {
+		src string
+		err string
+	}{
+		{`return 1 +`, "line 1: unexpected symbol"},
+		{`x = = 1`, "unexpected symbol"},
+		{`break`, "break outside loop"},
+		{`return "a" < 1`, "attempt to compare string with number"},
+		{"local t = nil\nreturn t.x", "line 2: attempt to index a nil value"},
+		{`return {} .. "a"`, "attempt to concatenate a table value"},
+		{`undefined()`, "attempt to call a nil value"},
+		{`error("boom")`, "line 1: boom"},
+		{`assert(false, "bad")`, "bad"},
+		{`local function f() return f() + 1 end return f()`, "stack overflow"},
+		{`local t = {} t[nil] = 1`, "table index is nil"},
+		{`return ("x"):rep(1e9)`, "string is too long"},
+		{`return ` + strings.Repeat("(", maxNesting+1), "too deep nesting"},
+	}
+
+	for _, c := range cases {
+		p, err := Compile(c.src)
+		if err == nil {
+			_, err = p.Run(NewGlobals(), time.Second)
+		}
+		if err == nil || !strings.Contains(err.Error(), c.err) {
+			t.Errorf("%q: got error %v, want %q", c.src, err, c.err)
+		}
+	}
+}
+
+func TestTimeout(t *testing.T) {
+	p, err := Compile(`while true do end`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now()
+	if _, err := p.Run(NewGlobals(), 50*time.Millisecond); err != ErrTimeout {
+		t.Fatalf("expected timeout, got %v", err)
+	}
+	if time.Since(start) > time.Second {
+		t.Fatal("script was not stopped in time")
+	}
+}
+
+func TestFunction(t *testing.T) {
+	g := NewGlobals()
+	g.Set("double", &Function{Name: "double", Fn: func(args []interface{}) ([]interface{}, error) {
+		return []interface{}{args[0].(float64) * 2}, nil
+	}})
+
+	p, err := Compile(`return double(x)`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	g.Set("x", 21.0)
+
+	res, err := p.Run(g, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res) != 1 || res[0] != 42.0 {
+		t.Fatalf("unexpected result %v", res)
+	}
+}
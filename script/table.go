@@ -0,0 +1,170 @@
+package script
+
+import "math"
+
+// Table is associative array of values
+//
+// Consecutive integer keys from 1 are kept in array part,
+// other keys are iterated in order of insertion.
+type Table struct {
+	arr   []interface{}
+	hash  map[interface{}]*entry
+	order []*entry
+	dead  int
+}
+
+type entry struct {
+	key, val interface{}
+	dead     bool
+}
+
+func NewTable() *Table {
+	return &Table{}
+}
+
+// Returns position in array part for integer key
+func arrayIndex(k interface{}) (int, bool) {
+	f, ok := k.(float64)
+	if !ok || f != math.Trunc(f) || f < 1 || f > math.MaxInt32 {
+		return 0, false
+	}
+
+	return int(f) - 1, true
+}
+
+// Get returns value by key, nil if it is missing
+func (t *Table) Get(k interface{}) interface{} {
+	if i, ok := arrayIndex(k); ok && i < len(t.arr) {
+		return t.arr[i]
+	}
+
+	if e, ok := t.hash[k]; ok {
+		return e.val
+	}
+
+	return nil
+}
+
+// Set assigns value to key, nil removes key
+//
+// Key should not be nil or NaN.
+func (t *Table) Set(k, v interface{}) {
+	if i, ok := arrayIndex(k); ok {
+		switch {
+		case i < len(t.arr):
+			t.arr[i] = v
+			if v == nil && i == len(t.arr)-1 {
+				for len(t.arr) > 0 && t.arr[len(t.arr)-1] == nil {
+					t.arr = t.arr[:len(t.arr)-1]
+				}
+			}
+			return
+		case i == len(t.arr) && v != nil:
+			t.arr = append(t.arr, v)
+			t.remove(k)
+
+			// Following keys move from hash part
+			for {
+				next := float64(len(t.arr) + 1)
+				e, ok := t.hash[next]
+				if !ok {
+					break
+				}
+				t.arr = append(t.arr, e.val)
+				t.remove(next)
+			}
+			return
+		}
+	}
+
+	if v == nil {
+		t.remove(k)
+		return
+	}
+
+	if e, ok := t.hash[k]; ok {
+		e.val = v
+		return
+	}
+
+	if t.hash == nil {
+		t.hash = make(map[interface{}]*entry)
+	}
+	e := &entry{key: k, val: v}
+	t.hash[k] = e
+	t.order = append(t.order, e)
+}
+
+func (t *Table) remove(k interface{}) {
+	e, ok := t.hash[k]
+	if !ok {
+		return
+	}
+
+	delete(t.hash, k)
+	e.dead = true
+	t.dead++
+
+	// Compacts order when most entries are removed
+	if t.dead > len(t.order)/2 {
+		order := make([]*entry, 0, len(t.hash))
+		for _, e := range t.order {
+			if !e.dead {
+				order = append(order, e)
+			}
+		}
+		t.order = order
+		t.dead = 0
+	}
+}
+
+// Len returns length of array part
+func (t *Table) Len() int {
+	return len(t.arr)
+}
+
+// Append adds value after array part
+func (t *Table) Append(v interface{}) {
+	t.Set(float64(len(t.arr)+1), v)
+}
+
+// Range calls fn for all pairs until it returns false,
+// array part goes first
+func (t *Table) Range(fn func(k, v interface{}) bool) {
+	it := t.iter()
+	for {
+		k, v := it()
+		if k == nil || !fn(k, v) {
+			return
+		}
+	}
+}
+
+// Returns iterator over pairs existing at the moment of call,
+// nil key marks the end
+func (t *Table) iter() func() (interface{}, interface{}) {
+	var (
+		n     = len(t.arr)
+		order = t.order
+		i     int
+	)
+
+	return func() (interface{}, interface{}) {
+		for ; i < n; i++ {
+			if v := t.Get(float64(i + 1)); v != nil {
+				i++
+				return float64(i), v
+			}
+		}
+
+		for ; i-n < len(order); i++ {
+			e := order[i-n]
+			if !e.dead {
+				i++
+				return e.key, e.val
+			}
+		}
+
+		return nil, nil
+	}
+}
@@ -0,0 +1,166 @@
+// Package tlsconfig keeps certificates of node for TLS listeners
+// and connections to other nodes
+//
+// Certificate, key and CA of clients are read from PEM files and
+// could be reloaded without restart, new handshakes use them.
+// If CA is set, peers are verified by it: clients of listeners
+// and servers of connections to other nodes.
+package tlsconfig
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"sync"
+)
+
+var (
+	ErrNoCertificate = errors.New("no certificate of peer")
+)
+
+// Config is a set of PEM files
+type Config struct {
+	Cert string
+	Key  string
+
+	// CA of client certificates, clients are not verified if it is empty
+	ClientCA string
+
+	// Connections without verified client certificate are rejected
+	RequireClientCert bool
+}
+
+// Store keeps actual certificates
+type Store struct {
+	cfg Config
+
+	mu   sync.RWMutex
+	cert *tls.Certificate
+	pool *x509.CertPool
+}
+
+// Load reads files of config
+func Load(cfg Config) (*Store, error) {
+	if cfg.Cert == "" || cfg.Key == "" {
+		return nil, errors.New("tls: certificate and key are required")
+	}
+	if cfg.RequireClientCert && cfg.ClientCA == "" {
+		return nil, errors.New("tls: client certificates could not be verified without CA")
+	}
+
+	s := &Store{cfg: cfg}
+	if err := s.Reload(); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// Reload reads files again, old certificates stay on error
+func (s *Store) Reload() error {
+	cert, err := tls.LoadX509KeyPair(s.cfg.Cert, s.cfg.Key)
+	if err != nil {
+		return fmt.Errorf("tls: %s", err)
+	}
+
+	var pool *x509.CertPool
+	if s.cfg.ClientCA != "" {
+		data, err := ioutil.ReadFile(s.cfg.ClientCA)
+		if err != nil {
+			return fmt.Errorf("tls: %s", err)
+		}
+		pool = x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(data) {
+			return fmt.Errorf("tls: %s: no certificates", s.cfg.ClientCA)
+		}
+	}
+
+	s.mu.Lock()
+	s.cert, s.pool = &cert, pool
+	s.mu.Unlock()
+
+	return nil
+}
+
+func (s *Store) current() (*tls.Certificate, *x509.CertPool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.cert, s.pool
+}
+
+// Server returns config of listeners
+func (s *Store) Server() *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			cert, pool := s.current()
+
+			c := &tls.Config{
+				MinVersion:   tls.VersionTLS12,
+				Certificates: []tls.Certificate{*cert},
+			}
+			switch {
+			case pool == nil:
+			case s.cfg.RequireClientCert:
+				c.ClientAuth = tls.RequireAndVerifyClientCert
+				c.ClientCAs = pool
+			default:
+				c.ClientAuth = tls.VerifyClientCertIfGiven
+				c.ClientCAs = pool
+			}
+
+			return c, nil
+		},
+	}
+}
+
+// Client returns config of connections to other nodes, node
+// presents its certificate and verifies server by CA if it is set
+func (s *Store) Client() *tls.Config {
+	c := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetClientCertificate: func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			cert, _ := s.current()
+			return cert, nil
+		},
+	}
+
+	if s.cfg.ClientCA == "" {
+		return c
+	}
+
+	// Pool could be reloaded, so chain is verified here
+	c.InsecureSkipVerify = true
+	c.VerifyConnection = func(cs tls.ConnectionState) error {
+		if len(cs.PeerCertificates) == 0 {
+			return ErrNoCertificate
+		}
+
+		_, pool := s.current()
+		opts := x509.VerifyOptions{
+			DNSName:       cs.ServerName,
+			Roots:         pool,
+			Intermediates: x509.NewCertPool(),
+		}
+		for _, ic := range cs.PeerCertificates[1:] {
+			opts.Intermediates.AddCert(ic)
+		}
+
+		_, err := cs.PeerCertificates[0].Verify(opts)
+		return err
+	}
+
+	return c
+}
+
+// Subject returns common name of verified client certificate
+func Subject(cs *tls.ConnectionState) (string, error) {
+	if cs == nil || len(cs.VerifiedChains) == 0 {
+		return "", ErrNoCertificate
+	}
+
+	return cs.VerifiedChains[0][0].Subject.CommonName, nil
+}
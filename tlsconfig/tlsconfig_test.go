@@ -0,0 +1,169 @@
+package tlsconfig
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type issuer struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+// Issues certificate signed by parent, self signed CA if parent is nil
+func issue(t *testing.T, parent *issuer, name string) (*issuer, []byte, []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	signer := &issuer{cert: tmpl, key: key}
+	if parent == nil {
+		tmpl.IsCA = true
+		tmpl.BasicConstraintsValid = true
+		tmpl.KeyUsage = x509.KeyUsageCertSign
+	} else {
+		signer = parent
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, signer.cert, &key.PublicKey, signer.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	keyDER, _ := x509.MarshalECPrivateKey(key)
+
+	return &issuer{cert: cert, key: key},
+		pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+}
+
+func write(t *testing.T, dir, name string, data []byte) string {
+	path := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	return path
+}
+
+// Connects client to server and returns subject of client seen by server
+func handshake(server, client *tls.Config) (string, error) {
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", server)
+	if err != nil {
+		return "", err
+	}
+	defer ln.Close()
+
+	res := make(chan error, 1)
+	var subject string
+	go func() {
+		c, err := ln.Accept()
+		if err != nil {
+			res <- err
+			return
+		}
+		defer c.Close()
+
+		tc := c.(*tls.Conn)
+		if err := tc.Handshake(); err != nil {
+			res <- err
+			return
+		}
+		cs := tc.ConnectionState()
+		subject, _ = Subject(&cs)
+		res <- nil
+	}()
+
+	c, err := tls.Dial("tcp", ln.Addr().String(), client)
+	if err != nil {
+		return "", err
+	}
+	c.Close()
+
+	return subject, <-res
+}
+
+func TestStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tlsconfig")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ca, caPEM, _ := issue(t, nil, "ca")
+	_, certPEM, keyPEM := issue(t, ca, "node-a")
+
+	cfg := Config{
+		Cert:              write(t, dir, "cert.pem", certPEM),
+		Key:               write(t, dir, "key.pem", keyPEM),
+		ClientCA:          write(t, dir, "ca.pem", caPEM),
+		RequireClientCert: true,
+	}
+	s, err := Load(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	subject, err := handshake(s.Server(), s.Client())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if subject != "node-a" {
+		t.Fatalf("unexpected subject %q", subject)
+	}
+
+	// Client without certificate is rejected
+	if _, err := handshake(s.Server(), &tls.Config{InsecureSkipVerify: true}); err == nil {
+		t.Fatal("client without certificate is accepted")
+	}
+
+	// Certificate of other CA is rejected after reload
+	other, otherPEM, _ := issue(t, nil, "other")
+	_, certPEM, keyPEM = issue(t, other, "node-b")
+	write(t, dir, "cert.pem", certPEM)
+	write(t, dir, "key.pem", keyPEM)
+	if err := s.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := handshake(s.Server(), s.Client()); err == nil {
+		t.Fatal("certificate of unknown CA is accepted")
+	}
+
+	write(t, dir, "ca.pem", otherPEM)
+	if err := s.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if subject, err = handshake(s.Server(), s.Client()); err != nil || subject != "node-b" {
+		t.Fatalf("unexpected subject %q after reload: %v", subject, err)
+	}
+
+	// Broken files keep old certificates
+	write(t, dir, "key.pem", []byte("broken"))
+	if err := s.Reload(); err == nil {
+		t.Fatal("broken key is loaded")
+	}
+	if _, err := handshake(s.Server(), s.Client()); err != nil {
+		t.Fatal(err)
+	}
+}